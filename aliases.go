@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// aliasRewrite - whether a hash mode Set drops fields stored under a
+// field's alias names, completing the rename. Turn it off while readers of
+// the old names are still deployed; JSON documents are always written whole
+// under the current names.
+var aliasRewrite = true
+
+// fieldAliases - for one struct type, the names documents may carry a
+// field under (`redis:"lastname,alias=last_name|surname"`)
+type fieldAliases struct {
+	// json - old member name to the current JSON name
+	json map[string]string
+	// hash - old field name to the current hash field name
+	hash map[string]string
+}
+
+// aliasesOf - the aliases declared on the fields of struct type t
+func aliasesOf(t reflect.Type) fieldAliases {
+	return structInfoOf(t).aliases
+}
+
+func buildAliases(t reflect.Type, tags []fieldTag) (a fieldAliases) {
+	for i, tag := range tags {
+		f := t.Field(i)
+		names, ok := tag.value("alias")
+		if !ok || f.PkgPath != "" {
+			continue
+		}
+		if a.json == nil {
+			a.json, a.hash = make(map[string]string), make(map[string]string)
+		}
+
+		jsonName := strings.Split(f.Tag.Get("json"), ",")[0]
+		if jsonName == "" {
+			jsonName = f.Name
+		}
+		hashName := tag.Name
+		if hashName == "" {
+			hashName = f.Name
+		}
+		for _, old := range strings.Split(names, "|") {
+			if old != "" {
+				a.json[old] = jsonName
+				a.hash[old] = hashName
+			}
+		}
+	}
+	return
+}
+
+// walkStructTypes - whether fn holds for t or any struct type reachable
+// from its fields
+func walkStructTypes(t reflect.Type, seen map[reflect.Type]bool, fn func(reflect.Type) bool) bool {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || seen[t] {
+		return false
+	}
+	seen[t] = true
+	if fn(t) {
+		return true
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if walkStructTypes(t.Field(i).Type, seen, fn) {
+			return true
+		}
+	}
+	return false
+}
+
+// unmarshalStruct - json.Unmarshal into value, first renaming members
+// stored under alias names to the current ones (a member present under
+// both keeps the current name's value) and filling in defaults for missing
+// ones
+func unmarshalStruct(b []byte, value interface{}) (err error) {
+	t := reflect.TypeOf(value)
+	if t == nil || t.Kind() != reflect.Ptr || !(tagUseOf(t).alias || tagUseOf(t).defaults) {
+		return json.Unmarshal(b, value)
+	}
+
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	err = dec.Decode(&doc)
+	if err != nil {
+		return
+	}
+	renameAliases(doc, t)
+	err = fillDefaults(doc, t)
+	if err != nil {
+		return
+	}
+	b, err = json.Marshal(doc)
+	if err != nil {
+		return
+	}
+	return json.Unmarshal(b, value)
+}
+
+func renameAliases(doc interface{}, t reflect.Type) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		switch t.Kind() {
+		case reflect.Struct:
+			for old, current := range aliasesOf(t).json {
+				v, ok := d[old]
+				if !ok {
+					continue
+				}
+				delete(d, old)
+				if _, ok := d[current]; !ok {
+					d[current] = v
+				}
+			}
+			fields := jsonFields(t)
+			for name, v := range d {
+				if f, ok := fields[name]; ok {
+					renameAliases(v, f.Type)
+				}
+			}
+		case reflect.Map:
+			for _, v := range d {
+				renameAliases(v, t.Elem())
+			}
+		}
+	case []interface{}:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for _, v := range d {
+				renameAliases(v, t.Elem())
+			}
+		}
+	}
+}
+
+// renameHashAliases - HGETALL's field/value list with fields stored under
+// alias names renamed, for scanning into a struct of type t
+func renameHashAliases(src []interface{}, t reflect.Type) []interface{} {
+	aliases := aliasesOf(t).hash
+	if aliases == nil {
+		return src
+	}
+
+	present := make(map[string]bool, len(src)/2)
+	for i := 0; i+1 < len(src); i += 2 {
+		present[argString(src[i])] = true
+	}
+	out := make([]interface{}, 0, len(src))
+	for i := 0; i+1 < len(src); i += 2 {
+		name := argString(src[i])
+		if current, ok := aliases[name]; ok {
+			if present[current] {
+				continue
+			}
+			name = current
+		}
+		out = append(out, []byte(name), src[i+1])
+	}
+	return out
+}
+
+// staleAliasFields - the alias fields of value's type a hash mode Set
+// should drop, none when aliasRewrite is off
+func staleAliasFields(value interface{}) (fields []string) {
+	t := reflect.TypeOf(value)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if !aliasRewrite || t == nil || t.Kind() != reflect.Struct {
+		return
+	}
+	for old := range aliasesOf(t).hash {
+		fields = append(fields, old)
+	}
+	sort.Strings(fields)
+	return
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// analyzeOptions - how analyzeKeys samples and what it flags
+type analyzeOptions struct {
+	// Sample - keys inspected, at most
+	Sample int
+	// BigKeyBytes - MEMORY USAGE above which a key is flagged
+	BigKeyBytes int64
+}
+
+// analyzeReport - outcome of analyzeKeys
+type analyzeReport struct {
+	Sampled int
+	// Modes - per storage mode (plus "unknown") memory overhead figures
+	Modes map[string]*modeOverhead
+	// BigKeys - flagged keys, largest first
+	BigKeys []bigKey
+}
+
+// modeOverhead - serialized payload size versus what the server actually
+// spends on keys stored in one mode
+type modeOverhead struct {
+	Keys            int
+	SerializedBytes int64
+	MemoryBytes     int64
+}
+
+// Ratio - memory used per serialized byte
+func (m *modeOverhead) Ratio() float64 {
+	if m.SerializedBytes == 0 {
+		return 0
+	}
+	return float64(m.MemoryBytes) / float64(m.SerializedBytes)
+}
+
+type bigKey struct {
+	Key             string
+	Mode            string
+	MemoryBytes     int64
+	SerializedBytes int64
+	Suggestion      string
+}
+
+// analyzeKeys - samples keys matching pattern, measures the serialized size
+// and MEMORY USAGE of each, flags documents above opts.BigKeyBytes and
+// suggests what to do about them
+func analyzeKeys(ctx context.Context, conn redis.Conn, pattern string, opts analyzeOptions) (r analyzeReport, err error) {
+	if opts.Sample <= 0 {
+		opts.Sample = 1000
+	}
+	if opts.BigKeyBytes <= 0 {
+		opts.BigKeyBytes = 64 << 10
+	}
+	r.Modes = make(map[string]*modeOverhead)
+
+	errStop := errors.New("sample complete")
+	err = scanKeys(ctx, conn, pattern, func(key string) (err error) {
+		if r.Sampled >= opts.Sample {
+			return errStop
+		}
+
+		mem, err := redis.Int64(doContext(ctx, conn, "MEMORY", "USAGE", key))
+		if err == redis.ErrNil {
+			return nil
+		}
+		if err != nil {
+			return newCommandError("MEMORY USAGE", key, err)
+		}
+
+		modeName := "unknown"
+		var size int64
+		mode, merr := detectStorageMode(conn, key)
+		if merr == nil {
+			modeName = mode.String()
+			size, err = serializedSize(conn, mode, key)
+			if err != nil {
+				return
+			}
+		}
+
+		r.Sampled++
+		o := r.Modes[modeName]
+		if o == nil {
+			o = &modeOverhead{}
+			r.Modes[modeName] = o
+		}
+		o.Keys++
+		o.SerializedBytes += size
+		o.MemoryBytes += mem
+
+		if mem >= opts.BigKeyBytes {
+			r.BigKeys = append(r.BigKeys, bigKey{
+				Key:             key,
+				Mode:            modeName,
+				MemoryBytes:     mem,
+				SerializedBytes: size,
+				Suggestion:      suggestFor(modeName, mem, size),
+			})
+		}
+		return
+	})
+	if err == errStop {
+		err = nil
+	}
+
+	sort.Slice(r.BigKeys, func(i, j int) bool {
+		return r.BigKeys[i].MemoryBytes > r.BigKeys[j].MemoryBytes
+	})
+	return
+}
+
+// serializedSize - bytes a client receives when reading key in full
+func serializedSize(conn redis.Conn, mode storageMode, key string) (n int64, err error) {
+	switch mode {
+	case modeReJSON:
+		var b []byte
+		b, err = redis.Bytes(conn.Do("JSON.GET", key))
+		if err != nil {
+			return 0, newCommandError("JSON.GET", key, err)
+		}
+		return int64(len(b)), nil
+	case modeHashJSON:
+		var l int64
+		l, err = redis.Int64(conn.Do("HSTRLEN", key, "JSON"))
+		if err != nil {
+			return 0, newCommandError("HSTRLEN", key, err)
+		}
+		return l, nil
+	}
+
+	fields, err := redis.ByteSlices(conn.Do("HGETALL", key))
+	if err != nil {
+		return 0, newCommandError("HGETALL", key, err)
+	}
+	for _, f := range fields {
+		n += int64(len(f))
+	}
+	return
+}
+
+// suggestFor - what to do about a big key
+func suggestFor(mode string, mem, size int64) string {
+	switch {
+	case mode == modeReJSON.String() && size > 0 && mem > 2*size:
+		return "ReJSON tree overhead is over 2x the payload; store rarely queried sub-documents as hash-json or chunk them into separate keys"
+	case mode == modeHashJSON.String():
+		return "the whole blob is rewritten on every change; compress it or split it into per-section keys"
+	case mode == modeHash.String():
+		return "many hash fields; chunk into multiple hashes or move to rejson for partial reads"
+	case mode == modeReJSON.String():
+		return "large document; chunk into separate keys so readers fetch only what they need"
+	}
+	return "not stored in a known mode; inspect with dumpKey"
+}
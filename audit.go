@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// auditRecord - one audited write
+type auditRecord struct {
+	Who     string    `json:"who"`
+	Key     string    `json:"key"`
+	Op      string    `json:"op"`
+	Time    time.Time `json:"time"`
+	Outcome string    `json:"outcome"`
+}
+
+// OperationAudit - sink receiving a record of every write
+type OperationAudit interface {
+	Audit(r auditRecord) error
+}
+
+type auditWhoKey struct{}
+
+// withAuditWho - attaches the identity writes made under ctx are audited as,
+// e.g. auditMiddleware(func() string { return auditWho(ctx) }, sink, logger)
+func withAuditWho(ctx context.Context, who string) context.Context {
+	return context.WithValue(ctx, auditWhoKey{}, who)
+}
+
+func auditWho(ctx context.Context) string {
+	who, _ := ctx.Value(auditWhoKey{}).(string)
+	return who
+}
+
+// auditMiddleware - records every write command issued through it,
+// pipelined or not, on behalf of the identity who returns when the command
+// completes. who is asked per command so one audited pool can serve many
+// callers; a middleware built for one request can read it from that
+// request's context with withAuditWho. A failing sink never fails the
+// write; it is reported to logger instead.
+func auditMiddleware(who func() string, sink OperationAudit, logger Logger) Middleware {
+	logger = orNop(logger)
+
+	return func(next Handler) Handler {
+		return func(cmd string, args ...interface{}) (reply interface{}, err error) {
+			reply, err = next(cmd, args...)
+			if !isWriteCommand(cmd, args...) {
+				return
+			}
+
+			r := auditRecord{
+				Who:     who(),
+				Key:     auditKey(cmd, args),
+				Op:      commandName(cmd, args),
+				Time:    time.Now().UTC(),
+				Outcome: "ok",
+			}
+			if err != nil {
+				r.Outcome = err.Error()
+			}
+
+			if aerr := sink.Audit(r); aerr != nil {
+				logger.Error("audit failed", "op", r.Op, "key", r.Key, "err", aerr)
+			}
+			return
+		}
+	}
+}
+
+// auditKey - the (first) key cmd writes, which for most commands is the
+// first argument. Scripts and functions name theirs after a key count, and
+// BITOP after the operation.
+func auditKey(cmd string, args []interface{}) string {
+	i := 0
+	switch strings.ToUpper(cmd) {
+	case "EVAL", "EVALSHA", "FCALL":
+		if len(args) < 3 || argString(args[1]) == "0" {
+			return ""
+		}
+		i = 2
+	case "BITOP":
+		i = 1
+	}
+	if i >= len(args) {
+		return ""
+	}
+	return argString(args[i])
+}
+
+// streamAudit - XADDs records to a redis stream, capped at roughly maxLen
+// entries. It uses its own pool so audited connections don't recurse.
+type streamAudit struct {
+	pool   *redis.Pool
+	stream string
+	maxLen int
+}
+
+func (s streamAudit) Audit(r auditRecord) (err error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	args := redis.Args{s.stream}
+	if s.maxLen > 0 {
+		args = args.Add("MAXLEN", "~", s.maxLen)
+	}
+	args = args.Add("*",
+		"who", r.Who,
+		"key", r.Key,
+		"op", r.Op,
+		"time", r.Time.Format(time.RFC3339Nano),
+		"outcome", r.Outcome,
+	)
+
+	_, err = conn.Do("XADD", args...)
+	if err != nil {
+		return newCommandError("XADD", s.stream, err)
+	}
+	return
+}
+
+// writerAudit - writes records to w as JSON lines
+type writerAudit struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newWriterAudit(w io.Writer) *writerAudit {
+	return &writerAudit{w: w}
+}
+
+func (a *writerAudit) Audit(r auditRecord) (err error) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = fmt.Fprintf(a.w, "%s\n", b)
+	return
+}
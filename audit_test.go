@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+// sliceAudit - keeps what it is sent
+type sliceAudit []auditRecord
+
+func (a *sliceAudit) Audit(r auditRecord) error {
+	*a = append(*a, r)
+	return nil
+}
+
+func TestAuditMiddleware(t *testing.T) {
+	var sink sliceAudit
+	who := "alice"
+	rec := newRecordingConn(nil)
+	conn := withMiddleware(rec, auditMiddleware(func() string { return who }, &sink, nil))
+
+	conn.Do("SET", "k", "v")
+	conn.Do("GET", "k")
+	who = "bob"
+	conn.Send("EVAL", "return 1", 1, "scripted")
+	conn.Send("HGETALL", "k")
+	conn.Send("BITOP", "AND", "dest", "a", "b")
+	conn.Send("FCALL", "f", 0)
+	conn.Do("")
+
+	want := []auditRecord{
+		{Who: "alice", Key: "k", Op: "SET"},
+		{Who: "bob", Key: "scripted", Op: "EVAL"},
+		{Who: "bob", Key: "dest", Op: "BITOP"},
+		{Who: "bob", Key: "", Op: "FCALL"},
+	}
+	if len(sink) != len(want) {
+		t.Fatalf("audited %+v, want %+v", sink, want)
+	}
+	for i, w := range want {
+		got := sink[i]
+		if got.Who != w.Who || got.Key != w.Key || got.Op != w.Op || got.Outcome != "ok" {
+			t.Errorf("record %d: got %+v, want %+v", i, got, w)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// backupFormat - identifies a backup archive, checked on restore
+const backupFormat = "rejson-struct-backup/1"
+
+// backupHeader - first line of a backup archive
+type backupHeader struct {
+	Format  string    `json:"format"`
+	Created time.Time `json:"created"`
+	Pattern string    `json:"pattern"`
+	// SchemaVersion - opaque label of the document schema backed up
+	SchemaVersion string `json:"schemaVersion,omitempty"`
+}
+
+// backupRecord - one document of a backup archive
+type backupRecord struct {
+	Key  string `json:"key"`
+	Mode string `json:"mode"`
+	// TTL - milliseconds left when backed up, 0 for none
+	TTL int64           `json:"ttl,omitempty"`
+	Doc json.RawMessage `json:"doc"`
+	// Bits - the document's bits string (bitfield.go), if it has one
+	Bits []byte `json:"bits,omitempty"`
+}
+
+// backupKeys - writes every document matching pattern, with its storage mode,
+// remaining TTL and bits string, to w as gzipped JSON Lines after a backupHeader
+func backupKeys(ctx context.Context, conn redis.Conn, w io.Writer, pattern, schemaVersion string) (n int, err error) {
+	zw := gzip.NewWriter(w)
+	enc := json.NewEncoder(zw)
+
+	err = enc.Encode(backupHeader{
+		Format:        backupFormat,
+		Created:       time.Now().UTC(),
+		Pattern:       pattern,
+		SchemaVersion: schemaVersion,
+	})
+	if err != nil {
+		return
+	}
+
+	err = scanKeys(ctx, conn, pattern, func(key string) (err error) {
+		if isBitsKey(key) {
+			// backed up with its document
+			return nil
+		}
+		mode, err := detectStorageMode(conn, key)
+		if err == errUnknownMode || errors.Is(err, redis.ErrNil) {
+			return nil
+		}
+		if err != nil {
+			return
+		}
+		raw, err := getRaw(conn, mode, key)
+		if errors.Is(err, redis.ErrNil) {
+			return nil
+		}
+		if err != nil {
+			return
+		}
+		ttl, err := redis.Int64(conn.Do("PTTL", key))
+		if err != nil {
+			return newCommandError("PTTL", key, err)
+		}
+		if ttl < 0 {
+			ttl = 0
+		}
+		bits, err := getRawBits(conn, key)
+		if err != nil {
+			return
+		}
+
+		err = enc.Encode(backupRecord{Key: key, Mode: mode.String(), TTL: ttl, Doc: raw, Bits: bits})
+		if err == nil {
+			n++
+		}
+		return
+	})
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	return
+}
+
+// restoreOptions - how restoreKeys writes documents back
+type restoreOptions struct {
+	// Mode - store every document in this mode rather than the one it was
+	// backed up from
+	Mode *storageMode
+	// Batch - documents per pipeline round trip
+	Batch int
+}
+
+// restoreKeys - reads a backupKeys archive from r and writes every document
+// back, replacing existing keys and reapplying the TTL each had left when it
+// was backed up
+func restoreKeys(ctx context.Context, conn redis.Conn, r io.Reader, opts restoreOptions) (h backupHeader, n int, err error) {
+	if opts.Batch <= 0 {
+		opts.Batch = 500
+	}
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return
+	}
+	defer zr.Close()
+	dec := json.NewDecoder(bufio.NewReader(zr))
+
+	err = dec.Decode(&h)
+	if err != nil {
+		return h, 0, fmt.Errorf("reading backup header: %w", err)
+	}
+	if h.Format != backupFormat {
+		return h, 0, fmt.Errorf("not a backup archive (format %q)", h.Format)
+	}
+
+	// one entry per command sent, so replies can be matched to keys
+	var pending []string
+	var docs int
+	flush := func() (err error) {
+		err = receiveAll(conn, pending)
+		if err == nil {
+			n += docs
+		}
+		pending, docs = pending[:0], 0
+		return
+	}
+
+	for {
+		var rec backupRecord
+		err = dec.Decode(&rec)
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return h, n, fmt.Errorf("after %d documents: %w", n, err)
+		}
+
+		mode, merr := parseStorageMode(rec.Mode)
+		if opts.Mode != nil {
+			mode, merr = *opts.Mode, nil
+		}
+		if merr != nil {
+			return h, n, fmt.Errorf("%s: %w", rec.Key, merr)
+		}
+		cmd, args, cerr := rawCommand(mode, rec.Key, rec.Doc)
+		if cerr != nil {
+			return h, n, cerr
+		}
+
+		conn.Send("DEL", rec.Key, bitsKey(rec.Key))
+		conn.Send(cmd, args...)
+		pending = append(pending, rec.Key, rec.Key)
+		if rec.Bits != nil {
+			conn.Send("SET", bitsKey(rec.Key), rec.Bits)
+			pending = append(pending, rec.Key)
+		}
+		if rec.TTL > 0 {
+			conn.Send("PEXPIRE", rec.Key, rec.TTL)
+			pending = append(pending, rec.Key)
+			if rec.Bits != nil {
+				conn.Send("PEXPIRE", bitsKey(rec.Key), rec.TTL)
+				pending = append(pending, rec.Key)
+			}
+		}
+		docs++
+
+		if docs >= opts.Batch {
+			err = flush()
+			if err != nil {
+				return
+			}
+			if err = ctx.Err(); err != nil {
+				return
+			}
+		}
+	}
+	err = flush()
+	return
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// benchOptions - what runBenchmark writes and reads
+type benchOptions struct {
+	// N - objects written and read back per storage mode
+	N int
+	// Prefix - keys are Prefix<mode>:<i>, and are deleted afterwards
+	Prefix string
+	// Modes - storage modes to compare, all three when empty
+	Modes []storageMode
+}
+
+// benchResult - latency profile of one operation in one storage mode
+type benchResult struct {
+	Mode storageMode
+	Op   string
+	N    int
+
+	P50, P95, P99 time.Duration
+	Mean          time.Duration
+	// Throughput - operations per second
+	Throughput float64
+	// MemPerObject - mean MEMORY USAGE of the stored objects, in bytes
+	MemPerObject int64
+	// BytesSent, BytesReceived - mean RESP bytes per operation, commands
+	// and replies respectively
+	BytesSent, BytesReceived int64
+}
+
+// runBenchmark - writes and reads back opts.N synthetic Students in each
+// storage mode, the same comparison main.go walks through by hand. Reads
+// fetch the raw reply, as getStructHash and friends do, since the flat hash
+// can't be decoded back into a Student.
+func runBenchmark(conn redis.Conn, opts benchOptions) (results []benchResult, err error) {
+	if opts.N <= 0 {
+		opts.N = 1000
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = "bench:"
+	}
+	if len(opts.Modes) == 0 {
+		opts.Modes = []storageMode{modeHash, modeHashJSON, modeReJSON}
+	}
+
+	for _, mode := range opts.Modes {
+		var set, get benchResult
+		set, get, err = benchmarkMode(conn, mode, opts)
+		if err != nil {
+			return
+		}
+		results = append(results, set, get)
+	}
+	return
+}
+
+func benchmarkMode(conn redis.Conn, mode storageMode, opts benchOptions) (set, get benchResult, err error) {
+	keys := make([]string, opts.N)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%s%v:%d", opts.Prefix, mode, i)
+	}
+	defer deleteKeys(conn, keys)
+
+	wire := &wireConn{Conn: conn}
+	set, err = timeOps(mode, "set", keys, func(i int, key string) error {
+		return addStruct(wire, mode, key, syntheticStudent(i))
+	})
+	if err != nil {
+		return
+	}
+	set.BytesSent, set.BytesReceived = wire.perOp(len(keys))
+
+	wire = &wireConn{Conn: conn}
+	get, err = timeOps(mode, "get", keys, func(i int, key string) (err error) {
+		switch mode {
+		case modeHash:
+			_, err = getStructHash(wire, key)
+		case modeHashJSON:
+			_, err = getStructHashWithJSON(wire, key)
+		case modeReJSON:
+			_, err = getStructReJSON(wire, key)
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+	get.BytesSent, get.BytesReceived = wire.perOp(len(keys))
+
+	set.MemPerObject, err = meanMemoryUsage(conn, keys)
+	get.MemPerObject = set.MemPerObject
+	return
+}
+
+func timeOps(mode storageMode, op string, keys []string, fn func(i int, key string) error) (r benchResult, err error) {
+	lat := make([]time.Duration, len(keys))
+
+	start := time.Now()
+	for i, key := range keys {
+		t := time.Now()
+		err = fn(i, key)
+		if err != nil {
+			return
+		}
+		lat[i] = time.Since(t)
+	}
+	total := time.Since(start)
+
+	sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+	r = benchResult{
+		Mode:       mode,
+		Op:         op,
+		N:          len(keys),
+		P50:        percentile(lat, 50),
+		P95:        percentile(lat, 95),
+		P99:        percentile(lat, 99),
+		Mean:       total / time.Duration(len(keys)),
+		Throughput: float64(len(keys)) / total.Seconds(),
+	}
+	return
+}
+
+// percentile - p-th percentile of sorted, nearest-rank
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p + 99) / 100
+	if i < 1 {
+		i = 1
+	}
+	return sorted[i-1]
+}
+
+func meanMemoryUsage(conn redis.Conn, keys []string) (mean int64, err error) {
+	var total int64
+	for _, key := range keys {
+		var n int64
+		n, err = redis.Int64(conn.Do("MEMORY", "USAGE", key))
+		if err != nil {
+			return 0, newCommandError("MEMORY USAGE", key, err)
+		}
+		total += n
+	}
+	return total / int64(len(keys)), nil
+}
+
+func deleteKeys(conn redis.Conn, keys []string) {
+	for start := 0; start < len(keys); start += 500 {
+		end := start + 500
+		if end > len(keys) {
+			end = len(keys)
+		}
+		conn.Do("DEL", redis.Args{}.AddFlat(keys[start:end])...)
+	}
+}
+
+func syntheticStudent(i int) Student {
+	majors := []string{"CSE", "EEE", "ME", "CE"}
+	return Student{
+		Info: &StudentDetails{
+			FirstName: fmt.Sprintf("First%d", i),
+			LastName:  fmt.Sprintf("Last%d", i),
+			Major:     majors[i%len(majors)],
+		},
+		Rank: i + 1,
+	}
+}
+
+// writeBenchmarkResults - one line per result in `go test -bench` format, so
+// runs can be compared with benchcmp/benchstat
+func writeBenchmarkResults(w io.Writer, results []benchResult) (err error) {
+	for _, r := range results {
+		_, err = fmt.Fprintf(w, "Benchmark%s/%v\t%8d\t%12d ns/op\t%12d p50-ns\t%12d p95-ns\t%12d p99-ns\t%8d B/object\t%8d sent-B/op\t%8d recv-B/op\n",
+			benchOpName(r.Op), r.Mode, r.N,
+			r.Mean.Nanoseconds(), r.P50.Nanoseconds(), r.P95.Nanoseconds(), r.P99.Nanoseconds(),
+			r.MemPerObject, r.BytesSent, r.BytesReceived)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func benchOpName(op string) string {
+	switch op {
+	case "set":
+		return "Set"
+	case "get":
+		return "Get"
+	}
+	return op
+}
+
+// benchReport - runBenchmark's comparison as a structure for dashboards and
+// other programs, written out as JSON as is. Durations are nanoseconds.
+type benchReport struct {
+	Started time.Time `json:"started"`
+	// Server - redis_version of the server benchmarked
+	Server string            `json:"server,omitempty"`
+	N      int               `json:"n"`
+	Modes  []benchModeReport `json:"modes"`
+}
+
+// benchModeReport - how one storage mode fared
+type benchModeReport struct {
+	Mode string        `json:"mode"`
+	Set  benchOpReport `json:"set"`
+	Get  benchOpReport `json:"get"`
+	// MemPerObject - mean MEMORY USAGE of a stored object, in bytes
+	MemPerObject int64 `json:"memPerObject"`
+}
+
+// benchOpReport - latency and traffic of one operation
+type benchOpReport struct {
+	P50        time.Duration `json:"p50"`
+	P95        time.Duration `json:"p95"`
+	P99        time.Duration `json:"p99"`
+	Mean       time.Duration `json:"mean"`
+	Throughput float64       `json:"opsPerSec"`
+	// BytesSent, BytesReceived - mean RESP bytes per operation
+	BytesSent     int64 `json:"bytesSent"`
+	BytesReceived int64 `json:"bytesReceived"`
+}
+
+// runBenchmarkReport - runBenchmark, reported per storage mode
+func runBenchmarkReport(conn redis.Conn, opts benchOptions) (r benchReport, err error) {
+	r.Started = time.Now().UTC()
+	if info, ierr := redis.String(conn.Do("INFO", "server")); ierr == nil {
+		r.Server = infoField(info, "redis_version")
+	}
+
+	results, err := runBenchmark(conn, opts)
+	if err != nil {
+		return
+	}
+
+	byMode := make(map[storageMode]*benchModeReport)
+	for _, res := range results {
+		m := byMode[res.Mode]
+		if m == nil {
+			r.Modes = append(r.Modes, benchModeReport{Mode: res.Mode.String()})
+			m = &r.Modes[len(r.Modes)-1]
+			byMode[res.Mode] = m
+		}
+		r.N = res.N
+		m.MemPerObject = res.MemPerObject
+
+		op := benchOpReport{
+			P50:           res.P50,
+			P95:           res.P95,
+			P99:           res.P99,
+			Mean:          res.Mean,
+			Throughput:    res.Throughput,
+			BytesSent:     res.BytesSent,
+			BytesReceived: res.BytesReceived,
+		}
+		switch res.Op {
+		case "set":
+			m.Set = op
+		case "get":
+			m.Get = op
+		}
+	}
+	return
+}
+
+// wireConn - counts the RESP bytes of the commands sent through it and of
+// the replies received, as the server would see them
+type wireConn struct {
+	redis.Conn
+	sent, received int64
+}
+
+func (c *wireConn) Do(cmd string, args ...interface{}) (reply interface{}, err error) {
+	if cmd != "" {
+		c.sent += respCommandSize(cmd, args)
+	}
+	reply, err = c.Conn.Do(cmd, args...)
+	if pending, ok := reply.([]interface{}); cmd == "" && ok {
+		// the replies of every Send, gathered by redigo, not an array
+		// the server sent
+		for _, r := range pending {
+			c.received += respReplySize(r, nil)
+		}
+		return
+	}
+	c.received += respReplySize(reply, err)
+	return
+}
+
+func (c *wireConn) Send(cmd string, args ...interface{}) error {
+	c.sent += respCommandSize(cmd, args)
+	return c.Conn.Send(cmd, args...)
+}
+
+func (c *wireConn) Receive() (reply interface{}, err error) {
+	reply, err = c.Conn.Receive()
+	c.received += respReplySize(reply, err)
+	return
+}
+
+// perOp - bytes sent and received, averaged over n operations
+func (c *wireConn) perOp(n int) (sent, received int64) {
+	if n == 0 {
+		return
+	}
+	return c.sent / int64(n), c.received / int64(n)
+}
+
+// respCommandSize - length of cmd and args as a RESP array of bulk strings,
+// the arguments formatted the way redigo writes them
+func respCommandSize(cmd string, args []interface{}) int64 {
+	n := respHeaderSize(len(args)+1) + respBulkSize(len(cmd))
+	for _, arg := range args {
+		n += respBulkSize(len(redisArgString(arg)))
+	}
+	return n
+}
+
+// redisArgString - arg as redigo puts it on the wire
+func redisArgString(arg interface{}) string {
+	switch v := arg.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case nil:
+		return ""
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case redis.Argument:
+		return redisArgString(v.RedisArg())
+	}
+	return fmt.Sprint(arg)
+}
+
+// respReplySize - length of reply as RESP
+func respReplySize(reply interface{}, err error) int64 {
+	if rerr, ok := err.(redis.Error); ok {
+		return int64(len(rerr)) + 3
+	}
+	switch v := reply.(type) {
+	case nil:
+		return 5 // $-1\r\n
+	case string:
+		return int64(len(v)) + 3
+	case int64:
+		return int64(len(fmt.Sprint(v))) + 3
+	case []byte:
+		return respBulkSize(len(v))
+	case []interface{}:
+		n := respHeaderSize(len(v))
+		for _, e := range v {
+			n += respReplySize(e, nil)
+		}
+		return n
+	}
+	return 0
+}
+
+// respHeaderSize - length of an array header *n\r\n
+func respHeaderSize(n int) int64 {
+	return int64(len(fmt.Sprint(n))) + 3
+}
+
+// respBulkSize - length of a bulk string of n bytes, $n\r\n...\r\n
+func respBulkSize(n int) int64 {
+	return int64(len(fmt.Sprint(n))) + 3 + int64(n) + 2
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// bitsSuffix - appended to an object's key to name the string its bits
+// fields are packed into
+const bitsSuffix = ":bits"
+
+// bitsKey - the BITFIELD string holding the bits fields of the object at
+// key. It hashes to key's cluster slot, so the two can be written in one
+// MULTI and pipelined to the same node: key keeps its own hash tag, or is
+// made the tag, student:1 giving {student:1}:bits. A key with a '}' but no
+// tag can't be a tag itself, so it is given one for its slot instead.
+func bitsKey(key string) string {
+	switch {
+	case hashTag(key) != "":
+		return key + bitsSuffix
+	case strings.Contains(key, "}"):
+		return "{" + slotTag(keySlot(key)) + "}" + key + bitsSuffix
+	}
+	return "{" + key + "}" + bitsSuffix
+}
+
+// isBitsKey - whether key looks like the bits string of another. The walks
+// over a pattern (copy, backup, export) skip those and handle each along
+// with its object, which a pattern on the object's keys won't match.
+func isBitsKey(key string) bool {
+	return strings.HasSuffix(key, bitsSuffix) && hashTag(strings.TrimSuffix(key, bitsSuffix)) != ""
+}
+
+// bitsObject - the object whose bits string is key, undoing bitsKey. A key
+// made a tag and one that was already a whole tag look the same, so
+// {student:1}:bits is taken for student:1's rather than {student:1}'s.
+func bitsObject(key string) string {
+	obj := strings.TrimSuffix(key, bitsSuffix)
+	end := strings.IndexByte(obj, '}')
+	if !strings.HasPrefix(obj, "{") || end < 0 {
+		return obj
+	}
+	tag, rest := obj[1:end], obj[end+1:]
+	switch {
+	case rest == "":
+		return tag
+	case strings.Contains(rest, "}") && hashTag(rest) == "" && tag == slotTag(keySlot(rest)):
+		return rest
+	}
+	return obj
+}
+
+// getRawBits - the bits string of the object at key as stored, nil if it
+// has none
+func getRawBits(conn redis.Conn, key string) (raw []byte, err error) {
+	raw, err = redis.Bytes(conn.Do("GET", bitsKey(key)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, newCommandError("GET", bitsKey(key), err)
+	}
+	return
+}
+
+// bitField - a field tagged `redis:"name,bits=N"` and where it sits in the
+// packed string. Fields are packed in declaration order from bit 0, so
+// adding bits fields after the others keeps what is stored readable, while
+// reordering or widening them needs the strings rewritten.
+type bitField struct {
+	index int
+	// name - the hash field name it would otherwise be stored under
+	name string
+	// typ - its BITFIELD type, u4 for bits=4 on an unsigned field or a bool,
+	// i4 on a signed one
+	typ    string
+	offset int
+	width  int
+	signed bool
+}
+
+// buildBits - t's bits fields laid out, or why they can't be: the field
+// isn't an integer or bool, or N doesn't fit it (BITFIELD's unsigned
+// integers stop at 63 bits)
+func buildBits(t reflect.Type, tags []fieldTag) (fields []bitField, err error) {
+	offset := 0
+	for i, tag := range tags {
+		v, ok := tag.value("bits")
+		if !ok {
+			continue
+		}
+		sf := t.Field(i)
+		f := bitField{index: i, name: tag.Name, offset: offset}
+		if f.name == "" {
+			f.name = sf.Name
+		}
+
+		max := 0
+		switch sf.Type.Kind() {
+		case reflect.Bool:
+			max = 1
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			max = sf.Type.Bits()
+			if max > 63 {
+				max = 63
+			}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			max = sf.Type.Bits()
+			f.signed = true
+		default:
+			return nil, fmt.Errorf("%w: %s.%s: bits needs an integer or bool field, not %s", ErrUnsupportedType, t, sf.Name, sf.Type)
+		}
+		f.width, err = strconv.Atoi(v)
+		if err != nil || f.width < 1 || f.width > max {
+			return nil, fmt.Errorf("%w: %s.%s: bits=%s, want 1 to %d", ErrUnsupportedType, t, sf.Name, v, max)
+		}
+
+		f.typ = "u" + v
+		if f.signed {
+			f.typ = "i" + v
+		}
+		fields = append(fields, f)
+		offset += f.width
+	}
+	return
+}
+
+// bitFieldsOf - the bits fields of t, a struct or a pointer to one; other
+// types have none
+func bitFieldsOf(t reflect.Type) ([]bitField, error) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, nil
+	}
+	info := structInfoOf(t)
+	return info.bits, info.bitsErr
+}
+
+// load - the field's value in v as BITFIELD stores it, failing if it is
+// out of the field's range rather than letting BITFIELD wrap it
+func (f bitField) load(v reflect.Value) (n int64, err error) {
+	switch {
+	case v.Kind() == reflect.Bool:
+		if v.Bool() {
+			n = 1
+		}
+		return
+	case f.signed:
+		n = v.Int()
+		if limit := int64(1) << (f.width - 1); f.width < 64 && (n < -limit || n >= limit) {
+			return 0, fmt.Errorf("%s is %d, out of range for bits=%d", f.name, n, f.width)
+		}
+		return
+	}
+	u := v.Uint()
+	if u>>f.width != 0 {
+		return 0, fmt.Errorf("%s is %d, out of range for bits=%d", f.name, u, f.width)
+	}
+	return int64(u), nil
+}
+
+// store - sets the field in v to n, as read from BITFIELD
+func (f bitField) store(v reflect.Value, n int64) {
+	switch {
+	case v.Kind() == reflect.Bool:
+		v.SetBool(n != 0)
+	case f.signed:
+		v.SetInt(n)
+	default:
+		v.SetUint(uint64(n))
+	}
+}
+
+// bitsSetArgs - the BITFIELD arguments writing value's bits fields to key's
+// bits string, nil if it has none
+func bitsSetArgs(key string, value interface{}) (args redis.Args, err error) {
+	v := reflect.ValueOf(value)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	fields, err := bitFieldsOf(v.Type())
+	if err != nil || len(fields) == 0 {
+		return
+	}
+
+	args = redis.Args{bitsKey(key)}
+	for _, f := range fields {
+		var n int64
+		n, err = f.load(v.Field(f.index))
+		if err != nil {
+			return nil, err
+		}
+		args = args.Add("SET", f.typ, f.offset, n)
+	}
+	return
+}
+
+// bitsGetArgs - the BITFIELD arguments reading fields from key's bits
+// string; a missing string reads as all zeros
+func bitsGetArgs(key string, fields []bitField) redis.Args {
+	args := redis.Args{bitsKey(key)}
+	for _, f := range fields {
+		args = args.Add("GET", f.typ, f.offset)
+	}
+	return args
+}
+
+// scanBits - BITFIELD's reply to bitsGetArgs decoded into dest, a pointer
+// to the struct fields belong to
+func scanBits(reply interface{}, fields []bitField, dest interface{}) (err error) {
+	ns, err := redis.Int64s(reply, nil)
+	if err != nil {
+		return
+	}
+	if len(ns) != len(fields) {
+		return fmt.Errorf("BITFIELD returned %d values for %d fields", len(ns), len(fields))
+	}
+	v := reflect.ValueOf(dest)
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	for i, f := range fields {
+		f.store(v.Field(f.index), ns[i])
+	}
+	return
+}
+
+// BitCounters - the bits fields of the T stored at Key, read and updated
+// one at a time in the packed string without touching the rest of the
+// object. Fields are named by their hash field name or Go name. It works in
+// any storage mode; in the JSON modes, where addStruct keeps the fields in
+// the document, tag them `json:"-"` so the counters only live here.
+type BitCounters[T any] struct {
+	Key string
+}
+
+// NewBitCounters - the bits fields of the T at key
+func NewBitCounters[T any](key string) BitCounters[T] {
+	return BitCounters[T]{Key: key}
+}
+
+// field - the bits field called name
+func (b BitCounters[T]) field(name string) (f bitField, err error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	fields, err := bitFieldsOf(t)
+	if err != nil {
+		return
+	}
+	for _, f = range fields {
+		if f.name == name || t.Field(f.index).Name == name {
+			return
+		}
+	}
+	return bitField{}, fmt.Errorf("%s has no bits field %q", t, name)
+}
+
+// Get - the value of the field called name
+func (b BitCounters[T]) Get(ctx context.Context, conn redis.Conn, name string) (n int64, err error) {
+	f, err := b.field(name)
+	if err != nil {
+		return
+	}
+	ns, err := redis.Int64s(doContext(ctx, conn, "BITFIELD", bitsKey(b.Key), "GET", f.typ, f.offset))
+	if err == nil && len(ns) != 1 {
+		err = fmt.Errorf("unexpected reply %v", ns)
+	}
+	if err != nil {
+		return 0, newCommandError("BITFIELD", b.Key, err)
+	}
+	return ns[0], nil
+}
+
+// Incr - adds by (negative to decrement) to the field called name,
+// returning its new value. The result saturates at the field's bounds
+// instead of wrapping, so a 4 bit attempts counter stops at 15.
+func (b BitCounters[T]) Incr(ctx context.Context, conn redis.Conn, name string, by int64) (n int64, err error) {
+	f, err := b.field(name)
+	if err != nil {
+		return
+	}
+	ns, err := redis.Int64s(doContext(ctx, conn, "BITFIELD", bitsKey(b.Key), "OVERFLOW", "SAT", "INCRBY", f.typ, f.offset, by))
+	if err == nil && len(ns) != 1 {
+		err = fmt.Errorf("unexpected reply %v", ns)
+	}
+	if err != nil {
+		return 0, newCommandError("BITFIELD", b.Key, err)
+	}
+	return ns[0], nil
+}
+
+// Load - reads every bits field into value, leaving its other fields alone
+func (b BitCounters[T]) Load(ctx context.Context, conn redis.Conn, value *T) (err error) {
+	fields, err := bitFieldsOf(reflect.TypeOf(value))
+	if err != nil || len(fields) == 0 {
+		return
+	}
+	reply, err := doContext(ctx, conn, "BITFIELD", bitsGetArgs(b.Key, fields)...)
+	if err != nil {
+		return newCommandError("BITFIELD", b.Key, err)
+	}
+	return scanBits(reply, fields, value)
+}
+
+// Store - writes every bits field of value in one BITFIELD
+func (b BitCounters[T]) Store(ctx context.Context, conn redis.Conn, value *T) (err error) {
+	args, err := bitsSetArgs(b.Key, value)
+	if err != nil {
+		return fmt.Errorf("%s: %w", b.Key, err)
+	}
+	if args == nil {
+		return
+	}
+	_, err = doContext(ctx, conn, "BITFIELD", args...)
+	if err != nil {
+		return newCommandError("BITFIELD", b.Key, err)
+	}
+	return
+}
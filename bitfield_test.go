@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+type bitsDoc struct {
+	Name     string `redis:"name"`
+	Attempts uint8  `redis:"attempts,bits=4"`
+	Active   bool   `redis:"active,bits=1"`
+	Delta    int16  `redis:"delta,bits=6"`
+}
+
+func TestBitsKey(t *testing.T) {
+	tests := []struct {
+		key, want string
+	}{
+		{"student:1", "{student:1}:bits"},
+		{"{tenant}:student:1", "{tenant}:student:1:bits"},
+		{"{student:1", "{{student:1}:bits"},
+		// keys that can't be a tag get one hashing to their slot
+		{"a{}b", "{3991}a{}b:bits"},
+		{"a}b", "{20658}a}b:bits"},
+	}
+	for _, tt := range tests {
+		got := bitsKey(tt.key)
+		if got != tt.want {
+			t.Errorf("bitsKey(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+		if keySlot(got) != keySlot(tt.key) {
+			t.Errorf("bitsKey(%q) hashes to slot %d, the key to %d", tt.key, keySlot(got), keySlot(tt.key))
+		}
+		if !isBitsKey(got) {
+			t.Errorf("isBitsKey(%q) = false", got)
+		}
+		if obj := bitsObject(got); obj != tt.key {
+			t.Errorf("bitsObject(%q) = %q, want %q", got, obj, tt.key)
+		}
+	}
+
+	for _, key := range []string{"student:1", "student:1:bits", "{student:1}"} {
+		if isBitsKey(key) {
+			t.Errorf("isBitsKey(%q) = true", key)
+		}
+	}
+}
+
+func TestBitsSetArgs(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+		err   bool
+	}{
+		{"packed in order", bitsDoc{Attempts: 9, Active: true, Delta: -5},
+			"[{student:1}:bits SET u4 0 9 SET u1 4 1 SET i6 5 -5]", false},
+		{"pointer", &bitsDoc{Attempts: 15, Delta: 31},
+			"[{student:1}:bits SET u4 0 15 SET u1 4 0 SET i6 5 31]", false},
+		{"lowest signed", bitsDoc{Delta: -32},
+			"[{student:1}:bits SET u4 0 0 SET u1 4 0 SET i6 5 -32]", false},
+		{"nil pointer", (*bitsDoc)(nil), "[]", false},
+		{"no bits fields", Student{}, "[]", false},
+		{"unsigned overflow", bitsDoc{Attempts: 16}, "", true},
+		{"signed overflow", bitsDoc{Delta: 32}, "", true},
+		{"signed underflow", bitsDoc{Delta: -33}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := bitsSetArgs("student:1", tt.value)
+			if tt.err {
+				if err == nil {
+					t.Errorf("no error, args %v", args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprint([]interface{}(args)); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBitsRoundTrip(t *testing.T) {
+	fields, err := bitFieldsOf(reflect.TypeOf(bitsDoc{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint([]interface{}(bitsGetArgs("student:1", fields))), "[{student:1}:bits GET u4 0 GET u1 4 GET i6 5]"; got != want {
+		t.Errorf("bitsGetArgs: got %s, want %s", got, want)
+	}
+
+	for _, want := range []bitsDoc{
+		{},
+		{Attempts: 15, Active: true, Delta: 31},
+		{Attempts: 1, Delta: -32},
+	} {
+		args, err := bitsSetArgs("student:1", want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// what BITFIELD GET would return: the values SET wrote
+		var reply []interface{}
+		for i := 4; i < len(args); i += 4 {
+			reply = append(reply, args[i])
+		}
+
+		got := bitsDoc{Name: "kept"}
+		if err = scanBits(reply, fields, &got); err != nil {
+			t.Fatal(err)
+		}
+		want.Name = "kept"
+		if got != want {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+
+	if err = scanBits([]interface{}{int64(1)}, fields, &bitsDoc{}); err == nil {
+		t.Error("scanBits: no error for a short reply")
+	}
+}
+
+func TestBuildBitsErrors(t *testing.T) {
+	tests := []interface{}{
+		struct {
+			S string `redis:"s,bits=4"`
+		}{},
+		struct {
+			U uint8 `redis:"u,bits=0"`
+		}{},
+		struct {
+			U uint8 `redis:"u,bits=9"`
+		}{},
+		struct {
+			U uint64 `redis:"u,bits=64"`
+		}{},
+		struct {
+			B bool `redis:"b,bits=2"`
+		}{},
+		struct {
+			I int8 `redis:"i,bits=x"`
+		}{},
+	}
+	for _, v := range tests {
+		_, err := bitFieldsOf(reflect.TypeOf(v))
+		if !errors.Is(err, ErrUnsupportedType) {
+			t.Errorf("%T: got %v, want ErrUnsupportedType", v, err)
+		}
+	}
+}
+
+func TestAddStructHashBitsExecError(t *testing.T) {
+	// the BITFIELD is queued after the HMSET in one MULTI
+	checkExecFailed(t, addStructHash(failingExecConn(), "k", bitsDoc{Attempts: 1}))
+}
+
+func TestSplitRawBits(t *testing.T) {
+	typ := reflect.TypeOf(bitsDoc{})
+	tests := []struct {
+		name string
+		mode storageMode
+		typ  reflect.Type
+		raw  string
+		rest string
+		bits string
+		err  bool
+	}{
+		{"bits members moved", modeHash, typ, `{"Name":"a","attempts":3,"Active":true}`,
+			`{"Name":"a"}`, "[{k}:bits SET u4 0 3 SET u1 4 1]", false},
+		{"members left out are left alone", modeHash, typ, `{"Name":"a","Delta":-2}`,
+			`{"Name":"a"}`, "[{k}:bits SET i6 5 -2]", false},
+		{"no bits members", modeHash, typ, `{"Name":"a"}`, `{"Name":"a"}`, "[]", false},
+		{"untyped", modeHash, nil, `{"attempts":3}`, `{"attempts":3}`, "[]", false},
+		{"json modes keep them", modeReJSON, typ, `{"attempts":3}`, `{"attempts":3}`, "[]", false},
+		{"out of range", modeHash, typ, `{"attempts":16}`, "", "", true},
+		{"wrong type", modeHash, typ, `{"attempts":"x"}`, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rest, bits, _, err := splitRawBits(tt.mode, "k", []byte(tt.raw), tt.typ)
+			if tt.err {
+				if err == nil {
+					t.Errorf("no error, bits %v", bits)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(rest) != tt.rest {
+				t.Errorf("rest %s, want %s", rest, tt.rest)
+			}
+			if got := fmt.Sprint([]interface{}(bits)); got != tt.bits {
+				t.Errorf("bits %s, want %s", got, tt.bits)
+			}
+		})
+	}
+}
+
+func TestSetRawBits(t *testing.T) {
+	rec := newRecordingConn(nil)
+	err := setRaw(rec, modeHash, "k", []byte(`{"Name":"a","attempts":3}`), reflect.TypeOf(bitsDoc{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent []string
+	for _, c := range rec.commands() {
+		sent = append(sent, fmt.Sprint(c.Cmd, c.Args))
+	}
+	if got, want := fmt.Sprint(sent), "[MULTI[] HMSET[k Name a] BITFIELD[{k}:bits SET u4 0 3] EXEC[]]"; got != want {
+		t.Errorf("sent %s, want %s", got, want)
+	}
+
+	checkExecFailed(t, setRaw(failingExecConn(), modeHash, "k", []byte(`{"Name":"a","attempts":3}`), reflect.TypeOf(bitsDoc{})))
+}
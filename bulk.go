@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// bulkOptions - how bulkGet, bulkSet and bulkDelete spread their keys
+type bulkOptions struct {
+	// Workers - batches in flight at once, each on its own pooled conn
+	Workers int
+	// Batch - keys pipelined per round trip
+	Batch int
+}
+
+// bulkNodes - where bulk operations send each key: one server
+// (singleNode) or the masters of a Redis Cluster (clusterNodes)
+type bulkNodes interface {
+	// node - the node serving key; only keys of the same node are batched
+	// together
+	node(key string) string
+	// get - a conn to node
+	get(ctx context.Context, node string) (redis.Conn, error)
+}
+
+// singleNode - every key on the server behind pool
+type singleNode struct {
+	pool *redis.Pool
+}
+
+func (n singleNode) node(key string) string { return "" }
+
+func (n singleNode) get(ctx context.Context, node string) (redis.Conn, error) {
+	return n.pool.GetContext(ctx)
+}
+
+// bulkErrors - the keys a bulk operation failed on, with why
+type bulkErrors map[string]error
+
+func (e bulkErrors) Error() string {
+	keys := make([]string, 0, len(e))
+	for key := range e {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) == 1 {
+		return e[keys[0]].Error()
+	}
+	return fmt.Sprintf("%d keys failed, first: %v", len(keys), e[keys[0]])
+}
+
+// bulkItem - one object for bulkSet
+type bulkItem struct {
+	Key   string
+	Value interface{}
+}
+
+// bulkGet - reads keys, stored in mode, decoding each into a fresh
+// newValue() and passing it to fn (nil for a key that doesn't exist). fn is
+// called from the workers, one call at a time, in no particular order.
+// Keys that fail are reported in a bulkErrors; the rest are still read.
+func bulkGet(ctx context.Context, nodes bulkNodes, mode storageMode, keys []string, opts bulkOptions, newValue func() interface{}, fn func(key string, value interface{})) (err error) {
+	var mu sync.Mutex
+	return runBulk(ctx, nodes, keys, opts, func(conn redis.Conn, batch []int, fail func(i int, err error)) error {
+		batchKeys := make([]string, len(batch))
+		for j, i := range batch {
+			batchKeys[j] = keys[i]
+		}
+		values, errs, err := getMany(ctx, conn, mode, batchKeys, newValue)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for j, i := range batch {
+			if errs[j] != nil {
+				fail(i, errs[j])
+				continue
+			}
+			fn(keys[i], values[j])
+		}
+		return nil
+	})
+}
+
+// bulkSet - stores items in mode as addStruct would. Items that fail are
+// reported in a bulkErrors; the rest are still written.
+func bulkSet(ctx context.Context, nodes bulkNodes, mode storageMode, items []bulkItem, opts bulkOptions) (err error) {
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = item.Key
+	}
+
+	return runBulk(ctx, nodes, keys, opts, func(conn redis.Conn, batch []int, fail func(i int, err error)) error {
+		// replies each item's commands expect, 0 for an item not sent
+		sent := make([]int, len(batch))
+		for j, i := range batch {
+			n, err := sendSet(conn, mode, items[i].Key, items[i].Value)
+			if err != nil {
+				fail(i, err)
+				continue
+			}
+			sent[j] = n
+		}
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+
+		for j, i := range batch {
+			var failed error
+			for ; sent[j] > 0; sent[j]-- {
+				reply, err := conn.Receive()
+				if _, ok := err.(redis.Error); err != nil && !ok {
+					return err
+				}
+				if replies, ok := reply.([]interface{}); ok && err == nil {
+					// EXEC's, whose failures are among its replies
+					err = execError(replies)
+				}
+				if err != nil && failed == nil {
+					failed = newCommandError("set", keys[i], err)
+				}
+			}
+			if failed != nil {
+				fail(i, failed)
+			}
+		}
+		return nil
+	})
+}
+
+// sendSet - queues the commands storing value at key in mode, returning
+// how many were sent
+func sendSet(conn redis.Conn, mode storageMode, key string, value interface{}) (n int, err error) {
+	defer recoverUnsupported(&err)
+
+	value, err = prepareSet(key, value)
+	if err != nil {
+		return
+	}
+
+	switch mode {
+	case modeHash:
+		if isContainer(reflect.TypeOf(value)) {
+			var fields redis.Args
+			fields, err = containerHashArgs(value)
+			if err != nil {
+				return 0, fmt.Errorf("%s: %w", key, err)
+			}
+			// in a transaction, so readers never see the key emptied
+			conn.Send("MULTI")
+			conn.Send("DEL", key)
+			conn.Send("HMSET", redis.Args{key}.AddFlat(fields)...)
+			conn.Send("EXEC")
+			return 4, nil
+		}
+		var bits redis.Args
+		bits, err = bitsSetArgs(key, value)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", key, err)
+		}
+		args := redis.Args{key}.AddFlat(redigoValue(value))
+		conn.Send("HMSET", args...)
+		n = 1
+		if stale := staleAliasFields(value); len(stale) > 0 {
+			conn.Send("HDEL", redis.Args{key}.AddFlat(stale)...)
+			n++
+		}
+		if bits != nil {
+			conn.Send("BITFIELD", bits...)
+			n++
+		}
+		return n, nil
+	case modeHashJSON, modeReJSON:
+		var b *encodeBuffer
+		b, err = encodeJSON(value)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", key, err)
+		}
+		if mode == modeReJSON {
+			conn.Send("JSON.SET", key, ".", b.bytes())
+		} else {
+			conn.Send("HSET", key, "JSON", b.bytes())
+		}
+		b.release()
+		return 1, nil
+	}
+	return 0, fmt.Errorf("unknown storage mode %v", mode)
+}
+
+// bulkDelete - DELs keys, and their bits strings, returning how many keys
+// existed. Keys that fail are reported in a bulkErrors; the rest are still
+// deleted.
+func bulkDelete(ctx context.Context, nodes bulkNodes, keys []string, opts bulkOptions) (deleted int64, err error) {
+	var mu sync.Mutex
+	err = runBulk(ctx, nodes, keys, opts, func(conn redis.Conn, batch []int, fail func(i int, err error)) error {
+		for _, i := range batch {
+			conn.Send("DEL", keys[i])
+			conn.Send("DEL", bitsKey(keys[i]))
+		}
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+
+		var n int64
+		for _, i := range batch {
+			reply, err := redis.Int64(conn.Receive())
+			if _, ok := err.(redis.Error); err != nil && !ok {
+				return err
+			}
+			_, berr := conn.Receive()
+			if _, ok := berr.(redis.Error); berr != nil && !ok {
+				return berr
+			}
+			if err == nil && berr != nil {
+				err = berr
+			}
+			if err != nil {
+				fail(i, newCommandError("DEL", keys[i], err))
+				continue
+			}
+			n += reply
+		}
+
+		mu.Lock()
+		deleted += n
+		mu.Unlock()
+		return nil
+	})
+	return
+}
+
+// runBulk - splits keys into batches of at most opts.Batch keys served by
+// the same node and runs fn on each, opts.Workers at a time, with a conn to
+// that node. fn gets the batch as indexes into keys, and reports per key
+// failures with fail; an error it returns, like failing to get a conn,
+// fails every key of the batch. runBulk returns the failures as a
+// bulkErrors, or ctx's error if it ended early.
+func runBulk(ctx context.Context, nodes bulkNodes, keys []string, opts bulkOptions, fn func(conn redis.Conn, batch []int, fail func(i int, err error)) error) error {
+	if opts.Workers <= 0 {
+		opts.Workers = 8
+	}
+	if opts.Batch <= 0 {
+		opts.Batch = 100
+	}
+
+	type job struct {
+		node  string
+		batch []int
+	}
+
+	var mu sync.Mutex
+	failed := make(bulkErrors)
+	fail := func(i int, err error) {
+		mu.Lock()
+		failed[keys[i]] = err
+		mu.Unlock()
+	}
+
+	jobs := make(chan job)
+	var wg sync.WaitGroup
+	for w := 0; w < opts.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				err := runBatch(ctx, nodes, j.node, j.batch, fail, fn)
+				if err == nil {
+					continue
+				}
+				for _, i := range j.batch {
+					fail(i, fmt.Errorf("%s: %w", keys[i], err))
+				}
+			}
+		}()
+	}
+
+	pending := make(map[string][]int)
+	queue := func(node string, batch []int) bool {
+		select {
+		case jobs <- job{node, batch}:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	done := true
+	for i, key := range keys {
+		node := nodes.node(key)
+		pending[node] = append(pending[node], i)
+		if len(pending[node]) < opts.Batch {
+			continue
+		}
+		if done = queue(node, pending[node]); !done {
+			break
+		}
+		delete(pending, node)
+	}
+	for node, batch := range pending {
+		if !done || !queue(node, batch) {
+			done = false
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// runBatch - runs fn on batch with a conn to node, again on a fresh conn
+// for as long as fn or getting the conn fails with a transient error, like
+// a dropped connection. The per key failures of the last run are the ones
+// reported.
+func runBatch(ctx context.Context, nodes bulkNodes, node string, batch []int, fail func(i int, err error), fn func(conn redis.Conn, batch []int, fail func(i int, err error)) error) error {
+	var failed map[int]error
+	err := retryTransient(ctx, transientAttempts, transientBackoff, func() error {
+		failed = make(map[int]error)
+		conn, err := nodes.get(ctx, node)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		return fn(conn, batch, func(i int, err error) { failed[i] = err })
+	})
+	for i, ferr := range failed {
+		fail(i, ferr)
+	}
+	return err
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"container/list"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// structCache - in-process LRU of decoded structs, keyed by the redis key
+// they were read from. Only the struct is copied in and out, so the
+// pointers, slices and maps in a cached value are shared with whoever
+// stored or read it, unless setDeepCopy is on.
+type structCache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+	ttls  map[reflect.Type]time.Duration
+	modes map[reflect.Type]writeMode
+
+	// write-behind buffer, see cache_write.go
+	pending  map[string][]byte
+	batch    int
+	flushNow chan struct{}
+
+	// expiryPrefixes - prefixes whose expired keys an expiry watcher
+	// evicts, counting the watchers of each (see watchExpiry)
+	expiryPrefixes map[string]int
+
+	// deep - deep copy values going in and out, see setDeepCopy
+	deep bool
+
+	// gen - bumped by every invalidation. While reads are in flight
+	// (loads), stale holds the gen each key was last invalidated at, and
+	// cleared the gen of the last clear, so a value read before either is
+	// not cached after it (see beginLoad)
+	gen     uint64
+	loads   int
+	stale   map[string]uint64
+	cleared uint64
+	// unsynced - set when the keyspace subscription is lost, so nothing
+	// read is cached until invalidateOnNotify subscribes again
+	unsynced bool
+
+	hits   uint64
+	misses uint64
+}
+
+type cacheEntry struct {
+	key     string
+	value   reflect.Value
+	expires time.Time
+}
+
+// structLoader - reads the object stored at key into value (a pointer to a
+// struct). The cache decorates any loader with the same signature.
+type structLoader func(conn redis.Conn, key string, value interface{}) error
+
+// cacheStats - hit/miss counters for a structCache
+type cacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+func newStructCache(size int) *structCache {
+	return &structCache{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+		ttls:  make(map[reflect.Type]time.Duration),
+	}
+}
+
+// setTTL - entries decoded into the same type as value expire from the cache
+// after ttl. A zero ttl keeps them until evicted or invalidated.
+func (c *structCache) setTTL(value interface{}, ttl time.Duration) {
+	t := reflect.TypeOf(value)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	c.mu.Lock()
+	c.ttls[t] = ttl
+	c.mu.Unlock()
+}
+
+// setDeepCopy - with on, values are deep copied into and out of the cache,
+// so callers can change anything in what they read (or stored) without
+// changing the cached copy. Without, only the struct itself is copied, and
+// the slices, maps and pointers in it are shared with every reader.
+func (c *structCache) setDeepCopy(on bool) {
+	c.mu.Lock()
+	c.deep = on
+	c.mu.Unlock()
+}
+
+// readThrough - wraps load so that hits are served from the cache and misses
+// fall through to redis, populating the cache on the way back
+func (c *structCache) readThrough(load structLoader) structLoader {
+	return func(conn redis.Conn, key string, value interface{}) (err error) {
+		defer recoverUnsupported(&err)
+
+		if c.load(key, value) {
+			atomic.AddUint64(&c.hits, 1)
+			return
+		}
+		atomic.AddUint64(&c.misses, 1)
+
+		// deferred so that a load panicking, recovered above, still ends
+		since, ok := c.beginLoad(), false
+		defer func() { c.endLoad(key, value, since, ok) }()
+		err = load(conn, key, value)
+		ok = err == nil
+		return
+	}
+}
+
+// beginLoad - notes a read from redis starting, returning the gen to pass
+// to endLoad
+func (c *structCache) beginLoad() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loads++
+	return c.gen
+}
+
+// endLoad - caches value, read at gen since, if ok and key wasn't
+// invalidated since: the value may predate the write the invalidation was
+// for, and would be kept with nothing left to evict it
+func (c *structCache) endLoad(key string, value interface{}, since uint64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fresh := c.stale[key] <= since && c.cleared <= since && !c.unsynced
+	if c.loads--; c.loads == 0 {
+		c.stale = nil
+	}
+	if ok && fresh {
+		c.storeLocked(key, value)
+	}
+}
+
+// getStructReJSON - reads key into value (a pointer to a struct), serving it
+// from the cache when the decoded object is already present
+func (c *structCache) getStructReJSON(conn redis.Conn, key string, value interface{}) (err error) {
+	return c.readThrough(loadStructReJSON)(conn, key, value)
+}
+
+func (c *structCache) load(key string, value interface{}) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return false
+	}
+
+	entry := el.Value.(*cacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.removeElement(el)
+		return false
+	}
+
+	dst := reflect.ValueOf(value).Elem()
+	if dst.Type() != entry.value.Type() {
+		return false
+	}
+
+	if c.deep {
+		dst.Set(deepCopy(entry.value))
+	} else {
+		dst.Set(entry.value)
+	}
+	c.ll.MoveToFront(el)
+	return true
+}
+
+func (c *structCache) store(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.storeLocked(key, value)
+}
+
+func (c *structCache) storeLocked(key string, value interface{}) {
+	v := reflect.ValueOf(value).Elem()
+	cp := reflect.New(v.Type()).Elem()
+	if c.deep {
+		cp.Set(deepCopy(v))
+	} else {
+		cp.Set(v)
+	}
+
+	var expires time.Time
+	if ttl := c.ttls[v.Type()]; ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		entry.value, entry.expires = cp, expires
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&cacheEntry{key: key, value: cp, expires: expires})
+	if c.size > 0 && c.ll.Len() > c.size {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *structCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.markStale(key)
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+// markStale - bumps gen, recording it against key while reads are in
+// flight
+func (c *structCache) markStale(key string) {
+	c.gen++
+	if c.loads == 0 {
+		return
+	}
+	if c.stale == nil {
+		c.stale = make(map[string]uint64)
+	}
+	c.stale[key] = c.gen
+}
+
+// clear - drops every entry, and any value being read meanwhile
+func (c *structCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.cleared = c.gen
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+// take - removes key from the cache, returning a pointer to the decoded value
+// it held (nil if it was not cached)
+func (c *structCache) take(key string) interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.markStale(key)
+	el, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	c.removeElement(el)
+
+	v := el.Value.(*cacheEntry).value
+	p := reflect.New(v.Type())
+	p.Elem().Set(v)
+	return p.Interface()
+}
+
+// watchExpiry - leaves the eviction of expired keys starting with prefix to
+// an expiry watcher, until the returned func is called
+func (c *structCache) watchExpiry(prefix string) (unwatch func()) {
+	c.mu.Lock()
+	if c.expiryPrefixes == nil {
+		c.expiryPrefixes = make(map[string]int)
+	}
+	c.expiryPrefixes[prefix]++
+	c.mu.Unlock()
+
+	return func() {
+		c.mu.Lock()
+		if c.expiryPrefixes[prefix]--; c.expiryPrefixes[prefix] <= 0 {
+			delete(c.expiryPrefixes, prefix)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// expiryWatched - whether an expiry watcher evicts key when it expires
+func (c *structCache) expiryWatched(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for prefix := range c.expiryPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *structCache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*cacheEntry).key)
+}
+
+func (c *structCache) stats() cacheStats {
+	c.mu.Lock()
+	n := c.ll.Len()
+	c.mu.Unlock()
+
+	return cacheStats{
+		Hits:    atomic.LoadUint64(&c.hits),
+		Misses:  atomic.LoadUint64(&c.misses),
+		Entries: n,
+	}
+}
+
+// invalidateOnNotify - listens for keyspace notifications on conn and drops
+// any cached key that is modified, deleted or expired on the server. conn is
+// dedicated to the subscription; the call blocks until it is closed. Once
+// it returns, changes go unseen, so the cache is cleared and reads are no
+// longer cached until it is called again.
+func (c *structCache) invalidateOnNotify(conn redis.Conn) (err error) {
+	defer func() {
+		c.mu.Lock()
+		c.unsynced = true
+		c.mu.Unlock()
+		c.clear()
+	}()
+
+	// CHECKPOINT -
+	// Keyspace events are off by default. "K" enables the __keyspace@<db>__
+	// channels and "A" covers every command class (including the module
+	// type used by ReJSON).
+	err = enableKeyspaceEvents(conn, "KA")
+	if err != nil {
+		return
+	}
+
+	psc := redis.PubSubConn{Conn: conn}
+	err = psc.PSubscribe("__keyspace@*__:*")
+	if err != nil {
+		return
+	}
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Subscription:
+			// changes are seen from here on; whatever was cached, or is
+			// being read, from before could have missed one
+			c.mu.Lock()
+			c.unsynced = false
+			c.mu.Unlock()
+			c.clear()
+		case redis.Message:
+			// an expiry watcher evicts the keys under its prefix itself,
+			// after handing the last-known value to its handler
+			key := keyFromChannel(v.Channel)
+			if string(v.Data) == "expired" && c.expiryWatched(key) {
+				continue
+			}
+			c.invalidate(key)
+		case error:
+			return v
+		}
+	}
+}
+
+// enableKeyspaceEvents - adds flags to notify-keyspace-events without
+// dropping whatever the server is already configured with
+func enableKeyspaceEvents(conn redis.Conn, flags string) (err error) {
+	cfg, err := redis.StringMap(conn.Do("CONFIG", "GET", "notify-keyspace-events"))
+	if err != nil {
+		return
+	}
+
+	current := cfg["notify-keyspace-events"]
+	for _, f := range flags {
+		if !strings.ContainsRune(current, f) {
+			current += string(f)
+		}
+	}
+
+	_, err = conn.Do("CONFIG", "SET", "notify-keyspace-events", current)
+	return
+}
+
+// keyFromChannel - "__keyspace@0__:JohnDoeJSON" -> "JohnDoeJSON"
+func keyFromChannel(channel string) string {
+	i := strings.Index(channel, "__:")
+	if i < 0 {
+		return channel
+	}
+	return channel[i+len("__:"):]
+}
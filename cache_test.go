@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+type enumDoc struct {
+	Major string `json:"major" redis:"major,enum=CSE|EEE"`
+}
+
+func TestStructCacheSetRejectsBadEnum(t *testing.T) {
+	for _, mode := range []writeMode{writeThrough, writeBehind} {
+		c := newStructCache(10)
+		c.setWriteMode(enumDoc{}, mode)
+		rec := newRecordingConn(nil)
+
+		err := c.setStructReJSON(rec, "k", enumDoc{Major: "ART"})
+		if !errors.Is(err, ErrInvalidEnum) {
+			t.Errorf("mode %d: got %v, want ErrInvalidEnum", mode, err)
+		}
+		if cmds := rec.commands(); len(cmds) != 0 || len(c.pending) != 0 {
+			t.Errorf("mode %d: sent %v, buffered %d writes", mode, cmds, len(c.pending))
+		}
+		if _, ok := c.items["k"]; ok {
+			t.Errorf("mode %d: cached", mode)
+		}
+
+		if err = c.setStructReJSON(rec, "k", enumDoc{Major: "CSE"}); err != nil {
+			t.Errorf("mode %d: valid value: %v", mode, err)
+		}
+	}
+}
+
+func TestStructCacheFlushRetries(t *testing.T) {
+	defer func(b time.Duration) { transientBackoff = b }(transientBackoff)
+	transientBackoff = time.Millisecond
+
+	c := newStructCache(10)
+	c.setWriteMode(enumDoc{}, writeBehind)
+	if err := c.setStructReJSON(nil, "k", enumDoc{Major: "CSE"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := newRecordingConn(nil)
+	sets := 0
+	rec.reply = func(cmd string, args []interface{}) (interface{}, error) {
+		sets++
+		if sets == 1 {
+			return nil, redis.Error("LOADING Redis is loading the dataset in memory")
+		}
+		return "OK", nil
+	}
+	if err := c.flush(context.Background(), rec); err != nil || sets != 2 || len(c.pending) != 0 {
+		t.Errorf("got %v after %d JSON.SETs, %d still buffered", err, sets, len(c.pending))
+	}
+}
+
+func TestReadThroughPanicEndsLoad(t *testing.T) {
+	c := newStructCache(10)
+	get := c.readThrough(func(redis.Conn, string, interface{}) error { panic("bad type") })
+	err := get(nil, "k", &enumDoc{})
+	if !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("got %v, want ErrUnsupportedType", err)
+	}
+	if c.loads != 0 {
+		t.Errorf("%d loads still running", c.loads)
+	}
+}
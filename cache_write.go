@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// writeMode - how a structCache propagates Sets of a given type to redis
+type writeMode int
+
+const (
+	// writeThrough - JSON.SET synchronously, then update the cache
+	writeThrough writeMode = iota
+	// writeBehind - update the cache and buffer the write; a background
+	// flusher pipelines buffered writes in batches. Writes still buffered
+	// when the process dies are LOST, so only use this for data that can be
+	// recomputed (counters, last-seen timestamps...).
+	writeBehind
+)
+
+// setWriteMode - selects the write mode for the type of value
+func (c *structCache) setWriteMode(value interface{}, mode writeMode) {
+	t := reflect.TypeOf(value)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	c.mu.Lock()
+	if c.modes == nil {
+		c.modes = make(map[reflect.Type]writeMode)
+	}
+	c.modes[t] = mode
+	c.mu.Unlock()
+}
+
+// setStructReJSON - stores value under key according to the write mode
+// registered for its type (write-through by default)
+func (c *structCache) setStructReJSON(conn redis.Conn, key string, value interface{}) (err error) {
+	defer recoverUnsupported(&err)
+
+	t := reflect.TypeOf(value)
+	if t.Kind() != reflect.Ptr {
+		// the cache stores copies of *value, so work from a pointer
+		p := reflect.New(t)
+		p.Elem().Set(reflect.ValueOf(value))
+		value = p.Interface()
+		t = p.Type()
+	}
+	// before the write-behind buffer takes it, so it fails here rather
+	// than in the flush
+	value, err = prepareSet(key, value)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	mode := c.modes[t.Elem()]
+	c.mu.Unlock()
+
+	if mode == writeBehind {
+		b, err := json.Marshal(value)
+		if err != nil {
+			return encodeError(err)
+		}
+		if c.enqueue(key, b) {
+			c.store(key, value)
+			return nil
+		}
+		// the buffer is full, so the flusher is behind or not running:
+		// write through instead of buffering without bound
+	}
+
+	err = addStructReJSON(conn, key, value)
+	if err != nil {
+		c.invalidate(key)
+		return
+	}
+	c.store(key, value)
+	return
+}
+
+// maxPendingWrites - keys the write-behind buffer holds at most; Sets of
+// other keys are written through while it is full
+var maxPendingWrites = 10000
+
+// enqueue - buffers b for key, reporting false when the buffer is full
+func (c *structCache) enqueue(key string, b []byte) bool {
+	c.mu.Lock()
+	if c.pending == nil {
+		c.pending = make(map[string][]byte)
+	}
+	if _, ok := c.pending[key]; !ok && len(c.pending) >= maxPendingWrites {
+		c.mu.Unlock()
+		return false
+	}
+	c.pending[key] = b
+	full := len(c.pending) >= c.batchSizeLocked()
+	flushNow := c.flushNow
+	c.mu.Unlock()
+
+	if full {
+		select {
+		case flushNow <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+func (c *structCache) batchSizeLocked() int {
+	if c.batch <= 0 {
+		return 100
+	}
+	return c.batch
+}
+
+// runWriteBehind - flushes buffered writes on conn every interval, or as soon
+// as batch writes are pending. It blocks until stop is closed, performing a
+// final flush before returning. A failed flush doesn't stop it: the keys
+// that may still be written are kept buffered for the next, and the first
+// failure is returned once stop is closed.
+func (c *structCache) runWriteBehind(conn redis.Conn, interval time.Duration, batch int, stop <-chan struct{}) (err error) {
+	c.mu.Lock()
+	c.batch = batch
+	if c.flushNow == nil {
+		c.flushNow = make(chan struct{}, 1)
+	}
+	flushNow := c.flushNow
+	c.mu.Unlock()
+
+	// retries stop waiting once stop is closed; the final flush still
+	// tries every write once
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		stopping := false
+		select {
+		case <-ticker.C:
+		case <-flushNow:
+		case <-stop:
+			stopping = true
+		}
+
+		if ferr := c.flush(ctx, conn); ferr != nil && err == nil {
+			err = ferr
+		}
+		if stopping {
+			return
+		}
+	}
+}
+
+// flush - pipelines every buffered write as JSON.SET, one batch at a time.
+// Keys refused with a transient error reply (IsTransient), like LOADING,
+// are sent again as retryTransient does. Keys that failed are returned as a
+// bulkErrors. Those that still failed with a transient error, or weren't
+// sent because the connection broke, are buffered again; the rest, like a
+// WRONGTYPE, would only fail again and are dropped, from the cache too.
+func (c *structCache) flush(ctx context.Context, conn redis.Conn) (err error) {
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = nil
+	size := c.batchSizeLocked()
+	c.mu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(pending))
+	for key := range pending {
+		keys = append(keys, key)
+	}
+
+	failed := make(bulkErrors)
+	var retry []string
+	for start := 0; start < len(keys); start += size {
+		end := start + size
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		batch := keys[start:end]
+		var errs bulkErrors
+		var cerr error
+		// its error is that of a key left in batch, reported below
+		retryTransient(ctx, transientAttempts, transientBackoff, func() error {
+			errs, cerr = flushBatch(conn, batch, pending)
+			if cerr != nil {
+				return nil
+			}
+			var again []string
+			var first error
+			for key, kerr := range errs {
+				if IsTransient(kerr) {
+					again = append(again, key)
+					first = kerr
+					continue
+				}
+				failed[key] = kerr
+				// the cached value was never stored
+				c.invalidate(key)
+			}
+			batch = again
+			return first
+		})
+		if cerr != nil {
+			// nothing from batch on is known to be written
+			unsent := append(append([]string(nil), batch...), keys[end:]...)
+			for _, key := range unsent {
+				failed[key] = cerr
+			}
+			retry = append(retry, unsent...)
+			break
+		}
+		for _, key := range batch {
+			failed[key] = errs[key]
+			retry = append(retry, key)
+		}
+	}
+
+	c.requeue(retry, pending)
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// flushBatch - sends keys' writes in one pipeline, returning the keys whose
+// JSON.SET got an error reply. err is a failure of the connection itself.
+func flushBatch(conn redis.Conn, keys []string, pending map[string][]byte) (errs bulkErrors, err error) {
+	for _, key := range keys {
+		err = conn.Send("JSON.SET", key, ".", string(pending[key]))
+		if err != nil {
+			return
+		}
+	}
+
+	err = conn.Flush()
+	if err != nil {
+		return
+	}
+
+	// read every reply so the connection stays in sync
+	for _, key := range keys {
+		_, rerr := conn.Receive()
+		if _, ok := rerr.(redis.Error); rerr != nil && !ok {
+			return nil, rerr
+		}
+		if rerr != nil {
+			if errs == nil {
+				errs = make(bulkErrors)
+			}
+			errs[key] = newCommandError("JSON.SET", key, rerr)
+		}
+	}
+	return
+}
+
+// requeue - puts unwritten entries back, unless a newer write for the same
+// key was buffered in the meantime
+func (c *structCache) requeue(keys []string, pending map[string][]byte) {
+	if len(keys) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pending == nil {
+		c.pending = make(map[string][]byte)
+	}
+	for _, key := range keys {
+		if _, ok := c.pending[key]; !ok {
+			c.pending[key] = pending[key]
+		}
+	}
+}
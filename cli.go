@@ -0,0 +1,1385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// cliEnv - what subcommands run against
+type cliEnv struct {
+	conn   redis.Conn
+	pool   *redis.Pool
+	cfg    config
+	logger Logger
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+// command - a CLI subcommand
+type command struct {
+	usage   string
+	summary string
+	run     func(env *cliEnv, args []string) error
+	// offline - run without connecting first; env.conn and env.pool are nil
+	offline bool
+}
+
+var commands map[string]command
+
+func init() {
+	// populated in init since usage, reachable from the commands, lists them
+	commands = map[string]command{
+		"demo": {
+			usage:   "demo",
+			summary: "run the John Doe walkthrough (the default)",
+		},
+		"restore": {
+			usage:   "restore [-mode m] file.gz",
+			summary: "write an archive back, optionally in a different storage mode",
+			run:     cmdRestore,
+		},
+		"seed": {
+			usage:   "seed [-type T] [-count n] [-template file] [-key template] [-mode m] [-seed s]",
+			summary: "populate a server with generated documents of a registered type",
+			run:     cmdSeed,
+		},
+		"serve": {
+			usage:   "serve [-addr :8080] [-mode m] [-index T=name]...",
+			summary: "serve registered types over a JSON REST API",
+			run:     cmdServe,
+		},
+		"set": {
+			usage:   "set [-mode m] [-type T] [-ttl d] key [json]",
+			summary: "store a JSON document (read from stdin when json is omitted)",
+			run:     cmdSet,
+		},
+		"get": {
+			usage:   "get [-mode m] [-pretty | -table] [-expr e] key...",
+			summary: "print stored documents as JSON, or as a table",
+			run:     cmdGet,
+		},
+		"list": {
+			usage:   "list [-limit n] pattern",
+			summary: "print the documents under a pattern as a table",
+			run:     cmdList,
+		},
+		"compact": {
+			usage:   "compact [-type T] [-keep path]... [-dry-run] pattern",
+			summary: "strip fields a registered type no longer has from stored documents",
+			run:     cmdCompact,
+		},
+		"completion": {
+			usage:   "completion bash|zsh",
+			summary: "print a shell completion script for commands and key prefixes",
+			run:     cmdCompletion,
+			offline: true,
+		},
+		"copy": {
+			usage:   "copy [-from url] -to url [-workers n] [-rate r] [-replace] pattern",
+			summary: "copy keys to another database or instance with DUMP/RESTORE, keeping TTLs",
+			run:     cmdCopy,
+		},
+		"del": {
+			usage:   "del [-cascade [-type T]] key...",
+			summary: "delete keys",
+			run:     cmdDel,
+		},
+		"shell": {
+			usage:   "shell [-type name]",
+			summary: "browse and edit stored documents interactively",
+			run:     cmdShell,
+		},
+		"query": {
+			usage:   "query [-limit n] index query",
+			summary: "run a RediSearch FT.SEARCH and print matches as JSON lines",
+			run:     cmdQuery,
+		},
+		"backup": {
+			usage:   "backup [-schema-version v] pattern file.gz",
+			summary: "archive documents with their storage mode and TTL",
+			run:     cmdBackup,
+		},
+		"bench": {
+			usage:   "bench [-n N] [-modes hash,hash-json,rejson] [-json]",
+			summary: "compare the storage modes, in go test -bench format",
+			run:     cmdBench,
+		},
+		"diff": {
+			usage:   "diff [-source url] -target url pattern",
+			summary: "compare documents with another instance, exiting 1 if any differ",
+			run:     cmdDiff,
+		},
+		"export": {
+			usage:   "export [-format jsonl|csv] [-filter path=value]... [-columns a,b] [-cursor c] pattern",
+			summary: "write every matching document as JSON Lines or CSV",
+			run:     cmdExport,
+		},
+		"migrate": {
+			usage:   "migrate [-type name] [-batch n] [-dry-run] [-rollback] pattern",
+			summary: "convert hashes to ReJSON documents in place, or back",
+			run:     cmdMigrate,
+		},
+		"schema-migrate": {
+			usage:   "schema-migrate [-type T] [-pattern p] [-status]",
+			summary: "apply a registered type's pending versioned migrations to its documents",
+			run:     cmdSchemaMigrate,
+		},
+		"schema": {
+			usage:   "schema [-publish] [-check] [type]",
+			summary: "print a registered type's JSON Schema, or publish and check it against the server's",
+			run:     cmdSchema,
+		},
+		"import": {
+			usage:   "import [-mode m] [-type name] [-batch n] -key template file.jsonl",
+			summary: "bulk load JSON Lines, keyed by a template like student:{{.id}}",
+			run:     cmdImport,
+		},
+		"infer": {
+			usage:   "infer [-type Name] [-sample n] key-or-pattern...",
+			summary: "print a Go struct able to hold the stored documents",
+			run:     cmdInfer,
+		},
+		"inspect": {
+			usage:   "inspect key",
+			summary: "show a key's type, storage mode, TTL, memory, size and fields",
+			run:     cmdInspect,
+		},
+		"loadgen": {
+			usage:   "loadgen [-type T] [-mode m] [-n N] [-qps Q] [-workers W]",
+			summary: "write fake objects of a registered type at a target rate",
+			run:     cmdLoadgen,
+		},
+		"top": {
+			usage:   "top [-interval d] [-scan-interval d]",
+			summary: "live dashboard of namespaces, command rates and changes",
+			run:     cmdTop,
+		},
+		"hotkeys": {
+			usage:   "hotkeys [-sample N] [-top N] prefix",
+			summary: "rank sampled keys by access frequency (LFU) or idle time",
+			run:     cmdHotKeys,
+		},
+		"sample": {
+			usage:   "sample [-n N] [-type T] [-mode m] [-set key | -hash key] prefix",
+			summary: "print random documents under a prefix, flagging those that don't decode",
+			run:     cmdSample,
+		},
+		"validate": {
+			usage:   "validate [-type T] pattern",
+			summary: "check stored documents decode into a registered type, exiting 1 if not",
+			run:     cmdValidate,
+		},
+		"watch": {
+			usage:   "watch [-poll d] [-color=false] key",
+			summary: "print a field-level diff every time a document changes",
+			run:     cmdWatch,
+		},
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [command [args]]\n\nCommands:\n", os.Args[0])
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %s\t%s\n", commands[name].usage, commands[name].summary)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func runCommand(env *cliEnv, name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok || cmd.run == nil {
+		flag.Usage()
+		return fmt.Errorf("unknown command %q", name)
+	}
+	return cmd.run(env, args)
+}
+
+// newFlagSet - flag set for a subcommand, printing its usage line on error
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s\n", os.Args[0], commands[name].usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func cmdSet(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("set")
+	modeName := fs.String("mode", env.cfg.Mode, "storage mode: hash, hash-json or rejson")
+	typeName := fs.String("type", "", "registered type the document must decode into")
+	ttl := fs.Duration("ttl", time.Duration(env.cfg.TTL), "expire the key after this long")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return errors.New("set needs a key and at most one document")
+	}
+	key := fs.Arg(0)
+
+	mode, err := parseStorageMode(*modeName)
+	if err != nil {
+		return
+	}
+
+	var raw []byte
+	if fs.NArg() == 2 {
+		raw = []byte(fs.Arg(1))
+	} else {
+		raw, err = ioutil.ReadAll(env.stdin)
+		if err != nil {
+			return
+		}
+	}
+	raw = bytes.TrimSpace(raw)
+
+	if *typeName != "" {
+		raw, err = checkTyped(key, raw, *typeName)
+		if err != nil {
+			return
+		}
+	}
+
+	err = setRaw(env.conn, mode, key, raw, registeredTypes[*typeName])
+	if err != nil {
+		return
+	}
+	return applyTTL(env.conn, key, duration(*ttl))
+}
+
+func cmdShell(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("shell")
+	typeName := fs.String("type", "", "registered type documents set must decode into")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return errors.New("shell takes no arguments")
+	}
+	if *typeName != "" {
+		if _, err = newRegistered(*typeName); err != nil {
+			return
+		}
+	}
+	return runShell(env, *typeName)
+}
+
+// decodeStrict - raw decoded into a new value of the registered type,
+// failing on unknown fields
+func decodeStrict(raw []byte, typeName string) (v interface{}, err error) {
+	v, err = newRegistered(typeName)
+	if err != nil {
+		return
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(v)
+	if err != nil {
+		return nil, fmt.Errorf("document doesn't match %s: %w", typeName, err)
+	}
+	return
+}
+
+// checkTyped - raw, a document of the registered type typeName to be
+// stored at key, checked as addStruct checks a value: decodeStrict, then
+// prepareSet. A type with computed fields comes back encoded again with
+// them refreshed; otherwise raw is returned as is.
+func checkTyped(key string, raw []byte, typeName string) (out []byte, err error) {
+	v, err := decodeStrict(raw, typeName)
+	if err != nil {
+		return
+	}
+	_, err = prepareSet(key, v)
+	if err != nil || !tagUseOf(reflect.TypeOf(v)).computed {
+		return raw, err
+	}
+	out, err = json.Marshal(v)
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return
+}
+
+func cmdGet(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("get")
+	modeName := fs.String("mode", "auto", "storage mode: auto, hash, hash-json or rejson")
+	pretty := fs.Bool("pretty", false, "indent the documents")
+	table := fs.Bool("table", false, "print the documents as a table, one column per field")
+	exprSrc := fs.String("expr", "", "print a projection of each document instead, e.g. '.info | {Major}'")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("get needs at least one key")
+	}
+
+	var proj *projection
+	if *exprSrc != "" {
+		proj, err = compileProjection(*exprSrc)
+		if err != nil {
+			return
+		}
+	}
+
+	var rows []tableRow
+	for _, key := range fs.Args() {
+		var mode storageMode
+		mode, err = resolveMode(env.conn, key, *modeName)
+		if err != nil {
+			return
+		}
+
+		var raw []byte
+		if proj != nil {
+			var v interface{}
+			err = projectKey(env.conn, mode, key, proj, &v)
+			if err == errNoValue {
+				err = nil
+				continue
+			}
+			if err != nil {
+				return
+			}
+			raw, err = json.Marshal(v)
+		} else if *pretty && !*table {
+			raw, err = getPretty(env.conn, mode, key)
+		} else {
+			raw, err = getRaw(env.conn, mode, key)
+		}
+		if err != nil {
+			return
+		}
+
+		if *table {
+			var r tableRow
+			r, err = tableRowOf(key, raw)
+			if err != nil {
+				return
+			}
+			rows = append(rows, r)
+			continue
+		}
+		_, err = fmt.Fprintf(env.stdout, "%s\n", raw)
+		if err != nil {
+			return
+		}
+	}
+
+	if *table {
+		err = writeTable(env.stdout, rows)
+	}
+	return
+}
+
+// cmdList - the documents under a pattern, as a table
+func cmdList(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("list")
+	limit := fs.Int("limit", 50, "rows shown, at most")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("list needs a key pattern")
+	}
+
+	var rows []tableRow
+	errLimit := errors.New("limit reached")
+	err = scanKeys(contextForCLI(), env.conn, fs.Arg(0), func(key string) (err error) {
+		if len(rows) >= *limit {
+			return errLimit
+		}
+		mode, err := detectStorageMode(env.conn, key)
+		if err == errUnknownMode {
+			return nil
+		}
+		if err != nil {
+			return
+		}
+		raw, err := getRaw(env.conn, mode, key)
+		if err != nil {
+			return
+		}
+		r, err := tableRowOf(key, raw)
+		if err != nil {
+			return
+		}
+		rows = append(rows, r)
+		return
+	})
+	if err != nil && err != errLimit {
+		return
+	}
+
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Key < rows[j].Key })
+	return writeTable(env.stdout, rows)
+}
+
+func cmdDel(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("del")
+	cascade := fs.Bool("cascade", false, "also delete the objects the documents own (Ref fields tagged owns)")
+	typeName := fs.String("type", "Student", "registered type of the documents, for -cascade")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+	args = fs.Args()
+	if len(args) == 0 {
+		return errors.New("del needs at least one key")
+	}
+
+	if *cascade {
+		var total int
+		for _, key := range args {
+			var n int
+			n, err = deleteStruct(contextForCLI(), env.conn, key, deleteOptions{Type: *typeName, Cascade: true})
+			if err != nil {
+				return
+			}
+			total += n
+		}
+		_, err = fmt.Fprintf(env.stdout, "%d\n", total)
+		return
+	}
+
+	// with their bits strings, which deleteStruct removes too
+	bits := make([]string, len(args))
+	for i, key := range args {
+		bits[i] = bitsKey(key)
+	}
+	m := newMultiExec(env.conn)
+	m.send("DEL", redis.Args{}.AddFlat(args)...)
+	m.send("DEL", redis.Args{}.AddFlat(bits)...)
+	replies, err := m.exec(contextForCLI())
+	if err != nil {
+		return newCommandError("DEL", strings.Join(args, " "), err)
+	}
+	var n int
+	if len(replies) > 0 {
+		n, err = redis.Int(replies[0], nil)
+		if err != nil {
+			return
+		}
+	}
+	_, err = fmt.Fprintf(env.stdout, "%d\n", n)
+	return
+}
+
+// cmdQuery - FT.SEARCH against an existing index. Documents from ON JSON
+// indexes come back whole under "$"; hash indexes as their fields.
+func cmdQuery(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("query")
+	limit := fs.Int("limit", 10, "maximum number of matches")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("query needs an index and a query")
+	}
+	index := fs.Arg(0)
+
+	hits, _, err := searchDocuments(env.conn, index, fs.Arg(1), 0, *limit)
+	if err != nil {
+		return
+	}
+
+	enc := json.NewEncoder(env.stdout)
+	for _, h := range hits {
+		err = enc.Encode(h)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func cmdBench(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("bench")
+	n := fs.Int("n", 1000, "objects per storage mode")
+	modeNames := fs.String("modes", "hash,hash-json,rejson", "comma separated storage modes")
+	asJSON := fs.Bool("json", false, "write a JSON report instead of go test -bench lines")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+
+	opts := benchOptions{N: *n}
+	for _, name := range strings.Split(*modeNames, ",") {
+		var mode storageMode
+		mode, err = parseStorageMode(strings.TrimSpace(name))
+		if err != nil {
+			return
+		}
+		opts.Modes = append(opts.Modes, mode)
+	}
+
+	if *asJSON {
+		var r benchReport
+		r, err = runBenchmarkReport(env.conn, opts)
+		if err != nil {
+			return
+		}
+		enc := json.NewEncoder(env.stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+
+	results, err := runBenchmark(env.conn, opts)
+	if err != nil {
+		return
+	}
+	return writeBenchmarkResults(env.stdout, results)
+}
+
+func cmdLoadgen(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("loadgen")
+	typeName := fs.String("type", "Student", "registered type to generate")
+	modeName := fs.String("mode", env.cfg.Mode, "storage mode: hash, hash-json or rejson")
+	n := fs.Int("n", 1000, "objects to write")
+	qps := fs.Int("qps", 0, "target writes per second, 0 for unlimited")
+	workers := fs.Int("workers", 4, "concurrent writers")
+	prefix := fs.String("prefix", "loadgen:", "key prefix")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+
+	mode, err := parseStorageMode(*modeName)
+	if err != nil {
+		return
+	}
+
+	s, err := runLoadgen(contextForCLI(), env.pool, loadgenOptions{
+		Type:    *typeName,
+		Mode:    mode,
+		N:       *n,
+		Prefix:  *prefix,
+		QPS:     *qps,
+		Workers: *workers,
+		Seed:    time.Now().UnixNano(),
+	})
+	if err != nil {
+		return
+	}
+
+	_, err = fmt.Fprintf(env.stdout, "wrote %d objects (%d errors) in %v, %.0f/s\n",
+		s.Written, s.Errors, s.Elapsed.Round(time.Millisecond), float64(s.Written)/s.Elapsed.Seconds())
+	if s.FirstErr != nil {
+		env.logger.Warn("loadgen writes failed", "count", s.Errors, "first", s.FirstErr)
+	}
+	return
+}
+
+// contextForCLI - cancelled on SIGINT/SIGTERM, so long running commands can
+// stop cleanly
+func contextForCLI() context.Context {
+	ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	return ctx
+}
+
+func cmdImport(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("import")
+	modeName := fs.String("mode", env.cfg.Mode, "storage mode: hash, hash-json or rejson")
+	keyTmpl := fs.String("key", "", "key template, e.g. student:{{.id}}")
+	typeName := fs.String("type", "", "registered type every line must decode into")
+	batch := fs.Int("batch", 500, "documents per pipeline round trip")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+	if fs.NArg() != 1 || *keyTmpl == "" {
+		fs.Usage()
+		return errors.New("import needs -key and a file (- for stdin)")
+	}
+
+	mode, err := parseStorageMode(*modeName)
+	if err != nil {
+		return
+	}
+
+	in, size := env.stdin, int64(0)
+	if name := fs.Arg(0); name != "-" {
+		var f *os.File
+		f, err = os.Open(name)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		if st, serr := f.Stat(); serr == nil {
+			size = st.Size()
+		}
+		in = f
+	}
+
+	cr := &countingReader{r: in}
+	start := time.Now()
+	lines, err := bulkImport(contextForCLI(), env.conn, cr, importOptions{
+		KeyTemplate: *keyTmpl,
+		Mode:        mode,
+		Type:        *typeName,
+		Batch:       *batch,
+		Progress: func(lines int) {
+			printProgress(os.Stderr, lines, cr.n, size, start)
+		},
+	})
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return fmt.Errorf("after %d documents: %w", lines, err)
+	}
+	_, err = fmt.Fprintf(env.stdout, "imported %d documents in %v\n", lines, time.Since(start).Round(time.Millisecond))
+	return
+}
+
+// countingReader - counts the bytes read through it, for progress
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	c.n += int64(n)
+	return
+}
+
+// printProgress - redraws a one line progress bar; size is 0 when unknown
+func printProgress(w io.Writer, done int, read, size int64, start time.Time) {
+	rate := float64(done) / time.Since(start).Seconds()
+	if size <= 0 {
+		fmt.Fprintf(w, "\r%d documents (%.0f/s)", done, rate)
+		return
+	}
+
+	const width = 30
+	frac := float64(read) / float64(size)
+	if frac > 1 {
+		frac = 1
+	}
+	filled := int(frac * width)
+	fmt.Fprintf(w, "\r[%s%s] %3.0f%% %d documents (%.0f/s)",
+		strings.Repeat("=", filled), strings.Repeat(" ", width-filled), frac*100, done, rate)
+}
+
+// stringList - repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+func cmdExport(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("export")
+	format := fs.String("format", "jsonl", "jsonl or csv")
+	columns := fs.String("columns", "", "comma separated CSV columns (default: fields of the first document)")
+	cursor := fs.String("cursor", "0", "resume from a cursor printed by an interrupted export")
+	var filters stringList
+	fs.Var(&filters, "filter", "only export documents where path=value (repeatable)")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("export needs a key pattern")
+	}
+
+	opts := exportOptions{
+		Pattern: fs.Arg(0),
+		Format:  *format,
+		Filters: filters,
+		Cursor:  *cursor,
+		OnCursor: func(c string) {
+			if c != "0" {
+				fmt.Fprintf(os.Stderr, "cursor: %s\n", c)
+			}
+		},
+	}
+	if *columns != "" {
+		opts.Columns = strings.Split(*columns, ",")
+	}
+
+	n, err := exportKeys(contextForCLI(), env.conn, env.stdout, opts)
+	if err != nil {
+		return fmt.Errorf("after %d documents (resume with the last cursor printed): %w", n, err)
+	}
+	fmt.Fprintf(os.Stderr, "exported %d documents\n", n)
+	return
+}
+
+func cmdMigrate(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("migrate")
+	typeName := fs.String("type", "", "registered type used to restore field types")
+	batch := fs.Int("batch", 100, "keys converted per transaction")
+	dryRun := fs.Bool("dry-run", false, "print the commands instead of running them")
+	rollback := fs.Bool("rollback", false, "convert ReJSON documents back to hashes")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("migrate needs a key pattern")
+	}
+
+	conn := env.conn
+	if *dryRun {
+		conn = newDryRunConn(conn, env.stdout)
+	}
+
+	var skipped int
+	opts := migrateOptions{
+		Pattern:  fs.Arg(0),
+		Type:     *typeName,
+		Batch:    *batch,
+		Rollback: *rollback,
+		OnSkip: func(key string, err error) {
+			skipped++
+			env.logger.Warn("skipped", "key", key, "err", err)
+		},
+		Progress: func(done int) {
+			fmt.Fprintf(os.Stderr, "\rconverted %d", done)
+		},
+	}
+
+	n, err := migrateKeys(contextForCLI(), conn, opts)
+	fmt.Fprintf(os.Stderr, "\rconverted %d, skipped %d\n", n, skipped)
+	return
+}
+
+func cmdInfer(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("infer")
+	typeName := fs.String("type", "Document", "name of the generated struct")
+	sample := fs.Int("sample", 100, "documents read, at most")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("infer needs at least one key or pattern")
+	}
+
+	docs, fromHash, err := inferDocuments(contextForCLI(), env.conn, fs.Args(), *sample)
+	if err != nil {
+		return
+	}
+	src, err := inferStruct(*typeName, docs, fromHash)
+	if err != nil {
+		return
+	}
+	_, err = env.stdout.Write(src)
+	return
+}
+
+func cmdDiff(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("diff")
+	sourceURL := fs.String("source", "", "source redis:// URL (default: the configured server)")
+	targetURL := fs.String("target", "", "target redis:// URL")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+	if fs.NArg() != 1 || *targetURL == "" {
+		fs.Usage()
+		return errors.New("diff needs -target and a key pattern")
+	}
+
+	source := env.conn
+	if *sourceURL != "" {
+		source, err = redis.DialURL(*sourceURL)
+		if err != nil {
+			return
+		}
+		defer source.Close()
+	}
+	target, err := redis.DialURL(*targetURL)
+	if err != nil {
+		return
+	}
+	defer target.Close()
+
+	var differ int
+	n, err := diffInstances(contextForCLI(), source, target, fs.Arg(0), func(d keyDiff) (err error) {
+		differ++
+		switch {
+		case d.Missing:
+			_, err = fmt.Fprintf(env.stdout, "- %s\n", d.Key)
+		case d.Extra:
+			_, err = fmt.Fprintf(env.stdout, "+ %s\n", d.Key)
+		default:
+			_, err = fmt.Fprintf(env.stdout, "~ %s\n", d.Key)
+			for _, f := range d.Fields {
+				if err == nil {
+					_, err = fmt.Fprintf(env.stdout, "    %s: %q -> %q\n", f.Path, f.Source, f.Target)
+				}
+			}
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+	if differ > 0 {
+		return fmt.Errorf("%d of %d keys differ", differ, n)
+	}
+	fmt.Fprintf(os.Stderr, "%d keys identical\n", n)
+	return
+}
+
+func cmdSeed(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("seed")
+	typeName := fs.String("type", "Student", "registered type to generate")
+	count := fs.Int("count", 1000, "documents to write")
+	tmplFile := fs.String("template", "", "text/template file rendering one JSON document (default: random values)")
+	keyTmpl := fs.String("key", "", "key template over {{.I}} (default: <type>:{{.I}})")
+	modeName := fs.String("mode", env.cfg.Mode, "storage mode: hash, hash-json or rejson")
+	seed := fs.Int64("seed", 1, "random seed")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return errors.New("seed takes no arguments")
+	}
+
+	mode, err := parseStorageMode(*modeName)
+	if err != nil {
+		return
+	}
+	opts := seedOptions{
+		Type:        *typeName,
+		Count:       *count,
+		KeyTemplate: *keyTmpl,
+		Mode:        mode,
+		Seed:        *seed,
+		Progress: func(n int) {
+			fmt.Fprintf(os.Stderr, "\rseeded %d/%d", n, *count)
+		},
+	}
+	if *tmplFile != "" {
+		var b []byte
+		b, err = ioutil.ReadFile(*tmplFile)
+		if err != nil {
+			return
+		}
+		opts.Template = string(b)
+	}
+
+	_, err = runSeed(contextForCLI(), env.conn, opts)
+	fmt.Fprintln(os.Stderr)
+	return
+}
+
+// codecs - how each storage mode encodes a document
+var codecs = map[string]string{
+	"hash":      "one field per top-level member, values as text",
+	"hash-json": "JSON text in the JSON field",
+	"rejson":    "ReJSON tree",
+	"unknown":   "-",
+}
+
+func cmdInspect(env *cliEnv, args []string) (err error) {
+	if len(args) != 1 {
+		return errors.New("inspect needs exactly one key")
+	}
+
+	d, err := dumpKey(env.conn, args[0])
+	if err != nil {
+		return
+	}
+
+	ttl := "none"
+	if d.TTL >= 0 {
+		ttl = d.TTL.String()
+	}
+	tw := tabwriter.NewWriter(env.stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "key\t%s\n", d.Key)
+	fmt.Fprintf(tw, "type\t%s (%s)\n", d.Type, d.Encoding)
+	fmt.Fprintf(tw, "mode\t%s\n", d.Mode)
+	fmt.Fprintf(tw, "codec\t%s\n", codecs[d.Mode])
+	fmt.Fprintf(tw, "ttl\t%s\n", ttl)
+	fmt.Fprintf(tw, "memory\t%d bytes\n", d.Memory)
+	fmt.Fprintf(tw, "size\t%d bytes\n", d.Size)
+	fmt.Fprintf(tw, "fields\t%s\n", strings.Join(d.FieldNames, ", "))
+	return tw.Flush()
+}
+
+func cmdWatch(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("watch")
+	poll := fs.Duration("poll", 0, "re-read the key this often instead of using keyspace notifications")
+	color := fs.Bool("color", os.Getenv("NO_COLOR") == "", "color removed and added values")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("watch needs exactly one key")
+	}
+	key := fs.Arg(0)
+
+	sub := env.pool.Get()
+	defer sub.Close()
+
+	fmt.Fprintf(os.Stderr, "watching %s, ^C to stop\n", key)
+	return watchKey(contextForCLI(), env.conn, sub, key, *poll, func(event string, diffs []fieldDiff) error {
+		header := fmt.Sprintf("%s %s %s", time.Now().Format("15:04:05.000"), key, event)
+		if *color {
+			header = ansiBold + header + ansiReset
+		}
+		fmt.Fprintln(env.stdout, header)
+		return printFieldDiffs(env.stdout, diffs, *color)
+	})
+}
+
+func cmdCopy(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("copy")
+	fromURL := fs.String("from", "", "source redis:// URL, database as path (default: the configured server)")
+	toURL := fs.String("to", "", "target redis:// URL, e.g. redis://host:6379/2")
+	workers := fs.Int("workers", 4, "concurrent copiers")
+	rate := fs.Int("rate", 0, "keys per second, unlimited when 0")
+	replace := fs.Bool("replace", false, "overwrite existing keys instead of skipping them")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+	if fs.NArg() != 1 || *toURL == "" {
+		fs.Usage()
+		return errors.New("copy needs -to and a key pattern")
+	}
+
+	scan, dialSource := env.conn, func() (redis.Conn, error) { return env.pool.Get(), nil }
+	if *fromURL != "" {
+		dialSource = func() (redis.Conn, error) { return redis.DialURL(*fromURL) }
+		scan, err = dialSource()
+		if err != nil {
+			return
+		}
+		defer scan.Close()
+	}
+	dialTarget := func() (redis.Conn, error) { return redis.DialURL(*toURL) }
+
+	s, err := copyKeys(contextForCLI(), scan, dialSource, dialTarget, copyOptions{
+		Pattern: fs.Arg(0),
+		Workers: *workers,
+		Rate:    *rate,
+		Replace: *replace,
+	})
+	fmt.Fprintf(os.Stderr, "copied %d, skipped %d, %d errors in %v\n", s.Copied, s.Skipped, s.Errors, s.Elapsed.Round(time.Millisecond))
+	if err == nil && s.FirstErr != nil {
+		err = fmt.Errorf("first of %d errors: %w", s.Errors, s.FirstErr)
+	}
+	return
+}
+
+func cmdBackup(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("backup")
+	schemaVersion := fs.String("schema-version", "", "label recorded with the documents")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("backup needs a key pattern and a file")
+	}
+
+	f, err := os.Create(fs.Arg(1))
+	if err != nil {
+		return
+	}
+	n, err := backupKeys(contextForCLI(), env.conn, f, fs.Arg(0), *schemaVersion)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "backed up %d documents\n", n)
+	return
+}
+
+func cmdRestore(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("restore")
+	modeName := fs.String("mode", "", "store in this mode instead of the one backed up")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("restore needs a file")
+	}
+
+	var opts restoreOptions
+	if *modeName != "" {
+		var mode storageMode
+		mode, err = parseStorageMode(*modeName)
+		if err != nil {
+			return
+		}
+		opts.Mode = &mode
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	h, n, err := restoreKeys(contextForCLI(), env.conn, f, opts)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "restored %d documents of %s, backed up %v\n", n, h.Pattern, h.Created.Format(time.RFC3339))
+	return
+}
+
+func cmdValidate(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("validate")
+	typeName := fs.String("type", "Student", "registered type documents must decode into")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("validate needs a key pattern")
+	}
+
+	bad := make(map[string]bool)
+	n, err := validateKeys(contextForCLI(), env.conn, fs.Arg(0), *typeName, func(issue validationIssue) (err error) {
+		bad[issue.Key] = true
+		_, err = fmt.Fprintf(env.stdout, "%s\t%s\t%s\n", issue.Key, issue.Kind, issue.Detail)
+		return
+	})
+	if err != nil {
+		return
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("%d of %d documents don't match %s", len(bad), n, *typeName)
+	}
+	fmt.Fprintf(os.Stderr, "%d documents match %s\n", n, *typeName)
+	return
+}
+
+func cmdCompact(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("compact")
+	typeName := fs.String("type", "Student", "registered type whose fields are kept")
+	dryRun := fs.Bool("dry-run", false, "report what would be removed without writing")
+	var keep stringList
+	fs.Var(&keep, "keep", "dotted path to keep although the type lacks it (repeatable)")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("compact needs a key pattern")
+	}
+
+	var saved int64
+	opts := compactOptions{Type: *typeName, Keep: keep, DryRun: *dryRun}
+	n, err := compactKeys(contextForCLI(), env.conn, fs.Arg(0), opts, func(r compactResult) (err error) {
+		saved += r.Saved
+		_, err = fmt.Fprintf(env.stdout, "%s\t-%d bytes\t%s\n", r.Key, r.Saved, strings.Join(r.Removed, ", "))
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	verb := "compacted"
+	if *dryRun {
+		verb = "would compact"
+	}
+	fmt.Fprintf(os.Stderr, "%s %d documents, saving %d bytes\n", verb, n, saved)
+	return
+}
+
+func cmdTop(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("top")
+	interval := fs.Duration("interval", time.Second, "refresh interval")
+	scanInterval := fs.Duration("scan-interval", 30*time.Second, "namespace recount interval (a full SCAN)")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+
+	sub := env.pool.Get()
+	defer sub.Close()
+
+	return runTop(contextForCLI(), env.conn, sub, env.stdout, topOptions{
+		Interval:     *interval,
+		ScanInterval: *scanInterval,
+	})
+}
+
+func cmdServe(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("serve")
+	addr := fs.String("addr", ":8080", "listen address")
+	modeName := fs.String("mode", env.cfg.Mode, "storage mode: hash, hash-json or rejson")
+	var indexes stringList
+	fs.Var(&indexes, "index", "RediSearch index for a type's ?query=, as Type=index (repeatable)")
+	redactName := fs.String("redact", "none", "sensitive fields in replies: none, mask or omit")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+
+	mode, err := parseStorageMode(*modeName)
+	if err != nil {
+		return
+	}
+	redact, err := parseRedaction(*redactName)
+	if err != nil {
+		return
+	}
+	index := make(map[string]string)
+	for _, ti := range indexes {
+		i := strings.Index(ti, "=")
+		if i <= 0 {
+			return fmt.Errorf("bad -index %q, want Type=index", ti)
+		}
+		index[ti[:i]] = ti[i+1:]
+	}
+
+	var resources []restResource
+	for _, name := range registeredNames() {
+		resources = append(resources, restResource{Type: name, Mode: mode, Index: index[name], Redact: redact})
+	}
+	h, err := newRESTHandler(env.pool, env.logger, resources...)
+	if err != nil {
+		return
+	}
+
+	srv := &http.Server{Addr: *addr, Handler: h}
+	ctx := contextForCLI()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdown)
+	}()
+
+	env.logger.Info("serving", "addr", *addr, "types", strings.Join(registeredNames(), ","))
+	err = srv.ListenAndServe()
+	if err == http.ErrServerClosed {
+		err = nil
+	}
+	return
+}
+
+func cmdSchemaMigrate(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("schema-migrate")
+	typeName := fs.String("type", "Student", "registered type to migrate")
+	pattern := fs.String("pattern", "", "keys holding its documents, lower case type plus :* by default")
+	status := fs.Bool("status", false, "list applied and pending migrations without running any")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+
+	r := migrationRunner{
+		Type:    *typeName,
+		Pattern: *pattern,
+		Progress: func(m schemaMigration, changed int) {
+			fmt.Fprintf(os.Stderr, "\rv%d %s: %d documents changed", m.Version, m.Name, changed)
+		},
+	}
+
+	if *status {
+		var v int
+		v, err = r.version(env.conn)
+		if err != nil {
+			return
+		}
+		for _, m := range schemaMigrations[*typeName] {
+			state := "pending"
+			if m.Version <= v {
+				state = "applied"
+			}
+			fmt.Fprintf(env.stdout, "v%d\t%s\t%s\n", m.Version, state, m.Name)
+		}
+		return
+	}
+
+	applied, err := r.run(contextForCLI(), env.conn)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "applied %d migrations %v\n", len(applied), applied)
+	return
+}
+
+func cmdSchema(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("schema")
+	publish := fs.Bool("publish", false, "store the schemas under schema:<type> for other clients")
+	check := fs.Bool("check", false, "compare with the published schemas, failing if incompatible")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+	names := fs.Args()
+	if len(names) == 0 {
+		names = registeredNames()
+	}
+
+	for _, name := range names {
+		switch {
+		case *check:
+			err = checkSchema(env.conn, name)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(env.stdout, "%s\tcompatible\n", name)
+		case *publish:
+			var p publishedSchema
+			p, err = publishSchema(env.conn, name)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(env.stdout, "%s\t%s\tv%d\n", name, p.Fingerprint, p.Version)
+		default:
+			var p publishedSchema
+			p, err = localSchema(name)
+			if err != nil {
+				return
+			}
+			var pretty []byte
+			pretty, err = prettyJSON.apply(p.Schema)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(env.stdout, "%s\n", pretty)
+		}
+	}
+	return
+}
+
+func cmdSample(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("sample")
+	n := fs.Int("n", 10, "documents to sample")
+	typeName := fs.String("type", "Student", "registered type documents decode into")
+	modeName := fs.String("mode", env.cfg.Mode, "storage mode: hash, hash-json or rejson")
+	keySet := fs.String("set", "", "SET of the namespace's keys to draw from (SRANDMEMBER)")
+	keyHash := fs.String("hash", "", "hash whose fields are the namespace's keys (HRANDFIELD)")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("sample needs a key prefix")
+	}
+	mode, err := parseStorageMode(*modeName)
+	if err != nil {
+		return
+	}
+	if _, err = newRegistered(*typeName); err != nil {
+		return
+	}
+
+	docs, err := sampleDocuments(contextForCLI(), env.conn, mode, fs.Arg(0), *n,
+		sampleOptions{KeySet: *keySet, KeyHash: *keyHash},
+		func() interface{} {
+			v, _ := newRegistered(*typeName)
+			return v
+		})
+	if err != nil {
+		return
+	}
+
+	bad := 0
+	for _, d := range docs {
+		if d.Err != nil {
+			bad++
+			fmt.Fprintf(env.stdout, "%s\terror\t%v\n", d.Key, d.Err)
+			continue
+		}
+		var raw []byte
+		raw, err = json.Marshal(d.Value)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(env.stdout, "%s\tok\t%s\n", d.Key, raw)
+	}
+	if bad > 0 {
+		return fmt.Errorf("%d of %d sampled documents don't decode into %s", bad, len(docs), *typeName)
+	}
+	return
+}
+
+func cmdHotKeys(env *cliEnv, args []string) (err error) {
+	fs := newFlagSet("hotkeys")
+	sample := fs.Int("sample", 1000, "keys to inspect")
+	top := fs.Int("top", 20, "keys to list at each end")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("hotkeys needs a key prefix")
+	}
+
+	r, err := hotKeys(contextForCLI(), env.conn, fs.Arg(0), hotKeysOptions{Sample: *sample, Top: *top})
+	if err != nil {
+		return
+	}
+
+	tw := tabwriter.NewWriter(env.stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "%d keys sampled, ranked by %s\n", r.Sampled, r.Metric)
+	for _, section := range []struct {
+		name  string
+		heats []keyHeat
+	}{{"hot", r.Hot}, {"cold", r.Cold}} {
+		fmt.Fprintf(tw, "\n%s\n", section.name)
+		for _, h := range section.heats {
+			if r.Metric == "freq" {
+				fmt.Fprintf(tw, "  %s\tfreq %d\n", h.Key, h.Freq)
+			} else {
+				fmt.Fprintf(tw, "  %s\tidle %v\n", h.Key, h.Idle)
+			}
+		}
+	}
+	return tw.Flush()
+}
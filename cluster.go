@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// clusterSlotCount - hash slots a Redis Cluster divides keys between
+const clusterSlotCount = 16384
+
+// clusterNodes - the masters of a Redis Cluster, by the hash slots they
+// serve, as CLUSTER SLOTS reported them. A reshard after loading shows up
+// as MOVED errors on the keys involved; load again and retry those.
+type clusterNodes struct {
+	slots [clusterSlotCount]string
+	pools map[string]*redis.Pool
+}
+
+// newClusterNodes - asks the cluster node behind conn for the slot layout
+// and makes a pool per master with newPool(address)
+func newClusterNodes(conn redis.Conn, newPool func(addr string) *redis.Pool) (c *clusterNodes, err error) {
+	ranges, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, newCommandError("CLUSTER SLOTS", "", err)
+	}
+
+	c = &clusterNodes{pools: make(map[string]*redis.Pool)}
+	for _, r := range ranges {
+		var (
+			start, end int
+			master     []interface{}
+		)
+		_, err = redis.Scan(r.([]interface{}), &start, &end, &master)
+		if err != nil {
+			return nil, fmt.Errorf("CLUSTER SLOTS: %w", err)
+		}
+		var (
+			host string
+			port int
+		)
+		_, err = redis.Scan(master, &host, &port)
+		if err != nil {
+			return nil, fmt.Errorf("CLUSTER SLOTS: %w", err)
+		}
+		if start < 0 || end >= clusterSlotCount || start > end {
+			return nil, fmt.Errorf("CLUSTER SLOTS: bad range %d-%d", start, end)
+		}
+
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		if c.pools[addr] == nil {
+			c.pools[addr] = newPool(addr)
+		}
+		for slot := start; slot <= end; slot++ {
+			c.slots[slot] = addr
+		}
+	}
+	return
+}
+
+func (c *clusterNodes) node(key string) string {
+	return c.slots[keySlot(key)]
+}
+
+func (c *clusterNodes) get(ctx context.Context, node string) (redis.Conn, error) {
+	pool := c.pools[node]
+	if pool == nil {
+		return nil, fmt.Errorf("no cluster node serves the slot")
+	}
+	return pool.GetContext(ctx)
+}
+
+// close - closes every node's pool
+func (c *clusterNodes) close() (err error) {
+	for _, pool := range c.pools {
+		if cerr := pool.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return
+}
+
+// keySlot - the hash slot of key: CRC16 of its hash tag or of the whole key
+func keySlot(key string) int {
+	if tag := hashTag(key); tag != "" {
+		key = tag
+	}
+	return int(crc16(key)) % clusterSlotCount
+}
+
+// hashTag - the part of key between the first { and the next }, which
+// Redis Cluster hashes instead of the whole key; "" when there is none or
+// it is empty
+func hashTag(key string) string {
+	if open := strings.IndexByte(key, '{'); open >= 0 {
+		if n := strings.IndexByte(key[open+1:], '}'); n > 0 {
+			return key[open+1 : open+1+n]
+		}
+	}
+	return ""
+}
+
+// crc16 - CRC-16/XMODEM, the checksum Redis Cluster hashes keys with
+func crc16(s string) (crc uint16) {
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return
+}
+
+// slotTags - for each slot, the shortest decimal string hashing to it
+var (
+	slotTags     [clusterSlotCount]string
+	slotTagsOnce sync.Once
+)
+
+// slotTag - a hash tag putting a key in slot, for keys that can't be made
+// to share a slot by tagging them with another key
+func slotTag(slot int) string {
+	slotTagsOnce.Do(func() {
+		left := clusterSlotCount
+		for n := 0; left > 0; n++ {
+			tag := strconv.Itoa(n)
+			if s := keySlot(tag); slotTags[s] == "" {
+				slotTags[s] = tag
+				left--
+			}
+		}
+	})
+	return slotTags[slot]
+}
@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+func TestCRC16(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint16
+	}{
+		// the check value of CRC-16/XMODEM
+		{"123456789", 0x31c3},
+		{"", 0},
+		{"a", 0x7c87},
+	}
+	for _, tt := range tests {
+		if got := crc16(tt.in); got != tt.want {
+			t.Errorf("crc16(%q) = %#04x, want %#04x", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		want int
+	}{
+		// as reported by CLUSTER KEYSLOT
+		{"foo", 12182},
+		{"bar", 5061},
+		{"hello", 866},
+		{"{foo}:student:1", 12182},
+		{"student:{foo}", 12182},
+		{"{foo}{bar}", 12182},
+		// an empty tag hashes the whole key
+		{"{}foo", int(crc16("{}foo")) % clusterSlotCount},
+		{"foo{}{bar}", int(crc16("foo{}{bar}")) % clusterSlotCount},
+		// an unclosed brace too
+		{"{foo", int(crc16("{foo")) % clusterSlotCount},
+		{"foo{{bar}}", int(crc16("{bar")) % clusterSlotCount},
+	}
+	for _, tt := range tests {
+		if got := keySlot(tt.key); got != tt.want {
+			t.Errorf("keySlot(%q) = %d, want %d", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestHashTag(t *testing.T) {
+	tests := []struct {
+		key, want string
+	}{
+		{"student:1", ""},
+		{"{student:1}:bits", "student:1"},
+		{"a{b}c{d}", "b"},
+		{"{}x", ""},
+		{"x{", ""},
+		{"x}{y}", "y"},
+	}
+	for _, tt := range tests {
+		if got := hashTag(tt.key); got != tt.want {
+			t.Errorf("hashTag(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
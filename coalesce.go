@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// writeCoalescer - collapses rapid successive Sets of the same key into a
+// single JSON.SET. The first Set of a key opens a window; every Set landing
+// inside that window only replaces the buffered state, and the final state is
+// written when the window closes. A hot key therefore costs at most one write
+// per window no matter how often it is updated.
+type writeCoalescer struct {
+	pool   *redis.Pool
+	window time.Duration
+
+	// onError - called with the key and error of a failed deferred write
+	onError func(key string, err error)
+	// logger - receives an Error per failed deferred write
+	logger Logger
+
+	mu      sync.Mutex
+	pending map[string]*coalescedWrite
+}
+
+type coalescedWrite struct {
+	data  []byte
+	timer *time.Timer
+}
+
+func newWriteCoalescer(pool *redis.Pool, window time.Duration) *writeCoalescer {
+	return &writeCoalescer{
+		pool:    pool,
+		window:  window,
+		pending: make(map[string]*coalescedWrite),
+	}
+}
+
+// setStructReJSON - buffers value as the next state of key
+func (w *writeCoalescer) setStructReJSON(key string, value interface{}) (err error) {
+	defer recoverUnsupported(&err)
+
+	value, err = prepareSet(key, value)
+	if err != nil {
+		return
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if p, ok := w.pending[key]; ok {
+		p.data = b
+		return
+	}
+
+	w.pending[key] = &coalescedWrite{
+		data:  b,
+		timer: time.AfterFunc(w.window, func() { w.fire(key) }),
+	}
+	return
+}
+
+func (w *writeCoalescer) fire(key string) {
+	w.mu.Lock()
+	p, ok := w.pending[key]
+	delete(w.pending, key)
+	w.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	err := w.write(key, p.data)
+	if err == nil {
+		return
+	}
+
+	orNop(w.logger).Error("coalesced write failed", "key", key, "err", err)
+	if w.onError != nil {
+		w.onError(key, err)
+	}
+}
+
+func (w *writeCoalescer) write(key string, b []byte) (err error) {
+	conn := w.pool.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("JSON.SET", key, ".", string(b))
+	if err != nil {
+		return newCommandError("JSON.SET", key, err)
+	}
+	return
+}
+
+// flush - writes every buffered key now instead of waiting for its window
+func (w *writeCoalescer) flush() (err error) {
+	w.mu.Lock()
+	pending := w.pending
+	w.pending = make(map[string]*coalescedWrite)
+	w.mu.Unlock()
+
+	for key, p := range pending {
+		p.timer.Stop()
+		werr := w.write(key, p.data)
+		if werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Collection - an append-mostly list of T under one key, such as the
+// grades of one student. Elements are JSON encoded, and kept either in a
+// redis list (RPUSH) or, with Document set, in a ReJSON array document
+// that can be indexed and read by path like any other.
+type Collection[T any] struct {
+	Key      string
+	Document bool
+}
+
+// NewCollection - the list of T at key
+func NewCollection[T any](key string) Collection[T] {
+	return Collection[T]{Key: key}
+}
+
+// Push - appends items, returning the new length
+func (c Collection[T]) Push(ctx context.Context, conn redis.Conn, items ...T) (n int, err error) {
+	if len(items) == 0 {
+		return c.Len(ctx, conn)
+	}
+	args := redis.Args{c.Key}
+	if c.Document {
+		args = args.Add("$")
+	}
+	for _, item := range items {
+		var b []byte
+		b, err = json.Marshal(item)
+		if err != nil {
+			return 0, encodeError(err)
+		}
+		args = args.Add(string(b))
+	}
+
+	if !c.Document {
+		n, err = redis.Int(doContext(ctx, conn, "RPUSH", args...))
+		if err != nil {
+			return 0, newCommandError("RPUSH", c.Key, err)
+		}
+		return
+	}
+
+	// JSON.ARRAPPEND needs the array to exist
+	conn.Send("MULTI")
+	conn.Send("JSON.SET", c.Key, "$", "[]", "NX")
+	conn.Send("JSON.ARRAPPEND", args...)
+	replies, err := redis.Values(doContext(ctx, conn, "EXEC"))
+	if err != nil {
+		return 0, newCommandError("JSON.ARRAPPEND", c.Key, err)
+	}
+	lens, err := redis.Ints(replies[1], nil)
+	if err != nil || len(lens) != 1 {
+		return 0, newCommandError("JSON.ARRAPPEND", c.Key, fmt.Errorf("unexpected reply %v: %v", replies[1], err))
+	}
+	return lens[0], nil
+}
+
+// Range - elements start to stop, inclusive; negative indexes count from
+// the end, as LRANGE's do
+func (c Collection[T]) Range(ctx context.Context, conn redis.Conn, start, stop int) (items []T, err error) {
+	var raw [][]byte
+	if c.Document {
+		raw, err = c.jsonRange(ctx, conn, start, stop)
+	} else {
+		raw, err = redis.ByteSlices(doContext(ctx, conn, "LRANGE", c.Key, start, stop))
+		if err != nil {
+			err = newCommandError("LRANGE", c.Key, err)
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	items = make([]T, len(raw))
+	for i, b := range raw {
+		err = json.Unmarshal(b, &items[i])
+		if err != nil {
+			return nil, fmt.Errorf("%s[%d]: %w", c.Key, i, err)
+		}
+	}
+	return
+}
+
+// jsonRange - LRANGE semantics over the array document: JSONPath slices
+// are end-exclusive, so stop is resolved against the length first
+func (c Collection[T]) jsonRange(ctx context.Context, conn redis.Conn, start, stop int) (raw [][]byte, err error) {
+	n, err := c.Len(ctx, conn)
+	if err != nil {
+		return
+	}
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return nil, nil
+	}
+
+	b, err := redis.Bytes(doContext(ctx, conn, "JSON.GET", c.Key, fmt.Sprintf("$[%d:%d]", start, stop+1)))
+	if err != nil {
+		return nil, newCommandError("JSON.GET", c.Key, err)
+	}
+	var elems []json.RawMessage
+	err = json.Unmarshal(b, &elems)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", c.Key, err)
+	}
+	raw = make([][]byte, len(elems))
+	for i, e := range elems {
+		raw[i] = e
+	}
+	return
+}
+
+// All - every element
+func (c Collection[T]) All(ctx context.Context, conn redis.Conn) ([]T, error) {
+	return c.Range(ctx, conn, 0, -1)
+}
+
+// Trim - keeps only elements start to stop, inclusive, as LTRIM does;
+// Trim(ctx, conn, -100, -1) keeps the newest hundred
+func (c Collection[T]) Trim(ctx context.Context, conn redis.Conn, start, stop int) (err error) {
+	if !c.Document {
+		_, err = doContext(ctx, conn, "LTRIM", c.Key, start, stop)
+		if err != nil {
+			return newCommandError("LTRIM", c.Key, err)
+		}
+		return
+	}
+
+	// JSON.ARRTRIM doesn't take negative indexes relative to the end on
+	// every version; resolve them against the length
+	n, err := c.Len(ctx, conn)
+	if err != nil || n == 0 {
+		return
+	}
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	_, err = doContext(ctx, conn, "JSON.ARRTRIM", c.Key, "$", start, stop)
+	if err != nil {
+		return newCommandError("JSON.ARRTRIM", c.Key, err)
+	}
+	return
+}
+
+// Len - the number of elements, 0 for a missing key
+func (c Collection[T]) Len(ctx context.Context, conn redis.Conn) (n int, err error) {
+	if !c.Document {
+		n, err = redis.Int(doContext(ctx, conn, "LLEN", c.Key))
+		if err != nil {
+			return 0, newCommandError("LLEN", c.Key, err)
+		}
+		return
+	}
+
+	reply, err := doContext(ctx, conn, "JSON.ARRLEN", c.Key, "$")
+	if err == nil && reply == nil {
+		return 0, nil
+	}
+	lens, err := redis.Ints(reply, err)
+	if err != nil {
+		return 0, newCommandError("JSON.ARRLEN", c.Key, err)
+	}
+	if len(lens) == 1 {
+		n = lens[0]
+	}
+	return
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// compactOptions - what compactKeys strips, and whether it writes
+type compactOptions struct {
+	// Type - registered type whose fields are kept
+	Type string
+	// Keep - dotted paths kept even though Type has no field for them,
+	// along with everything below them
+	Keep []string
+	// DryRun - report what would be removed without writing
+	DryRun bool
+}
+
+// compactResult - what compactKeys did (or would do) to one document
+type compactResult struct {
+	Key     string
+	Removed []string
+	// Saved - bytes the serialized document shrinks by
+	Saved int64
+}
+
+// compactKeys - rewrites every document matching pattern without the
+// members opts.Type no longer has a field for, calling fn for each document
+// changed. Each rewrite is WATCHed, so a document modified concurrently is
+// re-read rather than clobbered. Rewritten ReJSON and hash-json documents
+// come back with their members sorted; TTLs are kept.
+func compactKeys(ctx context.Context, conn redis.Conn, pattern string, opts compactOptions, fn func(compactResult) error) (n int, err error) {
+	if _, err = newRegistered(opts.Type); err != nil {
+		return
+	}
+
+	err = scanKeys(ctx, conn, pattern, func(key string) (err error) {
+		var r compactResult
+		for attempt := 0; attempt < 3; attempt++ {
+			r, err = compactKey(ctx, conn, key, opts)
+			if err != errBatchConflict {
+				break
+			}
+		}
+		if err != nil || len(r.Removed) == 0 {
+			return
+		}
+		n++
+		return fn(r)
+	})
+	return
+}
+
+func compactKey(ctx context.Context, conn redis.Conn, key string, opts compactOptions) (r compactResult, err error) {
+	r.Key = key
+	typ := registeredTypes[opts.Type]
+
+	_, err = conn.Do("WATCH", key)
+	if err != nil {
+		return r, newCommandError("WATCH", key, err)
+	}
+	defer conn.Do("UNWATCH")
+
+	mode, err := detectStorageMode(conn, key)
+	if err == errUnknownMode || errors.Is(err, redis.ErrNil) {
+		return r, nil
+	}
+	if err != nil {
+		return
+	}
+	raw, err := getRaw(conn, mode, key)
+	if err != nil {
+		return
+	}
+
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	err = dec.Decode(&doc)
+	if err != nil {
+		return r, fmt.Errorf("%s: %w", key, err)
+	}
+	if mode == modeHash {
+		doc = typedHashFields(doc)
+	}
+
+	walkUnknown(doc, typ, "", func(parent map[string]interface{}, name, path string) {
+		for _, keep := range opts.Keep {
+			if path == keep || strings.HasPrefix(path, keep+".") {
+				return
+			}
+		}
+		delete(parent, name)
+		r.Removed = append(r.Removed, path)
+	})
+	if len(r.Removed) == 0 {
+		return
+	}
+	sort.Strings(r.Removed)
+
+	compacted, err := json.Marshal(doc)
+	if err != nil {
+		return r, encodeError(err)
+	}
+	r.Saved = int64(len(raw) - len(compacted))
+	if opts.DryRun {
+		return
+	}
+
+	// bits fields kept as plain hash fields move to the bits string
+	compacted, bits, moved, err := splitRawBits(mode, key, compacted, typ)
+	if err != nil {
+		return
+	}
+	cmd, args, err := rawCommand(mode, key, compacted)
+	if err != nil {
+		return
+	}
+
+	m := newMultiExec(conn)
+	if mode == modeHash {
+		// HMSET only overwrites; drop the removed top-level fields
+		top := moved
+		for _, path := range r.Removed {
+			if !strings.Contains(path, ".") {
+				top = append(top, path)
+			}
+		}
+		if len(top) > 0 {
+			m.send("HDEL", redis.Args{key}.AddFlat(top)...)
+		}
+	}
+	m.send(cmd, args...)
+	if bits != nil {
+		m.send("BITFIELD", bits...)
+	}
+	replies, err := m.exec(ctx)
+	if err != nil {
+		return r, newCommandError("EXEC", key, err)
+	}
+	if replies == nil {
+		return r, errBatchConflict
+	}
+	return
+}
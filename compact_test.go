@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCompactKeyExecError(t *testing.T) {
+	rec := newRecordingConn(nil)
+	rec.reply = func(cmd string, args []interface{}) (interface{}, error) {
+		switch cmd {
+		case "TYPE":
+			return "ReJSON-RL", nil
+		case "JSON.GET":
+			return []byte(`{"rank":1,"legacyId":7}`), nil
+		case "EXEC":
+			return []interface{}{wrongType}, nil
+		}
+		return "OK", nil
+	}
+	r, err := compactKey(context.Background(), rec, "k", compactOptions{Type: "Student"})
+	checkExecFailed(t, err)
+	if len(r.Removed) != 1 || r.Removed[0] != "legacyId" {
+		t.Errorf("removed %v, want [legacyId]", r.Removed)
+	}
+}
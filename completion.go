@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// completionKeyLimit - keys scanned per completion, so completing against a
+// large keyspace stays interactive
+const completionKeyLimit = 2000
+
+var completionScripts = map[string]*template.Template{
+	"bash": template.Must(template.New("bash").Parse(`# {{.Prog}} bash completion; source <({{.Prog}} completion bash)
+_{{.Func}}() {
+	local cur=${COMP_WORDS[COMP_CWORD]} i cmd=0
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		case ${COMP_WORDS[i]} in
+		-Server|-config|-profile) ((i++)) ;;
+		-*) ;;
+		*) cmd=$i; break ;;
+		esac
+	done
+	if ((cmd == 0)); then
+		COMPREPLY=($(compgen -W "{{.Commands}}" -- "$cur"))
+		return
+	fi
+	COMPREPLY=($({{.Prog}} "${COMP_WORDS[@]:1:cmd-1}" completion keys "$cur" 2>/dev/null))
+	compopt -o nospace 2>/dev/null
+}
+complete -F _{{.Func}} {{.Prog}}
+`)),
+	"zsh": template.Must(template.New("zsh").Parse(`#compdef {{.Prog}}
+# {{.Prog}} zsh completion; source <({{.Prog}} completion zsh)
+_{{.Func}}() {
+	local i cmd=0
+	for ((i = 2; i < CURRENT; i++)); do
+		case ${words[i]} in
+		-Server|-config|-profile) ((i++)) ;;
+		-*) ;;
+		*) cmd=$i; break ;;
+		esac
+	done
+	if ((cmd == 0)); then
+		compadd -- {{.Commands}}
+		return
+	fi
+	compadd -S '' -- ${(f)"$({{.Prog}} ${words[2,cmd-1]} completion keys "$PREFIX" 2>/dev/null)"}
+}
+compdef _{{.Func}} {{.Prog}}
+`)),
+}
+
+// cmdCompletion - prints a shell completion script, or (as the scripts call
+// it) the key completions for a partially typed key
+func cmdCompletion(env *cliEnv, args []string) (err error) {
+	if len(args) == 0 {
+		return errors.New("completion needs bash, zsh or keys")
+	}
+
+	if args[0] == "keys" {
+		var prefix string
+		if len(args) > 1 {
+			prefix = args[1]
+		}
+		pool := newPool(env.cfg)
+		defer pool.Close()
+		conn := pool.Get()
+		defer conn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		var keys []string
+		keys, err = completeKeys(ctx, conn, prefix)
+		if err != nil {
+			return
+		}
+		_, err = fmt.Fprintln(env.stdout, strings.Join(keys, "\n"))
+		return
+	}
+
+	tmpl, ok := completionScripts[args[0]]
+	if !ok {
+		return fmt.Errorf("no completion for %q (want bash or zsh)", args[0])
+	}
+	return writeCompletion(env.stdout, tmpl)
+}
+
+func writeCompletion(w io.Writer, tmpl *template.Template) error {
+	prog := filepath.Base(os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return tmpl.Execute(w, struct {
+		Prog, Func, Commands string
+	}{
+		Prog:     prog,
+		Func:     strings.NewReplacer("-", "_", ".", "_").Replace(prog),
+		Commands: strings.Join(names, " "),
+	})
+}
+
+// completeKeys - candidates for a partially typed key: the distinct
+// prefixes up to the next ':' (student: for stu), or whole keys where there
+// is none
+func completeKeys(ctx context.Context, conn redis.Conn, prefix string) (candidates []string, err error) {
+	seen := make(map[string]bool)
+	scanned := 0
+	errEnough := errors.New("enough keys")
+
+	err = scanKeys(ctx, conn, escapeGlob(prefix)+"*", func(key string) error {
+		if scanned++; scanned > completionKeyLimit {
+			return errEnough
+		}
+		c := key
+		if i := strings.Index(key[len(prefix):], ":"); i >= 0 {
+			c = key[:len(prefix)+i+1]
+		}
+		if !seen[c] {
+			seen[c] = true
+			candidates = append(candidates, c)
+		}
+		return nil
+	})
+	if err == errEnough || errors.Is(err, context.DeadlineExceeded) {
+		err = nil
+	}
+	sort.Strings(candidates)
+	return
+}
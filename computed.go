@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// computedField - a struct type and one of its fields
+type computedField struct {
+	t     reflect.Type
+	field string
+}
+
+var (
+	computedMu    sync.RWMutex
+	computedFuncs = map[computedField]func(v interface{}) (interface{}, error){}
+)
+
+// registerComputed - fn derives field of the struct type of v from the
+// rest of it. fn is passed a pointer to the struct and its result is
+// assigned to field, which must be tagged `redis:"...,computed"`, whenever
+// a value holding such a struct is Set, so the derived value is stored in
+// the document for RediSearch to index.
+func registerComputed(v interface{}, field string, fn func(v interface{}) (interface{}, error)) {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	f, ok := t.FieldByName(field)
+	if !ok || !parseFieldTag(f).has("computed") {
+		panic(fmt.Sprintf("%s.%s is not a field tagged computed", t.Name(), field))
+	}
+
+	computedMu.Lock()
+	computedFuncs[computedField{t, field}] = fn
+	computedMu.Unlock()
+}
+
+// withComputed - value with every computed field refreshed. A pointer is
+// updated in place; anything else is copied first (structs it points to
+// are still updated in place).
+func withComputed(value interface{}) (out interface{}, err error) {
+	v := reflect.ValueOf(value)
+	if !v.IsValid() || !tagUseOf(v.Type()).computed {
+		return value, nil
+	}
+	if v.Kind() != reflect.Ptr {
+		p := reflect.New(v.Type())
+		p.Elem().Set(v)
+		v = p
+	}
+	err = refreshComputed(v)
+	return v.Interface(), err
+}
+
+func refreshComputed(v reflect.Value) (err error) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return
+		}
+		if v.Elem().Kind() != reflect.Struct {
+			return refreshComputed(v.Elem())
+		}
+		// nested structs first, so a computed field can build on theirs
+		t := v.Elem().Type()
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).PkgPath == "" {
+				if err = refreshComputed(v.Elem().Field(i)); err != nil {
+					return
+				}
+			}
+		}
+		info := structInfoOf(t)
+		if !info.own.computed {
+			return
+		}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !info.tags[i].has("computed") {
+				continue
+			}
+			computedMu.RLock()
+			fn, ok := computedFuncs[computedField{t, f.Name}]
+			computedMu.RUnlock()
+			if !ok {
+				return fmt.Errorf("%s.%s: no function registered for computed field", t.Name(), f.Name)
+			}
+
+			var r interface{}
+			r, err = fn(v.Interface())
+			if err != nil {
+				return fmt.Errorf("%s.%s: %w", t.Name(), f.Name, err)
+			}
+			rv := reflect.ValueOf(r)
+			fv := v.Elem().Field(i)
+			switch {
+			case r == nil:
+				fv.Set(reflect.Zero(f.Type))
+			case rv.Type().AssignableTo(f.Type):
+				fv.Set(rv)
+			case rv.Type().ConvertibleTo(f.Type):
+				fv.Set(rv.Convert(f.Type))
+			default:
+				return fmt.Errorf("%s.%s: computed %T, want %v", t.Name(), f.Name, r, f.Type)
+			}
+		}
+	case reflect.Struct:
+		if v.CanAddr() {
+			return refreshComputed(v.Addr())
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err = refreshComputed(v.Index(i)); err != nil {
+				return
+			}
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			e := reflect.New(v.Type().Elem())
+			e.Elem().Set(v.MapIndex(k))
+			if err = refreshComputed(e); err != nil {
+				return
+			}
+			v.SetMapIndex(k, e.Elem())
+		}
+	}
+	return
+}
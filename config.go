@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// config - connection, pool and storage settings. Values are layered:
+// defaults, then the JSON config file, then REJSON_STRUCT_* environment
+// variables, then any command line flag that was explicitly set.
+type config struct {
+	Server   string `json:"server"`
+	Password string `json:"password,omitempty"`
+	DB       int    `json:"db"`
+
+	Pool struct {
+		MaxIdle     int      `json:"maxIdle"`
+		MaxActive   int      `json:"maxActive"`
+		IdleTimeout duration `json:"idleTimeout"`
+	} `json:"pool"`
+
+	Timeouts struct {
+		Connect duration `json:"connect"`
+		Read    duration `json:"read"`
+		Write   duration `json:"write"`
+	} `json:"timeouts"`
+
+	// OpTimeouts - per command class, see timeouts.go
+	OpTimeouts struct {
+		Read  duration `json:"read"`
+		Write duration `json:"write"`
+		Scan  duration `json:"scan"`
+	} `json:"opTimeouts"`
+
+	// TTL - expiry applied to stored objects, 0 for none
+	TTL duration `json:"ttl"`
+	// Mode - storage mode: hash, hash-json or rejson
+	Mode string `json:"mode"`
+
+	// Profiles - named partial configs (dev, staging, prod...) laid over
+	// the rest of the file when selected
+	Profiles map[string]json.RawMessage `json:"profiles,omitempty"`
+}
+
+// duration - time.Duration written as "1.5s" in config files
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) (err error) {
+	var s string
+	err = json.Unmarshal(b, &s)
+	if err != nil {
+		return
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return
+	}
+	*d = duration(v)
+	return
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func defaultConfig() (cfg config) {
+	cfg.Server = "localhost:6379"
+	cfg.Pool.MaxIdle = 4
+	cfg.Pool.IdleTimeout = duration(5 * time.Minute)
+	cfg.Timeouts.Connect = duration(5 * time.Second)
+	cfg.Mode = modeReJSON.String()
+	return
+}
+
+// loadConfig - defaults, overlaid with the JSON file at path (if path isn't
+// empty), the named profile from it (if profile isn't empty) and then the
+// environment
+func loadConfig(path, profile string) (cfg config, err error) {
+	cfg = defaultConfig()
+
+	if path != "" {
+		var f *os.File
+		f, err = os.Open(path)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&cfg)
+		if err != nil {
+			return cfg, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if profile != "" {
+		raw, ok := cfg.Profiles[profile]
+		if !ok {
+			return cfg, fmt.Errorf("no profile %q in %q (have %v)", profile, path, cfg.profileNames())
+		}
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&cfg)
+		if err != nil {
+			return cfg, fmt.Errorf("%s: profile %s: %w", path, profile, err)
+		}
+	}
+
+	err = cfg.applyEnv(os.LookupEnv)
+	if err != nil {
+		return
+	}
+
+	_, err = parseStorageMode(cfg.Mode)
+	return
+}
+
+// applyEnv - overrides cfg with any REJSON_STRUCT_* variable that is set
+func (cfg *config) applyEnv(lookup func(string) (string, bool)) (err error) {
+	str := func(name string, dst *string) {
+		if v, ok := lookup("REJSON_STRUCT_" + name); ok {
+			*dst = v
+		}
+	}
+	num := func(name string, dst *int) {
+		if v, ok := lookup("REJSON_STRUCT_" + name); ok && err == nil {
+			*dst, err = strconv.Atoi(v)
+			if err != nil {
+				err = fmt.Errorf("REJSON_STRUCT_%s: %w", name, err)
+			}
+		}
+	}
+	dur := func(name string, dst *duration) {
+		if v, ok := lookup("REJSON_STRUCT_" + name); ok && err == nil {
+			var d time.Duration
+			d, err = time.ParseDuration(v)
+			if err != nil {
+				err = fmt.Errorf("REJSON_STRUCT_%s: %w", name, err)
+				return
+			}
+			*dst = duration(d)
+		}
+	}
+
+	str("SERVER", &cfg.Server)
+	str("PASSWORD", &cfg.Password)
+	num("DB", &cfg.DB)
+	num("POOL_MAX_IDLE", &cfg.Pool.MaxIdle)
+	num("POOL_MAX_ACTIVE", &cfg.Pool.MaxActive)
+	dur("POOL_IDLE_TIMEOUT", &cfg.Pool.IdleTimeout)
+	dur("CONNECT_TIMEOUT", &cfg.Timeouts.Connect)
+	dur("READ_TIMEOUT", &cfg.Timeouts.Read)
+	dur("WRITE_TIMEOUT", &cfg.Timeouts.Write)
+	dur("OP_READ_TIMEOUT", &cfg.OpTimeouts.Read)
+	dur("OP_WRITE_TIMEOUT", &cfg.OpTimeouts.Write)
+	dur("OP_SCAN_TIMEOUT", &cfg.OpTimeouts.Scan)
+	dur("TTL", &cfg.TTL)
+	str("MODE", &cfg.Mode)
+	return
+}
+
+func (cfg config) profileNames() []string {
+	names := make([]string, 0, len(cfg.Profiles))
+	for name := range cfg.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newPool - redis.Pool dialing the configured server
+func newPool(cfg config) *redis.Pool {
+	opts := []redis.DialOption{
+		redis.DialDatabase(cfg.DB),
+		redis.DialConnectTimeout(time.Duration(cfg.Timeouts.Connect)),
+		redis.DialReadTimeout(time.Duration(cfg.Timeouts.Read)),
+		redis.DialWriteTimeout(time.Duration(cfg.Timeouts.Write)),
+	}
+	if cfg.Password != "" {
+		opts = append(opts, redis.DialPassword(cfg.Password))
+	}
+
+	return &redis.Pool{
+		MaxIdle:     cfg.Pool.MaxIdle,
+		MaxActive:   cfg.Pool.MaxActive,
+		IdleTimeout: time.Duration(cfg.Pool.IdleTimeout),
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", cfg.Server, opts...)
+		},
+	}
+}
+
+func (cfg config) opTimeouts() opTimeouts {
+	return opTimeouts{
+		Read:  time.Duration(cfg.OpTimeouts.Read),
+		Write: time.Duration(cfg.OpTimeouts.Write),
+		Scan:  time.Duration(cfg.OpTimeouts.Scan),
+	}
+}
+
+// applyTTL - EXPIREs key, and its bits string if it has one, when a TTL is
+// configured
+func applyTTL(conn redis.Conn, key string, ttl duration) (err error) {
+	if ttl <= 0 {
+		return
+	}
+	ms := int64(time.Duration(ttl) / time.Millisecond)
+	m := newMultiExec(conn)
+	m.send("PEXPIRE", key, ms)
+	m.send("PEXPIRE", bitsKey(key), ms)
+	_, err = m.exec(context.Background())
+	if err != nil {
+		return newCommandError("PEXPIRE", key, err)
+	}
+	return
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// hashCountField - the field a slice, array or map stored in hash mode keeps
+// its length in
+const hashCountField = "#"
+
+// isContainer - whether t, or what it points to, is a slice, array or map.
+// The JSON modes store those as arrays and objects as they are; hash mode
+// lays their elements out with containerHashArgs.
+func isContainer(t reflect.Type) bool {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil {
+		return false
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return true
+	}
+	return false
+}
+
+// containerHashArgs - the fields storing value, a slice, array or map (with
+// string keys) of structs, in one hash: field F of element i, or of the
+// element under map key k, as "i.F" or "k.F", and the length under
+// hashCountField. Elements are flattened as addStructHash flattens a struct,
+// so they must be flat too; map keys can't contain a dot.
+func containerHashArgs(value interface{}) (args redis.Args, err error) {
+	defer recoverUnsupported(&err)
+
+	v := reflect.ValueOf(value)
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	args = redis.Args{hashCountField, v.Len()}
+
+	add := func(id string, elem reflect.Value) error {
+		for elem.Kind() == reflect.Ptr {
+			if elem.IsNil() {
+				return fmt.Errorf("element %s is nil", id)
+			}
+			elem = elem.Elem()
+		}
+		if elem.Kind() != reflect.Struct {
+			return fmt.Errorf("hash mode stores slices and maps of structs, not of %s", elem.Type())
+		}
+		if bits, _ := bitFieldsOf(elem.Type()); len(bits) > 0 {
+			// the bits string is per key, not per element
+			return fmt.Errorf("hash mode can't store %s, which has bits fields, in a slice or map", elem.Type())
+		}
+
+		fields := redis.Args{}.AddFlat(redigoValue(elem.Interface()))
+		if len(fields) == 0 {
+			// keep a field so an element with nothing to store still exists
+			args = args.Add(id+".", "")
+		}
+		for i := 0; i+1 < len(fields); i += 2 {
+			args = args.Add(id+"."+argString(fields[i]), fields[i+1])
+		}
+		return nil
+	}
+
+	if v.Kind() == reflect.Map {
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("hash mode stores maps with string keys, not %s", v.Type().Key())
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			id := iter.Key().String()
+			if strings.Contains(id, ".") || id == hashCountField {
+				return nil, fmt.Errorf("map key %q can't be stored in hash mode", id)
+			}
+			if err = add(id, iter.Value()); err != nil {
+				return
+			}
+		}
+		return
+	}
+	for i := 0; i < v.Len(); i++ {
+		if err = add(strconv.Itoa(i), v.Index(i)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// scanContainer - the inverse of containerHashArgs: HGETALL's src decoded
+// into dest, a pointer to a slice, array or map of structs
+func scanContainer(src []interface{}, dest interface{}) (err error) {
+	d := reflect.ValueOf(dest)
+	if d.Kind() != reflect.Ptr || d.IsNil() {
+		return fmt.Errorf("scanContainer needs a non-nil pointer, not %T", dest)
+	}
+	c := d.Elem()
+
+	n := -1
+	elems := make(map[string][]interface{})
+	for i := 0; i+1 < len(src); i += 2 {
+		name := argString(src[i])
+		if name == hashCountField {
+			n, err = strconv.Atoi(argString(src[i+1]))
+			if err != nil {
+				return fmt.Errorf("bad %s field: %w", hashCountField, err)
+			}
+			continue
+		}
+		id, field, ok := strings.Cut(name, ".")
+		if !ok {
+			continue
+		}
+		if field == "" {
+			// the marker of an element with no fields
+			if _, ok := elems[id]; !ok {
+				elems[id] = nil
+			}
+			continue
+		}
+		elems[id] = append(elems[id], []byte(field), src[i+1])
+	}
+	if n < 0 {
+		return fmt.Errorf("no %s field; not a slice or map stored in hash mode", hashCountField)
+	}
+
+	switch c.Kind() {
+	case reflect.Map:
+		m := reflect.MakeMapWithSize(c.Type(), len(elems))
+		for id, fields := range elems {
+			var e reflect.Value
+			e, err = scanElem(fields, c.Type().Elem())
+			if err != nil {
+				return fmt.Errorf("%s: %w", id, err)
+			}
+			m.SetMapIndex(reflect.ValueOf(id).Convert(c.Type().Key()), e)
+		}
+		c.Set(m)
+		return
+	case reflect.Slice:
+		c.Set(reflect.MakeSlice(c.Type(), n, n))
+	case reflect.Array:
+		if n > c.Len() {
+			return fmt.Errorf("%d elements stored, %s holds %d", n, c.Type(), c.Len())
+		}
+	default:
+		return fmt.Errorf("scanContainer needs a slice, array or map, not %s", c.Type())
+	}
+	for id := range elems {
+		if i, aerr := strconv.Atoi(id); aerr != nil || i < 0 || i >= n {
+			return fmt.Errorf("field prefix %q is not an index below %d", id, n)
+		}
+	}
+	for i := 0; i < n; i++ {
+		var e reflect.Value
+		e, err = scanElem(elems[strconv.Itoa(i)], c.Type().Elem())
+		if err != nil {
+			return fmt.Errorf("%d: %w", i, err)
+		}
+		c.Index(i).Set(e)
+	}
+	// an array longer than what was stored keeps no elements from before
+	for i := n; i < c.Len(); i++ {
+		c.Index(i).Set(reflect.Zero(c.Type().Elem()))
+	}
+	return
+}
+
+// scanElem - a new t, a struct or a pointer to one, scanned from fields
+func scanElem(fields []interface{}, t reflect.Type) (e reflect.Value, err error) {
+	st := t
+	if t.Kind() == reflect.Ptr {
+		st = t.Elem()
+	}
+	p := reflect.New(st)
+	err = scanStruct(fields, p.Interface())
+	if t.Kind() == reflect.Ptr {
+		return p, err
+	}
+	return p.Elem(), err
+}
+
+// scanHash - HGETALL's src decoded into dest: scanContainer for slices,
+// arrays and maps, scanStruct otherwise
+func scanHash(src []interface{}, dest interface{}) error {
+	if isContainer(reflect.TypeOf(dest)) {
+		return scanContainer(src, dest)
+	}
+	return scanStruct(src, dest)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// hashOf - what HGETALL would return for value written with HMSET
+func hashOf(value interface{}) (src []interface{}) {
+	for _, arg := range (redis.Args{}).AddFlat(redigoValue(value)) {
+		src = append(src, []byte(argString(arg)))
+	}
+	return
+}
+
+type containerElem struct {
+	A int    `redis:"a"`
+	B string `redis:"b,omitempty"`
+}
+
+func TestContainerHashArgs(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{"slice", []containerElem{{1, "x"}, {2, "y"}}, "[# 2 0.a 1 0.b x 1.a 2 1.b y]"},
+		{"pointer elements", &[]*containerElem{{A: 3}}, "[# 1 0.a 3]"},
+		{"array", [2]containerElem{{A: 1}}, "[# 2 0.a 1 1.a 0]"},
+		{"empty", []containerElem{}, "[# 0]"},
+		{"map", map[string]containerElem{"k": {5, "z"}}, "[# 1 k.a 5 k.b z]"},
+		{"element with no fields", []struct {
+			A int `redis:"a,omitempty"`
+		}{{}}, "[# 1 0. ]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := containerHashArgs(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprint([]interface{}(args)); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainerHashArgsErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+	}{
+		{"not structs", []int{1}},
+		{"nil element", []*containerElem{nil}},
+		{"int keys", map[int]containerElem{1: {}}},
+		{"dotted key", map[string]containerElem{"a.b": {}}},
+		{"count key", map[string]containerElem{hashCountField: {}}},
+		{"bits fields", []struct {
+			N uint8 `redis:"n,bits=4"`
+		}{{}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := containerHashArgs(tt.value); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
+
+func TestContainerRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		// dest - what to scan into, prefilled to show what is replaced
+		dest interface{}
+		want interface{}
+	}{
+		{
+			"slice",
+			[]containerElem{{1, "x"}, {2, ""}},
+			&[]containerElem{{9, "old"}, {9, "old"}, {9, "old"}},
+			[]containerElem{{1, "x"}, {2, ""}},
+		},
+		{
+			"pointer elements",
+			[]*containerElem{{A: 1}},
+			&[]*containerElem{},
+			[]*containerElem{{A: 1}},
+		},
+		{
+			"array tail zeroed",
+			[]containerElem{{1, "x"}},
+			&[3]containerElem{{9, "old"}, {9, "old"}, {9, "old"}},
+			[3]containerElem{{1, "x"}},
+		},
+		{
+			"map replaced",
+			map[string]containerElem{"k": {5, "z"}, "l": {}},
+			&map[string]containerElem{"old": {}},
+			map[string]containerElem{"k": {5, "z"}, "l": {}},
+		},
+		{
+			"empty",
+			[]containerElem{},
+			&[]containerElem{{9, "old"}},
+			[]containerElem{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := containerHashArgs(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = scanContainer(hashOf(args), tt.dest); err != nil {
+				t.Fatal(err)
+			}
+			got := reflect.ValueOf(tt.dest).Elem().Interface()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScanContainerErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  []interface{}
+		dest interface{}
+	}{
+		{"no count", []interface{}{[]byte("0.a"), []byte("1")}, &[]containerElem{}},
+		{"bad count", []interface{}{[]byte("#"), []byte("x")}, &[]containerElem{}},
+		{"index past count", []interface{}{[]byte("#"), []byte("1"), []byte("1.a"), []byte("1")}, &[]containerElem{}},
+		{"array too short", []interface{}{[]byte("#"), []byte("3")}, &[2]containerElem{}},
+		{"not a pointer", []interface{}{[]byte("#"), []byte("0")}, []containerElem{}},
+		{"not a container", []interface{}{[]byte("#"), []byte("0")}, &containerElem{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := scanContainer(tt.src, tt.dest); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
+
+func TestAddContainerHashExecError(t *testing.T) {
+	checkExecFailed(t, addStructHash(failingExecConn(), "k", []containerElem{{A: 1}}))
+}
+
+// recordingNodes - bulkNodes sending every key to conn
+type recordingNodes struct{ conn redis.Conn }
+
+func (n recordingNodes) node(string) string { return "" }
+
+func (n recordingNodes) get(context.Context, string) (redis.Conn, error) { return n.conn, nil }
+
+func TestBulkSetExecError(t *testing.T) {
+	rec := newRecordingConn(nil)
+	rec.reply = func(cmd string, args []interface{}) (interface{}, error) {
+		switch cmd {
+		case "EXEC":
+			return []interface{}{int64(1), wrongType}, nil
+		case "MULTI":
+			return "OK", nil
+		}
+		return "QUEUED", nil
+	}
+	items := []bulkItem{
+		{Key: "container", Value: []containerElem{{A: 1}}},
+	}
+	err := bulkSet(context.Background(), recordingNodes{rec}, modeHash, items, bulkOptions{Workers: 1})
+	var errs bulkErrors
+	if !errors.As(err, &errs) || !errors.Is(errs["container"], wrongType) {
+		t.Errorf("got %v, want container failed with %v", err, wrongType)
+	}
+}
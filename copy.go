@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// copyOptions - what copyKeys copies, and how fast
+type copyOptions struct {
+	Pattern string
+	// Workers - concurrent copiers, each with its own source and target conn
+	Workers int
+	// Rate - keys copied per second at most, unlimited when 0
+	Rate int
+	// Replace - overwrite keys that already exist on the target; they are
+	// skipped otherwise
+	Replace bool
+}
+
+// copyStats - outcome of a copyKeys
+type copyStats struct {
+	Copied  int64
+	Skipped int64
+	Errors  int64
+	Elapsed time.Duration
+	// FirstErr - the first copy error, for diagnosis
+	FirstErr error
+}
+
+// copyKeys - copies every key matching opts.Pattern, and its bits string,
+// with DUMP/RESTORE, keeping its remaining TTL. Keys are SCANned on scan and copied by
+// opts.Workers workers dialing their own conns. DUMP payloads are
+// version-specific and ReJSON documents need the module on the target too.
+// It stops early, without error, when ctx is done.
+func copyKeys(ctx context.Context, scan redis.Conn, dialSource, dialTarget func() (redis.Conn, error), opts copyOptions) (s copyStats, err error) {
+	if opts.Workers <= 0 {
+		opts.Workers = 4
+	}
+
+	var mu sync.Mutex
+	fail := func(err error) {
+		atomic.AddInt64(&s.Errors, 1)
+		mu.Lock()
+		if s.FirstErr == nil {
+			s.FirstErr = err
+		}
+		mu.Unlock()
+	}
+
+	keys := make(chan string)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < opts.Workers; w++ {
+		src, serr := dialSource()
+		if serr != nil {
+			close(keys)
+			wg.Wait()
+			return s, serr
+		}
+		dst, derr := dialTarget()
+		if derr != nil {
+			src.Close()
+			close(keys)
+			wg.Wait()
+			return s, derr
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer src.Close()
+			defer dst.Close()
+
+			for key := range keys {
+				copied, cerr := copyKey(src, dst, key, opts.Replace)
+				if cerr == nil && copied {
+					cerr = copyBits(src, dst, key)
+				}
+				switch {
+				case cerr != nil:
+					fail(cerr)
+				case copied:
+					atomic.AddInt64(&s.Copied, 1)
+				default:
+					atomic.AddInt64(&s.Skipped, 1)
+				}
+			}
+		}()
+	}
+
+	var tick <-chan time.Time
+	if opts.Rate > 0 && opts.Rate <= int(time.Second) {
+		ticker := time.NewTicker(time.Second / time.Duration(opts.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	err = scanKeys(ctx, scan, opts.Pattern, func(key string) error {
+		if isBitsKey(key) {
+			// copied with its object
+			return nil
+		}
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		select {
+		case keys <- key:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(keys)
+	wg.Wait()
+	s.Elapsed = time.Since(start)
+
+	if err == ctx.Err() {
+		err = nil
+	}
+	return
+}
+
+// copyKey - DUMPs key on src and RESTOREs it on dst with its remaining TTL.
+// It reports false, without error, for keys that vanished or (without
+// replace) already exist on dst.
+func copyKey(src, dst redis.Conn, key string, replace bool) (copied bool, err error) {
+	src.Send("MULTI")
+	src.Send("DUMP", key)
+	src.Send("PTTL", key)
+	reply, err := redis.Values(src.Do("EXEC"))
+	if err == nil {
+		err = execError(reply)
+	}
+	if err != nil {
+		return false, newCommandError("DUMP", key, err)
+	}
+
+	payload, err := redis.Bytes(reply[0], nil)
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, newCommandError("DUMP", key, err)
+	}
+	ttl, err := redis.Int64(reply[1], nil)
+	if err != nil {
+		return false, newCommandError("PTTL", key, err)
+	}
+	if ttl == -2 {
+		return false, nil
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	args := redis.Args{key, ttl, payload}
+	if replace {
+		args = args.Add("REPLACE")
+	}
+	_, err = dst.Do("RESTORE", args...)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "BUSYKEY") {
+			return false, nil
+		}
+		return false, newCommandError("RESTORE", key, err)
+	}
+	return true, nil
+}
+
+// copyBits - copies key's bits string after key itself was copied. Any bits
+// string already on dst belonged to the object key replaced, so it is
+// overwritten, or deleted when key has none on src.
+func copyBits(src, dst redis.Conn, key string) (err error) {
+	bits := bitsKey(key)
+	// a missing bits string reads as not copied
+	copied, err := copyKey(src, dst, bits, true)
+	if err != nil || copied {
+		return
+	}
+	if _, err = dst.Do("DEL", bits); err != nil {
+		err = newCommandError("DEL", bits, err)
+	}
+	return
+}
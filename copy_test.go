@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// dumpConn - a recordingConn answering DUMP/PTTL transactions from dumps,
+// where a key that is missing doesn't exist
+func dumpConn(dumps map[string]interface{}) *recordingConn {
+	rec := newRecordingConn(nil)
+	var key string
+	rec.reply = func(cmd string, args []interface{}) (interface{}, error) {
+		switch cmd {
+		case "DUMP":
+			key = argString(args[0])
+		case "EXEC":
+			if dump, ok := dumps[key]; ok {
+				return []interface{}{dump, int64(-1)}, nil
+			}
+			return []interface{}{nil, int64(-2)}, nil
+		case "MULTI":
+			return "OK", nil
+		}
+		return "QUEUED", nil
+	}
+	return rec
+}
+
+func TestCopyBits(t *testing.T) {
+	tests := []struct {
+		name  string
+		dumps map[string]interface{}
+		want  string
+	}{
+		{"copied", map[string]interface{}{"{k}:bits": []byte("b")}, "[RESTORE[{k}:bits 0 [98] REPLACE]]"},
+		// whatever is on the target belonged to the object k replaced
+		{"stale bits deleted", nil, "[DEL[{k}:bits]]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := newRecordingConn(nil)
+			if err := copyBits(dumpConn(tt.dumps), dst, "k"); err != nil {
+				t.Fatal(err)
+			}
+			var sent []string
+			for _, c := range dst.commands() {
+				sent = append(sent, fmt.Sprint(c.Cmd, c.Args))
+			}
+			if got := fmt.Sprint(sent); got != tt.want {
+				t.Errorf("sent %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyKeyExecError(t *testing.T) {
+	// DUMP failing, then PTTL
+	for _, replies := range [][]interface{}{{wrongType, int64(-1)}, {[]byte("v"), wrongType}} {
+		src := newRecordingConn(nil)
+		src.reply = func(cmd string, args []interface{}) (interface{}, error) {
+			if cmd == "EXEC" {
+				return replies, nil
+			}
+			return "QUEUED", nil
+		}
+		dst := newRecordingConn(nil)
+		_, err := copyKey(src, dst, "k", true)
+		checkExecFailed(t, err)
+		if n := len(dst.commands()); n != 0 {
+			t.Errorf("sent %d commands to the target", n)
+		}
+	}
+}
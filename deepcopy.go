@@ -0,0 +1,83 @@
+package main
+
+import "reflect"
+
+// deepCopy - a copy of v sharing no pointers, slices, maps or interface
+// values with it, so either can be changed without the other seeing it.
+// Pointers that alias, or cycle, alias and cycle the same way in the copy.
+// Unexported fields can't be set through reflect and are copied as they
+// are; whatever they point to stays shared.
+func deepCopy(v reflect.Value) reflect.Value {
+	return copyValue(v, make(map[copiedPtr]reflect.Value))
+}
+
+// copiedPtr - a pointer already copied; the type tells a struct apart from
+// its first field, which has the same address
+type copiedPtr struct {
+	p uintptr
+	t reflect.Type
+}
+
+func copyValue(v reflect.Value, seen map[copiedPtr]reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		k := copiedPtr{v.Pointer(), v.Type()}
+		if c, ok := seen[k]; ok {
+			return c
+		}
+		c := reflect.New(v.Type().Elem())
+		seen[k] = c
+		c.Elem().Set(copyValue(v.Elem(), seen))
+		return c
+
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		for i := 0; i < c.NumField(); i++ {
+			if f := c.Field(i); f.CanSet() {
+				f.Set(copyValue(v.Field(i), seen))
+			}
+		}
+		return c
+
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyValue(v.Index(i), seen))
+		}
+		return c
+
+	case reflect.Array:
+		c := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyValue(v.Index(i), seen))
+		}
+		return c
+
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			c.SetMapIndex(copyValue(iter.Key(), seen), copyValue(iter.Value(), seen))
+		}
+		return c
+
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(copyValue(v.Elem(), seen))
+		return c
+	}
+	return v
+}
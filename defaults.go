@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// fieldDefault - a field's `default:"..."` tag as JSON: the text itself,
+// quoted, for string fields, and parsed as JSON for anything else
+// (`default:"3"`, `default:"true"`, `default:"[\"a\"]"`). The field's json
+// and redis tags can't be omitempty (see omitsZero).
+func fieldDefault(f reflect.StructField) (raw json.RawMessage, ok bool) {
+	text, ok := f.Tag.Lookup("default")
+	if !ok {
+		return nil, false
+	}
+	t := f.Type
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.String {
+		raw, _ = json.Marshal(text)
+		return raw, true
+	}
+	return json.RawMessage(text), true
+}
+
+// omitsZero - whether f's tag (json, or redis for the hash modes) leaves
+// its zero value out. Such a field can't have a default: one missing may
+// hold a zero that was written, which the default would replace.
+func omitsZero(f reflect.StructField, tag string) bool {
+	for _, opt := range strings.Split(f.Tag.Get(tag), ",")[1:] {
+		if opt == "omitempty" || opt == "omitzero" {
+			return true
+		}
+	}
+	return false
+}
+
+// buildDefaults - the defaults of struct type t's fields by JSON name, or
+// an error if any sits on an omitempty field
+func buildDefaults(t reflect.Type, fields map[string]reflect.StructField) (defaults map[string]json.RawMessage, err error) {
+	for name, f := range fields {
+		raw, ok := fieldDefault(f)
+		if !ok {
+			continue
+		}
+		if omitsZero(f, "json") || omitsZero(f, "redis") {
+			return nil, fmt.Errorf("%w: %s.%s: default on an omitempty field", ErrUnsupportedType, t.Name(), f.Name)
+		}
+		if defaults == nil {
+			defaults = make(map[string]json.RawMessage)
+		}
+		defaults[name] = raw
+	}
+	return
+}
+
+// fillDefaults - adds the default of every defaulted field missing from
+// doc, at any depth. Only objects that are there are filled: a missing
+// nested struct stays missing.
+func fillDefaults(doc interface{}, t reflect.Type) (err error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		switch t.Kind() {
+		case reflect.Struct:
+			info := structInfoOf(t)
+			if info.defaultsErr != nil {
+				return info.defaultsErr
+			}
+			fields := jsonFields(t)
+			for name, raw := range info.defaults {
+				if _, ok := d[name]; ok {
+					continue
+				}
+				var v interface{}
+				err = json.Unmarshal(raw, &v)
+				if err != nil {
+					return fmt.Errorf("%s.%s: bad default %s: %w", t.Name(), name, raw, err)
+				}
+				d[name] = v
+			}
+			for name, v := range d {
+				if f, ok := fields[name]; ok {
+					if err = fillDefaults(v, f.Type); err != nil {
+						return
+					}
+				}
+			}
+		case reflect.Map:
+			for _, v := range d {
+				if err = fillDefaults(v, t.Elem()); err != nil {
+					return
+				}
+			}
+		}
+	case []interface{}:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for _, v := range d {
+				if err = fillDefaults(v, t.Elem()); err != nil {
+					return
+				}
+			}
+		}
+	}
+	return
+}
+
+// applyHashDefaults - sets the defaulted fields of dest (a pointer to a
+// struct) that HGETALL's src didn't return
+func applyHashDefaults(src []interface{}, dest reflect.Value) (err error) {
+	t := dest.Elem().Type()
+	info := structInfoOf(t)
+	if info.defaults == nil {
+		return info.defaultsErr
+	}
+
+	present := make(map[string]bool, len(src)/2)
+	for i := 0; i+1 < len(src); i += 2 {
+		present[argString(src[i])] = true
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		raw, ok := fieldDefault(f)
+		if !ok || f.PkgPath != "" {
+			continue
+		}
+		name := info.tags[i].Name
+		if name == "" {
+			name = f.Name
+		}
+		if present[name] {
+			continue
+		}
+		err = json.Unmarshal(raw, dest.Elem().Field(i).Addr().Interface())
+		if err != nil {
+			return fmt.Errorf("%s.%s: bad default %s: %w", t.Name(), f.Name, raw, err)
+		}
+	}
+	return
+}
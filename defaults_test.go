@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+type defaultsDoc struct {
+	Plain   int    `json:"plain" redis:"plain" default:"3"`
+	Omitted int    `json:"omitted,omitempty" redis:"omitted,omitempty"`
+	Name    string `json:"name" redis:"name" default:"anon"`
+}
+
+func TestDefaultsRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		value defaultsDoc
+	}{
+		{"zero values", defaultsDoc{}},
+		{"set values", defaultsDoc{Plain: 1, Omitted: 2, Name: "x"}},
+		{"zero omitempty values", defaultsDoc{Plain: 7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"/json", func(t *testing.T) {
+			b, err := json.Marshal(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got defaultsDoc
+			if err = unmarshalStruct(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.value {
+				t.Errorf("read back %+v, want %+v", got, tt.value)
+			}
+		})
+		t.Run(tt.name+"/hash", func(t *testing.T) {
+			var got defaultsDoc
+			if err := scanStruct(hashOf(tt.value), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.value {
+				t.Errorf("read back %+v, want %+v", got, tt.value)
+			}
+		})
+	}
+}
+
+func TestDefaultsFillMissing(t *testing.T) {
+	want := defaultsDoc{Plain: 3, Name: "anon"}
+
+	var got defaultsDoc
+	if err := unmarshalStruct([]byte(`{}`), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("json: got %+v, want %+v", got, want)
+	}
+
+	got = defaultsDoc{}
+	if err := scanStruct(nil, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("hash: got %+v, want %+v", got, want)
+	}
+}
+
+func TestDefaultsOnOmitempty(t *testing.T) {
+	var jsonDoc struct {
+		N int `json:"n,omitempty" redis:"n" default:"5"`
+	}
+	var hashDoc struct {
+		N int `json:"n" redis:"n,omitempty" default:"5"`
+	}
+
+	// either tag rules the default out, in every mode
+	for _, dest := range []interface{}{&jsonDoc, &hashDoc} {
+		if err := unmarshalStruct([]byte(`{}`), dest); !errors.Is(err, ErrUnsupportedType) {
+			t.Errorf("json %T: got %v, want ErrUnsupportedType", dest, err)
+		}
+		if err := scanStruct(nil, dest); !errors.Is(err, ErrUnsupportedType) {
+			t.Errorf("hash %T: got %v, want ErrUnsupportedType", dest, err)
+		}
+	}
+}
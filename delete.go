@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// deleteOptions - what deleteStruct removes besides the key itself
+type deleteOptions struct {
+	// Type - registered type of the document, needed with Cascade, and to
+	// delete the string its bits fields are packed in (bitfield.go)
+	Type string
+	// Cascade - also delete the objects its Ref fields tagged
+	// `redis:"...,owns"` point to, and what those own in turn
+	Cascade bool
+}
+
+// deleteStruct - deletes key (and its bits string, given opts.Type) and,
+// with opts.Cascade, every object it owns, in one WATCHed MULTI/EXEC so a
+// concurrent writer re-pointing a reference makes it start over rather
+// than orphan or wrongly delete a child. Search
+// indexes (RediSearch 2 and later) follow the keyspace, so the deleted
+// documents leave them with the DEL. deleted counts the keys removed.
+func deleteStruct(ctx context.Context, conn redis.Conn, key string, opts deleteOptions) (deleted int, err error) {
+	var typ reflect.Type
+	if opts.Cascade || opts.Type != "" {
+		var ok bool
+		typ, ok = registeredTypes[opts.Type]
+		if !ok {
+			return 0, fmt.Errorf("unknown type %q (registered: %v)", opts.Type, registeredNames())
+		}
+	}
+
+	for attempt := 0; attempt < modifyAttempts; attempt++ {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		deleted, err = deleteOnce(ctx, conn, key, typ, opts.Cascade)
+		if err != errBatchConflict {
+			return
+		}
+	}
+	return 0, newCommandError("EXEC", key, errModifyConflict)
+}
+
+func deleteOnce(ctx context.Context, conn redis.Conn, key string, typ reflect.Type, cascade bool) (deleted int, err error) {
+	_, err = doContext(ctx, conn, "WATCH", key)
+	if err != nil {
+		return 0, newCommandError("WATCH", key, err)
+	}
+	defer conn.Do("UNWATCH")
+
+	keys := withBitsKey(nil, key, typ)
+	if cascade {
+		seen := map[string]bool{key: true}
+		err = collectOwned(ctx, conn, key, typ, seen, &keys)
+		if err != nil {
+			return
+		}
+	}
+
+	m := newMultiExec(conn)
+	m.send("DEL", redis.Args{}.AddFlat(keys)...)
+	replies, err := m.exec(ctx)
+	if err != nil {
+		return 0, newCommandError("DEL", key, err)
+	}
+	if replies == nil {
+		return 0, errBatchConflict
+	}
+	deleted, err = redis.Int(replies[0], nil)
+	if err != nil {
+		return 0, newCommandError("DEL", key, err)
+	}
+	return
+}
+
+// withBitsKey - keys with key appended, and the bits string of key if typ
+// has bits fields
+func withBitsKey(keys []string, key string, typ reflect.Type) []string {
+	keys = append(keys, key)
+	if bits, _ := bitFieldsOf(typ); len(bits) > 0 {
+		keys = append(keys, bitsKey(key))
+	}
+	return keys
+}
+
+// collectOwned - WATCHes and appends to keys everything the document at
+// key, of type typ, owns, depth first. A document that no longer exists
+// owns nothing.
+func collectOwned(ctx context.Context, conn redis.Conn, key string, typ reflect.Type, seen map[string]bool, keys *[]string) (err error) {
+	mode, err := detectStorageMode(conn, key)
+	if errors.Is(err, redis.ErrNil) || err == errUnknownMode {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	v := reflect.New(typ)
+	err = getStruct(conn, mode, key, v.Interface())
+	if err != nil {
+		return
+	}
+
+	for _, ref := range ownedRefs(v.Elem()) {
+		child := ref.refKey()
+		if child == "" || seen[child] {
+			continue
+		}
+		seen[child] = true
+		_, err = doContext(ctx, conn, "WATCH", child)
+		if err != nil {
+			return newCommandError("WATCH", child, err)
+		}
+		*keys = withBitsKey(*keys, child, ref.refType())
+		err = collectOwned(ctx, conn, child, ref.refType(), seen, keys)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// ownedRefs - the Refs in v held by fields tagged owns, at any depth of
+// nested structs and slices (but not through other Refs)
+func ownedRefs(v reflect.Value) (refs []refLoader) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			refs = ownedRefs(v.Elem())
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			refs = append(refs, ownedRefs(v.Index(i))...)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		if !tagUseOf(t).owns {
+			return
+		}
+		info := structInfoOf(t)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			fv := v.Field(i)
+			if !fv.CanAddr() {
+				continue
+			}
+			if ref, ok := fv.Addr().Interface().(refLoader); ok {
+				if info.tags[i].has("owns") {
+					refs = append(refs, ref)
+				}
+				continue
+			}
+			if info.tags[i].has("owns") {
+				// owns on a slice of Refs
+				refs = append(refs, refsIn(fv)...)
+				continue
+			}
+			refs = append(refs, ownedRefs(fv)...)
+		}
+	}
+	return
+}
+
+// refsIn - every Ref directly in v, a slice, array or pointer
+func refsIn(v reflect.Value) (refs []refLoader) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			refs = refsIn(v.Elem())
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			refs = append(refs, refsIn(v.Index(i))...)
+		}
+	case reflect.Struct:
+		if v.CanAddr() {
+			if ref, ok := v.Addr().Interface().(refLoader); ok {
+				refs = append(refs, ref)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDeleteStructExecError(t *testing.T) {
+	_, err := deleteStruct(context.Background(), failingExecConn(), "k", deleteOptions{})
+	checkExecFailed(t, err)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// keyDiff - one key that differs between two instances
+type keyDiff struct {
+	Key string
+	// Missing - the key exists only in the source; Extra - only in the target
+	Missing, Extra bool
+	Fields         []fieldDiff
+}
+
+// fieldDiff - a dotted path whose value differs; absent values are ""
+type fieldDiff struct {
+	Path           string
+	Source, Target string
+}
+
+// diffInstances - compares every document matching pattern on source with
+// the one under the same key on target, calling fn for each key that
+// differs. Documents are compared decoded and flattened, so a key stored in
+// different modes on either side (say, mid-migration) only differs if its
+// values do. It returns how many keys were compared.
+func diffInstances(ctx context.Context, source, target redis.Conn, pattern string, fn func(d keyDiff) error) (n int, err error) {
+	err = scanKeys(ctx, source, pattern, func(key string) (err error) {
+		src, err := flatDocument(source, key)
+		if err == errUnknownMode || errors.Is(err, redis.ErrNil) {
+			return nil
+		}
+		if err != nil {
+			return
+		}
+		n++
+
+		dst, err := flatDocument(target, key)
+		if errors.Is(err, redis.ErrNil) {
+			return fn(keyDiff{Key: key, Missing: true})
+		}
+		if err != nil && err != errUnknownMode {
+			return
+		}
+
+		d := keyDiff{Key: key, Fields: diffFlat(src, dst)}
+		if len(d.Fields) == 0 {
+			return nil
+		}
+		return fn(d)
+	})
+	if err != nil {
+		return
+	}
+
+	err = scanKeys(ctx, target, pattern, func(key string) (err error) {
+		exists, err := redis.Bool(source.Do("EXISTS", key))
+		if err != nil {
+			return newCommandError("EXISTS", key, err)
+		}
+		if exists {
+			return nil
+		}
+		n++
+		return fn(keyDiff{Key: key, Extra: true})
+	})
+	return
+}
+
+// flatDocument - key read in whatever mode it is stored in, flattened.
+// Hash fields holding JSON text are decoded first so they compare equal to
+// the same value stored natively.
+func flatDocument(conn redis.Conn, key string) (flat map[string]string, err error) {
+	mode, err := detectStorageMode(conn, key)
+	if err != nil {
+		return
+	}
+	raw, err := getRaw(conn, mode, key)
+	if err != nil {
+		return
+	}
+
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	err = dec.Decode(&doc)
+	if err != nil {
+		return
+	}
+	if mode == modeHash {
+		doc = typedHashFields(doc)
+	}
+
+	flat = make(map[string]string)
+	flattenValue("", doc, flat)
+	return
+}
+
+// diffFlat - paths whose values differ between two flattened documents
+func diffFlat(src, dst map[string]string) (diffs []fieldDiff) {
+	paths := sortedKeys(src)
+	for _, p := range sortedKeys(dst) {
+		if _, ok := src[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+
+	for _, p := range paths {
+		s, sok := src[p]
+		d, dok := dst[p]
+		if sok != dok || s != d {
+			diffs = append(diffs, fieldDiff{Path: p, Source: s, Target: d})
+		}
+	}
+	return
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// readCommands - commands that don't modify data: reads, and connection,
+// transaction and pub/sub control. A command with subcommands that differ
+// is listed as "CMD SUB" ("CONFIG GET", but not CONFIG SET). Anything not
+// listed counts as a write, so a command this package learns to issue is
+// held back by a dry run until it is known to be safe.
+var readCommands = map[string]bool{
+	// Do("") flushes and reads pending replies
+	"": true,
+
+	"GET": true, "MGET": true, "GETRANGE": true, "STRLEN": true, "GETBIT": true,
+	"BITCOUNT": true, "BITPOS": true, "BITFIELD_RO": true,
+	"HGET": true, "HMGET": true, "HGETALL": true, "HKEYS": true, "HVALS": true,
+	"HLEN": true, "HEXISTS": true, "HSTRLEN": true, "HRANDFIELD": true, "HSCAN": true,
+	"LRANGE": true, "LLEN": true, "LINDEX": true, "LPOS": true,
+	"SMEMBERS": true, "SISMEMBER": true, "SMISMEMBER": true, "SCARD": true,
+	"SRANDMEMBER": true, "SSCAN": true, "SINTER": true, "SUNION": true, "SDIFF": true,
+	"ZRANGE": true, "ZRANGEBYSCORE": true, "ZREVRANGE": true, "ZCARD": true,
+	"ZSCORE": true, "ZRANK": true, "ZCOUNT": true, "ZSCAN": true,
+	"XRANGE": true, "XREVRANGE": true, "XLEN": true, "XREAD": true, "XINFO": true,
+	"PFCOUNT": true, "GEOPOS": true, "GEODIST": true, "GEOSEARCH": true,
+	"EXISTS": true, "TYPE": true, "TTL": true, "PTTL": true, "EXPIRETIME": true,
+	"PEXPIRETIME": true, "DUMP": true, "OBJECT": true, "MEMORY": true,
+	"SCAN": true, "KEYS": true, "RANDOMKEY": true, "DBSIZE": true, "SORT_RO": true,
+	"EVAL_RO": true, "EVALSHA_RO": true, "FCALL_RO": true,
+	"SCRIPT EXISTS": true, "FUNCTION LIST": true, "FUNCTION DUMP": true,
+	"FUNCTION STATS": true,
+
+	"JSON.GET": true, "JSON.MGET": true, "JSON.TYPE": true, "JSON.OBJKEYS": true,
+	"JSON.OBJLEN": true, "JSON.ARRLEN": true, "JSON.ARRINDEX": true,
+	"JSON.STRLEN": true, "JSON.RESP": true, "JSON.DEBUG": true,
+	"FT.SEARCH": true, "FT.AGGREGATE": true, "FT.INFO": true, "FT._LIST": true,
+	"FT.EXPLAIN": true, "FT.PROFILE": true,
+
+	"PING": true, "ECHO": true, "AUTH": true, "HELLO": true, "SELECT": true,
+	"CLIENT": true, "QUIT": true, "RESET": true, "READONLY": true, "READWRITE": true,
+	"INFO": true, "TIME": true, "ROLE": true, "LASTSAVE": true, "COMMAND": true,
+	"SLOWLOG": true, "LATENCY": true, "CLUSTER": true, "CONFIG GET": true, "MODULE LIST": true,
+	"WAIT": true, "MULTI": true, "EXEC": true, "DISCARD": true, "WATCH": true, "UNWATCH": true,
+	"SUBSCRIBE": true, "PSUBSCRIBE": true, "UNSUBSCRIBE": true,
+	"PUNSUBSCRIBE": true, "PUBSUB": true,
+}
+
+// writeReplies - the reply a real server gives on success to writes whose
+// reply isn't OK
+var writeReplies = map[string]interface{}{
+	"SETNX":          int64(1),
+	"DEL":            int64(1),
+	"UNLINK":         int64(1),
+	"HSET":           int64(1),
+	"HDEL":           int64(1),
+	"HINCRBY":        int64(1),
+	"INCR":           int64(1),
+	"INCRBY":         int64(1),
+	"DECR":           int64(0),
+	"EXPIRE":         int64(1),
+	"PEXPIRE":        int64(1),
+	"PERSIST":        int64(1),
+	"RPUSH":          int64(1),
+	"LPUSH":          int64(1),
+	"SADD":           int64(1),
+	"SREM":           int64(1),
+	"ZADD":           int64(1),
+	"PUBLISH":        int64(0),
+	"XADD":           "0-1",
+	"BITFIELD":       []interface{}{int64(0)},
+	"JSON.DEL":       int64(1),
+	"JSON.FORGET":    int64(1),
+	"JSON.NUMINCRBY": "0",
+	"JSON.ARRAPPEND": int64(1),
+	"JSON.ARRTRIM":   int64(0),
+	// scripts and functions reply with whatever they return
+	"EVAL":          nil,
+	"EVALSHA":       nil,
+	"FCALL":         nil,
+	"SCRIPT LOAD":   "",
+	"FUNCTION LOAD": "",
+}
+
+// commandName - cmd upper cased, with its subcommand (the first of args)
+// when readCommands or writeReplies tell that one apart. INFO
+// commandstats' config|get form is understood too.
+func commandName(cmd string, args []interface{}) string {
+	name := strings.ToUpper(strings.Replace(cmd, "|", " ", 1))
+	if len(args) == 0 || strings.Contains(name, " ") {
+		return name
+	}
+	sub := name + " " + strings.ToUpper(argString(args[0]))
+	if _, ok := writeReplies[sub]; ok || readCommands[sub] {
+		return sub
+	}
+	return name
+}
+
+// isWriteCommand - whether cmd, with args if at hand, may modify data:
+// anything that isn't known to be a read
+func isWriteCommand(cmd string, args ...interface{}) bool {
+	name := commandName(cmd, args)
+	if readCommands[name] {
+		return false
+	}
+	if i := strings.IndexByte(name, ' '); i >= 0 && readCommands[name[:i]] {
+		// CLIENT LIST and the like
+		return false
+	}
+	return true
+}
+
+// writeReply - the reply a successful cmd would get: nil for reads, OK for
+// writes not in writeReplies
+func writeReply(cmd string, args []interface{}) interface{} {
+	if !isWriteCommand(cmd, args...) {
+		return nil
+	}
+	if reply, ok := writeReplies[commandName(cmd, args)]; ok {
+		return reply
+	}
+	return "OK"
+}
+
+// dryRunConn - redis.Conn that prints every write command, as it would be
+// typed into redis-cli, instead of executing it, and answers with the reply
+// a successful write would get. Reads still go to the wrapped connection so
+// that read-then-write jobs (migrations, bulk updates) render realistically.
+type dryRunConn struct {
+	redis.Conn
+	w io.Writer
+
+	// one entry per Send: a synthesized reply, or realReply when the
+	// command was forwarded
+	queued []interface{}
+}
+
+type realReplyMarker struct{}
+
+var realReply = realReplyMarker{}
+
+func newDryRunConn(conn redis.Conn, w io.Writer) *dryRunConn {
+	return &dryRunConn{Conn: conn, w: w}
+}
+
+func (c *dryRunConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if !isWriteCommand(cmd, args...) {
+		// Do reads every pending reply, real and synthesized alike
+		c.queued = nil
+		return c.Conn.Do(cmd, args...)
+	}
+	return c.render(cmd, args)
+}
+
+func (c *dryRunConn) Send(cmd string, args ...interface{}) (err error) {
+	if !isWriteCommand(cmd, args...) {
+		err = c.Conn.Send(cmd, args...)
+		if err == nil {
+			c.queued = append(c.queued, realReply)
+		}
+		return
+	}
+
+	reply, err := c.render(cmd, args)
+	if err == nil {
+		c.queued = append(c.queued, reply)
+	}
+	return
+}
+
+func (c *dryRunConn) Receive() (interface{}, error) {
+	if len(c.queued) == 0 {
+		return c.Conn.Receive()
+	}
+
+	reply := c.queued[0]
+	c.queued = c.queued[1:]
+	if reply == realReply {
+		return c.Conn.Receive()
+	}
+	return reply, nil
+}
+
+func (c *dryRunConn) render(cmd string, args []interface{}) (reply interface{}, err error) {
+	parts := make([]string, 0, len(args)+1)
+	parts = append(parts, strings.ToUpper(cmd))
+	for _, arg := range args {
+		parts = append(parts, quoteArg(arg))
+	}
+
+	_, err = fmt.Fprintln(c.w, strings.Join(parts, " "))
+	if err != nil {
+		return
+	}
+	return writeReply(cmd, args), nil
+}
+
+// quoteArg - formats arg the way it would be typed into redis-cli, single
+// quoting anything that isn't a plain word
+func quoteArg(arg interface{}) string {
+	var s string
+	switch v := arg.(type) {
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	default:
+		s = fmt.Sprint(v)
+	}
+
+	if s != "" && !strings.ContainsAny(s, " \t\r\n'\"\\{}[]") {
+		return s
+	}
+	if !strings.ContainsAny(s, "'\\\r\n\t") {
+		return "'" + s + "'"
+	}
+	return strconv.Quote(s)
+}
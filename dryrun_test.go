@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestIsWriteCommand(t *testing.T) {
+	tests := []struct {
+		cmd   string
+		args  []interface{}
+		write bool
+	}{
+		{"", nil, false},
+		{"GET", []interface{}{"k"}, false},
+		{"get", []interface{}{"k"}, false},
+		{"HGETALL", []interface{}{"k"}, false},
+		{"JSON.GET", []interface{}{"k", "."}, false},
+		{"SCAN", []interface{}{0}, false},
+		{"MULTI", nil, false},
+		{"EXEC", nil, false},
+		{"EVAL_RO", []interface{}{"return 1", 0}, false},
+		{"FCALL_RO", []interface{}{"f", 0}, false},
+		{"BITFIELD_RO", []interface{}{"k", "GET", "u4", 0}, false},
+		{"CONFIG", []interface{}{"GET", "maxmemory"}, false},
+		{"config|get", nil, false},
+		{"CLIENT", []interface{}{"LIST"}, false},
+		{"SCRIPT", []interface{}{"EXISTS", "sha"}, false},
+		{"FUNCTION", []interface{}{"list"}, false},
+
+		{"SET", []interface{}{"k", "v"}, true},
+		{"HMSET", []interface{}{"k", "f", "v"}, true},
+		{"JSON.SET", []interface{}{"k", ".", "{}"}, true},
+		{"DEL", []interface{}{"k"}, true},
+		{"BITFIELD", []interface{}{"k", "GET", "u4", 0}, true},
+		{"EVAL", []interface{}{"return 1", 0}, true},
+		{"EVALSHA", []interface{}{"sha", 0}, true},
+		{"FCALL", []interface{}{"f", 0}, true},
+		{"CONFIG", []interface{}{"SET", "maxmemory", "1"}, true},
+		{"config|set", nil, true},
+		{"SCRIPT", []interface{}{"LOAD", "return 1"}, true},
+		{"FUNCTION", []interface{}{"LOAD", "code"}, true},
+		{"FLUSHALL", nil, true},
+		// unknown commands are writes until listed
+		{"FOO.BAR", []interface{}{"k"}, true},
+	}
+	for _, tt := range tests {
+		if got := isWriteCommand(tt.cmd, tt.args...); got != tt.write {
+			t.Errorf("isWriteCommand(%q, %v) = %v, want %v", tt.cmd, tt.args, got, tt.write)
+		}
+	}
+}
+
+func TestWriteReply(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		args []interface{}
+		want interface{}
+	}{
+		{"GET", []interface{}{"k"}, nil},
+		{"SET", []interface{}{"k", "v"}, "OK"},
+		{"DEL", []interface{}{"k"}, int64(1)},
+		{"BITFIELD", []interface{}{"k"}, []interface{}{int64(0)}},
+		{"EVAL", []interface{}{"return 1", 0}, nil},
+		{"SCRIPT", []interface{}{"LOAD", "return 1"}, ""},
+		{"FOO.BAR", nil, "OK"},
+	}
+	for _, tt := range tests {
+		if got := writeReply(tt.cmd, tt.args); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("writeReply(%q, %v) = %#v, want %#v", tt.cmd, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestDryRunConn(t *testing.T) {
+	rec := newRecordingConn(nil)
+	rec.reply = func(cmd string, args []interface{}) (interface{}, error) {
+		return "real " + cmd, nil
+	}
+	var out bytes.Buffer
+	conn := newDryRunConn(rec, &out)
+
+	reply, err := conn.Do("SET", "k", "two words")
+	if err != nil || reply != "OK" {
+		t.Errorf("SET: got %v, %v", reply, err)
+	}
+	reply, err = conn.Do("GET", "k")
+	if err != nil || reply != "real GET" {
+		t.Errorf("GET: got %v, %v", reply, err)
+	}
+
+	// pipelined replies come back in order, real and synthesized alike
+	conn.Send("HGETALL", "k")
+	conn.Send("DEL", "k")
+	conn.Send("EVAL", "return 1", 0)
+	conn.Flush()
+	want := []interface{}{"real HGETALL", int64(1), nil}
+	for i, w := range want {
+		reply, err = conn.Receive()
+		if err != nil || !reflect.DeepEqual(reply, w) {
+			t.Errorf("reply %d: got %#v, %v, want %#v", i, reply, err, w)
+		}
+	}
+
+	if got := rec.count("SET") + rec.count("DEL") + rec.count("EVAL"); got != 0 {
+		t.Errorf("%d writes reached the server", got)
+	}
+	if rec.count("GET") != 1 || rec.count("HGETALL") != 1 {
+		t.Errorf("reads not forwarded: %v", rec.commands())
+	}
+	if got, want := out.String(), "SET k 'two words'\nDEL k\nEVAL 'return 1' 0\n"; got != want {
+		t.Errorf("printed %q, want %q", got, want)
+	}
+}
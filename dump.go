@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// keyDump - raw server-side view of a key, for working out why it doesn't
+// decode
+type keyDump struct {
+	Key      string
+	Type     string
+	Mode     string
+	Encoding string
+	// TTL - -1 when the key has no expiry
+	TTL time.Duration
+	// Memory - MEMORY USAGE, in bytes
+	Memory int64
+	// Size - bytes of the document as a client reads it
+	Size int64
+	// FieldNames - top-level field names (JSON.OBJKEYS or HKEYS)
+	FieldNames []string
+
+	// Fields - HGETALL pairs, for hashes
+	Fields map[string]string
+	// JSON - the JSON field of a hash-json key, or the indented JSON.GET of
+	// a ReJSON document
+	JSON string
+}
+
+// dumpKey - collects TYPE, TTL, OBJECT ENCODING and the raw stored value of
+// key, whatever storage mode it was written with
+func dumpKey(conn redis.Conn, key string) (d keyDump, err error) {
+	d.Key = key
+
+	d.Type, err = redis.String(conn.Do("TYPE", key))
+	if err != nil {
+		return d, newCommandError("TYPE", key, err)
+	}
+	if d.Type == "none" {
+		return d, newCommandError("TYPE", key, redis.ErrNil)
+	}
+
+	ttl, err := redis.Int64(conn.Do("PTTL", key))
+	if err != nil {
+		return d, newCommandError("PTTL", key, err)
+	}
+	d.TTL = -1
+	if ttl >= 0 {
+		d.TTL = time.Duration(ttl) * time.Millisecond
+	}
+
+	d.Encoding, err = redis.String(conn.Do("OBJECT", "ENCODING", key))
+	if err != nil {
+		return d, newCommandError("OBJECT ENCODING", key, err)
+	}
+
+	d.Memory, err = redis.Int64(conn.Do("MEMORY", "USAGE", key))
+	if err != nil {
+		return d, newCommandError("MEMORY USAGE", key, err)
+	}
+
+	mode, err := detectStorageMode(conn, key)
+	if err == errUnknownMode {
+		d.Mode = "unknown"
+		return d, nil
+	}
+	if err != nil {
+		return
+	}
+	d.Mode = mode.String()
+
+	d.Size, err = serializedSize(conn, mode, key)
+	if err != nil {
+		return
+	}
+
+	switch mode {
+	case modeHash, modeHashJSON:
+		d.Fields, err = redis.StringMap(conn.Do("HGETALL", key))
+		if err != nil {
+			return d, newCommandError("HGETALL", key, err)
+		}
+		d.JSON = d.Fields["JSON"]
+		if mode == modeHash {
+			d.FieldNames = sortedKeys(d.Fields)
+		} else {
+			var top map[string]json.RawMessage
+			if json.Unmarshal([]byte(d.JSON), &top) == nil {
+				for name := range top {
+					d.FieldNames = append(d.FieldNames, name)
+				}
+				sort.Strings(d.FieldNames)
+			}
+		}
+	case modeReJSON:
+		// OBJKEYS fails on documents that aren't objects; that's fine
+		d.FieldNames, _ = redis.Strings(conn.Do("JSON.OBJKEYS", key))
+		var raw []byte
+		raw, err = getPretty(conn, mode, key)
+		if err != nil {
+			return
+		}
+		d.JSON = string(raw)
+	}
+	return
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// hashValueField - the single field hash mode keeps a value that isn't a
+// JSON object in, as its JSON text (hash-json's JSON field, for scalars and
+// arrays)
+const hashValueField = "VALUE"
+
+// setValue - stores a schemaless value (map[string]interface{},
+// []interface{}, string, number, bool) under key in mode, for data no Go
+// struct describes yet. Hash mode flattens objects as setRaw does and keeps
+// anything else whole in hashValueField.
+func setValue(conn redis.Conn, mode storageMode, key string, v interface{}) (err error) {
+	cmd, args, err := valueCommand(mode, key, v)
+	if err != nil {
+		return
+	}
+	if mode == modeHash {
+		// a value replacing an object (or the other way round) must not
+		// leave old fields behind
+		m := newMultiExec(conn)
+		m.send("DEL", key)
+		m.send(cmd, args...)
+		_, err = m.exec(context.Background())
+	} else {
+		_, err = conn.Do(cmd, args...)
+	}
+	if err != nil {
+		return newCommandError(cmd, key, err)
+	}
+	return
+}
+
+// valueCommand - the command setValue issues (after a DEL in hash mode)
+func valueCommand(mode storageMode, key string, v interface{}) (cmd string, args redis.Args, err error) {
+	b, err := encodeJSON(v)
+	if err != nil {
+		return
+	}
+	defer b.release()
+
+	raw := b.bytes()
+	if mode == modeHash && !bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+		return "HSET", redis.Args{key, hashValueField, string(raw)}, nil
+	}
+	return rawCommand(mode, key, raw)
+}
+
+// getValue - reads key, stored in mode, as a schemaless value; numbers are
+// json.Numbers. Hash fields holding JSON other than a string come back
+// decoded, as typedHashFields does.
+func getValue(conn redis.Conn, mode storageMode, key string) (v interface{}, err error) {
+	raw, err := getRaw(conn, mode, key)
+	if err != nil {
+		return
+	}
+	v, err = decodeValue(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	if mode != modeHash {
+		return
+	}
+
+	fields := v.(map[string]interface{})
+	if s, ok := fields[hashValueField].(string); ok && len(fields) == 1 {
+		v, err = decodeValue([]byte(s))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", key, hashValueField, err)
+		}
+		return
+	}
+	return typedHashFields(fields), nil
+}
+
+func decodeValue(raw []byte) (v interface{}, err error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	err = dec.Decode(&v)
+	return
+}
+
+// getValuePath - the member of a schemaless value at path, dotted with
+// array indexes as numbers (tags.0, the form flattenJSON produces). ReJSON
+// documents are read with JSON.GET on just that path.
+func getValuePath(conn redis.Conn, mode storageMode, key, path string) (v interface{}, err error) {
+	if mode == modeReJSON {
+		var raw []byte
+		raw, err = redis.Bytes(conn.Do("JSON.GET", key, valuePath(path)))
+		if err != nil {
+			return nil, newCommandError("JSON.GET", key, err)
+		}
+		return decodeValue(raw)
+	}
+
+	v, err = getValue(conn, mode, key)
+	if err != nil {
+		return
+	}
+	for _, elem := range splitValuePath(path) {
+		v, err = valueMember(v, elem)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", key, path, err)
+		}
+	}
+	return
+}
+
+// setValuePath - sets the member at path (see getValuePath) to v. ReJSON
+// sets just that path; the other modes reread and rewrite the whole value
+// in a WATCHed transaction, as modifyStruct does. Objects along the path
+// must exist.
+func setValuePath(ctx context.Context, conn redis.Conn, mode storageMode, key, path string, v interface{}) (err error) {
+	if mode == modeReJSON {
+		var b *encodeBuffer
+		b, err = encodeJSON(v)
+		if err != nil {
+			return
+		}
+		_, err = doContext(ctx, conn, "JSON.SET", key, valuePath(path), b.bytes())
+		b.release()
+		if err != nil {
+			return newCommandError("JSON.SET", key, err)
+		}
+		return
+	}
+
+	elems := splitValuePath(path)
+	if len(elems) == 0 {
+		return setValue(conn, mode, key, v)
+	}
+	return modifyValue(ctx, conn, mode, key, func(doc interface{}) (interface{}, error) {
+		parent := doc
+		for _, elem := range elems[:len(elems)-1] {
+			var err error
+			parent, err = valueMember(parent, elem)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", key, path, err)
+			}
+		}
+
+		last := elems[len(elems)-1]
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			p[last] = v
+		case []interface{}:
+			i, err := strconv.Atoi(last)
+			if err != nil || i < 0 || i >= len(p) {
+				return nil, fmt.Errorf("%s: %s: no element %s", key, path, last)
+			}
+			p[i] = v
+		default:
+			return nil, fmt.Errorf("%s: %s: parent is a %T", key, path, parent)
+		}
+		return doc, nil
+	})
+}
+
+// modifyValue - modifyStruct for schemaless values: fn returns the value
+// to store in place of doc
+func modifyValue(ctx context.Context, conn redis.Conn, mode storageMode, key string, fn func(doc interface{}) (interface{}, error)) (err error) {
+	for attempt := 0; attempt < modifyAttempts; attempt++ {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+
+		var done bool
+		done, err = modifyValueOnce(ctx, conn, mode, key, fn)
+		if err != nil || done {
+			return
+		}
+	}
+	return newCommandError("EXEC", key, errModifyConflict)
+}
+
+func modifyValueOnce(ctx context.Context, conn redis.Conn, mode storageMode, key string, fn func(doc interface{}) (interface{}, error)) (done bool, err error) {
+	_, err = doContext(ctx, conn, "WATCH", key)
+	if err != nil {
+		return false, newCommandError("WATCH", key, err)
+	}
+	defer conn.Do("UNWATCH")
+
+	doc, err := getValue(conn, mode, key)
+	if err != nil {
+		return
+	}
+	doc, err = fn(doc)
+	if err != nil {
+		return
+	}
+	cmd, args, err := valueCommand(mode, key, doc)
+	if err != nil {
+		return
+	}
+
+	m := newMultiExec(conn)
+	if mode == modeHash {
+		m.send("DEL", key)
+	}
+	m.send(cmd, args...)
+	replies, err := m.exec(ctx)
+	if err != nil {
+		return false, newCommandError(cmd, key, err)
+	}
+	return replies != nil, nil
+}
+
+func splitValuePath(path string) []string {
+	path = strings.Trim(path, ".")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, ".")
+}
+
+// valuePath - path as a legacy ReJSON path, numbers selecting array
+// elements
+func valuePath(path string) string {
+	elems := splitValuePath(path)
+	if len(elems) == 0 {
+		return "."
+	}
+	var b strings.Builder
+	for _, elem := range elems {
+		if _, err := strconv.Atoi(elem); err == nil {
+			b.WriteString("[" + elem + "]")
+			continue
+		}
+		b.WriteString(pathElem(elem))
+	}
+	return b.String()
+}
+
+// valueMember - the member or element of v named elem
+func valueMember(v interface{}, elem string) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m, ok := v[elem]
+		if !ok {
+			return nil, fmt.Errorf("no member %q", elem)
+		}
+		return m, nil
+	case []interface{}:
+		i, err := strconv.Atoi(elem)
+		if err != nil || i < 0 || i >= len(v) {
+			return nil, fmt.Errorf("no element %s", elem)
+		}
+		return v[i], nil
+	}
+	return nil, fmt.Errorf("%q: not an object or array", elem)
+}
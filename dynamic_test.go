@@ -0,0 +1,7 @@
+package main
+
+import "testing"
+
+func TestSetValueExecError(t *testing.T) {
+	checkExecFailed(t, setValue(failingExecConn(), modeHash, "k", map[string]interface{}{"a": 1}))
+}
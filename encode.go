@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+)
+
+// maxPooledBuffer - encode buffers that grew beyond this are dropped rather
+// than pooled, so one huge document doesn't pin its memory forever
+const maxPooledBuffer = 64 << 10
+
+// encodeBuffer - reusable scratch space, and an encoder writing into it, for
+// JSON encoded on the way to redis. json.Marshal allocates a fresh result
+// per call (and callers a string copy of it on top); on hot paths that
+// garbage dominates.
+type encodeBuffer struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+var encodeBuffers = sync.Pool{
+	New: func() interface{} {
+		b := &encodeBuffer{}
+		b.enc = json.NewEncoder(&b.buf)
+		return b
+	},
+}
+
+// encodeJSON - value as json.Marshal would encode it, in a pooled buffer.
+// Pass b.bytes() straight to a command and call b.release once it has been
+// sent (Do or Send returned); the bytes are reused afterwards. b is nil when
+// err isn't.
+func encodeJSON(value interface{}) (b *encodeBuffer, err error) {
+	b = encodeBuffers.Get().(*encodeBuffer)
+	err = b.enc.Encode(value)
+	if err != nil {
+		b.release()
+		return nil, encodeError(err)
+	}
+	return
+}
+
+// bytes - the encoded JSON, without the newline json.Encoder ends it with
+func (b *encodeBuffer) bytes() []byte {
+	return bytes.TrimSuffix(b.buf.Bytes(), []byte("\n"))
+}
+
+func (b *encodeBuffer) release() {
+	if b.buf.Cap() > maxPooledBuffer {
+		return
+	}
+	b.buf.Reset()
+	encodeBuffers.Put(b)
+}
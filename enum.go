@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ErrInvalidEnum - a field tagged `redis:"...,enum=A|B"` holds another value
+var ErrInvalidEnum = errors.New("value not in enum")
+
+// enumPolicy - what reads do with a stored value outside its field's enum
+type enumPolicy int
+
+const (
+	// enumAccept - decode it as it is
+	enumAccept enumPolicy = iota
+	// enumReject - fail the read with ErrInvalidEnum
+	enumReject
+	// enumFallback - replace it with the field's default tag, or its zero
+	// value
+	enumFallback
+)
+
+// enumOnDecode - how getStruct treats out-of-enum values it reads. Writes
+// always reject them.
+var enumOnDecode = enumAccept
+
+// fieldEnum - the values a field's enum option allows, parsed from its
+// tag. Use the copy structInfo keeps instead, see structInfoOf.
+func fieldEnum(f reflect.StructField) (values []string, ok bool) {
+	list, ok := parseFieldTag(f).value("enum")
+	if !ok {
+		return nil, false
+	}
+	return strings.Split(list, "|"), true
+}
+
+// checkEnums - ErrInvalidEnum, naming the field, if any enum field of v
+// (a struct, or anything holding structs) holds a value outside its enum.
+// The empty string passes, as a field that isn't set. With fallback, such
+// fields are reset to their default instead, and no error is returned.
+func checkEnums(v interface{}, fallback bool) error {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || !tagUseOf(rv.Type()).enum {
+		return nil
+	}
+	return walkEnums(rv, "", fallback)
+}
+
+func walkEnums(v reflect.Value, path string, fallback bool) (err error) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			return walkEnums(v.Elem(), path, fallback)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err = walkEnums(v.Index(i), fmt.Sprintf("%s[%d]", path, i), fallback); err != nil {
+				return
+			}
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			e := reflect.New(v.Type().Elem()).Elem()
+			e.Set(v.MapIndex(k))
+			if err = walkEnums(e, fmt.Sprintf("%s[%v]", path, k), fallback); err != nil {
+				return
+			}
+			if fallback {
+				v.SetMapIndex(k, e)
+			}
+		}
+	case reflect.Struct:
+		t := v.Type()
+		if !tagUseOf(t).enum {
+			return
+		}
+		info := structInfoOf(t)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			fv := v.Field(i)
+			fpath := joinPath(path, f.Name)
+
+			values := info.enums[i]
+			if values == nil {
+				if err = walkEnums(fv, fpath, fallback); err != nil {
+					return
+				}
+				continue
+			}
+			if inEnum(fv, values) {
+				continue
+			}
+			if !fallback || !fv.CanSet() {
+				return fmt.Errorf("%s %q: %w %s", fpath, fmt.Sprint(fv.Interface()), ErrInvalidEnum, strings.Join(values, "|"))
+			}
+			fv.Set(reflect.Zero(f.Type))
+			if raw, ok := fieldDefault(f); ok {
+				err = unmarshalStruct(raw, fv.Addr().Interface())
+				if err != nil {
+					return fmt.Errorf("%s: bad default %s: %w", fpath, raw, err)
+				}
+			}
+		}
+	}
+	return
+}
+
+func inEnum(v reflect.Value, values []string) bool {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return true
+		}
+		v = v.Elem()
+	}
+	s := fmt.Sprint(v.Interface())
+	if v.Kind() == reflect.String && s == "" {
+		return true
+	}
+	for _, allowed := range values {
+		if s == allowed {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// ErrUnsupportedType - the value can't be stored or decoded in the chosen
+// storage mode (e.g. channels, funcs, or redis tags redigo can't flatten)
+var ErrUnsupportedType = errors.New("unsupported type")
+
+// commandError - a failed redis command and the key it was issued for
+type commandError struct {
+	Cmd string
+	Key string
+	Err error
+}
+
+func (e *commandError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Cmd, e.Key, e.Err)
+}
+
+func (e *commandError) Unwrap() error {
+	return e.Err
+}
+
+func newCommandError(cmd, key string, err error) error {
+	return &commandError{Cmd: cmd, Key: key, Err: err}
+}
+
+// multiExec - commands queued for one MULTI/EXEC, keeping the first Send
+// that fails
+type multiExec struct {
+	conn redis.Conn
+	err  error
+}
+
+// newMultiExec - sends MULTI on conn
+func newMultiExec(conn redis.Conn) *multiExec {
+	m := &multiExec{conn: conn}
+	m.send("MULTI")
+	return m
+}
+
+// send - queues cmd, unless an earlier Send failed
+func (m *multiExec) send(cmd string, args ...interface{}) {
+	if m.err == nil {
+		m.err = m.conn.Send(cmd, args...)
+	}
+}
+
+// exec - sends EXEC, returning the queued commands' replies. Nil replies
+// and err mean a WATCHed key changed and nothing ran.
+func (m *multiExec) exec(ctx context.Context) (replies []interface{}, err error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	reply, err := doContext(ctx, m.conn, "EXEC")
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	replies, err = redis.Values(reply, nil)
+	if err != nil {
+		return
+	}
+	return replies, execError(replies)
+}
+
+// execError - the first error reply among EXEC's replies. redigo hands a
+// queued command's failure, like WRONGTYPE, back as an element of EXEC's
+// array rather than as its error, so without this it passes for success.
+func execError(replies []interface{}) error {
+	for _, r := range replies {
+		if err, ok := r.(redis.Error); ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverUnsupported - deferred by anything that reflects over caller
+// supplied values; turns a panic into ErrUnsupportedType instead of taking
+// the process down
+func recoverUnsupported(err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("%w: %v", ErrUnsupportedType, r)
+	}
+}
+
+// encodeError - classifies a json.Marshal failure
+func encodeError(err error) error {
+	var ute *json.UnsupportedTypeError
+	var uve *json.UnsupportedValueError
+	if errors.As(err, &ute) || errors.As(err, &uve) {
+		return fmt.Errorf("%w: %v", ErrUnsupportedType, err)
+	}
+	return err
+}
+
+// transientPrefixes - error replies that clear up on their own: the server
+// is still loading its dataset, a replica was written to during failover, a
+// script is hogging the server, or the cluster is resharding. MOVED and ASK
+// are not among them: they name another node, so sending the command to
+// the same one again can never succeed.
+var transientPrefixes = []string{
+	"LOADING",
+	"READONLY",
+	"BUSY",
+	"TRYAGAIN",
+	"CLUSTERDOWN",
+	"MASTERDOWN",
+}
+
+// IsTransient - reports whether the operation that failed with err may
+// succeed if retried. Network failures, timeouts, an exhausted pool and the
+// error replies in transientPrefixes are transient. Everything else,
+// including OOM (retrying straight away won't free any memory), WRONGTYPE
+// and redis.ErrNil, is permanent.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var rerr redis.Error
+	if errors.As(err, &rerr) {
+		for _, p := range transientPrefixes {
+			if strings.HasPrefix(string(rerr), p+" ") || string(rerr) == p {
+				return true
+			}
+		}
+		return false
+	}
+
+	var nerr net.Error
+	switch {
+	case errors.As(err, &nerr):
+		return true
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	case errors.Is(err, redis.ErrPoolExhausted):
+		return true
+	case errors.Is(err, context.DeadlineExceeded):
+		return true
+	}
+	return false
+}
+
+// transientAttempts, transientBackoff - how often doContext, the bulk
+// operations and the write-behind flush try what fails with a transient
+// error, and how long they wait before the second try (doubling after)
+var (
+	transientAttempts = 3
+	transientBackoff  = 50 * time.Millisecond
+)
+
+// retryTransient - calls fn up to attempts times (at least once), doubling
+// backoff between attempts, for as long as it fails with a transient error.
+// It returns fn's last error, or ctx's if ctx ends during a backoff.
+func retryTransient(ctx context.Context, attempts int, backoff time.Duration, fn func() error) (err error) {
+	for i := 0; ; i++ {
+		err = fn()
+		if !IsTransient(err) || i >= attempts-1 {
+			return
+		}
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
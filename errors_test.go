@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const wrongType = redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// failingExecConn - a recordingConn whose EXEC reports the last queued
+// command failed, as a server does for WRONGTYPE
+func failingExecConn() *recordingConn {
+	rec := newRecordingConn(nil)
+	rec.reply = func(cmd string, args []interface{}) (interface{}, error) {
+		if strings.ToUpper(cmd) != "EXEC" {
+			return "QUEUED", nil
+		}
+		cmds := rec.commands()
+		multi := len(cmds) - 1
+		for multi >= 0 && cmds[multi].Cmd != "MULTI" {
+			multi--
+		}
+		replies := make([]interface{}, len(cmds)-multi-1)
+		for i := range replies {
+			replies[i] = "OK"
+		}
+		replies[len(replies)-1] = wrongType
+		return replies, nil
+	}
+	return rec
+}
+
+// checkExecFailed - fails t unless err carries failingExecConn's error
+// reply: a command failing inside MULTI fails the write, though EXEC
+// itself succeeds
+func checkExecFailed(t *testing.T, err error) {
+	t.Helper()
+	var re redis.Error
+	if !errors.As(err, &re) || re != wrongType {
+		t.Errorf("got %v, want %v", err, wrongType)
+	}
+}
+
+func TestExecError(t *testing.T) {
+	tests := []struct {
+		name    string
+		replies []interface{}
+		want    error
+	}{
+		{"none", nil, nil},
+		{"all ok", []interface{}{"OK", int64(1)}, nil},
+		{"one failed", []interface{}{"OK", wrongType, redis.Error("ERR second")}, wrongType},
+	}
+	for _, tt := range tests {
+		if got := execError(tt.replies); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMultiExec(t *testing.T) {
+	rec := newRecordingConn(nil)
+	m := newMultiExec(rec)
+	m.send("DEL", "k")
+	m.send("HSET", "k", "f", "v")
+	replies, err := m.exec(context.Background())
+	if err != nil || !reflect.DeepEqual(replies, []interface{}{int64(1), int64(1)}) {
+		t.Errorf("got %v, %v", replies, err)
+	}
+	var cmds []string
+	for _, c := range rec.commands() {
+		cmds = append(cmds, c.Cmd)
+	}
+	if got, want := strings.Join(cmds, " "), "MULTI DEL HSET EXEC"; got != want {
+		t.Errorf("sent %s, want %s", got, want)
+	}
+
+	// a WATCHed key changed: EXEC replies nil
+	rec.reply = func(string, []interface{}) (interface{}, error) { return nil, nil }
+	replies, err = newMultiExec(rec).exec(context.Background())
+	if replies != nil || err != nil {
+		t.Errorf("aborted EXEC: got %v, %v", replies, err)
+	}
+}
+
+type aliasedDoc struct {
+	Name string `redis:"name,alias=fullname"`
+}
+
+func TestAddStructHashExecError(t *testing.T) {
+	// the stale alias field's HDEL puts the HMSET in a MULTI
+	checkExecFailed(t, addStructHash(failingExecConn(), "k", aliasedDoc{Name: "x"}))
+}
+
+func TestRetryTransient(t *testing.T) {
+	loading := redis.Error("LOADING Redis is loading the dataset in memory")
+	tests := []struct {
+		name     string
+		attempts int
+		errs     []error
+		calls    int
+		want     error
+	}{
+		{"no attempts still calls", 0, []error{nil}, 1, nil},
+		{"succeeds after transient", 3, []error{loading, nil}, 2, nil},
+		{"gives up", 2, []error{loading, loading, nil}, 2, loading},
+		{"permanent not retried", 3, []error{wrongType, nil}, 1, wrongType},
+	}
+	for _, tt := range tests {
+		calls := 0
+		err := retryTransient(context.Background(), tt.attempts, time.Millisecond, func() error {
+			calls++
+			return tt.errs[calls-1]
+		})
+		if err != tt.want || calls != tt.calls {
+			t.Errorf("%s: got %v after %d calls, want %v after %d", tt.name, err, calls, tt.want, tt.calls)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := retryTransient(ctx, 3, time.Hour, func() error { return loading })
+	if err != context.Canceled {
+		t.Errorf("cancelled: got %v", err)
+	}
+}
+
+func TestDoContextRetries(t *testing.T) {
+	defer func(b time.Duration) { transientBackoff = b }(transientBackoff)
+	transientBackoff = time.Millisecond
+
+	rec := newRecordingConn(nil)
+	calls := 0
+	rec.reply = func(cmd string, args []interface{}) (interface{}, error) {
+		calls++
+		if calls == 1 {
+			return nil, redis.Error("LOADING Redis is loading the dataset in memory")
+		}
+		return "PONG", nil
+	}
+	if reply, err := doContext(context.Background(), rec, "PING"); reply != "PONG" || err != nil {
+		t.Errorf("PING: got %v, %v", reply, err)
+	}
+
+	// a failed EXEC ended its transaction
+	calls = 0
+	if _, err := doContext(context.Background(), rec, "EXEC"); err == nil || calls != 1 {
+		t.Errorf("EXEC: got %v after %d calls", err, calls)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// expiredHandler - called with the key that expired and, when a cache was
+// attached, a pointer to its last decoded value (nil otherwise)
+type expiredHandler func(key string, last interface{})
+
+// watchExpired - subscribes to expired keyevents on conn and invokes handler
+// for every expired key starting with prefix. cache may be nil. conn is
+// dedicated to the subscription; the call blocks until it is closed.
+func watchExpired(conn redis.Conn, prefix string, cache *structCache, handler expiredHandler) (err error) {
+	// "E" enables the __keyevent@<db>__ channels and "x" the expired events
+	err = enableKeyspaceEvents(conn, "Ex")
+	if err != nil {
+		return
+	}
+
+	if cache != nil {
+		defer cache.watchExpiry(prefix)()
+	}
+
+	psc := redis.PubSubConn{Conn: conn}
+	err = psc.PSubscribe("__keyevent@*__:expired")
+	if err != nil {
+		return
+	}
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			// keyevent messages carry the key as payload
+			key := string(v.Data)
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+
+			var last interface{}
+			if cache != nil {
+				last = cache.take(key)
+			}
+			handler(key, last)
+		case error:
+			return v
+		}
+	}
+}
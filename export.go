@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// exportOptions - what exportKeys writes, and how
+type exportOptions struct {
+	Pattern string
+	// Format - "jsonl" or "csv"
+	Format string
+	// Filters - "path=value" on the flattened document (info.Major=CSE); a
+	// document is exported only if every filter matches
+	Filters []string
+	// Columns - CSV columns; taken from the first exported document when
+	// empty, in which case fields only later documents have are dropped
+	Columns []string
+	// Cursor - SCAN cursor to resume from, "0" (or empty) to start over
+	Cursor string
+	// OnCursor - called whenever everything before cursor has been written;
+	// pass it back in Cursor to resume an interrupted export
+	OnCursor func(cursor string)
+}
+
+// exportRecord - one JSON Lines export entry
+type exportRecord struct {
+	Key  string          `json:"key"`
+	Mode string          `json:"mode"`
+	Doc  json.RawMessage `json:"doc"`
+	// Bits - the document's bits string (bitfield.go), if it has one
+	Bits []byte `json:"bits,omitempty"`
+}
+
+// exportKeys - SCANs opts.Pattern and writes every document, whatever mode
+// it is stored in, to w. Keys that aren't in a known storage mode are
+// skipped.
+func exportKeys(ctx context.Context, conn redis.Conn, w io.Writer, opts exportOptions) (n int, err error) {
+	filters, err := parseFilters(opts.Filters)
+	if err != nil {
+		return
+	}
+	if opts.Cursor == "" {
+		opts.Cursor = "0"
+	}
+
+	var write func(key string, mode storageMode, raw []byte, flat map[string]string) error
+	var cw *csv.Writer
+	switch opts.Format {
+	case "", "jsonl":
+		enc := json.NewEncoder(w)
+		// bits strings go in JSON Lines records only; CSV has no type to
+		// decode them with
+		write = func(key string, mode storageMode, raw []byte, flat map[string]string) (err error) {
+			bits, err := getRawBits(conn, key)
+			if err != nil {
+				return
+			}
+			return enc.Encode(exportRecord{Key: key, Mode: mode.String(), Doc: raw, Bits: bits})
+		}
+	case "csv":
+		cw = csv.NewWriter(w)
+		columns := opts.Columns
+		write = func(key string, mode storageMode, raw []byte, flat map[string]string) (err error) {
+			if columns == nil {
+				columns = sortedKeys(flat)
+				err = cw.Write(append([]string{"key"}, columns...))
+				if err != nil {
+					return
+				}
+			}
+			row := []string{key}
+			for _, c := range columns {
+				row = append(row, flat[c])
+			}
+			return cw.Write(row)
+		}
+		if columns != nil {
+			err = cw.Write(append([]string{"key"}, columns...))
+			if err != nil {
+				return
+			}
+		}
+	default:
+		return 0, fmt.Errorf("unknown export format %q (want jsonl or csv)", opts.Format)
+	}
+
+	err = scanKeysFrom(ctx, conn, opts.Pattern, opts.Cursor, func(key string) (err error) {
+		if isBitsKey(key) {
+			// exported with its document
+			return nil
+		}
+		mode, err := detectStorageMode(conn, key)
+		if err == errUnknownMode || errors.Is(err, redis.ErrNil) {
+			return nil
+		}
+		if err != nil {
+			return
+		}
+
+		raw, err := getRaw(conn, mode, key)
+		if errors.Is(err, redis.ErrNil) {
+			return nil
+		}
+		if err != nil {
+			return
+		}
+
+		var flat map[string]string
+		if len(filters) > 0 || cw != nil {
+			flat, err = flattenJSON(raw)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			if !matchFilters(flat, filters) {
+				return nil
+			}
+		}
+
+		err = write(key, mode, raw, flat)
+		if err == nil {
+			n++
+		}
+		return
+	}, func(next string) error {
+		if cw != nil {
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+		}
+		if opts.OnCursor != nil {
+			opts.OnCursor(next)
+		}
+		return nil
+	})
+	if cw != nil {
+		cw.Flush()
+		if err == nil {
+			err = cw.Error()
+		}
+	}
+	return
+}
+
+func parseFilters(filters []string) (m map[string]string, err error) {
+	m = make(map[string]string, len(filters))
+	for _, f := range filters {
+		i := strings.Index(f, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("bad filter %q, want path=value", f)
+		}
+		m[f[:i]] = f[i+1:]
+	}
+	return
+}
+
+func matchFilters(flat, filters map[string]string) bool {
+	for path, want := range filters {
+		if flat[path] != want {
+			return false
+		}
+	}
+	return true
+}
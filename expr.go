@@ -0,0 +1,906 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// projection - a compiled expression in a small jq-like language, evaluated
+// against decoded documents:
+//
+//	.info.FirstName                       paths, .a[0], .["odd key"]
+//	.info | {name: (.FirstName + " " + .LastName), Major}
+//	[.rank, .info.Major]                  array construction
+//	select(.rank <= 10 and .info.Major == "CSE")
+//	length, keys, not, tostring, tonumber
+//
+// Arithmetic (+ - * /), comparisons (== != < <= > >=), and, or and
+// parentheses work as in jq. Unlike jq, every expression yields exactly one
+// value, except select, which yields none when its condition is false, and
+// there is no comma operator: array elements are separate expressions, so
+// parenthesize a pipe inside one.
+type projection struct {
+	src  string
+	root exprNode
+	// fetch - path the expression only ever reads below, so callers can
+	// fetch just that part of a document; "." when it reads the whole thing
+	fetch []string
+}
+
+// errNoValue - a projection that yields nothing for a document (select
+// rejected it)
+var errNoValue = errors.New("projection yields no value")
+
+type exprNode interface {
+	eval(v interface{}) (interface{}, error)
+}
+
+// compileProjection - parses src
+func compileProjection(src string) (p *projection, err error) {
+	toks, err := lexExpr(src)
+	if err != nil {
+		return
+	}
+	ps := &exprParser{toks: toks}
+	root, err := ps.parsePipe()
+	if err != nil {
+		return
+	}
+	if ps.peek().kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at offset %d", ps.peek().text, ps.peek().pos)
+	}
+
+	p = &projection{src: src, root: root}
+	switch n := root.(type) {
+	case pathNode:
+		p.fetch = n.fields
+	case pipeNode:
+		if path, ok := n.left.(pathNode); ok {
+			p.fetch = path.fields
+		}
+	}
+	return
+}
+
+// eval - the value p yields for doc, a value as produced by json.Unmarshal
+// into an interface{}
+func (p *projection) eval(doc interface{}) (v interface{}, err error) {
+	v, err = p.root.eval(doc)
+	if err == nil && v == noValue {
+		err = errNoValue
+	}
+	return
+}
+
+// String - the source p was compiled from
+func (p *projection) String() string { return p.src }
+
+// projectKey - evaluates p against the document at key, decoding the result
+// into out (a struct, map or interface{} pointer). When the expression only
+// reads below a leading path, ReJSON documents are fetched from that path
+// only. It returns errNoValue when p yields nothing.
+func projectKey(conn redis.Conn, mode storageMode, key string, p *projection, out interface{}) (err error) {
+	var doc interface{}
+	var fetched []byte
+	if mode == modeReJSON && len(p.fetch) > 0 {
+		// a missing path is an error to ReJSON but null to the expression,
+		// so on any error fall back to reading the whole document
+		fetched, _ = redis.Bytes(conn.Do("JSON.GET", key, legacyPath(p.fetch)))
+	}
+	if fetched != nil {
+		err = json.Unmarshal(fetched, &doc)
+		if err != nil {
+			return
+		}
+		// evaluate the rest of the pipeline, the path already applied
+		root := p.root
+		if pn, ok := root.(pipeNode); ok {
+			root = pn.right
+		} else {
+			root = identityNode{}
+		}
+		doc, err = root.eval(doc)
+	} else {
+		var raw []byte
+		raw, err = getRaw(conn, mode, key)
+		if err != nil {
+			return
+		}
+		err = json.Unmarshal(raw, &doc)
+		if err != nil {
+			return
+		}
+		doc, err = p.root.eval(doc)
+	}
+	if err != nil {
+		return
+	}
+	if doc == noValue {
+		return errNoValue
+	}
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return encodeError(err)
+	}
+	return json.Unmarshal(b, out)
+}
+
+// legacyPath - ReJSON path selecting fields, e.g. .info["first name"]
+func legacyPath(fields []string) string {
+	var b strings.Builder
+	for _, f := range fields {
+		b.WriteString(pathElem(f))
+	}
+	return b.String()
+}
+
+// pathElem - a legacy ReJSON path element selecting name
+func pathElem(name string) string {
+	for i, r := range name {
+		if !(r == '_' || unicode.IsLetter(r) || (i > 0 && unicode.IsDigit(r))) {
+			return "[" + strconv.Quote(name) + "]"
+		}
+	}
+	if name == "" {
+		return `[""]`
+	}
+	return "." + name
+}
+
+// noValue - what select yields for a rejected input
+var noValue = &struct{ _ byte }{}
+
+// --- evaluation
+
+type identityNode struct{}
+
+func (identityNode) eval(v interface{}) (interface{}, error) { return v, nil }
+
+// pathNode - .a.b, the common case, kept apart so it can be fetched
+// server side
+type pathNode struct{ fields []string }
+
+func (n pathNode) eval(v interface{}) (interface{}, error) {
+	for _, f := range n.fields {
+		var err error
+		v, err = indexValue(v, f)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+type indexNode struct{ target, index exprNode }
+
+func (n indexNode) eval(v interface{}) (interface{}, error) {
+	t, err := n.target.eval(v)
+	if err != nil || t == noValue {
+		return t, err
+	}
+	i, err := n.index.eval(v)
+	if err != nil || i == noValue {
+		return i, err
+	}
+	return indexValue(t, i)
+}
+
+// indexValue - v[i] for an object member or (possibly negative) array index
+func indexValue(v, i interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		k, ok := i.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot index object with %s", typeName(i))
+		}
+		return t[k], nil
+	case []interface{}:
+		f, ok := i.(float64)
+		if !ok {
+			return nil, fmt.Errorf("cannot index array with %s", typeName(i))
+		}
+		n := int(f)
+		if n < 0 {
+			n += len(t)
+		}
+		if n < 0 || n >= len(t) {
+			return nil, nil
+		}
+		return t[n], nil
+	}
+	return nil, fmt.Errorf("cannot index %s", typeName(v))
+}
+
+type pipeNode struct{ left, right exprNode }
+
+func (n pipeNode) eval(v interface{}) (interface{}, error) {
+	l, err := n.left.eval(v)
+	if err != nil || l == noValue {
+		return l, err
+	}
+	return n.right.eval(l)
+}
+
+type literalNode struct{ v interface{} }
+
+func (n literalNode) eval(interface{}) (interface{}, error) { return n.v, nil }
+
+type arrayNode struct{ elems []exprNode }
+
+func (n arrayNode) eval(v interface{}) (interface{}, error) {
+	out := make([]interface{}, 0, len(n.elems))
+	for _, e := range n.elems {
+		ev, err := e.eval(v)
+		if err != nil {
+			return nil, err
+		}
+		if ev != noValue {
+			out = append(out, ev)
+		}
+	}
+	return out, nil
+}
+
+type objectNode struct {
+	keys, values []exprNode
+}
+
+func (n objectNode) eval(v interface{}) (interface{}, error) {
+	out := make(map[string]interface{}, len(n.keys))
+	for i := range n.keys {
+		k, err := n.keys[i].eval(v)
+		if err != nil {
+			return nil, err
+		}
+		ks, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("object key must be a string, not %s", typeName(k))
+		}
+		ev, err := n.values[i].eval(v)
+		if err != nil {
+			return nil, err
+		}
+		if ev == noValue {
+			return noValue, nil
+		}
+		out[ks] = ev
+	}
+	return out, nil
+}
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n binaryNode) eval(v interface{}) (interface{}, error) {
+	l, err := n.left.eval(v)
+	if err != nil || l == noValue {
+		return l, err
+	}
+
+	// and/or short-circuit, as in jq
+	switch n.op {
+	case "and":
+		if !truthy(l) {
+			return false, nil
+		}
+	case "or":
+		if truthy(l) {
+			return true, nil
+		}
+	}
+
+	r, err := n.right.eval(v)
+	if err != nil || r == noValue {
+		return r, err
+	}
+
+	switch n.op {
+	case "and", "or":
+		return truthy(r), nil
+	case "==":
+		return reflect.DeepEqual(l, r), nil
+	case "!=":
+		return !reflect.DeepEqual(l, r), nil
+	case "<", "<=", ">", ">=":
+		c, err := compareValues(l, r)
+		if err != nil {
+			return nil, err
+		}
+		switch n.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	case "+":
+		return addValues(l, r)
+	}
+
+	lf, lok := l.(float64)
+	rf, rok := r.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("cannot apply %s to %s and %s", n.op, typeName(l), typeName(r))
+	}
+	switch n.op {
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	}
+	if rf == 0 {
+		return nil, errors.New("division by zero")
+	}
+	return lf / rf, nil
+}
+
+func addValues(l, r interface{}) (interface{}, error) {
+	if l == nil {
+		return r, nil
+	}
+	if r == nil {
+		return l, nil
+	}
+	switch lt := l.(type) {
+	case float64:
+		if rt, ok := r.(float64); ok {
+			return lt + rt, nil
+		}
+	case string:
+		if rt, ok := r.(string); ok {
+			return lt + rt, nil
+		}
+	case []interface{}:
+		if rt, ok := r.([]interface{}); ok {
+			return append(append([]interface{}{}, lt...), rt...), nil
+		}
+	case map[string]interface{}:
+		if rt, ok := r.(map[string]interface{}); ok {
+			out := make(map[string]interface{}, len(lt)+len(rt))
+			for k, v := range lt {
+				out[k] = v
+			}
+			for k, v := range rt {
+				out[k] = v
+			}
+			return out, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot add %s and %s", typeName(l), typeName(r))
+}
+
+func compareValues(l, r interface{}) (int, error) {
+	switch lt := l.(type) {
+	case float64:
+		if rt, ok := r.(float64); ok {
+			switch {
+			case lt < rt:
+				return -1, nil
+			case lt > rt:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case string:
+		if rt, ok := r.(string); ok {
+			return strings.Compare(lt, rt), nil
+		}
+	}
+	return 0, fmt.Errorf("cannot compare %s and %s", typeName(l), typeName(r))
+}
+
+func truthy(v interface{}) bool {
+	return v != nil && v != false
+}
+
+type callNode struct {
+	name string
+	args []exprNode
+}
+
+func (n callNode) eval(v interface{}) (interface{}, error) {
+	switch n.name {
+	case "select":
+		c, err := n.args[0].eval(v)
+		if err != nil {
+			return nil, err
+		}
+		if truthy(c) {
+			return v, nil
+		}
+		return noValue, nil
+	case "not":
+		return !truthy(v), nil
+	case "length":
+		switch t := v.(type) {
+		case nil:
+			return 0.0, nil
+		case string:
+			return float64(len([]rune(t))), nil
+		case []interface{}:
+			return float64(len(t)), nil
+		case map[string]interface{}:
+			return float64(len(t)), nil
+		case float64:
+			if t < 0 {
+				return -t, nil
+			}
+			return t, nil
+		}
+	case "keys":
+		if m, ok := v.(map[string]interface{}); ok {
+			keys := make([]string, 0, len(m))
+			for k := range m {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			out := make([]interface{}, len(keys))
+			for i, k := range keys {
+				out[i] = k
+			}
+			return out, nil
+		}
+	case "tostring":
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+		b, err := json.Marshal(v)
+		return string(b), err
+	case "tonumber":
+		switch t := v.(type) {
+		case float64:
+			return t, nil
+		case string:
+			f, err := strconv.ParseFloat(t, 64)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse %q as a number", t)
+			}
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("%s not defined for %s", n.name, typeName(v))
+}
+
+// exprFuncs - functions and how many arguments they take
+var exprFuncs = map[string]int{
+	"select":   1,
+	"not":      0,
+	"length":   0,
+	"keys":     0,
+	"tostring": 0,
+	"tonumber": 0,
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// --- lexing
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokPunct
+)
+
+type exprTok struct {
+	kind tokKind
+	text string
+	pos  int
+}
+
+// lexExpr - src's tokens, scanned a rune at a time so names may be any
+// Unicode letters and digits; offsets are in bytes
+func lexExpr(src string) (toks []exprTok, err error) {
+	for i := 0; i < len(src); {
+		c, size := utf8.DecodeRuneInString(src[i:])
+		switch {
+		case c == utf8.RuneError && size == 1:
+			return nil, fmt.Errorf("invalid UTF-8 at offset %d", i)
+		case unicode.IsSpace(c):
+			i += size
+		case c == '"':
+			j := i + 1
+			for ; j < len(src) && src[j] != '"'; j++ {
+				if src[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			var s string
+			err = json.Unmarshal([]byte(src[i:j+1]), &s)
+			if err != nil {
+				return nil, fmt.Errorf("bad string at offset %d: %w", i, err)
+			}
+			toks = append(toks, exprTok{tokString, s, i})
+			i = j + 1
+		case c >= '0' && c <= '9':
+			j := lexNumber(src, i)
+			toks = append(toks, exprTok{tokNumber, src[i:j], i})
+			i = j
+		case c == '_' || unicode.IsLetter(c):
+			j := i + size
+			for j < len(src) {
+				r, n := utf8.DecodeRuneInString(src[j:])
+				if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				j += n
+			}
+			toks = append(toks, exprTok{tokIdent, src[i:j], i})
+			i = j
+		default:
+			op := string(c)
+			if i+1 < len(src) {
+				switch two := src[i : i+2]; two {
+				case "==", "!=", "<=", ">=":
+					op = two
+				}
+			}
+			if size > 1 || len(op) == 1 && !strings.Contains(".|,:()[]{}+-*/<>", op) {
+				return nil, fmt.Errorf("unexpected %q at offset %d", op, i)
+			}
+			toks = append(toks, exprTok{tokPunct, op, i})
+			i += len(op)
+		}
+	}
+	return append(toks, exprTok{tokEOF, "end of expression", len(src)}), nil
+}
+
+// lexNumber - the end of the number starting at src[i]: digits, then a
+// fraction only if a digit follows the '.', so .a[0].b stays a path, then
+// an exponent (1e-5, 2E+3) only if it has digits
+func lexNumber(src string, i int) int {
+	digits := func(j int) int {
+		for j < len(src) && src[j] >= '0' && src[j] <= '9' {
+			j++
+		}
+		return j
+	}
+	j := digits(i)
+	if j+1 < len(src) && src[j] == '.' && src[j+1] >= '0' && src[j+1] <= '9' {
+		j = digits(j + 1)
+	}
+	if j < len(src) && (src[j] == 'e' || src[j] == 'E') {
+		k := j + 1
+		if k < len(src) && (src[k] == '+' || src[k] == '-') {
+			k++
+		}
+		if end := digits(k); end > k {
+			j = end
+		}
+	}
+	return j
+}
+
+// --- parsing
+
+type exprParser struct {
+	toks []exprTok
+	i    int
+}
+
+func (p *exprParser) peek() exprTok { return p.toks[p.i] }
+
+func (p *exprParser) next() exprTok {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *exprParser) accept(text string) bool {
+	t := p.peek()
+	if (t.kind == tokPunct || t.kind == tokIdent) && t.text == text {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(text string) error {
+	if !p.accept(text) {
+		t := p.peek()
+		return fmt.Errorf("expected %q, got %q at offset %d", text, t.text, t.pos)
+	}
+	return nil
+}
+
+func (p *exprParser) parsePipe() (n exprNode, err error) {
+	n, err = p.parseBinary(0)
+	if err != nil {
+		return
+	}
+	if p.accept("|") {
+		var right exprNode
+		right, err = p.parsePipe()
+		if err != nil {
+			return
+		}
+		n = pipeNode{n, right}
+	}
+	return
+}
+
+// binaryLevels - operators by increasing precedence
+var binaryLevels = [][]string{
+	{"or"},
+	{"and"},
+	{"==", "!=", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/"},
+}
+
+func (p *exprParser) parseBinary(level int) (n exprNode, err error) {
+	if level == len(binaryLevels) {
+		return p.parsePostfix()
+	}
+	n, err = p.parseBinary(level + 1)
+	if err != nil {
+		return
+	}
+	for {
+		op := ""
+		for _, candidate := range binaryLevels[level] {
+			if p.accept(candidate) {
+				op = candidate
+				break
+			}
+		}
+		if op == "" {
+			return
+		}
+		var right exprNode
+		right, err = p.parseBinary(level + 1)
+		if err != nil {
+			return
+		}
+		n = binaryNode{op, n, right}
+	}
+}
+
+func (p *exprParser) parsePostfix() (n exprNode, err error) {
+	n, err = p.parsePrimary()
+	if err != nil {
+		return
+	}
+	for {
+		switch {
+		case p.peek().text == "." && p.peek().kind == tokPunct:
+			p.next()
+			var field exprNode
+			field, err = p.parseField()
+			if err != nil {
+				return
+			}
+			n = joinIndex(n, field)
+		case p.peek().text == "[" && p.peek().kind == tokPunct:
+			p.next()
+			var idx exprNode
+			idx, err = p.parsePipe()
+			if err != nil {
+				return
+			}
+			if err = p.expect("]"); err != nil {
+				return
+			}
+			n = joinIndex(n, idx)
+		default:
+			return
+		}
+	}
+}
+
+// parseField - what follows a '.': a name, a quoted name or [index]
+func (p *exprParser) parseField() (n exprNode, err error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokIdent || t.kind == tokString:
+		p.next()
+		return literalNode{t.text}, nil
+	case t.kind == tokPunct && t.text == "[":
+		p.next()
+		n, err = p.parsePipe()
+		if err != nil {
+			return
+		}
+		return n, p.expect("]")
+	}
+	return nil, fmt.Errorf("expected a field name after '.', got %q at offset %d", t.text, t.pos)
+}
+
+// joinIndex - target[index], kept a pathNode while both are plain names
+func joinIndex(target, index exprNode) exprNode {
+	if lit, ok := index.(literalNode); ok {
+		if name, ok := lit.v.(string); ok {
+			switch t := target.(type) {
+			case identityNode:
+				return pathNode{[]string{name}}
+			case pathNode:
+				return pathNode{append(append([]string{}, t.fields...), name)}
+			}
+		}
+	}
+	return indexNode{target, index}
+}
+
+func (p *exprParser) parsePrimary() (n exprNode, err error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		var f float64
+		f, err = strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q at offset %d", t.text, t.pos)
+		}
+		return literalNode{f}, nil
+	case tokString:
+		return literalNode{t.text}, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return literalNode{true}, nil
+		case "false":
+			return literalNode{false}, nil
+		case "null":
+			return literalNode{nil}, nil
+		}
+		nargs, ok := exprFuncs[t.text]
+		if !ok {
+			return nil, fmt.Errorf("unknown function %q at offset %d", t.text, t.pos)
+		}
+		call := callNode{name: t.text}
+		if nargs > 0 {
+			if err = p.expect("("); err != nil {
+				return
+			}
+			for i := 0; i < nargs; i++ {
+				var arg exprNode
+				arg, err = p.parsePipe()
+				if err != nil {
+					return
+				}
+				call.args = append(call.args, arg)
+			}
+			if err = p.expect(")"); err != nil {
+				return
+			}
+		}
+		return call, nil
+	case tokPunct:
+		switch t.text {
+		case ".":
+			next := p.peek()
+			if next.kind == tokIdent || next.kind == tokString || (next.kind == tokPunct && next.text == "[") {
+				var field exprNode
+				field, err = p.parseField()
+				if err != nil {
+					return
+				}
+				return joinIndex(identityNode{}, field), nil
+			}
+			return identityNode{}, nil
+		case "(":
+			n, err = p.parsePipe()
+			if err != nil {
+				return
+			}
+			return n, p.expect(")")
+		case "[":
+			var arr arrayNode
+			if p.accept("]") {
+				return arr, nil
+			}
+			for {
+				var e exprNode
+				e, err = p.parseBinary(0)
+				if err != nil {
+					return
+				}
+				arr.elems = append(arr.elems, e)
+				if p.accept("]") {
+					return arr, nil
+				}
+				if err = p.expect(","); err != nil {
+					return
+				}
+			}
+		case "{":
+			return p.parseObject()
+		case "-":
+			n, err = p.parsePostfix()
+			if err != nil {
+				return
+			}
+			return binaryNode{"-", literalNode{0.0}, n}, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d", t.text, t.pos)
+}
+
+// parseObject - {key: value, shorthand, "quoted": value, (expr): value}
+func (p *exprParser) parseObject() (n exprNode, err error) {
+	var obj objectNode
+	if p.accept("}") {
+		return obj, nil
+	}
+	for {
+		var key exprNode
+		var name string
+		t := p.next()
+		switch {
+		case t.kind == tokIdent || t.kind == tokString:
+			name = t.text
+			key = literalNode{name}
+		case t.kind == tokPunct && t.text == "(":
+			key, err = p.parsePipe()
+			if err != nil {
+				return
+			}
+			if err = p.expect(")"); err != nil {
+				return
+			}
+		default:
+			return nil, fmt.Errorf("expected an object key, got %q at offset %d", t.text, t.pos)
+		}
+
+		var value exprNode
+		if p.accept(":") {
+			value, err = p.parseBinary(0)
+			if err != nil {
+				return
+			}
+		} else if name != "" {
+			// {Major} is {Major: .Major}
+			value = pathNode{[]string{name}}
+		} else {
+			return nil, fmt.Errorf("expected ':' at offset %d", p.peek().pos)
+		}
+		obj.keys = append(obj.keys, key)
+		obj.values = append(obj.values, value)
+
+		if p.accept("}") {
+			return obj, nil
+		}
+		if err = p.expect(","); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestLexExpr(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{`.a.b`, []string{".", "a", ".", "b"}},
+		{`.a[0].b`, []string{".", "a", "[", "0", "]", ".", "b"}},
+		{`1e-5`, []string{"1e-5"}},
+		{`2.5E+3 * 1e2`, []string{"2.5E+3", "*", "1e2"}},
+		{`1.5-2`, []string{"1.5", "-", "2"}},
+		{`.é_1 >= .ünïcode`, []string{".", "é_1", ">=", ".", "ünïcode"}},
+		{`.a != "x\"y"`, []string{".", "a", "!=", `x"y`}},
+		{"\t.a\n| .b", []string{".", "a", "|", ".", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			toks, err := lexExpr(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, tok := range toks {
+				if tok.kind != tokEOF {
+					got = append(got, tok.text)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLexExprErrors(t *testing.T) {
+	for _, src := range []string{
+		`.a = 1`,
+		`.a ! .b`,
+		`.a → .b`,
+		`"open`,
+		".a\xff",
+	} {
+		if _, err := lexExpr(src); err == nil {
+			t.Errorf("%q: no error", src)
+		}
+	}
+}
+
+const exprDoc = `{
+	"rank": 3,
+	"tags": ["x", "y", "z"],
+	"info": {"FirstName": "John", "LastName": "Doe", "Major": "CSE"},
+	"odd key": 1,
+	"名前": "太郎"
+}`
+
+func TestProjection(t *testing.T) {
+	tests := []struct {
+		src   string
+		want  string
+		fetch []string
+	}{
+		{`.`, exprDoc, nil},
+		{`.info.FirstName`, `"John"`, []string{"info", "FirstName"}},
+		{`.tags[0]`, `"x"`, nil},
+		{`.tags[-1]`, `"z"`, nil},
+		{`.["odd key"]`, `1`, []string{"odd key"}},
+		{`.名前`, `"太郎"`, []string{"名前"}},
+		{`.missing.deeper`, `null`, []string{"missing", "deeper"}},
+		{`.rank * 1e-1`, `0.30000000000000004`, nil},
+		{`.rank + 2E+1`, `23`, nil},
+		{`-.rank`, `-3`, nil},
+		{`.rank / 2 - 1`, `0.5`, nil},
+		{`.info | {name: (.FirstName + " " + .LastName), Major}`, `{"name": "John Doe", "Major": "CSE"}`, []string{"info"}},
+		{`[.rank, .info.Major]`, `[3, "CSE"]`, nil},
+		{`.rank <= 10 and .info.Major == "CSE"`, `true`, nil},
+		{`.rank > 10 or null`, `false`, nil},
+		{`.tags | length`, `3`, []string{"tags"}},
+		{`.info | keys`, `["FirstName", "LastName", "Major"]`, []string{"info"}},
+		{`.rank | tostring`, `"3"`, []string{"rank"}},
+		{`"1.5e1" | tonumber`, `15`, nil},
+		{`{(.info.Major): .rank}`, `{"CSE": 3}`, nil},
+	}
+	var doc interface{}
+	if err := json.Unmarshal([]byte(exprDoc), &doc); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			p, err := compileProjection(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.eval(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want interface{}
+			if err = json.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %#v, want %#v", got, want)
+			}
+			if !reflect.DeepEqual(p.fetch, tt.fetch) {
+				t.Errorf("fetch %q, want %q", p.fetch, tt.fetch)
+			}
+		})
+	}
+}
+
+func TestProjectionSelect(t *testing.T) {
+	tests := []struct {
+		src  string
+		pass bool
+	}{
+		{`select(.rank <= 10)`, true},
+		{`select(.rank > 10)`, false},
+		{`select(.info.Major == "CSE" and (.tags | length) == 3)`, true},
+		{`select(.missing | not)`, true},
+	}
+	var doc interface{}
+	if err := json.Unmarshal([]byte(exprDoc), &doc); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			p, err := compileProjection(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = p.eval(doc)
+			if tt.pass && err != nil {
+				t.Errorf("rejected: %v", err)
+			}
+			if !tt.pass && err != errNoValue {
+				t.Errorf("got %v, want errNoValue", err)
+			}
+		})
+	}
+}
+
+func TestCompileProjectionErrors(t *testing.T) {
+	for _, src := range []string{
+		``,
+		`.a.`,
+		`.a[0`,
+		`[.a, .b`,
+		`{a: 1`,
+		`{: 1}`,
+		`nosuch`,
+		`select .a`,
+		`.a |`,
+		`1e`,
+	} {
+		if _, err := compileProjection(src); err == nil {
+			t.Errorf("%q: no error", src)
+		}
+	}
+}
+
+func TestProjectionEvalErrors(t *testing.T) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(exprDoc), &doc); err != nil {
+		t.Fatal(err)
+	}
+	for _, src := range []string{
+		`.rank / 0`,
+		`.rank - "a"`,
+		`.tags < 1`,
+		`.rank.x`,
+		`.tags["x"]`,
+		`.info | tonumber`,
+	} {
+		p, err := compileProjection(src)
+		if err != nil {
+			t.Fatalf("%q: %v", src, err)
+		}
+		if _, err = p.eval(doc); err == nil {
+			t.Errorf("%q: no error", src)
+		}
+	}
+}
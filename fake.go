@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var (
+	fakeFirstNames = []string{"John", "Jane", "Ada", "Alan", "Grace", "Linus", "Barbara", "Ken", "Margaret", "Dennis"}
+	fakeLastNames  = []string{"Doe", "Lovelace", "Turing", "Hopper", "Torvalds", "Liskov", "Thompson", "Hamilton", "Ritchie"}
+	fakeMajors     = []string{"CSE", "EEE", "ME", "CE", "MATH", "PHY"}
+	fakeWords      = []string{"alpha", "bravo", "charlie", "delta", "echo", "foxtrot", "golf", "hotel"}
+)
+
+// fakeFill - populates every exported field of the struct v points to with a
+// plausible random value, picked by field kind and, for strings, by field
+// name (FirstName gets a first name, Major a major...). Fields tagged
+// json:"-" or redis:"-" are left alone.
+func fakeFill(v interface{}, r *rand.Rand) {
+	fakeValue(reflect.ValueOf(v).Elem(), "", r, 0)
+}
+
+func fakeValue(v reflect.Value, name string, r *rand.Rand, depth int) {
+	if depth > 4 {
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			v.Set(reflect.ValueOf(time.Now().Add(-time.Duration(r.Int63n(int64(365 * 24 * time.Hour)))).UTC()))
+			return
+		}
+		t := v.Type()
+		enums := structInfoOf(t).enums
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" || f.Tag.Get("json") == "-" || f.Tag.Get("redis") == "-" {
+				continue
+			}
+			if values := enums[i]; values != nil && f.Type.Kind() == reflect.String {
+				// Sets reject anything else
+				v.Field(i).SetString(values[r.Intn(len(values))])
+				continue
+			}
+			fakeValue(v.Field(i), f.Name, r, depth+1)
+		}
+	case reflect.Ptr:
+		p := reflect.New(v.Type().Elem())
+		fakeValue(p.Elem(), name, r, depth+1)
+		v.Set(p)
+	case reflect.String:
+		v.SetString(fakeString(name, r))
+	case reflect.Bool:
+		v.SetBool(r.Intn(2) == 1)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(r.Int63n(100) + 1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(uint64(r.Int63n(100) + 1))
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(float64(r.Intn(10000)) / 100)
+	case reflect.Slice:
+		n := r.Intn(4)
+		s := reflect.MakeSlice(v.Type(), n, n)
+		for i := 0; i < n; i++ {
+			fakeValue(s.Index(i), name, r, depth+1)
+		}
+		v.Set(s)
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return
+		}
+		m := reflect.MakeMap(v.Type())
+		for i := r.Intn(4); i > 0; i-- {
+			e := reflect.New(v.Type().Elem()).Elem()
+			fakeValue(e, name, r, depth+1)
+			m.SetMapIndex(reflect.ValueOf(fakeWords[r.Intn(len(fakeWords))]).Convert(v.Type().Key()), e)
+		}
+		v.Set(m)
+	}
+}
+
+func fakeString(field string, r *rand.Rand) string {
+	pick := func(s []string) string { return s[r.Intn(len(s))] }
+
+	f := strings.ToLower(field)
+	switch {
+	case strings.Contains(f, "first"):
+		return pick(fakeFirstNames)
+	case strings.Contains(f, "last"), strings.Contains(f, "surname"):
+		return pick(fakeLastNames)
+	case strings.Contains(f, "middle"):
+		return string(rune('A'+r.Intn(26))) + "."
+	case strings.Contains(f, "major"):
+		return pick(fakeMajors)
+	case strings.Contains(f, "email"):
+		return fmt.Sprintf("%s.%s@example.com", strings.ToLower(pick(fakeFirstNames)), strings.ToLower(pick(fakeLastNames)))
+	case strings.Contains(f, "name"):
+		return pick(fakeFirstNames) + " " + pick(fakeLastNames)
+	}
+	return pick(fakeWords) + "-" + pick(fakeWords)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// flattenJSON - decodes raw and flattens it into dotted paths, e.g.
+// {"info":{"FirstName":"John"},"tags":["a"]} -> info.FirstName=John, tags.0=a
+func flattenJSON(raw []byte) (flat map[string]string, err error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	err = dec.Decode(&v)
+	if err != nil {
+		return
+	}
+
+	flat = make(map[string]string)
+	flattenValue("", v, flat)
+	return
+}
+
+func flattenValue(path string, v interface{}, out map[string]string) {
+	join := func(k string) string {
+		if path == "" {
+			return k
+		}
+		return path + "." + k
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if len(t) == 0 && path != "" {
+			out[path] = "{}"
+		}
+		for k, e := range t {
+			flattenValue(join(k), e, out)
+		}
+	case []interface{}:
+		if len(t) == 0 && path != "" {
+			out[path] = "[]"
+		}
+		for i, e := range t {
+			flattenValue(join(strconv.Itoa(i)), e, out)
+		}
+	case nil:
+		out[path] = ""
+	case string:
+		out[path] = t
+	default:
+		out[path] = fmt.Sprint(t)
+	}
+}
+
+// sortedKeys - keys of a flattened document, in order
+func sortedKeys(flat map[string]string) []string {
+	keys := make([]string, 0, len(flat))
+	for k := range flat {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
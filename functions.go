@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// functionLibraryName - name the bundled library is loaded under
+const functionLibraryName = "rejson_struct"
+
+// functionLibrary - Redis 7 function library of common document mutations,
+// each done server side in one step. Paths are legacy ReJSON paths
+// (.info.Major).
+//
+//	rejson_struct_set_if KEY path expected value
+//	    JSON.SET path to value if it currently holds expected (compact JSON
+//	    text as JSON.GET returns it, "null" for a missing path); 1 if set
+//	rejson_struct_bounded_incr KEY path by min max
+//	    JSON.NUMINCRBY clamped to [min, max]; the new value
+//	rejson_struct_append_capped KEY path max value...
+//	    JSON.ARRAPPEND, then drop the oldest elements beyond max; the
+//	    new length
+var functionLibrary = `#!lua name=` + functionLibraryName + `
+
+local function get(key, path)
+	local ok, cur = pcall(redis.call, "JSON.GET", key, path)
+	if not ok or not cur then
+		return "null"
+	end
+	return cur
+end
+
+local function set_if(keys, args)
+	if get(keys[1], args[1]) ~= args[2] then
+		return 0
+	end
+	redis.call("JSON.SET", keys[1], args[1], args[3])
+	return 1
+end
+
+local function bounded_incr(keys, args)
+	local cur = tonumber(get(keys[1], args[1])) or 0
+	local n = cur + tonumber(args[2])
+	n = math.max(tonumber(args[3]), math.min(tonumber(args[4]), n))
+	redis.call("JSON.SET", keys[1], args[1], tostring(n))
+	return tostring(n)
+end
+
+local function append_capped(keys, args)
+	local max = tonumber(args[2])
+	local n = redis.call("JSON.ARRAPPEND", keys[1], args[1], unpack(args, 3))
+	if n > max then
+		redis.call("JSON.ARRTRIM", keys[1], args[1], n - max, -1)
+		n = max
+	end
+	return n
+end
+
+redis.register_function("rejson_struct_set_if", set_if)
+redis.register_function("rejson_struct_bounded_incr", bounded_incr)
+redis.register_function("rejson_struct_append_capped", append_capped)
+`
+
+// loadFunctions - FUNCTION LOADs functionLibrary, replacing an older copy
+func loadFunctions(conn redis.Conn) (err error) {
+	_, err = conn.Do("FUNCTION", "LOAD", "REPLACE", functionLibrary)
+	if err != nil {
+		return newCommandError("FUNCTION LOAD", functionLibraryName, err)
+	}
+	return
+}
+
+// fcall - FCALLs a function of the bundled library on key, loading the
+// library first if the server doesn't have it yet
+func fcall(conn redis.Conn, name, key string, args ...interface{}) (reply interface{}, err error) {
+	fargs := redis.Args{name, 1, key}.Add(args...)
+	reply, err = conn.Do("FCALL", fargs...)
+	if err != nil && strings.Contains(err.Error(), "Function not found") {
+		err = loadFunctions(conn)
+		if err != nil {
+			return
+		}
+		reply, err = conn.Do("FCALL", fargs...)
+	}
+	if err != nil {
+		return nil, newCommandError("FCALL "+name, key, err)
+	}
+	return
+}
+
+// setFieldIf - sets path to value only if it currently holds expected (nil
+// for a missing path); reports whether it did. Comparison is of compact
+// JSON text, so it is reliable for scalars.
+func setFieldIf(conn redis.Conn, key, path string, expected, value interface{}) (ok bool, err error) {
+	exp, err := json.Marshal(expected)
+	if err != nil {
+		return false, encodeError(err)
+	}
+	val, err := json.Marshal(value)
+	if err != nil {
+		return false, encodeError(err)
+	}
+	return redis.Bool(fcall(conn, "rejson_struct_set_if", key, path, string(exp), string(val)))
+}
+
+// incrBounded - adds by to the number at path, clamped to [min, max]
+func incrBounded(conn redis.Conn, key, path string, by, min, max float64) (n float64, err error) {
+	s, err := redis.String(fcall(conn, "rejson_struct_bounded_incr", key, path, by, min, max))
+	if err != nil {
+		return
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// appendCapped - appends values to the array at path, keeping only the
+// newest max elements; returns the resulting length
+func appendCapped(conn redis.Conn, key, path string, max int, values ...interface{}) (n int, err error) {
+	args := redis.Args{path, max}
+	for _, v := range values {
+		var b []byte
+		b, err = json.Marshal(v)
+		if err != nil {
+			return 0, encodeError(err)
+		}
+		args = args.Add(string(b))
+	}
+	return redis.Int(fcall(conn, "rejson_struct_append_capped", key, args...))
+}
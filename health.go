@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// healthReport - result of checkHealth, shaped to be written out as-is by an
+// HTTP healthz handler
+type healthReport struct {
+	OK      bool           `json:"ok"`
+	Latency time.Duration  `json:"latency"`
+	Version string         `json:"version,omitempty"`
+	Modules map[string]int `json:"modules,omitempty"`
+	Missing []string       `json:"missing,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// module names as reported by MODULE LIST
+const (
+	moduleJSON   = "ReJSON"
+	moduleSearch = "search"
+)
+
+// checkHealth - PINGs the server, reads its version and loaded modules and
+// verifies the JSON module (and, if requireSearch, RediSearch) is present.
+// Problems are reported in the returned healthReport rather than as err,
+// which is only set when ctx is done.
+func checkHealth(ctx context.Context, conn redis.Conn, requireSearch bool) (r healthReport, err error) {
+	start := time.Now()
+	_, perr := doContext(ctx, conn, "PING")
+	r.Latency = time.Since(start)
+	if perr != nil {
+		r.Error = perr.Error()
+		return r, ctx.Err()
+	}
+
+	info, ierr := redis.String(doContext(ctx, conn, "INFO", "server"))
+	if ierr != nil {
+		r.Error = ierr.Error()
+		return r, ctx.Err()
+	}
+	r.Version = infoField(info, "redis_version")
+
+	r.Modules, err = listModules(ctx, conn)
+	if err != nil {
+		r.Error = err.Error()
+		return r, ctx.Err()
+	}
+
+	required := []string{moduleJSON}
+	if requireSearch {
+		required = append(required, moduleSearch)
+	}
+	for _, name := range required {
+		if _, ok := r.Modules[name]; !ok {
+			r.Missing = append(r.Missing, name)
+		}
+	}
+
+	r.OK = len(r.Missing) == 0
+	return
+}
+
+// listModules - MODULE LIST as name -> version
+func listModules(ctx context.Context, conn redis.Conn) (modules map[string]int, err error) {
+	list, err := redis.Values(doContext(ctx, conn, "MODULE", "LIST"))
+	if err != nil {
+		return
+	}
+
+	modules = make(map[string]int, len(list))
+	for _, m := range list {
+		// each module is a flat list of attribute name/value pairs, and
+		// not every value is a bulk string (args is an array)
+		attrs, err := redis.Values(m, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var name string
+		var ver int
+		for i := 0; i+1 < len(attrs); i += 2 {
+			attr, _ := redis.String(attrs[i], nil)
+			switch attr {
+			case "name":
+				name, _ = redis.String(attrs[i+1], nil)
+			case "ver":
+				ver, _ = redis.Int(attrs[i+1], nil)
+			}
+		}
+		modules[name] = ver
+	}
+	return
+}
+
+// infoField - value of field in an INFO reply
+func infoField(info, field string) string {
+	for _, line := range strings.Split(info, "\r\n") {
+		if strings.HasPrefix(line, field+":") {
+			return strings.TrimPrefix(line, field+":")
+		}
+	}
+	return ""
+}
+
+// doContext - conn.Do bounded by ctx's deadline. redigo has no context
+// support, so cancellation without a deadline is only checked up front.
+// Transient error replies, like LOADING, are retried as retryTransient does:
+// the server refused cmd, so it can be sent again. A broken connection
+// isn't, as cmd may have run, and neither is EXEC, whose transaction is
+// over once it has failed.
+func doContext(ctx context.Context, conn redis.Conn, cmd string, args ...interface{}) (reply interface{}, err error) {
+	attempts := transientAttempts
+	if strings.EqualFold(cmd, "EXEC") {
+		attempts = 1
+	}
+	var last error
+	err = retryTransient(ctx, attempts, transientBackoff, func() error {
+		reply, last = doContextOnce(ctx, conn, cmd, args...)
+		if conn.Err() != nil {
+			return nil
+		}
+		return last
+	})
+	if err == nil {
+		err = last
+	}
+	return
+}
+
+func doContextOnce(ctx context.Context, conn redis.Conn, cmd string, args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if _, supported := conn.(redis.ConnWithTimeout); !ok || !supported {
+		return conn.Do(cmd, args...)
+	}
+	return redis.DoWithTimeout(conn, time.Until(deadline), cmd, args...)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// hotKeysOptions - how hotKeys samples and how much it reports
+type hotKeysOptions struct {
+	// Sample - keys inspected, at most
+	Sample int
+	// Top - keys reported at each end, hottest and coldest
+	Top int
+}
+
+// hotKeysReport - outcome of hotKeys
+type hotKeysReport struct {
+	// Metric - "freq" when the server runs an LFU maxmemory-policy and keys
+	// are ranked by OBJECT FREQ, "idle" when they are ranked by OBJECT
+	// IDLETIME instead
+	Metric  string
+	Sampled int
+	// Hot - the most used keys, hottest first
+	Hot []keyHeat
+	// Cold - the least used keys, coldest first
+	Cold []keyHeat
+}
+
+// keyHeat - how recently or often a key is accessed
+type keyHeat struct {
+	Key string
+	// Freq - OBJECT FREQ's logarithmic access counter, with metric "freq"
+	Freq int64
+	// Idle - time since the last access, with metric "idle"
+	Idle time.Duration
+}
+
+// hotKeys - samples keys starting with prefix and ranks them by access
+// frequency (OBJECT FREQ) under an LFU maxmemory-policy, or by recency
+// (OBJECT IDLETIME) under any other, since the server only tracks one.
+// OBJECT doesn't count as an access, so sampling leaves the ranking as it
+// was.
+func hotKeys(ctx context.Context, conn redis.Conn, prefix string, opts hotKeysOptions) (r hotKeysReport, err error) {
+	if opts.Sample <= 0 {
+		opts.Sample = 1000
+	}
+	if opts.Top <= 0 {
+		opts.Top = 20
+	}
+	r.Metric = "freq"
+
+	var heats []keyHeat
+	errStop := errors.New("sample complete")
+	err = scanKeys(ctx, conn, prefix+"*", func(key string) (err error) {
+		if r.Sampled >= opts.Sample {
+			return errStop
+		}
+
+		h := keyHeat{Key: key}
+		if r.Metric == "freq" {
+			h.Freq, err = redis.Int64(doContext(ctx, conn, "OBJECT", "FREQ", key))
+			if _, ok := err.(redis.Error); ok && r.Sampled == 0 {
+				// not an LFU policy: the server keeps idle times instead
+				r.Metric = "idle"
+			}
+		}
+		if r.Metric == "idle" {
+			var secs int64
+			secs, err = redis.Int64(doContext(ctx, conn, "OBJECT", "IDLETIME", key))
+			h.Idle = time.Duration(secs) * time.Second
+		}
+		if err == redis.ErrNil {
+			// expired or deleted since SCAN returned it
+			return nil
+		}
+		if err != nil {
+			return newCommandError("OBJECT", key, err)
+		}
+
+		r.Sampled++
+		heats = append(heats, h)
+		return
+	})
+	if err == errStop {
+		err = nil
+	}
+
+	// hottest first
+	sort.Slice(heats, func(i, j int) bool {
+		if r.Metric == "freq" {
+			return heats[i].Freq > heats[j].Freq
+		}
+		return heats[i].Idle < heats[j].Idle
+	})
+	top := opts.Top
+	if top > len(heats) {
+		top = len(heats)
+	}
+	r.Hot = heats[:top]
+	for i := len(heats) - 1; i >= len(heats)-top; i-- {
+		r.Cold = append(r.Cold, heats[i])
+	}
+	return
+}
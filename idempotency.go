@@ -0,0 +1,36 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// claimIdempotencyKey - SET NX with a TTL; reports whether this caller is the
+// first to see key within ttl
+func claimIdempotencyKey(conn redis.Conn, key string, ttl time.Duration) (claimed bool, err error) {
+	reply, err := conn.Do("SET", key, time.Now().UnixNano(), "NX", "PX", int64(ttl/time.Millisecond))
+	if err != nil {
+		return false, newCommandError("SET", key, err)
+	}
+	// SET NX replies nil when the key already exists
+	return reply != nil, nil
+}
+
+// applyOnce - runs fn only if the idempotency key can be claimed, so that an
+// at-least-once delivery of the same event applies its side effect once. If
+// fn fails the claim is released (best effort - it expires after ttl anyway)
+// so a redelivery can retry it.
+func applyOnce(conn redis.Conn, key string, ttl time.Duration, fn func() error) (applied bool, err error) {
+	claimed, err := claimIdempotencyKey(conn, key, ttl)
+	if err != nil || !claimed {
+		return
+	}
+
+	err = fn()
+	if err != nil {
+		conn.Do("DEL", key)
+		return
+	}
+	return true, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/template"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// importOptions - how bulkImport maps and writes lines
+type importOptions struct {
+	// KeyTemplate - text/template rendering a line's key from its decoded
+	// object, e.g. "student:{{.id}}"
+	KeyTemplate string
+	Mode        storageMode
+	// Type - registered type every line must decode into, if any; in hash
+	// mode its bits fields are written to each key's bits string
+	Type string
+	// Batch - lines per pipeline round trip
+	Batch int
+	// Progress - called after every batch with the lines imported so far
+	Progress func(lines int)
+}
+
+// bulkImport - streams JSON Lines from r, writing each object under the key
+// its KeyTemplate renders, pipelined opts.Batch at a time. It stops at the
+// first bad line, reporting its line number; everything before it has been
+// written.
+func bulkImport(ctx context.Context, conn redis.Conn, r io.Reader, opts importOptions) (lines int, err error) {
+	tmpl, err := template.New("key").Option("missingkey=error").Parse(opts.KeyTemplate)
+	if err != nil {
+		return
+	}
+	if opts.Batch <= 0 {
+		opts.Batch = 500
+	}
+	if opts.Type != "" {
+		if _, err = newRegistered(opts.Type); err != nil {
+			return
+		}
+	}
+	typ := registeredTypes[opts.Type]
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 64<<20)
+
+	// one entry per command sent, so replies can be matched to keys
+	var pending []string
+	var docs int
+	flush := func() (err error) {
+		if len(pending) == 0 {
+			return
+		}
+		err = receiveAll(conn, pending)
+		lines += docs
+		pending, docs = pending[:0], 0
+		if err == nil && opts.Progress != nil {
+			opts.Progress(lines)
+		}
+		return
+	}
+
+	var keyBuf bytes.Buffer
+	for n := 1; sc.Scan(); n++ {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var obj map[string]interface{}
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.UseNumber()
+		err = dec.Decode(&obj)
+		if err != nil {
+			return lines, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		keyBuf.Reset()
+		err = tmpl.Execute(&keyBuf, obj)
+		if err != nil {
+			return lines, fmt.Errorf("line %d: key template: %w", n, err)
+		}
+		key := keyBuf.String()
+
+		if opts.Type != "" {
+			line, err = checkTyped(key, line, opts.Type)
+			if err != nil {
+				return lines, fmt.Errorf("line %d: %w", n, err)
+			}
+		}
+		doc, bits, _, cerr := splitRawBits(opts.Mode, key, line, typ)
+		if cerr != nil {
+			return lines, fmt.Errorf("line %d: %w", n, cerr)
+		}
+		cmd, args, cerr := rawCommand(opts.Mode, key, doc)
+		if cerr != nil {
+			return lines, fmt.Errorf("line %d: %w", n, cerr)
+		}
+		err = conn.Send(cmd, args...)
+		if err != nil {
+			return
+		}
+		pending = append(pending, key)
+		if bits != nil {
+			err = conn.Send("BITFIELD", bits...)
+			if err != nil {
+				return
+			}
+			pending = append(pending, key)
+		}
+		docs++
+
+		if docs >= opts.Batch {
+			err = flush()
+			if err != nil {
+				return
+			}
+			if err = ctx.Err(); err != nil {
+				return
+			}
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return
+	}
+	err = flush()
+	return
+}
+
+// receiveAll - flushes the pipeline and reads one reply per key, returning
+// the first error (naming its key) after draining every reply
+func receiveAll(conn redis.Conn, keys []string) (err error) {
+	err = conn.Flush()
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		_, rerr := conn.Receive()
+		if rerr != nil && err == nil {
+			err = fmt.Errorf("%s: %w", key, rerr)
+		}
+	}
+	return
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/format"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// shape - what inferStruct has seen at one position across documents
+type shape struct {
+	kinds map[string]bool
+	// objects - times an object was seen here, to tell optional fields
+	objects int
+	fields  map[string]*shape
+	present map[string]int
+	order   []string
+	elem    *shape
+}
+
+func newShape() *shape {
+	return &shape{kinds: make(map[string]bool)}
+}
+
+func (s *shape) add(v interface{}) {
+	switch t := v.(type) {
+	case nil:
+		s.kinds["null"] = true
+	case bool:
+		s.kinds["bool"] = true
+	case string:
+		s.kinds["string"] = true
+	case json.Number:
+		if strings.ContainsAny(string(t), ".eE") {
+			s.kinds["float"] = true
+		} else {
+			s.kinds["int"] = true
+		}
+	case []interface{}:
+		s.kinds["array"] = true
+		if s.elem == nil {
+			s.elem = newShape()
+		}
+		for _, e := range t {
+			s.elem.add(e)
+		}
+	case map[string]interface{}:
+		s.kinds["object"] = true
+		if s.fields == nil {
+			s.fields = make(map[string]*shape)
+			s.present = make(map[string]int)
+		}
+		s.objects++
+		names := make([]string, 0, len(t))
+		for name := range t {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			f := s.fields[name]
+			if f == nil {
+				f = newShape()
+				s.fields[name] = f
+				s.order = append(s.order, name)
+			}
+			f.add(t[name])
+			s.present[name]++
+		}
+	}
+}
+
+// inferer - accumulates struct definitions while rendering a shape
+type inferer struct {
+	decls    [][]byte
+	names    map[string]bool
+	fromHash bool
+}
+
+// inferStruct - Go source declaring typeName (and a struct per nested
+// object) able to hold every one of docs. Numbers that were always integral
+// become int, fields missing from some documents get omitempty, and
+// positions holding conflicting kinds fall back to interface{}. fromHash adds
+// redis tags matching the field names.
+func inferStruct(typeName string, docs []interface{}, fromHash bool) (src []byte, err error) {
+	root := newShape()
+	for _, d := range docs {
+		root.add(d)
+	}
+	if len(root.kinds) != 1 || !root.kinds["object"] {
+		return nil, errors.New("documents aren't all JSON objects")
+	}
+
+	in := &inferer{names: make(map[string]bool), fromHash: fromHash}
+	in.declare(typeName, root)
+	return format.Source(bytes.Join(in.decls, nil))
+}
+
+func (in *inferer) declare(name string, s *shape) {
+	in.names[name] = true
+	// reserve a slot so name is declared before the structs it nests
+	i := len(in.decls)
+	in.decls = append(in.decls, nil)
+
+	var body bytes.Buffer
+	fieldNames := make(map[string]bool)
+	for _, jsonName := range s.order {
+		f := s.fields[jsonName]
+		goName := exportedName(jsonName)
+		for fieldNames[goName] {
+			goName += "_"
+		}
+		fieldNames[goName] = true
+
+		tag := jsonName
+		if s.present[jsonName] < s.objects || f.kinds["null"] {
+			tag += ",omitempty"
+		}
+		tags := fmt.Sprintf("json:%q", tag)
+		if in.fromHash {
+			tags += fmt.Sprintf(" redis:%q", jsonName)
+		}
+		fmt.Fprintf(&body, "\t%s %s `%s`\n", goName, in.typeOf(name+goName, f), tags)
+	}
+
+	in.decls[i] = []byte(fmt.Sprintf("\n// %s - inferred from stored documents\ntype %s struct {\n%s}\n", name, name, body.Bytes()))
+}
+
+// typeOf - Go type for s, declaring a struct named (about) name for objects
+func (in *inferer) typeOf(name string, s *shape) string {
+	kinds := make(map[string]bool, len(s.kinds))
+	for k := range s.kinds {
+		kinds[k] = true
+	}
+	nullable := kinds["null"]
+	delete(kinds, "null")
+	if kinds["int"] && kinds["float"] {
+		delete(kinds, "int")
+	}
+	if len(kinds) != 1 {
+		return "interface{}"
+	}
+
+	switch {
+	case kinds["bool"]:
+		return "bool"
+	case kinds["string"]:
+		return "string"
+	case kinds["int"]:
+		return "int"
+	case kinds["float"]:
+		return "float64"
+	case kinds["array"]:
+		if s.elem == nil || len(s.elem.kinds) == 0 {
+			return "[]interface{}"
+		}
+		return "[]" + in.typeOf(strings.TrimSuffix(name, "s"), s.elem)
+	}
+
+	for in.names[name] {
+		name += "_"
+	}
+	in.declare(name, s)
+	if nullable {
+		return "*" + name
+	}
+	return name
+}
+
+// exportedName - json member name as an exported Go identifier:
+// first_name -> FirstName
+func exportedName(s string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if b.Len() == 0 && unicode.IsDigit(r) {
+			b.WriteByte('F')
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	if b.Len() == 0 {
+		return "Field"
+	}
+	return b.String()
+}
+
+// inferDocuments - reads up to sample documents from keys (patterns are
+// SCANned), decoding hash fields that hold JSON numbers, booleans, objects
+// or arrays. fromHash reports whether any came from a flat hash.
+func inferDocuments(ctx context.Context, conn redis.Conn, keys []string, sample int) (docs []interface{}, fromHash bool, err error) {
+	errStop := errors.New("sample complete")
+	read := func(key string) (err error) {
+		if len(docs) >= sample {
+			return errStop
+		}
+		mode, err := detectStorageMode(conn, key)
+		if err == errUnknownMode {
+			return nil
+		}
+		if err != nil {
+			return
+		}
+		raw, err := getRaw(conn, mode, key)
+		if err != nil {
+			return
+		}
+
+		var doc interface{}
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber()
+		err = dec.Decode(&doc)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		if mode == modeHash {
+			fromHash = true
+			doc = typedHashFields(doc)
+		}
+		docs = append(docs, doc)
+		return
+	}
+
+	for _, k := range keys {
+		if strings.ContainsAny(k, "*?[") {
+			err = scanKeys(ctx, conn, k, read)
+		} else {
+			err = read(k)
+		}
+		if err == errStop {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+	}
+	if len(docs) == 0 && err == nil {
+		err = errors.New("no documents found")
+	}
+	return
+}
+
+// typedHashFields - hash field values that are JSON text of something other
+// than a string, decoded
+func typedHashFields(doc interface{}) interface{} {
+	fields, ok := doc.(map[string]interface{})
+	if !ok {
+		return doc
+	}
+	for name, v := range fields {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var decoded interface{}
+		dec := json.NewDecoder(strings.NewReader(s))
+		dec.UseNumber()
+		if dec.Decode(&decoded) == nil && !dec.More() {
+			if _, isString := decoded.(string); !isString {
+				fields[name] = decoded
+			}
+		}
+	}
+	return fields
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nitishm/rejson-struct/testsupport"
+)
+
+type integrationDoc struct {
+	Name     string `json:"name" redis:"name"`
+	Rank     int    `json:"rank" redis:"rank"`
+	Attempts uint8  `json:"-" redis:"attempts,bits=4"`
+}
+
+// TestStorageRoundTrip - what each mode writes reads back the same from a
+// real server; skipped when testsupport can't start one
+func TestStorageRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		mode storageMode
+		opts testsupport.Options
+	}{
+		{"hash", modeHash, testsupport.Options{}},
+		{"hash-json", modeHashJSON, testsupport.Options{}},
+		{"rejson", modeReJSON, testsupport.Options{ReJSON: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.StartTimeout = 30 * time.Second
+			pool := testsupport.New(t, tt.opts)
+			conn := pool.Get()
+			defer conn.Close()
+
+			want := integrationDoc{Name: "John", Rank: 3, Attempts: 5}
+			if tt.mode != modeHash {
+				// only hash mode packs bits fields
+				want.Attempts = 0
+			}
+			if err := addStruct(conn, tt.mode, "doc:1", want); err != nil {
+				t.Fatal(err)
+			}
+			var got integrationDoc
+			if err := getStruct(conn, tt.mode, "doc:1", &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("read back %+v, want %+v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// listFields - names of the members of the object at path (dotted, see
+// getValuePath; "" for the whole document) of the value at key, in the
+// order stored. ReJSON answers with JSON.OBJKEYS without sending the
+// document; the other modes read it whole, and report names sorted.
+func listFields(conn redis.Conn, mode storageMode, key, path string) (names []string, err error) {
+	if mode == modeReJSON {
+		var reply interface{}
+		reply, err = conn.Do("JSON.OBJKEYS", key, valuePath(path))
+		if err == nil && reply == nil {
+			err = redis.ErrNil
+		}
+		if err == nil {
+			names, err = redis.Strings(reply, nil)
+		}
+		if err != nil {
+			return nil, newCommandError("JSON.OBJKEYS", key, err)
+		}
+		return
+	}
+
+	v, err := getValuePath(conn, mode, key, path)
+	if err != nil {
+		return
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: %s: %s is not an object", key, orRoot(path), jsonType(v))
+	}
+	names = make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// fieldType - the JSON type of the member at path of the value at key, as
+// JSON.TYPE names them: object, array, string, integer, number, boolean or
+// null. ReJSON answers without sending the member; the other modes read
+// the whole value.
+func fieldType(conn redis.Conn, mode storageMode, key, path string) (typ string, err error) {
+	if mode == modeReJSON {
+		typ, err = redis.String(conn.Do("JSON.TYPE", key, valuePath(path)))
+		if err != nil {
+			return "", newCommandError("JSON.TYPE", key, err)
+		}
+		return
+	}
+
+	v, err := getValuePath(conn, mode, key, path)
+	if err != nil {
+		return
+	}
+	return jsonType(v), nil
+}
+
+// jsonType - JSON.TYPE's name for a value decoded by decodeValue
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if strings.ContainsAny(v.String(), ".eE") {
+			return "number"
+		}
+		return "integer"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// lifecycle - tracks the background workers (write-behind flushers,
+// keyspace subscribers, ...) and resources (pools, coalescers) started by a
+// process so they can be drained and released together on shutdown
+type lifecycle struct {
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex
+	closers []func() error
+	errs    []error
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{stop: make(chan struct{})}
+}
+
+// goWorker - runs fn in the background. fn must return soon after stop is
+// closed; an error it returns is reported by close.
+func (l *lifecycle) goWorker(fn func(stop <-chan struct{}) error) {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		if err := fn(l.stop); err != nil {
+			l.addErr(err)
+		}
+	}()
+}
+
+// goSubscriber - runs a blocking subscription (invalidateOnNotify,
+// watchExpired, ...) on its dedicated conn. conn is closed on shutdown to
+// unblock it, and the error that causes is not reported.
+func (l *lifecycle) goSubscriber(conn redis.Conn, fn func(conn redis.Conn) error) {
+	l.goWorker(func(stop <-chan struct{}) error {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-stop:
+				conn.Close()
+			case <-done:
+			}
+		}()
+
+		err := fn(conn)
+		select {
+		case <-stop:
+			return nil
+		default:
+			return err
+		}
+	})
+}
+
+// onClose - registers fn to run once every worker has stopped. Like defers,
+// closers run in reverse order, so register a pool before whatever flushes
+// through it.
+func (l *lifecycle) onClose(fn func() error) {
+	l.mu.Lock()
+	l.closers = append(l.closers, fn)
+	l.mu.Unlock()
+}
+
+// close - signals every worker to stop, waits for them (bounded by ctx),
+// then runs the closers. It returns the first error reported along the way,
+// or ctx's error if the workers didn't stop in time; the closers run either
+// way. Calling it again only waits for the workers, as the closers have run.
+func (l *lifecycle) close(ctx context.Context) (err error) {
+	l.stopOnce.Do(func() { close(l.stop) })
+
+	stopped := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		l.addErr(ctx.Err())
+	}
+
+	l.mu.Lock()
+	closers := l.closers
+	l.closers = nil
+	l.mu.Unlock()
+
+	for i := len(closers) - 1; i >= 0; i-- {
+		if cerr := closers[i](); cerr != nil {
+			l.addErr(cerr)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.errs) > 0 {
+		err = l.errs[0]
+	}
+	return
+}
+
+func (l *lifecycle) addErr(err error) {
+	l.mu.Lock()
+	l.errs = append(l.errs, err)
+	l.mu.Unlock()
+}
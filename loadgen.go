@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// loadgenOptions - what runLoadgen writes, and how fast
+type loadgenOptions struct {
+	// Type - registered type name, see registry.go
+	Type   string
+	Mode   storageMode
+	N      int
+	Prefix string
+	// QPS - target writes per second, unlimited when 0
+	QPS int
+	// Workers - concurrent writers, each with its own pooled conn
+	Workers int
+	Seed    int64
+}
+
+// loadgenStats - outcome of a runLoadgen
+type loadgenStats struct {
+	Written int64
+	Errors  int64
+	Elapsed time.Duration
+	// FirstErr - the first write error, for diagnosis
+	FirstErr error
+}
+
+// runLoadgen - writes opts.N fake objects of a registered type at up to
+// opts.QPS, for capacity testing a server before migrating to it. It stops
+// early, without error, when ctx is done.
+func runLoadgen(ctx context.Context, pool *redis.Pool, opts loadgenOptions) (s loadgenStats, err error) {
+	if _, err = newRegistered(opts.Type); err != nil {
+		return
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 4
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = "loadgen:"
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	start := time.Now()
+	for w := 0; w < opts.Workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			conn := pool.Get()
+			defer conn.Close()
+			r := rand.New(rand.NewSource(opts.Seed + int64(w)))
+
+			for i := range jobs {
+				v, _ := newRegistered(opts.Type)
+				fakeFill(v, r)
+
+				werr := addStruct(conn, opts.Mode, fmt.Sprintf("%s%d", opts.Prefix, i), v)
+				if werr != nil {
+					atomic.AddInt64(&s.Errors, 1)
+					mu.Lock()
+					if s.FirstErr == nil {
+						s.FirstErr = werr
+					}
+					mu.Unlock()
+					continue
+				}
+				atomic.AddInt64(&s.Written, 1)
+			}
+		}(w)
+	}
+
+	var tick <-chan time.Time
+	if opts.QPS > 0 && opts.QPS <= int(time.Second) {
+		ticker := time.NewTicker(time.Second / time.Duration(opts.QPS))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+feed:
+	for i := 0; i < opts.N; i++ {
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				break feed
+			}
+		}
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	s.Elapsed = time.Since(start)
+	return
+}
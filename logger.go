@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Logger - structured logging hook. fields are alternating key/value pairs,
+// e.g. logger.Warn("shadow read mismatch", "key", key, "mode", mode).
+type Logger interface {
+	Debug(msg string, fields ...interface{})
+	Info(msg string, fields ...interface{})
+	Warn(msg string, fields ...interface{})
+	Error(msg string, fields ...interface{})
+}
+
+// nopLogger - the default Logger, discards everything
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, fields ...interface{}) {}
+func (nopLogger) Info(msg string, fields ...interface{})  {}
+func (nopLogger) Warn(msg string, fields ...interface{})  {}
+func (nopLogger) Error(msg string, fields ...interface{}) {}
+
+// orNop - l, or a nopLogger when l is nil
+func orNop(l Logger) Logger {
+	if l == nil {
+		return nopLogger{}
+	}
+	return l
+}
+
+// stdLogger - Logger writing "LEVEL msg key=value ..." lines to a log.Logger
+type stdLogger struct {
+	l *log.Logger
+}
+
+func newStdLogger(l *log.Logger) stdLogger {
+	return stdLogger{l: l}
+}
+
+func (s stdLogger) Debug(msg string, fields ...interface{}) { s.print("DEBUG", msg, fields) }
+func (s stdLogger) Info(msg string, fields ...interface{})  { s.print("INFO", msg, fields) }
+func (s stdLogger) Warn(msg string, fields ...interface{})  { s.print("WARN", msg, fields) }
+func (s stdLogger) Error(msg string, fields ...interface{}) { s.print("ERROR", msg, fields) }
+
+func (s stdLogger) print(level, msg string, fields []interface{}) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%-5s %s", level, msg)
+	for i := 0; i < len(fields); i += 2 {
+		var v interface{} = "(missing)"
+		if i+1 < len(fields) {
+			v = fields[i+1]
+		}
+		fmt.Fprintf(&buf, " %v=%v", fields[i], v)
+	}
+	s.l.Print(buf.String())
+}
+
+// loggingMiddleware - reports every command at Debug and every failed
+// command at Error
+func loggingMiddleware(logger Logger) Middleware {
+	logger = orNop(logger)
+	return func(next Handler) Handler {
+		return func(cmd string, args ...interface{}) (reply interface{}, err error) {
+			start := time.Now()
+			reply, err = next(cmd, args...)
+
+			// Do("") only flushes a pipeline, there's nothing to report
+			if cmd == "" {
+				return
+			}
+
+			key := ""
+			if len(args) > 0 {
+				key = fmt.Sprint(args[0])
+			}
+
+			if err != nil {
+				logger.Error("redis command failed", "cmd", cmd, "key", key, "err", err)
+				return
+			}
+			logger.Debug("redis command", "cmd", cmd, "key", key, "took", time.Since(start))
+			return
+		}
+	}
+}
+
+func newLoggedConn(conn redis.Conn, logger Logger) redis.Conn {
+	return withMiddleware(conn, loggingMiddleware(logger))
+}
@@ -1,16 +1,24 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	rejson "go-rejson"
 	"log"
+	"os"
+	"reflect"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
 )
 
+//go:generate go run ./rejson-gen
+
 var addr = flag.String("Server", "localhost:6379", "Redis server address")
+var configFile = flag.String("config", "", "JSON config file (see config.go)")
+var profileName = flag.String("profile", "", "named profile from the config file, e.g. staging")
 
 // Name - student name
 type Name struct {
@@ -20,6 +28,8 @@ type Name struct {
 }
 
 // Student - student object
+//
+//rejson:store student:
 type Student struct {
 	// CHECKPOINT -
 	// Info is an embedded pointer. This is where redigo's base
@@ -35,14 +45,83 @@ type StudentDetails struct {
 }
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 
-	conn, err := redis.Dial("tcp", *addr)
+	logger := newStdLogger(log.New(os.Stderr, "", log.LstdFlags))
+
+	profile := *profileName
+	if profile == "" {
+		profile = os.Getenv("REJSON_STRUCT_PROFILE")
+	}
+	cfg, err := loadConfig(*configFile, profile)
 	if err != nil {
-		log.Fatalf("Failed to connect to redis-server @ %s", *addr)
+		fatal(logger, "Failed to load config", "err", err)
+		return
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "Server" {
+			cfg.Server = *addr
+		}
+	})
+
+	// CHECKPOINT -
+	// With no subcommand the binary runs the original John Doe walkthrough.
+	name, args := "demo", flag.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	env := &cliEnv{
+		cfg:    cfg,
+		logger: logger,
+		stdin:  os.Stdin,
+		stdout: os.Stdout,
+	}
+	if commands[name].offline {
+		err = runCommand(env, name, args)
+		if err != nil {
+			fatal(logger, "Failed to "+name, "err", err)
+		}
 		return
 	}
 
+	// CHECKPOINT -
+	// Connections come from a pool that is drained on the way out, along with
+	// any background workers, rather than leaving it to process exit.
+	pool := newPool(cfg)
+	lc := newLifecycle()
+	lc.onClose(pool.Close)
+
+	conn := pool.Get()
+	err = conn.Err()
+	if err != nil {
+		fatal(logger, "Failed to connect to redis-server", "addr", cfg.Server, "err", err)
+		return
+	}
+	conn = withOpTimeouts(conn, cfg.opTimeouts())
+
+	if name == "demo" {
+		runDemo(logger, conn, cfg)
+	} else {
+		env.conn, env.pool = conn, pool
+		err = runCommand(env, name, args)
+		if err != nil {
+			fatal(logger, "Failed to "+name, "err", err)
+			return
+		}
+	}
+
+	conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = lc.close(ctx)
+	if err != nil {
+		fatal(logger, "Failed to shut down cleanly", "err", err)
+		return
+	}
+}
+
+func runDemo(logger Logger, conn redis.Conn, cfg config) {
 	student := Student{
 		Info: &StudentDetails{
 			FirstName: "John",
@@ -54,9 +133,9 @@ func main() {
 
 	// CHECKPOINT -
 	// Add the student object to the store as a HMSET.
-	err = addStructHash(conn, "JohnDoeHash", student)
+	err := addStructHash(conn, "JohnDoeHash", student)
 	if err != nil {
-		log.Fatalf("Failed to addStructHash - %s", err)
+		fatal(logger, "Failed to addStructHash", "err", err)
 		return
 	}
 
@@ -64,7 +143,7 @@ func main() {
 	// Add the student object to the store as a JSON.SET
 	err = addStructReJSON(conn, "JohnDoeJSON", student)
 	if err != nil {
-		log.Fatalf("Failed to addStructReJSON - %s", err)
+		fatal(logger, "Failed to addStructReJSON", "err", err)
 		return
 	}
 
@@ -75,7 +154,7 @@ func main() {
 	// the values as a map[string]string.
 	outStudentMap, err := redis.StringMap(getStructHash(conn, "JohnDoeHash"))
 	if err != nil {
-		log.Fatalf("Failed to getStructHash - %s", err)
+		fatal(logger, "Failed to getStructHash", "err", err)
 		return
 	}
 	fmt.Printf("[HASH] Student Info %v [Type %T]\n", outStudentMap["Info"], outStudentMap["Info"])
@@ -89,14 +168,14 @@ func main() {
 
 	outJSON, err := getStructReJSON(conn, "JohnDoeJSON")
 	if err != nil {
-		log.Fatalf("Failed to getStructReJSON - %s", err)
+		fatal(logger, "Failed to getStructReJSON", "err", err)
 		return
 	}
 
 	outStudent := &Student{}
 	err = json.Unmarshal(outJSON.([]byte), outStudent)
 	if err != nil {
-		log.Fatalf("Failed to JSON Unmarshal - %s", err)
+		fatal(logger, "Failed to JSON Unmarshal", "err", err)
 		return
 	}
 	fmt.Printf("[ReJSON] Student Info %v [Type %T]\n", outStudent.Info, outStudent.Info)
@@ -115,20 +194,20 @@ func main() {
 	// Alternatively we could still use Redigo HSET to store our object as a JSON string
 	err = addStructHashWithJSON(conn, "JohnDoeHashJSON", student)
 	if err != nil {
-		log.Fatalf("Failed to addStructHashWithJSON - %s", err)
+		fatal(logger, "Failed to addStructHashWithJSON", "err", err)
 		return
 	}
 
 	outHashJSON, err := getStructHashWithJSON(conn, "JohnDoeHashJSON")
 	if err != nil {
-		log.Fatalf("Failed to getStructHashWithJSON - %s", err)
+		fatal(logger, "Failed to getStructHashWithJSON", "err", err)
 		return
 	}
 
 	outHashJSONStudent := &Student{}
 	err = json.Unmarshal(outHashJSON.([]byte), outHashJSONStudent)
 	if err != nil {
-		log.Fatalf("Failed to JSON Unmarshal - %s", err)
+		fatal(logger, "Failed to JSON Unmarshal", "err", err)
 		return
 	}
 	fmt.Printf("[HSET JSON] Student Info %v [Type %T]\n", outHashJSONStudent.Info, outHashJSONStudent.Info)
@@ -140,41 +219,152 @@ func main() {
 	// {"info":{"FirstName":"John","LastName":"Doe","Major":"CSE"},"rank":1}
 	// =====================================
 
+	for _, key := range []string{"JohnDoeHash", "JohnDoeJSON", "JohnDoeHashJSON"} {
+		err = applyTTL(conn, key, cfg.TTL)
+		if err != nil {
+			fatal(logger, "Failed to applyTTL", "err", err)
+			return
+		}
+	}
+}
+
+// fatal - logs msg through logger and exits
+func fatal(logger Logger, msg string, fields ...interface{}) {
+	logger.Error(msg, fields...)
+	os.Exit(1)
 }
 
 func addStructHash(conn redis.Conn, key string, value interface{}) (err error) {
-	_, err = conn.Do("HMSET", redis.Args{key}.AddFlat(value)...)
+	defer recoverUnsupported(&err)
+
+	if isContainer(reflect.TypeOf(value)) {
+		return addContainerHash(conn, key, value)
+	}
+
+	bits, err := bitsSetArgs(key, value)
 	if err != nil {
-		return
+		return fmt.Errorf("%s: %w", key, err)
 	}
+	args := redis.Args{key}.AddFlat(redigoValue(value))
+	stale := staleAliasFields(value)
+	if len(stale) > 0 || bits != nil {
+		m := newMultiExec(conn)
+		m.send("HMSET", args...)
+		if len(stale) > 0 {
+			// finish renames: drop the fields stored under old names
+			m.send("HDEL", redis.Args{key}.AddFlat(stale)...)
+		}
+		if bits != nil {
+			m.send("BITFIELD", bits...)
+		}
+		_, err = m.exec(context.Background())
+	} else {
+		_, err = conn.Do("HMSET", args...)
+	}
+	if err != nil {
+		return newCommandError("HMSET", key, err)
+	}
+	return
+}
+
+// addContainerHash - stores a slice, array or map of structs in one hash,
+// laid out by containerHashArgs. The hash is replaced, not merged into, so
+// elements removed since the last Set go too.
+func addContainerHash(conn redis.Conn, key string, value interface{}) (err error) {
+	fields, err := containerHashArgs(value)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+
+	m := newMultiExec(conn)
+	m.send("DEL", key)
+	m.send("HMSET", redis.Args{key}.AddFlat(fields)...)
+	_, err = m.exec(context.Background())
+	if err != nil {
+		return newCommandError("HMSET", key, err)
+	}
+	return
+}
+
+// hashReplaceArgs - value laid out as addStructHash and addContainerHash
+// store it: the HMSET field/value pairs, and the BITFIELD arguments for its
+// bits fields (nil without any)
+func hashReplaceArgs(key string, value interface{}) (fields, bits redis.Args, err error) {
+	defer recoverUnsupported(&err)
 
+	if isContainer(reflect.TypeOf(value)) {
+		fields, err = containerHashArgs(value)
+	} else {
+		bits, err = bitsSetArgs(key, value)
+		fields = redis.Args{}.AddFlat(redigoValue(value))
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", key, err)
+	}
 	return
 }
 
+// sendHashReplace - queues on m the commands replacing the hash at key with
+// hashReplaceArgs' fields and bits. Starting from an empty hash drops
+// fields no longer set and old alias names; the bits string needs no DEL,
+// as every bits field is rewritten.
+func sendHashReplace(m *multiExec, key string, fields, bits redis.Args) {
+	m.send("DEL", key)
+	if len(fields) > 0 {
+		m.send("HMSET", redis.Args{key}.AddFlat(fields)...)
+	}
+	if bits != nil {
+		m.send("BITFIELD", bits...)
+	}
+}
+
 func getStructHash(conn redis.Conn, key string) (value interface{}, err error) {
-	return conn.Do("HGETALL", "JohnDoeHash")
+	value, err = conn.Do("HGETALL", key)
+	if err != nil {
+		return nil, newCommandError("HGETALL", key, err)
+	}
+	return
 }
 
 func addStructReJSON(conn redis.Conn, key string, value interface{}) (err error) {
-	_, err = rejson.JSONSet(conn, key, ".", value, false, false)
+	defer recoverUnsupported(&err)
+
+	b, err := encodeJSON(value)
 	if err != nil {
-		return
+		return newCommandError("JSON.SET", key, err)
+	}
+	defer b.release()
+
+	_, err = conn.Do("JSON.SET", key, ".", b.bytes())
+	if err != nil {
+		return newCommandError("JSON.SET", key, err)
 	}
 	return
 }
 
-func getStructReJSON(conn redis.Conn, key string) (value interface{}, err error) {
-	return rejson.JSONGet(conn, key, "")
+// getStructReJSON - the document at key, formatted as format says when given
+func getStructReJSON(conn redis.Conn, key string, format ...jsonFormat) (value interface{}, err error) {
+	if len(format) > 0 {
+		value, err = conn.Do("JSON.GET", redis.Args{key}.AddFlat(format[0].args())...)
+	} else {
+		value, err = rejson.JSONGet(conn, key, "")
+	}
+	if err != nil {
+		return nil, newCommandError("JSON.GET", key, err)
+	}
+	return
 }
 
 func addStructHashWithJSON(conn redis.Conn, key string, value interface{}) (err error) {
-	b, err := json.Marshal(value)
+	b, err := encodeJSON(value)
 	if err != nil {
 		return
 	}
-	_, err = conn.Do("HSET", key, "JSON", string(b))
+	defer b.release()
+
+	_, err = conn.Do("HSET", key, "JSON", b.bytes())
 	if err != nil {
-		return
+		return newCommandError("HSET", key, err)
 	}
 	return
 }
@@ -182,7 +372,7 @@ func addStructHashWithJSON(conn redis.Conn, key string, value interface{}) (err
 func getStructHashWithJSON(conn redis.Conn, key string) (value interface{}, err error) {
 	value, err = conn.Do("HGET", key, "JSON")
 	if err != nil {
-		return
+		return nil, newCommandError("HGET", key, err)
 	}
 	return
 }
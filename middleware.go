@@ -0,0 +1,144 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Handler - executes a single redis command
+type Handler func(cmd string, args ...interface{}) (interface{}, error)
+
+// Middleware - wraps a Handler, e.g. to time, log, rewrite or fail commands
+type Middleware func(next Handler) Handler
+
+// middlewareConn - redis.Conn whose commands run through a middleware chain.
+// Do and DoWithTimeout run it around the command itself. A pipelined
+// command has already gone out by the time its reply comes back, so Receive
+// runs the chain around reading that reply: middleware sees the command and
+// its outcome, and can fail it, but cannot rewrite it.
+type middlewareConn struct {
+	redis.Conn
+	mws []Middleware
+
+	// pending - the commands sent and not yet received, oldest first
+	pending []pendingCommand
+}
+
+type pendingCommand struct {
+	cmd  string
+	args []interface{}
+}
+
+// withMiddleware - wraps conn so every command passes through mws, the first
+// one being the outermost
+func withMiddleware(conn redis.Conn, mws ...Middleware) redis.Conn {
+	return &middlewareConn{Conn: conn, mws: mws}
+}
+
+func (c *middlewareConn) chain(h Handler) Handler {
+	for i := len(c.mws) - 1; i >= 0; i-- {
+		h = c.mws[i](h)
+	}
+	return h
+}
+
+func (c *middlewareConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return c.do(cmd, args, c.Conn.Do, c.Conn.Receive)
+}
+
+func (c *middlewareConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	return c.do(cmd, args,
+		func(cmd string, args ...interface{}) (interface{}, error) {
+			return redis.DoWithTimeout(c.Conn, timeout, cmd, args...)
+		},
+		func() (interface{}, error) {
+			return redis.ReceiveWithTimeout(c.Conn, timeout)
+		})
+}
+
+// do - runs cmd through the chain. The underlying Do would read the replies
+// of anything still pending without the chain seeing them, so those are
+// received through it first, and Do("") returns them as redigo's does.
+func (c *middlewareConn) do(cmd string, args []interface{}, do Handler, recv func() (interface{}, error)) (reply interface{}, err error) {
+	if len(c.pending) == 0 {
+		return c.chain(do)(cmd, args...)
+	}
+	if err = c.Conn.Flush(); err != nil {
+		c.pending = nil
+		return
+	}
+
+	var replies []interface{}
+	var failed, replyErr error
+	for len(c.pending) > 0 {
+		r, e := c.receive(recv)
+		if re, ok := e.(redis.Error); ok {
+			r, e = re, nil
+			if replyErr == nil {
+				replyErr = re
+			}
+		}
+		if e != nil && failed == nil {
+			failed = e
+		}
+		replies = append(replies, r)
+	}
+	if cmd == "" {
+		return replies, failed
+	}
+
+	reply, err = c.chain(do)(cmd, args...)
+	if err == nil {
+		err = failed
+	}
+	if err == nil {
+		err = replyErr
+	}
+	return
+}
+
+func (c *middlewareConn) Send(cmd string, args ...interface{}) (err error) {
+	err = c.Conn.Send(cmd, args...)
+	if err == nil {
+		c.pending = append(c.pending, pendingCommand{cmd: cmd, args: args})
+	}
+	return
+}
+
+func (c *middlewareConn) Receive() (interface{}, error) {
+	return c.receive(c.Conn.Receive)
+}
+
+func (c *middlewareConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	return c.receive(func() (interface{}, error) {
+		return redis.ReceiveWithTimeout(c.Conn, timeout)
+	})
+}
+
+// receive - the oldest pending reply, read by recv inside the chain run for
+// the command it answers. The reply is read exactly once, whether the chain
+// calls next more than once or fails the command without calling it, so
+// the replies after it stay in step.
+func (c *middlewareConn) receive(recv func() (interface{}, error)) (reply interface{}, err error) {
+	if len(c.pending) == 0 {
+		return recv()
+	}
+	p := c.pending[0]
+	c.pending = c.pending[1:]
+
+	var received bool
+	var r interface{}
+	var e error
+	reply, err = c.chain(func(string, ...interface{}) (interface{}, error) {
+		if !received {
+			received = true
+			r, e = recv()
+		}
+		return r, e
+	})(p.cmd, p.args...)
+	if !received {
+		recv()
+	}
+	return
+}
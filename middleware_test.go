@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMiddlewarePipelined(t *testing.T) {
+	rec := newRecordingConn(nil)
+	var seen []string
+	failGet := errors.New("GET refused")
+	conn := withMiddleware(rec, func(next Handler) Handler {
+		return func(cmd string, args ...interface{}) (interface{}, error) {
+			seen = append(seen, cmd)
+			if cmd == "GET" {
+				return nil, failGet
+			}
+			return next(cmd, args...)
+		}
+	})
+
+	conn.Send("SET", "k", "v")
+	conn.Send("GET", "k")
+	conn.Send("DEL", "k")
+	conn.Flush()
+	want := []struct {
+		reply interface{}
+		err   error
+	}{{"OK", nil}, {nil, failGet}, {int64(1), nil}}
+	for i, w := range want {
+		reply, err := conn.Receive()
+		if !reflect.DeepEqual(reply, w.reply) || err != w.err {
+			t.Errorf("reply %d: got %#v, %v, want %#v, %v", i, reply, err, w.reply, w.err)
+		}
+	}
+	if got, want := seen, []string{"SET", "GET", "DEL"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("chain saw %v, want %v", got, want)
+	}
+
+	// Do("") hands back what is pending, through the chain
+	seen = nil
+	conn.Send("SET", "a", "1")
+	conn.Send("HSET", "b", "f", "v")
+	replies, err := conn.Do("")
+	if err != nil || !reflect.DeepEqual(replies, []interface{}{"OK", int64(1)}) {
+		t.Errorf("Do(\"\"): got %#v, %v", replies, err)
+	}
+	if got, want := seen, []string{"SET", "HSET"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("chain saw %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// migrateOptions - what migrateKeys converts, and how
+type migrateOptions struct {
+	Pattern string
+	// Type - registered type hash fields are coerced into, so numbers and
+	// nested objects come out typed instead of as strings. Optional.
+	Type string
+	// Batch - keys converted per MULTI/EXEC
+	Batch int
+	// Rollback - convert ReJSON documents back to flat hashes instead
+	Rollback bool
+	// OnSkip - called for each key left as it was because it couldn't be
+	// converted
+	OnSkip func(key string, err error)
+	// Progress - called after every batch with the keys converted so far
+	Progress func(done int)
+}
+
+// errBatchConflict - a key in the batch changed between read and EXEC
+var errBatchConflict = errors.New("batch modified concurrently")
+
+// migrateKeys - converts every hash matching opts.Pattern into a ReJSON
+// document under the same key (or back, with opts.Rollback). Each batch is
+// WATCHed and replaced in one MULTI/EXEC, so a concurrent writer makes the
+// batch retry rather than lose its write. Wrap conn in a dryRunConn to print
+// the commands instead.
+func migrateKeys(ctx context.Context, conn redis.Conn, opts migrateOptions) (n int, err error) {
+	if opts.Batch <= 0 {
+		opts.Batch = 100
+	}
+	from, to := modeHash, modeReJSON
+	if opts.Rollback {
+		from, to = modeReJSON, modeHash
+	}
+
+	var typ reflect.Type
+	if opts.Type != "" {
+		var ok bool
+		typ, ok = registeredTypes[opts.Type]
+		if !ok {
+			return 0, fmt.Errorf("unknown type %q (registered: %v)", opts.Type, registeredNames())
+		}
+	}
+
+	skip := func(key string, err error) {
+		if opts.OnSkip != nil {
+			opts.OnSkip(key, err)
+		}
+	}
+
+	var batch []string
+	flush := func() (err error) {
+		if len(batch) == 0 {
+			return
+		}
+		var done int
+		for attempt := 0; attempt < 3; attempt++ {
+			done, err = migrateBatch(conn, batch, from, to, typ, skip)
+			if err != errBatchConflict {
+				break
+			}
+		}
+		if err != nil {
+			return
+		}
+		n += done
+		batch = batch[:0]
+		if opts.Progress != nil {
+			opts.Progress(n)
+		}
+		return
+	}
+
+	err = scanKeys(ctx, conn, opts.Pattern, func(key string) (err error) {
+		batch = append(batch, key)
+		if len(batch) >= opts.Batch {
+			err = flush()
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+	err = flush()
+	return
+}
+
+// migrateBatch - converts the keys of batch stored in from to mode to,
+// atomically and keeping their TTLs, returning how many were converted.
+// Keys with a bits string are skipped.
+func migrateBatch(conn redis.Conn, batch []string, from, to storageMode, typ reflect.Type, skip func(string, error)) (n int, err error) {
+	watched := redis.Args{}.AddFlat(batch)
+	for _, key := range batch {
+		// a bits string appearing meanwhile makes the batch retry, and skip
+		// that key
+		watched = watched.Add(bitsKey(key))
+	}
+	_, err = conn.Do("WATCH", watched...)
+	if err != nil {
+		return 0, newCommandError("WATCH", strings.Join(batch, " "), err)
+	}
+	defer func() {
+		if err != nil {
+			conn.Do("UNWATCH")
+		}
+	}()
+
+	type conversion struct {
+		key  string
+		cmd  string
+		args redis.Args
+		// ttl - milliseconds the key had left, 0 for none
+		ttl int64
+	}
+	var convs []conversion
+	for _, key := range batch {
+		mode, derr := detectStorageMode(conn, key)
+		if derr != nil || mode != from {
+			// gone, already converted (SCAN can repeat keys) or another mode
+			continue
+		}
+
+		var raw []byte
+		raw, err = getRaw(conn, from, key)
+		if errors.Is(err, redis.ErrNil) {
+			err = nil
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		if from == modeHash && typ != nil {
+			raw, err = coerceHash(raw, typ)
+			if err != nil {
+				skip(key, err)
+				err = nil
+				continue
+			}
+		}
+
+		var bits []byte
+		bits, err = getRawBits(conn, key)
+		if err != nil {
+			return
+		}
+		if bits != nil {
+			// the fields packed there would be missing from the document
+			skip(key, fmt.Errorf("%s has a bits string (%s), which migrate can't convert", key, bitsKey(key)))
+			continue
+		}
+
+		var ttl int64
+		ttl, err = redis.Int64(conn.Do("PTTL", key))
+		if err != nil {
+			return 0, newCommandError("PTTL", key, err)
+		}
+		if ttl == -2 {
+			// expired since it was read
+			continue
+		}
+		if ttl < 0 {
+			ttl = 0
+		}
+
+		cmd, args, cerr := rawCommand(to, key, raw)
+		if cerr != nil {
+			skip(key, cerr)
+			continue
+		}
+		convs = append(convs, conversion{key, cmd, args, ttl})
+	}
+	if len(convs) == 0 {
+		_, err = conn.Do("UNWATCH")
+		return
+	}
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return
+	}
+	for _, c := range convs {
+		err = conn.Send("DEL", c.key)
+		if err != nil {
+			return
+		}
+		err = conn.Send(c.cmd, c.args...)
+		if err != nil {
+			return
+		}
+		if c.ttl > 0 {
+			// DEL dropped the TTL
+			err = conn.Send("PEXPIRE", c.key, c.ttl)
+			if err != nil {
+				return
+			}
+		}
+	}
+	reply, err := conn.Do("EXEC")
+	if err != nil {
+		return 0, newCommandError("EXEC", convs[0].key, err)
+	}
+	if reply == nil {
+		return 0, errBatchConflict
+	}
+	replies, err := redis.Values(reply, nil)
+	if err == nil {
+		err = execError(replies)
+	}
+	if err != nil {
+		return 0, newCommandError("EXEC", convs[0].key, err)
+	}
+	return len(convs), nil
+}
+
+// coerceHash - turns a hash read back as an object of strings into the JSON
+// typ marshals to. Hash fields are matched to struct fields by redis tag, Go
+// name or JSON name; non-string fields must hold JSON text of the field's
+// type (as rawCommand writes them).
+func coerceHash(raw []byte, typ reflect.Type) (out []byte, err error) {
+	var fields map[string]string
+	err = json.Unmarshal(raw, &fields)
+	if err != nil {
+		return
+	}
+
+	doc := make(map[string]json.RawMessage, len(fields))
+	for name, value := range fields {
+		f, jsonName, ok := structFieldFor(typ, name)
+		if !ok {
+			return nil, fmt.Errorf("hash field %q has no %s field", name, typ.Name())
+		}
+
+		if f.Type.Kind() == reflect.String {
+			doc[jsonName], err = json.Marshal(value)
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		v := reflect.New(f.Type)
+		if json.Unmarshal([]byte(value), v.Interface()) != nil {
+			return nil, fmt.Errorf("hash field %q: %q isn't a %v", name, value, f.Type)
+		}
+		doc[jsonName] = json.RawMessage(value)
+	}
+
+	out, err = json.Marshal(doc)
+	if err != nil {
+		return
+	}
+	// check the result decodes into typ as a whole
+	err = json.Unmarshal(out, reflect.New(typ).Interface())
+	return
+}
+
+// structFieldFor - exported field of typ a hash field name refers to, and
+// the name it has in JSON
+func structFieldFor(typ reflect.Type, name string) (f reflect.StructField, jsonName string, ok bool) {
+	for i := 0; i < typ.NumField(); i++ {
+		f = typ.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		jsonName = f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			jsonName = tag
+		}
+		redisName := strings.Split(f.Tag.Get("redis"), ",")[0]
+
+		if name == f.Name || name == jsonName || (redisName != "" && name == redisName) {
+			return f, jsonName, true
+		}
+	}
+	return f, "", false
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// schemaMigration - one versioned change applied to every stored document
+// of a type. Up gets a document as a schemaless object (see getValue) and
+// returns it changed; returning doc unchanged leaves the document alone. A
+// run interrupted mid-way resumes from its last SCAN page, so some
+// documents can be seen twice: Up must leave an already migrated document
+// as it is.
+type schemaMigration struct {
+	Version int
+	Name    string
+	Up      func(doc map[string]interface{}) (map[string]interface{}, error)
+}
+
+// schemaMigrations - registered migrations by type name
+var schemaMigrations = map[string][]schemaMigration{}
+
+// registerMigration - adds m to the migrations of the type registered as
+// typeName. Versions must be unique and positive; they run in order.
+func registerMigration(typeName string, m schemaMigration) {
+	if m.Version <= 0 {
+		panic(fmt.Sprintf("migration %s %q: version must be positive", typeName, m.Name))
+	}
+	for _, have := range schemaMigrations[typeName] {
+		if have.Version == m.Version {
+			panic(fmt.Sprintf("migration %s v%d registered twice", typeName, m.Version))
+		}
+	}
+	ms := append(schemaMigrations[typeName], m)
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+	schemaMigrations[typeName] = ms
+}
+
+func init() {
+	// Students were once written with a top-level name object
+	registerMigration("Student", schemaMigration{
+		Version: 1,
+		Name:    "move name into info",
+		Up: func(doc map[string]interface{}) (map[string]interface{}, error) {
+			name, ok := doc["name"].(map[string]interface{})
+			if !ok {
+				return doc, nil
+			}
+			info, _ := doc["info"].(map[string]interface{})
+			if info == nil {
+				info = map[string]interface{}{}
+				doc["info"] = info
+			}
+			for from, to := range map[string]string{"first": "FirstName", "last": "LastName"} {
+				if v, ok := name[from]; ok {
+					if _, set := info[to]; !set {
+						info[to] = v
+					}
+				}
+			}
+			delete(doc, "name")
+			return doc, nil
+		},
+	})
+}
+
+// migrationRunner - applies a type's pending migrations to its documents.
+// Bookkeeping lives next to the data, under migrations:<Type>:
+//
+//	version  last migration applied to every document
+//	lock     held by the running runner, expiring after LockTTL
+//	cursor   "<version> <SCAN cursor>" of a migration in progress
+type migrationRunner struct {
+	Type string
+	// Pattern - keys holding the type's documents, lower case Type plus
+	// ":*" by default
+	Pattern string
+	// LockTTL - how long a crashed runner blocks others, 30s by default;
+	// the lock is renewed after every SCAN page
+	LockTTL time.Duration
+	// Progress - called after each SCAN page with the documents changed so
+	// far by the migration running
+	Progress func(m schemaMigration, changed int)
+}
+
+// errMigrationLocked - another runner holds the lock
+var errMigrationLocked = errors.New("another migration runner holds the lock")
+
+var migrationLockScripts = struct{ renew, release string }{"migration-lock-renew", "migration-lock-release"}
+
+func init() {
+	scripts.register(migrationLockScripts.renew, 1, `
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+`)
+	scripts.register(migrationLockScripts.release, 1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+}
+
+func (r migrationRunner) key(name string) string {
+	return "migrations:" + r.Type + ":" + name
+}
+
+// version - the last migration applied everywhere, 0 for none
+func (r migrationRunner) version(conn redis.Conn) (v int, err error) {
+	v, err = redis.Int(conn.Do("GET", r.key("version")))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, newCommandError("GET", r.key("version"), err)
+	}
+	return
+}
+
+// pending - migrations newer than the applied version
+func (r migrationRunner) pending(conn redis.Conn) (ms []schemaMigration, err error) {
+	v, err := r.version(conn)
+	if err != nil {
+		return
+	}
+	for _, m := range schemaMigrations[r.Type] {
+		if m.Version > v {
+			ms = append(ms, m)
+		}
+	}
+	return
+}
+
+// run - takes the lock and applies every pending migration in order,
+// picking an interrupted one up where it stopped. It returns the versions
+// applied.
+func (r migrationRunner) run(ctx context.Context, conn redis.Conn) (applied []int, err error) {
+	if _, ok := registeredTypes[r.Type]; !ok {
+		return nil, fmt.Errorf("unknown type %q (registered: %v)", r.Type, registeredNames())
+	}
+	if r.Pattern == "" {
+		r.Pattern = strings.ToLower(r.Type) + ":*"
+	}
+	if r.LockTTL <= 0 {
+		r.LockTTL = 30 * time.Second
+	}
+
+	token, err := r.lock(conn)
+	if err != nil {
+		return
+	}
+	defer scripts.run(conn, migrationLockScripts.release, r.key("lock"), token)
+
+	pending, err := r.pending(conn)
+	if err != nil {
+		return
+	}
+	for _, m := range pending {
+		err = r.apply(ctx, conn, token, m)
+		if err != nil {
+			return applied, fmt.Errorf("migration %s v%d (%s): %w", r.Type, m.Version, m.Name, err)
+		}
+		applied = append(applied, m.Version)
+	}
+	return
+}
+
+func (r migrationRunner) lock(conn redis.Conn) (token string, err error) {
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		return
+	}
+	token = hex.EncodeToString(b)
+
+	_, err = redis.String(conn.Do("SET", r.key("lock"), token, "NX", "PX", int64(r.LockTTL/time.Millisecond)))
+	if err == redis.ErrNil {
+		return "", errMigrationLocked
+	}
+	if err != nil {
+		return "", newCommandError("SET", r.key("lock"), err)
+	}
+	return
+}
+
+// apply - runs m over every document, checkpointing the SCAN cursor after
+// each page, then records m as applied
+func (r migrationRunner) apply(ctx context.Context, conn redis.Conn, token string, m schemaMigration) (err error) {
+	cursor := "0"
+	saved, err := redis.String(conn.Do("GET", r.key("cursor")))
+	if err != nil && err != redis.ErrNil {
+		return newCommandError("GET", r.key("cursor"), err)
+	}
+	if f := strings.Fields(saved); len(f) == 2 && f[0] == strconv.Itoa(m.Version) {
+		cursor = f[1]
+	}
+
+	var changed int
+	err = scanKeysFrom(ctx, conn, r.Pattern, cursor, func(key string) (err error) {
+		if strings.HasPrefix(key, "migrations:") {
+			return
+		}
+		ok, err := r.migrateDocument(ctx, conn, key, m)
+		if ok {
+			changed++
+		}
+		return
+	}, func(next string) (err error) {
+		if r.Progress != nil {
+			r.Progress(m, changed)
+		}
+		renewed, err := redis.Int(scripts.run(conn, migrationLockScripts.renew, r.key("lock"), token, int64(r.LockTTL/time.Millisecond)))
+		if err != nil {
+			return
+		}
+		if renewed == 0 {
+			return errMigrationLocked
+		}
+		_, err = conn.Do("SET", r.key("cursor"), fmt.Sprintf("%d %s", m.Version, next))
+		if err != nil {
+			return newCommandError("SET", r.key("cursor"), err)
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	tx := newMultiExec(conn)
+	tx.send("SET", r.key("version"), m.Version)
+	tx.send("DEL", r.key("cursor"))
+	replies, err := tx.exec(ctx)
+	if err != nil {
+		// name the command that failed: the version may be set while the
+		// cursor lingers
+		cmd, key := "SET", r.key("version")
+		if len(replies) == 2 && execError(replies[:1]) == nil {
+			cmd, key = "DEL", r.key("cursor")
+		}
+		return newCommandError(cmd, key, err)
+	}
+	return
+}
+
+// migrateDocument - runs m.Up over key in a WATCHed rewrite; changed is
+// false when Up left it as it was
+func (r migrationRunner) migrateDocument(ctx context.Context, conn redis.Conn, key string, m schemaMigration) (changed bool, err error) {
+	mode, err := detectStorageMode(conn, key)
+	if err == errUnknownMode || errors.Is(err, redis.ErrNil) {
+		return false, nil
+	}
+	if err != nil {
+		return
+	}
+
+	errUnchanged := errors.New("unchanged")
+	err = modifyValue(ctx, conn, mode, key, func(v interface{}) (interface{}, error) {
+		doc, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: not an object", key)
+		}
+		// Up may change doc in place
+		before := deepCopy(reflect.ValueOf(doc)).Interface()
+		doc, err := m.Up(doc)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		if reflect.DeepEqual(doc, before) {
+			return nil, errUnchanged
+		}
+		return doc, nil
+	})
+	if err == errUnchanged {
+		return false, nil
+	}
+	return err == nil, err
+}
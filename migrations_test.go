@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// migrationConn - a recordingConn holding one ReJSON document, doc, whose
+// final MULTI replies exec
+func migrationConn(doc string, exec []interface{}) *recordingConn {
+	rec := newRecordingConn(nil)
+	multi := false
+	rec.reply = func(cmd string, args []interface{}) (interface{}, error) {
+		switch cmd {
+		case "MULTI":
+			multi = true
+			return "OK", nil
+		case "EXEC":
+			multi = false
+			return exec, nil
+		}
+		if multi {
+			return "QUEUED", nil
+		}
+		switch cmd {
+		case "TYPE":
+			return "ReJSON-RL", nil
+		case "JSON.GET":
+			return []byte(doc), nil
+		case "GET":
+			return nil, nil
+		case "SCAN":
+			return []interface{}{[]byte("0"), []interface{}{}}, nil
+		case "EVALSHA":
+			return int64(1), nil
+		}
+		return "OK", nil
+	}
+	return rec
+}
+
+func TestMigrateDocumentInPlace(t *testing.T) {
+	tests := []struct {
+		name    string
+		up      func(doc map[string]interface{})
+		changed bool
+	}{
+		{"changed in place", func(doc map[string]interface{}) { doc["a"] = "b" }, true},
+		{"nested change", func(doc map[string]interface{}) { doc["n"].(map[string]interface{})["x"] = true }, true},
+		{"left alone", func(map[string]interface{}) {}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := migrationConn(`{"a":1,"n":{}}`, []interface{}{"OK"})
+			m := schemaMigration{Version: 1, Up: func(doc map[string]interface{}) (map[string]interface{}, error) {
+				tt.up(doc)
+				return doc, nil
+			}}
+			changed, err := migrationRunner{}.migrateDocument(context.Background(), rec, "k", m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed != tt.changed || (rec.count("JSON.SET", "k") == 1) != tt.changed {
+				t.Errorf("changed %v, sent %d JSON.SETs", changed, rec.count("JSON.SET", "k"))
+			}
+		})
+	}
+}
+
+func TestMigrationApplyNamesFailedCommand(t *testing.T) {
+	r := migrationRunner{Type: "Student", Pattern: "student:*"}
+	tests := []struct {
+		exec []interface{}
+		cmd  string
+	}{
+		{[]interface{}{wrongType, int64(1)}, "SET"},
+		{[]interface{}{"OK", wrongType}, "DEL"},
+	}
+	for _, tt := range tests {
+		err := r.apply(context.Background(), migrationConn("", tt.exec), "token", schemaMigration{Version: 1})
+		var ce *commandError
+		if !errors.As(err, &ce) || ce.Cmd != tt.cmd || !errors.Is(err, wrongType) {
+			t.Errorf("got %v, want %s failing", err, tt.cmd)
+		}
+	}
+}
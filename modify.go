@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// modifyAttempts - how often modifyStruct rereads and reapplies fn after a
+// concurrent write aborted its transaction
+const modifyAttempts = 10
+
+// errModifyConflict - every attempt lost to a concurrent writer
+var errModifyConflict = errors.New("modified concurrently, giving up")
+
+// modifyStruct - read-modify-write of the struct at key, stored in mode:
+// WATCH key, read it into value (a pointer to a struct), call fn to change
+// value, then replace the document in MULTI/EXEC. When another client
+// writes key in between, EXEC aborts and the whole cycle is retried, so fn
+// must only change value and may run more than once. An error from fn
+// aborts without writing, and is returned as is.
+func modifyStruct(ctx context.Context, conn redis.Conn, mode storageMode, key string, value interface{}, fn func() error) (err error) {
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("modifyStruct: want a non-nil pointer, got %T", value)
+	}
+
+	for attempt := 0; attempt < modifyAttempts; attempt++ {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+
+		var done bool
+		done, err = modifyOnce(ctx, conn, mode, key, rv, fn)
+		if err != nil || done {
+			return
+		}
+	}
+	return newCommandError("EXEC", key, errModifyConflict)
+}
+
+// modifyOnce - one WATCH/read/apply/EXEC cycle; done is false when EXEC was
+// aborted by a concurrent write
+func modifyOnce(ctx context.Context, conn redis.Conn, mode storageMode, key string, rv reflect.Value, fn func() error) (done bool, err error) {
+	_, err = doContext(ctx, conn, "WATCH", key)
+	if err != nil {
+		return false, newCommandError("WATCH", key, err)
+	}
+	defer conn.Do("UNWATCH")
+
+	// reread into a zeroed value, so fields a previous attempt's fn set
+	// don't leak into this one
+	rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
+	err = getStruct(conn, mode, key, rv.Interface())
+	if err != nil {
+		return
+	}
+
+	err = fn()
+	if err != nil {
+		return
+	}
+	err = refreshComputed(rv)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", key, err)
+	}
+	err = checkEnums(rv.Interface(), false)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", key, err)
+	}
+
+	var m *multiExec
+	cmd := "HMSET"
+	if mode == modeHash {
+		var fields, bits redis.Args
+		fields, bits, err = hashReplaceArgs(key, rv.Interface())
+		if err != nil {
+			return
+		}
+		m = newMultiExec(conn)
+		sendHashReplace(m, key, fields, bits)
+	} else {
+		var args redis.Args
+		cmd, args, err = modifyCommand(mode, key, rv.Interface())
+		if err != nil {
+			return
+		}
+		m = newMultiExec(conn)
+		m.send(cmd, args...)
+	}
+	replies, err := m.exec(ctx)
+	if err != nil {
+		return false, newCommandError(cmd, key, err)
+	}
+	return replies != nil, nil
+}
+
+// modifyCommand - the command writing value back in the JSON modes
+func modifyCommand(mode storageMode, key string, value interface{}) (cmd string, args redis.Args, err error) {
+	b, err := encodeJSON(value)
+	if err != nil {
+		return
+	}
+	defer b.release()
+	return rawCommand(mode, key, b.bytes())
+}
+
+// modifyStudent - modifyStruct for Students
+func modifyStudent(ctx context.Context, conn redis.Conn, mode storageMode, key string, fn func(s *Student) error) error {
+	var s Student
+	return modifyStruct(ctx, conn, mode, key, &s, func() error {
+		return fn(&s)
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// modifyConn - a recordingConn holding stored for modifyStruct to read,
+// whose write EXEC replies write
+func modifyConn(stored bitsDoc, write []interface{}) *recordingConn {
+	rec := newRecordingConn(nil)
+	execs := 0
+	rec.reply = func(cmd string, args []interface{}) (interface{}, error) {
+		switch cmd {
+		case "MULTI":
+			return "OK", nil
+		case "EXEC":
+			execs++
+			if execs > 1 {
+				return write, nil
+			}
+			// HGETALL, then BITFIELD GET
+			return []interface{}{hashOf(stored), []interface{}{int64(stored.Attempts), int64(0), int64(0)}}, nil
+		}
+		return "QUEUED", nil
+	}
+	return rec
+}
+
+func TestModifyStructHash(t *testing.T) {
+	rec := modifyConn(bitsDoc{Name: "a", Attempts: 1}, []interface{}{int64(1), "OK", []interface{}{int64(1), int64(0), int64(0)}})
+	var doc bitsDoc
+	err := modifyStruct(context.Background(), rec, modeHash, "k", &doc, func() error {
+		doc.Attempts++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the write: what follows the read's EXEC
+	var sent []string
+	execs := 0
+	for _, c := range rec.commands() {
+		if execs == 1 && c.Cmd != "UNWATCH" {
+			sent = append(sent, fmt.Sprint(c.Cmd, c.Args))
+		}
+		if c.Cmd == "EXEC" {
+			execs++
+		}
+	}
+	want := []string{
+		"MULTI[]",
+		"DEL[k]",
+		"HMSET[k name a]",
+		"BITFIELD[{k}:bits SET u4 0 2 SET u1 4 0 SET i6 5 0]",
+		"EXEC[]",
+	}
+	if got := strings.Join(sent, " "); got != strings.Join(want, " ") {
+		t.Errorf("sent %s, want %s", got, strings.Join(want, " "))
+	}
+}
+
+func TestModifyStructHashExecError(t *testing.T) {
+	rec := modifyConn(bitsDoc{Name: "a"}, []interface{}{int64(1), "OK", wrongType})
+	var doc bitsDoc
+	checkExecFailed(t, modifyStruct(context.Background(), rec, modeHash, "k", &doc, func() error {
+		doc.Active = true
+		return nil
+	}))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// jsonFormat - JSON.GET's INDENT, NEWLINE and SPACE options. The zero value
+// is ReJSON's compact output.
+type jsonFormat struct {
+	Indent  string
+	Newline string
+	Space   string
+}
+
+// prettyJSON - the redis-cli walkthrough's formatting, INDENT "\t" NEWLINE
+// "\n" SPACE " "
+var prettyJSON = jsonFormat{Indent: "\t", Newline: "\n", Space: " "}
+
+// args - JSON.GET arguments selecting f, none for the zero value
+func (f jsonFormat) args() (args redis.Args) {
+	if f.Indent != "" {
+		args = args.Add("INDENT", f.Indent)
+	}
+	if f.Newline != "" {
+		args = args.Add("NEWLINE", f.Newline)
+	}
+	if f.Space != "" {
+		args = args.Add("SPACE", f.Space)
+	}
+	return
+}
+
+// apply - raw laid out the way JSON.GET would with f, for documents the
+// server can't format (hash and hash-json modes)
+func (f jsonFormat) apply(raw []byte) (out []byte, err error) {
+	var compact bytes.Buffer
+	err = json.Compact(&compact, raw)
+	if err != nil || f == (jsonFormat{}) {
+		return compact.Bytes(), err
+	}
+
+	var b bytes.Buffer
+	depth := 0
+	newline := func() {
+		b.WriteString(f.Newline)
+		b.WriteString(strings.Repeat(f.Indent, depth))
+	}
+
+	src := compact.Bytes()
+	inString, escaped := false, false
+	for i, c := range src {
+		if inString {
+			b.WriteByte(c)
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			inString = true
+			b.WriteByte(c)
+		case '{', '[':
+			b.WriteByte(c)
+			depth++
+			if i+1 < len(src) && src[i+1] != '}' && src[i+1] != ']' {
+				newline()
+			}
+		case '}', ']':
+			depth--
+			if i > 0 && src[i-1] != '{' && src[i-1] != '[' {
+				newline()
+			}
+			b.WriteByte(c)
+		case ',':
+			b.WriteByte(c)
+			newline()
+		case ':':
+			b.WriteByte(c)
+			b.WriteString(f.Space)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// getPretty - key as human readable JSON, whatever mode it is stored in
+func getPretty(conn redis.Conn, mode storageMode, key string) ([]byte, error) {
+	return getRaw(conn, mode, key, prettyJSON)
+}
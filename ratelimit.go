@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// ErrRateLimited - returned when a write is rejected by a rateLimiter
+var ErrRateLimited = errors.New("rate limited")
+
+// rateLimiter - token bucket deciding whether a write to key may proceed
+type rateLimiter interface {
+	allow(conn redis.Conn, key string) (bool, error)
+}
+
+// rateScope - maps a key to the bucket it draws tokens from
+type rateScope func(key string) string
+
+// perKey - every key has its own bucket
+func perKey(key string) string { return key }
+
+// perNamespace - keys share a bucket per prefix, e.g. "student:42" and
+// "student:43" both draw from "student"
+func perNamespace(key string) string {
+	if i := strings.Index(key, ":"); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// localRateLimiter - in-process token buckets, refilled at rate tokens per
+// second up to burst. A bucket left alone long enough to refill is the same
+// as a new one, so such buckets are dropped rather than kept for every key
+// ever seen.
+type localRateLimiter struct {
+	rate  float64
+	burst float64
+	scope rateScope
+	// idle - how long an empty bucket takes to refill
+	idle time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newLocalRateLimiter(rate float64, burst int, scope rateScope) (*localRateLimiter, error) {
+	if rate <= 0 {
+		return nil, fmt.Errorf("rate limit of %v per second, want more than 0", rate)
+	}
+	return &localRateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		scope:   scope,
+		idle:    time.Duration(float64(burst) / rate * float64(time.Second)),
+		buckets: make(map[string]*tokenBucket),
+		swept:   time.Now(),
+	}, nil
+}
+
+func (l *localRateLimiter) allow(conn redis.Conn, key string) (bool, error) {
+	name := l.scope(key)
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.swept) >= l.idle {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[name]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[name] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, nil
+	}
+	b.tokens--
+	return true, nil
+}
+
+// sweep - drops the buckets that have refilled by now. l.mu must be held.
+func (l *localRateLimiter) sweep(now time.Time) {
+	for name, b := range l.buckets {
+		if now.Sub(b.last) >= l.idle {
+			delete(l.buckets, name)
+		}
+	}
+	l.swept = now
+}
+
+// redisRateLimiter - token buckets kept in redis so that every process
+// writing to the same server shares the limit
+type redisRateLimiter struct {
+	rate   float64
+	burst  int
+	scope  rateScope
+	prefix string
+}
+
+// newRedisRateLimiter - rate must be positive: the script expires a
+// bucket once it could have refilled, burst/rate seconds after its last use
+func newRedisRateLimiter(rate float64, burst int, scope rateScope) (*redisRateLimiter, error) {
+	if rate <= 0 {
+		return nil, fmt.Errorf("rate limit of %v per second, want more than 0", rate)
+	}
+	return &redisRateLimiter{
+		rate:   rate,
+		burst:  burst,
+		scope:  scope,
+		prefix: "ratelimit:",
+	}, nil
+}
+
+// CHECKPOINT -
+// The bucket is refilled and drawn from in a single script so concurrent
+// writers can't both take the last token. The server clock is used so that
+// skew between client hosts doesn't matter.
+var tokenBucketScript = scripts.register("token-bucket", 1, `
+redis.replicate_commands()
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call("TIME")
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+
+local b = redis.call("HMGET", KEYS[1], "tokens", "last")
+local tokens = tonumber(b[1]) or burst
+local last = tonumber(b[2]) or now
+
+tokens = math.min(burst, tokens + (now - last) * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "last", tostring(now))
+redis.call("EXPIRE", KEYS[1], math.ceil(burst / rate) + 1)
+return allowed
+`)
+
+func (l *redisRateLimiter) allow(conn redis.Conn, key string) (bool, error) {
+	return redis.Bool(scripts.run(conn, "token-bucket", l.prefix+l.scope(key), l.rate, l.burst))
+}
+
+// addStructReJSONLimited - addStructReJSON guarded by limiter. A value
+// that can't be stored fails without taking a token.
+func addStructReJSONLimited(conn redis.Conn, limiter rateLimiter, key string, value interface{}) (err error) {
+	value, err = prepareSet(key, value)
+	if err != nil {
+		return
+	}
+	ok, err := limiter.allow(conn, key)
+	if err != nil {
+		return
+	}
+	if !ok {
+		return ErrRateLimited
+	}
+	return addStructReJSON(conn, key, value)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRejectsRate(t *testing.T) {
+	for _, rate := range []float64{0, -1} {
+		if _, err := newLocalRateLimiter(rate, 1, perKey); err == nil {
+			t.Errorf("local: rate %v allowed", rate)
+		}
+		if _, err := newRedisRateLimiter(rate, 1, perKey); err == nil {
+			t.Errorf("redis: rate %v allowed", rate)
+		}
+	}
+}
+
+func TestLocalRateLimiterEvicts(t *testing.T) {
+	// a bucket refills in a millisecond
+	l, err := newLocalRateLimiter(1000, 1, perKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := l.allow(nil, "a"); !ok {
+		t.Fatal("a: first write refused")
+	}
+	if ok, _ := l.allow(nil, "a"); ok {
+		t.Fatal("a: burst exceeded")
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	if ok, _ := l.allow(nil, "b"); !ok {
+		t.Fatal("b: first write refused")
+	}
+	if _, ok := l.buckets["a"]; ok || len(l.buckets) != 1 {
+		t.Errorf("buckets %v, want only b", l.buckets)
+	}
+}
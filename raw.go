@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// setRaw - stores the JSON document raw under key. In hash mode raw must be
+// an object; each top-level member becomes a hash field, strings as-is and
+// anything else as its JSON text (the same lossy flattening HMSET does for
+// structs). typ, when not nil, is the type raw holds, whose bits fields go
+// to key's bits string as splitRawBits says.
+func setRaw(conn redis.Conn, mode storageMode, key string, raw []byte, typ reflect.Type) (err error) {
+	raw, bits, _, err := splitRawBits(mode, key, raw, typ)
+	if err != nil {
+		return
+	}
+	cmd, args, err := rawCommand(mode, key, raw)
+	if err != nil {
+		return
+	}
+	if bits != nil {
+		m := newMultiExec(conn)
+		m.send(cmd, args...)
+		m.send("BITFIELD", bits...)
+		_, err = m.exec(context.Background())
+	} else {
+		_, err = conn.Do(cmd, args...)
+	}
+	if err != nil {
+		return newCommandError(cmd, key, err)
+	}
+	return
+}
+
+// splitRawBits - in hash mode, takes the members for typ's bits fields out
+// of raw, a document of that type, returning what is left and the BITFIELD
+// arguments writing them to key's bits string, as addStructHash stores
+// them. moved names the members taken out. Bits fields raw has no member
+// for are left alone. Otherwise, and for a nil typ, raw comes back as is
+// with nil bits.
+func splitRawBits(mode storageMode, key string, raw []byte, typ reflect.Type) (rest []byte, bits redis.Args, moved []string, err error) {
+	rest = raw
+	if mode != modeHash || typ == nil {
+		return
+	}
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	fields, err := bitFieldsOf(typ)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%s: %w", key, err)
+	}
+	var members map[string]json.RawMessage
+	if len(fields) == 0 || json.Unmarshal(raw, &members) != nil {
+		// not an object: rawCommand says so
+		return
+	}
+
+	v := reflect.New(typ).Elem()
+	for _, f := range fields {
+		for name, m := range members {
+			sf, _, ok := structFieldFor(typ, name)
+			if !ok || sf.Index[0] != f.index {
+				continue
+			}
+			fv := v.Field(f.index)
+			err = json.Unmarshal(m, fv.Addr().Interface())
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("%s: %s: %w", key, name, err)
+			}
+			var n int64
+			n, err = f.load(fv)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("%s: %w", key, err)
+			}
+			if bits == nil {
+				bits = redis.Args{bitsKey(key)}
+			}
+			bits = bits.Add("SET", f.typ, f.offset, n)
+			delete(members, name)
+			moved = append(moved, name)
+		}
+	}
+	if bits == nil {
+		return
+	}
+	rest, err = json.Marshal(members)
+	if err != nil {
+		return nil, nil, nil, encodeError(err)
+	}
+	return
+}
+
+// rawCommand - the single command setRaw issues, for callers pipelining
+// many documents
+func rawCommand(mode storageMode, key string, raw []byte) (cmd string, args redis.Args, err error) {
+	if !json.Valid(raw) {
+		return "", nil, fmt.Errorf("%s: invalid JSON", key)
+	}
+
+	switch mode {
+	case modeReJSON:
+		return "JSON.SET", redis.Args{key, ".", string(raw)}, nil
+	case modeHashJSON:
+		return "HSET", redis.Args{key, "JSON", string(raw)}, nil
+	case modeHash:
+		var fields map[string]json.RawMessage
+		err = json.Unmarshal(raw, &fields)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s: hash mode needs a JSON object: %w", key, err)
+		}
+		if len(fields) == 0 {
+			return "", nil, fmt.Errorf("%s: hash mode can't store an empty object", key)
+		}
+
+		args = redis.Args{key}
+		for name, v := range fields {
+			var s string
+			if json.Unmarshal(v, &s) != nil {
+				s = string(v)
+			}
+			args = args.Add(name, s)
+		}
+		return "HMSET", args, nil
+	}
+	return "", nil, fmt.Errorf("unknown storage mode %v", mode)
+}
+
+// getRaw - reads key back as JSON, laid out as format says (compact when
+// omitted). Hash mode yields an object of strings.
+func getRaw(conn redis.Conn, mode storageMode, key string, format ...jsonFormat) (raw []byte, err error) {
+	var f jsonFormat
+	if len(format) > 0 {
+		f = format[0]
+	}
+
+	switch mode {
+	case modeReJSON:
+		raw, err = redis.Bytes(conn.Do("JSON.GET", redis.Args{key}.AddFlat(f.args())...))
+		if err != nil {
+			return nil, newCommandError("JSON.GET", key, err)
+		}
+		return
+	case modeHashJSON:
+		raw, err = redis.Bytes(conn.Do("HGET", key, "JSON"))
+		if err != nil {
+			return nil, newCommandError("HGET", key, err)
+		}
+		if len(format) > 0 {
+			return f.apply(raw)
+		}
+		return
+	case modeHash:
+		var fields map[string]string
+		fields, err = redis.StringMap(conn.Do("HGETALL", key))
+		if err != nil {
+			return nil, newCommandError("HGETALL", key, err)
+		}
+		if len(fields) == 0 {
+			return nil, newCommandError("HGETALL", key, redis.ErrNil)
+		}
+		raw, err = json.Marshal(fields)
+		if err != nil || len(format) == 0 {
+			return
+		}
+		return f.apply(raw)
+	}
+	return nil, fmt.Errorf("unknown storage mode %v", mode)
+}
+
+// resolveMode - parses name, detecting the mode key is stored in for "auto"
+func resolveMode(conn redis.Conn, key, name string) (storageMode, error) {
+	if name == "auto" {
+		return detectStorageMode(conn, key)
+	}
+	return parseStorageMode(name)
+}
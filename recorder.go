@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// recordedCommand - one command issued through a recordingConn
+type recordedCommand struct {
+	Cmd   string
+	Args  []interface{}
+	Reply interface{}
+	Err   error
+}
+
+// recordingConn - redis.Conn that captures every command, its arguments and
+// its reply so tests can assert on exactly what was sent. With a nil conn it
+// needs no server: replies come from reply, or default to what a successful
+// write would return (nil for reads).
+type recordingConn struct {
+	conn  redis.Conn
+	reply func(cmd string, args []interface{}) (interface{}, error)
+
+	mu      sync.Mutex
+	cmds    []recordedCommand
+	pending []int
+	// queued - in stub mode, the replies EXEC will give to the commands
+	// queued since MULTI; nil outside a transaction
+	queued []interface{}
+}
+
+func newRecordingConn(conn redis.Conn) *recordingConn {
+	return &recordingConn{conn: conn}
+}
+
+func (c *recordingConn) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+func (c *recordingConn) Err() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Err()
+}
+
+func (c *recordingConn) Do(cmd string, args ...interface{}) (reply interface{}, err error) {
+	// as on a real connection, what was sent before is answered first
+	pending, err := c.receivePending()
+	if err != nil || cmd == "" {
+		return pending, err
+	}
+
+	if c.conn != nil {
+		reply, err = c.conn.Do(cmd, args...)
+	} else {
+		reply, err = c.stub(cmd, args)
+	}
+
+	c.mu.Lock()
+	c.cmds = append(c.cmds, recordedCommand{Cmd: cmd, Args: copyArgs(args), Reply: reply, Err: err})
+	c.mu.Unlock()
+	return
+}
+
+func (c *recordingConn) Send(cmd string, args ...interface{}) (err error) {
+	if c.conn != nil {
+		err = c.conn.Send(cmd, args...)
+		if err != nil {
+			return
+		}
+	}
+
+	c.mu.Lock()
+	c.pending = append(c.pending, len(c.cmds))
+	c.cmds = append(c.cmds, recordedCommand{Cmd: cmd, Args: copyArgs(args)})
+	c.mu.Unlock()
+	return
+}
+
+func (c *recordingConn) Flush() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Flush()
+}
+
+// Receive - fills in the reply of the oldest Send still waiting for one
+func (c *recordingConn) Receive() (reply interface{}, err error) {
+	c.mu.Lock()
+	if len(c.pending) == 0 {
+		c.mu.Unlock()
+		if c.conn == nil {
+			return nil, fmt.Errorf("recordingConn: Receive without Send")
+		}
+		return c.conn.Receive()
+	}
+	i := c.pending[0]
+	c.pending = c.pending[1:]
+	rc := c.cmds[i]
+	c.mu.Unlock()
+
+	if c.conn != nil {
+		reply, err = c.conn.Receive()
+	} else {
+		reply, err = c.stub(rc.Cmd, rc.Args)
+	}
+
+	c.mu.Lock()
+	c.cmds[i].Reply, c.cmds[i].Err = reply, err
+	c.mu.Unlock()
+	return
+}
+
+// receivePending - the replies of every Send still waiting for one, so
+// the Receives after a Do don't pair replies with the wrong commands
+func (c *recordingConn) receivePending() (replies []interface{}, err error) {
+	c.mu.Lock()
+	n := len(c.pending)
+	c.mu.Unlock()
+	if n == 0 {
+		return
+	}
+
+	if err = c.Flush(); err != nil {
+		return
+	}
+	for i := 0; i < n; i++ {
+		reply, err := c.Receive()
+		if re, ok := err.(redis.Error); ok {
+			reply, err = re, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, reply)
+	}
+	return
+}
+
+// copyArgs - args with []byte arguments copied, since callers reuse the
+// buffers they pass (see encodeJSON) once the command is sent
+func copyArgs(args []interface{}) []interface{} {
+	out := make([]interface{}, len(args))
+	for i, arg := range args {
+		if b, ok := arg.([]byte); ok {
+			arg = append([]byte(nil), b...)
+		}
+		out[i] = arg
+	}
+	return out
+}
+
+// stub - the reply to cmd without a server: reply's, or else a successful
+// write's. Commands between MULTI and EXEC are QUEUED, and EXEC answers
+// with an array holding each one's reply.
+func (c *recordingConn) stub(cmd string, args []interface{}) (interface{}, error) {
+	if c.reply != nil {
+		return c.reply(cmd, args)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch strings.ToUpper(cmd) {
+	case "MULTI":
+		c.queued = []interface{}{}
+		return "OK", nil
+	case "EXEC":
+		replies := c.queued
+		c.queued = nil
+		if replies == nil {
+			return nil, redis.Error("ERR EXEC without MULTI")
+		}
+		return replies, nil
+	case "DISCARD":
+		c.queued = nil
+		return "OK", nil
+	}
+	if c.queued != nil {
+		c.queued = append(c.queued, writeReply(cmd, args))
+		return "QUEUED", nil
+	}
+	return writeReply(cmd, args), nil
+}
+
+// commands - everything recorded so far
+func (c *recordingConn) commands() []recordedCommand {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]recordedCommand(nil), c.cmds...)
+}
+
+// count - number of recorded cmd commands whose leading arguments equal args,
+// e.g. count("JSON.SET", "JohnDoeJSON", ".rank")
+func (c *recordingConn) count(cmd string, args ...interface{}) (n int) {
+	for _, rc := range c.commands() {
+		if !strings.EqualFold(rc.Cmd, cmd) || len(rc.Args) < len(args) {
+			continue
+		}
+
+		match := true
+		for i, arg := range args {
+			if fmt.Sprint(arg) != argString(rc.Args[i]) {
+				match = false
+				break
+			}
+		}
+		if match {
+			n++
+		}
+	}
+	return
+}
+
+// reset - forgets everything recorded so far
+func (c *recordingConn) reset() {
+	c.mu.Lock()
+	c.cmds, c.pending, c.queued = nil, nil, nil
+	c.mu.Unlock()
+}
+
+func argString(arg interface{}) string {
+	if b, ok := arg.([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprint(arg)
+}
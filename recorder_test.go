@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestRecordingConnPipeline(t *testing.T) {
+	rec := newRecordingConn(nil)
+
+	// Do answers what was sent before it, so later Receives stay in step
+	rec.Send("SET", "a", "1")
+	if reply, err := rec.Do("DEL", "a"); err != nil || reply != int64(1) {
+		t.Errorf("DEL: got %#v, %v", reply, err)
+	}
+	rec.Send("HSET", "b", "f", "v")
+	rec.Flush()
+	if reply, err := rec.Receive(); err != nil || reply != int64(1) {
+		t.Errorf("HSET: got %#v, %v", reply, err)
+	}
+
+	rec.Send("SET", "c", "1")
+	rec.Send("GET", "c")
+	replies, err := rec.Do("")
+	if err != nil || !reflect.DeepEqual(replies, []interface{}{"OK", nil}) {
+		t.Errorf(`Do(""): got %#v, %v`, replies, err)
+	}
+
+	for i, rc := range rec.commands() {
+		if rc.Cmd != "GET" && rc.Reply == nil {
+			t.Errorf("command %d (%s) has no reply", i, rc.Cmd)
+		}
+	}
+}
+
+func TestRecordingConnTransaction(t *testing.T) {
+	rec := newRecordingConn(nil)
+
+	m := newMultiExec(rec)
+	m.send("SET", "k", "v")
+	m.send("HSET", "h", "f", "v")
+	m.send("GET", "k")
+	replies, err := m.exec(context.Background())
+	if err != nil || !reflect.DeepEqual(replies, []interface{}{"OK", int64(1), nil}) {
+		t.Errorf("EXEC: got %#v, %v", replies, err)
+	}
+	for _, rc := range rec.commands()[1:3] {
+		if rc.Reply != "QUEUED" {
+			t.Errorf("%s inside MULTI: got %#v, want QUEUED", rc.Cmd, rc.Reply)
+		}
+	}
+
+	if _, err = rec.Do("EXEC"); err == nil {
+		t.Error("EXEC without MULTI: no error")
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// redaction - what reads meant for API responses do with fields tagged
+// `redis:"...,sensitive"`
+type redaction int
+
+const (
+	redactNone redaction = iota
+	// redactMask - strings become redactedMask, anything else its zero
+	// value
+	redactMask
+	// redactOmit - the field is left out (zeroed, in a struct)
+	redactOmit
+)
+
+const redactedMask = "[redacted]"
+
+func parseRedaction(s string) (redaction, error) {
+	switch s {
+	case "", "none":
+		return redactNone, nil
+	case "mask":
+		return redactMask, nil
+	case "omit":
+		return redactOmit, nil
+	}
+	return 0, fmt.Errorf("unknown redaction %q (want none, mask or omit)", s)
+}
+
+type privilegedKey struct{}
+
+// withPrivileged - marks reads made under ctx as entitled to sensitive
+// fields, e.g. for an admin endpoint
+func withPrivileged(ctx context.Context) context.Context {
+	return context.WithValue(ctx, privilegedKey{}, true)
+}
+
+func isPrivileged(ctx context.Context) bool {
+	p, _ := ctx.Value(privilegedKey{}).(bool)
+	return p
+}
+
+// getStructRedacted - getStruct, then sensitive fields of value redacted as
+// how says unless ctx is privileged
+func getStructRedacted(ctx context.Context, conn redis.Conn, mode storageMode, key string, value interface{}, how redaction) (err error) {
+	err = getStruct(conn, mode, key, value)
+	if err != nil || how == redactNone || isPrivileged(ctx) {
+		return
+	}
+	redactValue(reflect.ValueOf(value), how)
+	return
+}
+
+// redactValue - redacts the sensitive fields of v, a struct or anything
+// holding structs, in place
+func redactValue(v reflect.Value, how redaction) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			redactValue(v.Elem(), how)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			redactValue(v.Index(i), how)
+		}
+	case reflect.Map:
+		// map elements aren't addressable; redact copies and put them back
+		for _, k := range v.MapKeys() {
+			e := reflect.New(v.Type().Elem()).Elem()
+			e.Set(v.MapIndex(k))
+			redactValue(e, how)
+			v.SetMapIndex(k, e)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		if !tagUseOf(t).sensitive {
+			return
+		}
+		info := structInfoOf(t)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			fv := v.Field(i)
+			if !fv.CanSet() {
+				continue
+			}
+			if !info.tags[i].has("sensitive") {
+				redactValue(fv, how)
+				continue
+			}
+			if how == redactMask && fv.Kind() == reflect.String {
+				fv.SetString(redactedMask)
+				continue
+			}
+			fv.Set(reflect.Zero(f.Type))
+		}
+	}
+}
+
+// redactJSON - raw, a document of type typ as getRaw returns it, with the
+// members for sensitive fields masked or removed. Members are matched by
+// JSON name, or by redis tag or Go name for hash mode fields.
+func redactJSON(raw []byte, typ reflect.Type, how redaction) ([]byte, error) {
+	if how == redactNone {
+		return raw, nil
+	}
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	err := dec.Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+	redactDoc(doc, typ, how)
+	return json.Marshal(doc)
+}
+
+// redactHit - a searchHit's Doc with sensitive members redacted: the JSON
+// document of an ON JSON index, or the returned fields of an ON HASH one
+func redactHit(doc interface{}, typ reflect.Type, how redaction) (interface{}, error) {
+	switch d := doc.(type) {
+	case json.RawMessage:
+		raw, err := redactJSON(d, typ, how)
+		return json.RawMessage(raw), err
+	case map[string]string:
+		fields := make(map[string]interface{}, len(d))
+		for name, v := range d {
+			fields[name] = v
+		}
+		redactDoc(fields, typ, how)
+		return fields, nil
+	}
+	redactDoc(doc, typ, how)
+	return doc, nil
+}
+
+func redactDoc(doc interface{}, typ reflect.Type, how redaction) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		switch typ.Kind() {
+		case reflect.Struct:
+			fields := jsonFields(typ)
+			for name, v := range d {
+				f, ok := fields[name]
+				if !ok {
+					f, _, ok = structFieldFor(typ, name)
+				}
+				if !ok {
+					continue
+				}
+				if !parseFieldTag(f).has("sensitive") {
+					redactDoc(v, f.Type, how)
+					continue
+				}
+				if how == redactOmit {
+					delete(d, name)
+				} else {
+					d[name] = redactedMask
+				}
+			}
+		case reflect.Map:
+			for _, v := range d {
+				redactDoc(v, typ.Elem(), how)
+			}
+		}
+	case []interface{}:
+		if typ.Kind() == reflect.Slice || typ.Kind() == reflect.Array {
+			for _, v := range d {
+				redactDoc(v, typ.Elem(), how)
+			}
+		}
+	}
+}
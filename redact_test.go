@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+type redactedDoc struct {
+	Name     string `json:"name" redis:"name"`
+	Password string `json:"password" redis:"pw,sensitive"`
+}
+
+func TestRESTQueryRedactsHits(t *testing.T) {
+	registerType("redactedDoc", redactedDoc{})
+	defer delete(registeredTypes, "redactedDoc")
+
+	tests := []struct {
+		name string
+		// fields - what FT.SEARCH returns for the one hit
+		fields []interface{}
+		want   interface{}
+	}{
+		{
+			"json index",
+			[]interface{}{[]byte("$"), []byte(`{"name":"ann","password":"hunter2"}`)},
+			map[string]interface{}{"name": "ann", "password": redactedMask},
+		},
+		{
+			"hash index",
+			[]interface{}{[]byte("name"), []byte("ann"), []byte("pw"), []byte("hunter2")},
+			map[string]interface{}{"name": "ann", "pw": redactedMask},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := newRecordingConn(nil)
+			rec.reply = func(string, []interface{}) (interface{}, error) {
+				return []interface{}{int64(1), []byte("doc:1"), tt.fields}, nil
+			}
+			h, err := newRESTHandler(nil, nil, restResource{Type: "redactedDoc", Index: "idx", Redact: redactMask})
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply, err := h.query(rec, h.resources["redacteddocs"], httptest.NewRequest("GET", "/redacteddocs?query=ann", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// as the client sees it
+			raw, err := json.Marshal(reply)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got restQueryReply
+			if err = json.Unmarshal(raw, &got); err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Hits) != 1 || !reflect.DeepEqual(got.Hits[0].Doc, tt.want) {
+				t.Errorf("got %s, want hit %v", raw, tt.want)
+			}
+		})
+	}
+}
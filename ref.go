@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Ref - a reference to another stored object of type T. Only the key is
+// stored: as a JSON string in documents and as the field's value in hash
+// mode. Load fetches the object, or getStructEager does it for every Ref
+// in a document.
+//
+//	type Student struct {
+//		Advisor Ref[Advisor] `json:"advisor"`
+//	}
+type Ref[T any] struct {
+	Key string
+
+	value *T
+}
+
+// NewRef - a reference to key
+func NewRef[T any](key string) Ref[T] {
+	return Ref[T]{Key: key}
+}
+
+// RefTo - a reference to key, already resolved to v, e.g. for an object
+// that was just stored
+func RefTo[T any](key string, v *T) Ref[T] {
+	return Ref[T]{Key: key, value: v}
+}
+
+// Load - the referenced object, read in whatever mode it is stored in the
+// first time and remembered after. A zero Ref loads nil.
+func (r *Ref[T]) Load(ctx context.Context, conn redis.Conn) (v *T, err error) {
+	if r.value != nil || r.Key == "" {
+		return r.value, nil
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	mode, err := detectStorageMode(conn, r.Key)
+	if err != nil {
+		return
+	}
+	v = new(T)
+	err = getStruct(conn, mode, r.Key, v)
+	if err != nil {
+		return nil, err
+	}
+	r.value = v
+	return
+}
+
+// Loaded - the referenced object if Load (or an eager Get) has fetched it
+func (r Ref[T]) Loaded() (v *T, ok bool) {
+	return r.value, r.value != nil
+}
+
+// IsZero - whether r refers to nothing
+func (r Ref[T]) IsZero() bool {
+	return r.Key == ""
+}
+
+func (r Ref[T]) MarshalJSON() ([]byte, error) {
+	if r.Key == "" {
+		return []byte("null"), nil
+	}
+	return json.Marshal(r.Key)
+}
+
+func (r *Ref[T]) UnmarshalJSON(b []byte) error {
+	*r = Ref[T]{}
+	if string(b) == "null" {
+		return nil
+	}
+	return json.Unmarshal(b, &r.Key)
+}
+
+// RedisArg - the key, for HMSET
+func (r Ref[T]) RedisArg() interface{} {
+	return r.Key
+}
+
+// RedisScan - the key, from HGETALL
+func (r *Ref[T]) RedisScan(src interface{}) error {
+	switch src := src.(type) {
+	case []byte:
+		*r = Ref[T]{Key: string(src)}
+	case string:
+		*r = Ref[T]{Key: src}
+	case nil:
+		*r = Ref[T]{}
+	default:
+		return fmt.Errorf("Ref: can't scan %T", src)
+	}
+	return nil
+}
+
+// refLoader - what every *Ref[T] is, whatever T
+type refLoader interface {
+	loadRef(ctx context.Context, conn redis.Conn) (loaded interface{}, err error)
+	// refKey - the key referred to
+	refKey() string
+	// refType - T
+	refType() reflect.Type
+}
+
+func (r *Ref[T]) refKey() string { return r.Key }
+
+func (r *Ref[T]) refType() reflect.Type { return reflect.TypeOf((*T)(nil)).Elem() }
+
+func (r *Ref[T]) loadRef(ctx context.Context, conn redis.Conn) (interface{}, error) {
+	v, err := r.Load(ctx, conn)
+	if v == nil {
+		return nil, err
+	}
+	return v, err
+}
+
+// getStructEager - getStruct, then every Ref in value loaded, and the Refs
+// in what they load, depth levels down (1 for just value's own)
+func getStructEager(ctx context.Context, conn redis.Conn, mode storageMode, key string, value interface{}, depth int) (err error) {
+	err = getStruct(conn, mode, key, value)
+	if err != nil {
+		return
+	}
+	return loadRefs(ctx, conn, reflect.ValueOf(value), depth)
+}
+
+// loadRefs - loads every Ref reachable from v, depth levels of references
+// deep
+func loadRefs(ctx context.Context, conn redis.Conn, v reflect.Value, depth int) (err error) {
+	if depth <= 0 {
+		return
+	}
+	if v.CanAddr() {
+		if l, ok := v.Addr().Interface().(refLoader); ok {
+			var loaded interface{}
+			loaded, err = l.loadRef(ctx, conn)
+			if err != nil || loaded == nil {
+				return
+			}
+			return loadRefs(ctx, conn, reflect.ValueOf(loaded), depth-1)
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			return loadRefs(ctx, conn, v.Elem(), depth)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath != "" {
+				continue
+			}
+			if err = loadRefs(ctx, conn, v.Field(i), depth); err != nil {
+				return
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err = loadRefs(ctx, conn, v.Index(i), depth); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
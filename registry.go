@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// registeredTypes - struct types that tooling (loadgen, the CLI, ...) can
+// refer to by name
+var registeredTypes = map[string]reflect.Type{
+	"Student": reflect.TypeOf(Student{}),
+}
+
+// registerType - makes the type of v available by name
+func registerType(name string, v interface{}) {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	registeredTypes[name] = t
+}
+
+// newRegistered - pointer to a new zero value of the type registered as name
+func newRegistered(name string) (interface{}, error) {
+	t, ok := registeredTypes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown type %q (registered: %v)", name, registeredNames())
+	}
+	return reflect.New(t).Interface(), nil
+}
+
+func registeredNames() []string {
+	names := make([]string, 0, len(registeredTypes))
+	for name := range registeredTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
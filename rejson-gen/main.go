@@ -0,0 +1,408 @@
+// rejson-gen - generates typed ReJSON accessors for annotated structs.
+//
+// A struct is annotated with a directive comment naming its key prefix:
+//
+//	//rejson:store student:
+//	type Student struct { ... }
+//
+// and `go generate` with
+//
+//	//go:generate go run ./rejson-gen
+//
+// writes student_store.go, holding a StudentStore with GetStudent and
+// SetStudent plus a setter per field (SetMajor, SetRank, ...) and an
+// incrementer per integer field (IncrRank, ...). JSON paths are resolved at
+// generation time, so the accessors never walk the struct with reflection.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const directive = "//rejson:store"
+
+var dir = flag.String("dir", ".", "package directory to scan for annotated structs")
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("rejson-gen: ")
+	flag.Parse()
+
+	err := generate(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// store - one annotated struct
+type store struct {
+	Package string
+	Type    string
+	Prefix  string
+	Fields  []field
+}
+
+// field - one settable path within the document
+type field struct {
+	Method string
+	// GoName - dotted Go field names from the root, for doc comments
+	GoName string
+	Path   string
+	Type   string
+	// Int - whether the field gets an Incr method
+	Int bool
+	// Nested - whether the field is inside another, which must exist
+	Nested bool
+}
+
+func generate(dir string) (err error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go") && !strings.HasSuffix(fi.Name(), "_store.go")
+	}, parser.ParseComments)
+	if err != nil {
+		return
+	}
+
+	for _, pkg := range pkgs {
+		structs := make(map[string]*ast.StructType)
+		var stores []store
+		for _, f := range pkg.Files {
+			for _, decl := range f.Decls {
+				gd, ok := decl.(*ast.GenDecl)
+				if !ok || gd.Tok != token.TYPE {
+					continue
+				}
+				for _, spec := range gd.Specs {
+					ts := spec.(*ast.TypeSpec)
+					st, ok := ts.Type.(*ast.StructType)
+					if !ok {
+						continue
+					}
+					structs[ts.Name.Name] = st
+
+					doc := ts.Doc
+					if doc == nil && len(gd.Specs) == 1 {
+						doc = gd.Doc
+					}
+					if prefix, ok := storePrefix(doc); ok {
+						stores = append(stores, store{Package: pkg.Name, Type: ts.Name.Name, Prefix: prefix})
+					}
+				}
+			}
+		}
+
+		for _, s := range stores {
+			s.Fields, err = fieldsOf(structs, structs[s.Type], "", "", nil)
+			if err != nil {
+				return fmt.Errorf("%s: %w", s.Type, err)
+			}
+			nameMethods(s.Fields)
+
+			var src []byte
+			src, err = render(s)
+			if err != nil {
+				return fmt.Errorf("%s: %w", s.Type, err)
+			}
+			name := filepath.Join(dir, strings.ToLower(s.Type)+"_store.go")
+			err = ioutil.WriteFile(name, src, 0644)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// storePrefix - the key prefix of a //rejson:store directive in doc
+func storePrefix(doc *ast.CommentGroup) (prefix string, ok bool) {
+	if doc == nil {
+		return
+	}
+	for _, c := range doc.List {
+		if c.Text == directive || strings.HasPrefix(c.Text, directive+" ") {
+			return strings.TrimSpace(strings.TrimPrefix(c.Text, directive)), true
+		}
+	}
+	return
+}
+
+// fieldsOf - the settable fields of st, recursing into structs declared in
+// the same package
+func fieldsOf(structs map[string]*ast.StructType, st *ast.StructType, path, goName string, seen []string) (fields []field, err error) {
+	for _, f := range st.Fields.List {
+		if len(f.Names) == 0 {
+			return nil, fmt.Errorf("embedded field %s isn't supported", exprString(f.Type))
+		}
+		for _, n := range f.Names {
+			if !n.IsExported() {
+				continue
+			}
+			jsonName := n.Name
+			if f.Tag != nil {
+				tag, _ := strconv.Unquote(f.Tag.Value)
+				if t := strings.Split(reflect.StructTag(tag).Get("json"), ",")[0]; t == "-" {
+					continue
+				} else if t != "" {
+					jsonName = t
+				}
+			}
+
+			fd := field{
+				GoName: strings.TrimPrefix(goName+"."+n.Name, "."),
+				Path:   path + pathElem(jsonName),
+				Type:   exprString(f.Type),
+				Nested: path != "",
+			}
+			fields = append(fields, fd)
+
+			base := f.Type
+			if star, ok := base.(*ast.StarExpr); ok {
+				base = star.X
+			}
+			id, ok := base.(*ast.Ident)
+			if !ok {
+				continue
+			}
+			switch id.Name {
+			case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64":
+				fields[len(fields)-1].Int = base == f.Type
+				continue
+			}
+			if nested, ok := structs[id.Name]; ok && !contains(seen, id.Name) {
+				var sub []field
+				sub, err = fieldsOf(structs, nested, fd.Path, fd.GoName, append(seen, id.Name))
+				if err != nil {
+					return
+				}
+				fields = append(fields, sub...)
+			}
+		}
+	}
+	return
+}
+
+// nameMethods - Set<Field> after the Go field name, or the whole dotted path
+// of Go names where that would collide
+func nameMethods(fields []field) {
+	count := make(map[string]int)
+	for _, f := range fields {
+		count[lastElem(f.GoName)]++
+	}
+	for i, f := range fields {
+		if count[lastElem(f.GoName)] == 1 {
+			fields[i].Method = lastElem(f.GoName)
+		} else {
+			fields[i].Method = strings.Replace(f.GoName, ".", "", -1)
+		}
+	}
+}
+
+var identRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// pathElem - a legacy ReJSON path element selecting name
+func pathElem(name string) string {
+	if identRE.MatchString(name) {
+		return "." + name
+	}
+	return "[" + strconv.Quote(name) + "]"
+}
+
+func lastElem(dotted string) string {
+	return dotted[strings.LastIndex(dotted, ".")+1:]
+}
+
+func contains(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func exprString(e ast.Expr) string {
+	var buf bytes.Buffer
+	format.Node(&buf, token.NewFileSet(), e)
+	return buf.String()
+}
+
+func render(s store) (src []byte, err error) {
+	var buf bytes.Buffer
+	err = storeTemplate.Execute(&buf, s)
+	if err != nil {
+		return
+	}
+	src, err = format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("generated invalid code: %w\n%s", err, buf.Bytes())
+	}
+	return
+}
+
+func hasInt(fields []field) bool {
+	for _, f := range fields {
+		if f.Int {
+			return true
+		}
+	}
+	return false
+}
+
+var storeTemplate = template.Must(template.New("store").Funcs(template.FuncMap{
+	"hasInt": hasInt,
+	"quote":  strconv.Quote,
+	"parent": func(dotted string) string { return dotted[:strings.LastIndex(dotted, ".")] },
+}).Parse(`// Code generated by rejson-gen; DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+{{- if hasInt .Fields}}
+	"strconv"
+{{- end}}
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// {{.Type}}Store - typed access to {{.Type}} documents stored as ReJSON under
+// {{quote .Prefix}} + id
+type {{.Type}}Store struct {
+	Conn redis.Conn
+}
+
+func (s {{.Type}}Store) key(id string) string {
+	return {{quote .Prefix}} + id
+}
+
+// Get{{.Type}} - the whole document
+func (s {{.Type}}Store) Get{{.Type}}(id string) (v {{.Type}}, err error) {
+	b, err := redis.Bytes(s.Conn.Do("JSON.GET", s.key(id)))
+	if err != nil {
+		return v, fmt.Errorf("JSON.GET %s: %w", s.key(id), err)
+	}
+	err = json.Unmarshal(b, &v)
+	return
+}
+
+// Set{{.Type}} - replaces the whole document
+func (s {{.Type}}Store) Set{{.Type}}(id string, v {{.Type}}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.set(id, ".", string(b))
+}
+// Modify{{.Type}} - reads the document, calls fn to change it and writes it
+// back, starting over when another client writes it in between; fn may run
+// more than once. An error from fn aborts without writing.
+func (s {{.Type}}Store) Modify{{.Type}}(ctx context.Context, id string, fn func(v *{{.Type}}) error) error {
+	for attempt := 0; attempt < 10; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		done, err := s.modify(id, fn)
+		if err != nil || done {
+			return err
+		}
+	}
+	return fmt.Errorf("modify %s: modified concurrently, giving up", s.key(id))
+}
+
+func (s {{.Type}}Store) modify(id string, fn func(v *{{.Type}}) error) (bool, error) {
+	_, err := s.Conn.Do("WATCH", s.key(id))
+	if err != nil {
+		return false, fmt.Errorf("WATCH %s: %w", s.key(id), err)
+	}
+	defer s.Conn.Do("UNWATCH")
+
+	v, err := s.Get{{.Type}}(id)
+	if err != nil {
+		return false, err
+	}
+	err = fn(&v)
+	if err != nil {
+		return false, err
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+
+	s.Conn.Send("MULTI")
+	s.Conn.Send("JSON.SET", s.key(id), ".", string(b))
+	replies, err := redis.Values(s.Conn.Do("EXEC"))
+	if err == redis.ErrNil {
+		// a concurrent write aborted the transaction
+		return false, nil
+	}
+	if err == nil {
+		err = s.execError(replies)
+	}
+	if err != nil {
+		return false, fmt.Errorf("JSON.SET %s: %w", s.key(id), err)
+	}
+	return true, nil
+}
+
+// execError - the first error reply among EXEC's replies: a queued
+// command's failure comes back among them, not as EXEC's error
+func (s {{.Type}}Store) execError(replies []interface{}) error {
+	for _, r := range replies {
+		if err, ok := r.(redis.Error); ok {
+			return err
+		}
+	}
+	return nil
+}
+{{range .Fields}}
+// Set{{.Method}} - sets {{.GoName}} ({{.Path}}){{if .Nested}}; {{parent .GoName}} must not be nil{{end}}
+func (s {{$.Type}}Store) Set{{.Method}}(id string, v {{.Type}}) error {
+{{- if .Int}}
+	return s.set(id, {{quote .Path}}, strconv.FormatInt(int64(v), 10))
+{{- else}}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.set(id, {{quote .Path}}, string(b))
+{{- end}}
+}
+{{if .Int}}
+// Incr{{.Method}} - adds by to {{.GoName}} ({{.Path}}), returning the new value
+func (s {{$.Type}}Store) Incr{{.Method}}(id string, by {{.Type}}) (n {{.Type}}, err error) {
+	r, err := redis.String(s.Conn.Do("JSON.NUMINCRBY", s.key(id), {{quote .Path}}, strconv.FormatInt(int64(by), 10)))
+	if err != nil {
+		return 0, fmt.Errorf("JSON.NUMINCRBY %s: %w", s.key(id), err)
+	}
+	err = json.Unmarshal([]byte(r), &n)
+	return
+}
+{{end}}
+{{- end}}
+func (s {{.Type}}Store) set(id, path, value string) error {
+	_, err := s.Conn.Do("JSON.SET", s.key(id), path, value)
+	if err != nil {
+		return fmt.Errorf("JSON.SET %s %s: %w", s.key(id), path, err)
+	}
+	return nil
+}
+`))
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// restMaxBody - largest request document accepted
+const restMaxBody = 1 << 20
+
+// restResource - a registered type served over HTTP
+type restResource struct {
+	// Type - registered type name; request bodies must decode into it
+	Type string
+	// Path - collection path segment, lower case Type plus "s" by default
+	Path string
+	// Prefix - key prefix documents are stored under, lower case Type
+	// plus ":" by default
+	Prefix string
+	Mode   storageMode
+	// Index - RediSearch index serving ?query=, if any
+	Index string
+	// Redact - what replies do with sensitive fields, unless the request
+	// context is privileged (see withPrivileged)
+	Redact redaction
+}
+
+// restHandler - CRUD and query endpoints over registered types:
+//
+//	GET    /students/{id}           the document
+//	PUT    /students/{id}           create or replace it
+//	POST   /students/{id}           create it, 409 if it exists
+//	DELETE /students/{id}           delete it
+//	GET    /students?query=@Major:{CSE}&offset=0&limit=10
+//	                                FT.SEARCH over the resource's Index
+//
+// Bodies and replies are JSON; errors are {"error": "..."}.
+type restHandler struct {
+	pool      *redis.Pool
+	logger    Logger
+	resources map[string]restResource
+}
+
+func newRESTHandler(pool *redis.Pool, logger Logger, resources ...restResource) (h *restHandler, err error) {
+	h = &restHandler{pool: pool, logger: orNop(logger), resources: make(map[string]restResource)}
+	for _, r := range resources {
+		if _, ok := registeredTypes[r.Type]; !ok {
+			return nil, fmt.Errorf("unknown type %q (registered: %v)", r.Type, registeredNames())
+		}
+		if r.Path == "" {
+			r.Path = strings.ToLower(r.Type) + "s"
+		}
+		if r.Prefix == "" {
+			r.Prefix = strings.ToLower(r.Type) + ":"
+		}
+		h.resources[r.Path] = r
+	}
+	return
+}
+
+// restError - an error with the status it should be reported with
+type restError struct {
+	status int
+	err    error
+}
+
+func (e restError) Error() string { return e.err.Error() }
+
+func (h *restHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(req.URL.Path, "/")
+	collection, id := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		collection, id = path[:i], path[i+1:]
+	}
+	res, ok := h.resources[collection]
+	if !ok || strings.Contains(id, "/") {
+		h.fail(w, req, restError{http.StatusNotFound, errors.New("no such resource")})
+		return
+	}
+
+	conn := h.pool.Get()
+	defer conn.Close()
+
+	var reply interface{}
+	status := http.StatusOK
+	var err error
+	switch {
+	case id == "" && req.Method == http.MethodGet:
+		reply, err = h.query(conn, res, req)
+	case id == "":
+		err = restError{http.StatusMethodNotAllowed, errors.New("use GET on a collection")}
+	case req.Method == http.MethodGet:
+		var raw []byte
+		raw, err = getRaw(conn, res.Mode, res.Prefix+id)
+		if err == nil {
+			raw, err = h.redact(req, res, raw)
+		}
+		reply = json.RawMessage(raw)
+	case req.Method == http.MethodPut, req.Method == http.MethodPost:
+		status, err = h.write(conn, res, res.Prefix+id, req)
+	case req.Method == http.MethodDelete:
+		err = h.delete(req.Context(), conn, res.Prefix+id)
+		status = http.StatusNoContent
+	default:
+		err = restError{http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", req.Method)}
+	}
+	if err != nil {
+		h.fail(w, req, err)
+		return
+	}
+
+	if reply == nil {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(reply)
+}
+
+// write - PUT upserts, POST only creates. Replies 201 for a new document
+// and 204 for a replaced one.
+func (h *restHandler) write(conn redis.Conn, res restResource, key string, req *http.Request) (status int, err error) {
+	raw, err := ioutil.ReadAll(io.LimitReader(req.Body, restMaxBody+1))
+	if err != nil {
+		return
+	}
+	if len(raw) > restMaxBody {
+		return 0, restError{http.StatusRequestEntityTooLarge, errors.New("document too large")}
+	}
+	raw = bytes.TrimSpace(raw)
+	raw, err = checkTyped(key, raw, res.Type)
+	if err != nil {
+		return 0, restError{http.StatusBadRequest, err}
+	}
+
+	// hash documents are written as several fields, so existence is
+	// checked and the write made in one transaction
+	_, err = conn.Do("WATCH", key)
+	if err != nil {
+		return
+	}
+	defer conn.Do("UNWATCH")
+	exists, err := redis.Bool(conn.Do("EXISTS", key))
+	if err != nil {
+		return
+	}
+	if exists && req.Method == http.MethodPost {
+		return 0, restError{http.StatusConflict, errors.New("already exists")}
+	}
+
+	raw, bits, _, err := splitRawBits(res.Mode, key, raw, registeredTypes[res.Type])
+	if err != nil {
+		return 0, restError{http.StatusBadRequest, err}
+	}
+	cmd, args, err := rawCommand(res.Mode, key, raw)
+	if err != nil {
+		return 0, restError{http.StatusBadRequest, err}
+	}
+	m := newMultiExec(conn)
+	if res.Mode == modeHash {
+		// the document is replaced, bits fields it leaves out too
+		m.send("DEL", key, bitsKey(key))
+	} else {
+		m.send("DEL", key)
+	}
+	m.send(cmd, args...)
+	if bits != nil {
+		m.send("BITFIELD", bits...)
+	}
+	replies, err := m.exec(req.Context())
+	if err != nil {
+		// including an error reply inside EXEC: fail reports a 503 for a
+		// transient one, a 500 otherwise
+		return 0, newCommandError(cmd, key, err)
+	}
+	if replies == nil {
+		return 0, restError{http.StatusConflict, errors.New("modified concurrently, retry")}
+	}
+
+	if exists {
+		return http.StatusNoContent, nil
+	}
+	return http.StatusCreated, nil
+}
+
+// delete - removes the document at key along with its bits string
+func (h *restHandler) delete(ctx context.Context, conn redis.Conn, key string) (err error) {
+	m := newMultiExec(conn)
+	m.send("DEL", key)
+	m.send("DEL", bitsKey(key))
+	replies, err := m.exec(ctx)
+	if err != nil {
+		return newCommandError("DEL", key, err)
+	}
+	var n int
+	if len(replies) > 0 {
+		n, err = redis.Int(replies[0], nil)
+	}
+	if err == nil && n == 0 {
+		err = restError{http.StatusNotFound, errors.New("not found")}
+	}
+	return
+}
+
+// restQueryReply - a page of search results
+type restQueryReply struct {
+	Total int64       `json:"total"`
+	Hits  []searchHit `json:"hits"`
+}
+
+func (h *restHandler) query(conn redis.Conn, res restResource, req *http.Request) (reply interface{}, err error) {
+	q := req.URL.Query()
+	if res.Index == "" {
+		return nil, restError{http.StatusNotImplemented, errors.New("no search index configured for " + res.Path)}
+	}
+	query := q.Get("query")
+	if query == "" {
+		query = "*"
+	}
+
+	intParam := func(name string, def int) (n int, err error) {
+		v := q.Get(name)
+		if v == "" {
+			return def, nil
+		}
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, restError{http.StatusBadRequest, fmt.Errorf("bad %s %q", name, v)}
+		}
+		return
+	}
+	offset, err := intParam("offset", 0)
+	if err != nil {
+		return
+	}
+	limit, err := intParam("limit", 10)
+	if err != nil {
+		return
+	}
+
+	hits, total, err := searchDocuments(conn, res.Index, query, offset, limit)
+	if err != nil {
+		return
+	}
+	if hits == nil {
+		hits = []searchHit{}
+	}
+	if res.Redact != redactNone && !isPrivileged(req.Context()) {
+		for i := range hits {
+			hits[i].Doc, err = redactHit(hits[i].Doc, registeredTypes[res.Type], res.Redact)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return restQueryReply{Total: total, Hits: hits}, nil
+}
+
+// redact - raw with sensitive fields redacted as res says, unless req is
+// privileged
+func (h *restHandler) redact(req *http.Request, res restResource, raw []byte) ([]byte, error) {
+	if res.Redact == redactNone || isPrivileged(req.Context()) {
+		return raw, nil
+	}
+	return redactJSON(raw, registeredTypes[res.Type], res.Redact)
+}
+
+// fail - reports err with the status it maps to
+func (h *restHandler) fail(w http.ResponseWriter, req *http.Request, err error) {
+	status := http.StatusInternalServerError
+	var re restError
+	switch {
+	case errors.As(err, &re):
+		status = re.status
+	case errors.Is(err, redis.ErrNil):
+		status, err = http.StatusNotFound, errors.New("not found")
+	case IsTransient(err):
+		status = http.StatusServiceUnavailable
+	}
+	if status >= 500 {
+		h.logger.Error("request failed", "method", req.Method, "path", req.URL.Path, "err", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
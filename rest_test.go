@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestRESTPutExecError(t *testing.T) {
+	rec := failingExecConn()
+	inner := rec.reply
+	rec.reply = func(cmd string, args []interface{}) (interface{}, error) {
+		switch cmd {
+		case "WATCH", "UNWATCH":
+			return "OK", nil
+		case "EXISTS":
+			return int64(0), nil
+		}
+		return inner(cmd, args)
+	}
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return rec, nil }}
+	h, err := newRESTHandler(pool, nil, restResource{Type: "Student", Mode: modeReJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/students/1", strings.NewReader(`{"rank":1}`)))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got %d %s, want 500", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// sampleOptions - where sampleKeys draws keys from. With neither KeySet nor
+// KeyHash it falls back to RANDOMKEY, which draws from the whole database
+// and so wastes calls on other namespaces.
+type sampleOptions struct {
+	// KeySet - a SET of the namespace's keys, e.g. one kept by SetOf,
+	// drawn from with SRANDMEMBER
+	KeySet string
+	// KeyHash - a hash whose fields are the namespace's keys, drawn from
+	// with HRANDFIELD (redis 6.2+)
+	KeyHash string
+	// MaxTries - RANDOMKEY calls at most, 10 per key wanted by default
+	MaxTries int
+}
+
+// sampledDoc - one document picked by sampleDocuments
+type sampledDoc struct {
+	Key   string
+	Value interface{}
+	// Err - why the document didn't decode, which is what a spot check is
+	// looking for
+	Err error
+}
+
+// sampleKeys - up to n distinct random keys starting with prefix. Fewer
+// come back when the namespace is smaller, or RANDOMKEY runs out of tries.
+func sampleKeys(ctx context.Context, conn redis.Conn, prefix string, n int, opts sampleOptions) (keys []string, err error) {
+	if n <= 0 {
+		return
+	}
+
+	switch {
+	case opts.KeySet != "":
+		// a positive count makes SRANDMEMBER and HRANDFIELD return
+		// distinct members
+		keys, err = redis.Strings(doContext(ctx, conn, "SRANDMEMBER", opts.KeySet, n))
+		if err != nil {
+			return nil, newCommandError("SRANDMEMBER", opts.KeySet, err)
+		}
+	case opts.KeyHash != "":
+		keys, err = redis.Strings(doContext(ctx, conn, "HRANDFIELD", opts.KeyHash, n))
+		if err != nil {
+			return nil, newCommandError("HRANDFIELD", opts.KeyHash, err)
+		}
+	default:
+		return randomKeys(ctx, conn, prefix, n, opts.MaxTries)
+	}
+
+	kept := keys[:0]
+	for _, key := range keys {
+		if strings.HasPrefix(key, prefix) {
+			kept = append(kept, key)
+		}
+	}
+	return kept, nil
+}
+
+func randomKeys(ctx context.Context, conn redis.Conn, prefix string, n, tries int) (keys []string, err error) {
+	if tries <= 0 {
+		tries = 10 * n
+	}
+
+	seen := make(map[string]bool, n)
+	for ; tries > 0 && len(keys) < n; tries-- {
+		var key string
+		key, err = redis.String(doContext(ctx, conn, "RANDOMKEY"))
+		if err == redis.ErrNil {
+			// empty database
+			return nil, nil
+		}
+		if err != nil {
+			return nil, newCommandError("RANDOMKEY", "", err)
+		}
+		if !strings.HasPrefix(key, prefix) || seen[key] {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	return
+}
+
+// sampleDocuments - up to n random documents under prefix, stored in mode,
+// each decoded into a fresh newValue(). Keys whose document has gone since
+// they were drawn (or, with a key set, that it still lists) are left out.
+func sampleDocuments(ctx context.Context, conn redis.Conn, mode storageMode, prefix string, n int, opts sampleOptions, newValue func() interface{}) (docs []sampledDoc, err error) {
+	keys, err := sampleKeys(ctx, conn, prefix, n, opts)
+	if err != nil || len(keys) == 0 {
+		return
+	}
+
+	values, errs, err := getMany(ctx, conn, mode, keys, newValue)
+	if err != nil {
+		return
+	}
+	for i, key := range keys {
+		if values[i] == nil && errs[i] == nil {
+			continue
+		}
+		docs = append(docs, sampledDoc{Key: key, Value: values[i], Err: errs[i]})
+	}
+	return
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// scanKeys - SCANs every key matching pattern, calling fn for each one. It
+// stops early if fn returns an error or ctx is done.
+func scanKeys(ctx context.Context, conn redis.Conn, pattern string, fn func(key string) error) (err error) {
+	return scanKeysFrom(ctx, conn, pattern, "0", fn, nil)
+}
+
+// scanKeysFrom - scanKeys starting at cursor. page, if not nil, is called
+// once every key of a SCAN page has been through fn, with the cursor to
+// resume from ("0" when the scan is complete).
+func scanKeysFrom(ctx context.Context, conn redis.Conn, pattern, cursor string, fn func(key string) error, page func(next string) error) (err error) {
+	for {
+		var reply []interface{}
+		reply, err = redis.Values(doContext(ctx, conn, "SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return
+		}
+
+		var keys []string
+		_, err = redis.Scan(reply, &cursor, &keys)
+		if err != nil {
+			return
+		}
+
+		for _, key := range keys {
+			err = fn(key)
+			if err != nil {
+				return
+			}
+		}
+
+		if page != nil {
+			err = page(cursor)
+			if err != nil {
+				return
+			}
+		}
+
+		if cursor == "0" {
+			return
+		}
+	}
+}
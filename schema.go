@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// schemasKey - set of type names with a published schema; each is kept in
+// the hash schemaKey(name), so clients in other languages can discover
+// document shapes without reading Go code
+const schemasKey = "schemas"
+
+func schemaKey(typeName string) string {
+	return "schema:" + typeName
+}
+
+// publishedSchema - what publishSchema stores for a type
+type publishedSchema struct {
+	Type string
+	// Schema - JSON Schema of the documents, as JSON
+	Schema json.RawMessage
+	// Fingerprint - hash of Schema, changing whenever the shape does
+	Fingerprint string
+	// Version - latest registered schema migration, 0 for none
+	Version   int
+	Published time.Time
+}
+
+// typeSchema - JSON Schema (2020-12) describing documents of type t as
+// json.Marshal writes them
+func typeSchema(t reflect.Type) map[string]interface{} {
+	s := schemaOf(t, map[reflect.Type]bool{})
+	s["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	s["title"] = t.Name()
+	return s
+}
+
+func schemaOf(t reflect.Type, seen map[reflect.Type]bool) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), seen)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), seen)}
+	case reflect.Struct:
+		if t == reflect.TypeOf(time.Time{}) {
+			return map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		if reflect.PtrTo(t).Implements(reflect.TypeOf((*refLoader)(nil)).Elem()) {
+			// a Ref is stored as the key it refers to
+			return map[string]interface{}{"type": "string", "description": "key of a " + t.Field(1).Type.Elem().Name()}
+		}
+		if seen[t] {
+			// recursive types are described once
+			return map[string]interface{}{"type": "object"}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+
+		info := structInfoOf(t)
+		props := map[string]interface{}{}
+		var required []string
+		for name, f := range info.json {
+			prop := schemaOf(f.Type, seen)
+			if raw, ok := fieldDefault(f); ok {
+				var v interface{}
+				if json.Unmarshal(raw, &v) == nil {
+					prop["default"] = v
+				}
+			}
+			if values, ok := info.jsonEnums[name]; ok {
+				prop["enum"] = values
+			}
+			props[name] = prop
+			if !strings.Contains(f.Tag.Get("json"), "omitempty") && f.Type.Kind() != reflect.Ptr {
+				required = append(required, name)
+			}
+		}
+		s := map[string]interface{}{"type": "object", "properties": props}
+		if len(required) > 0 {
+			sort.Strings(required)
+			s["required"] = required
+		}
+		return s
+	}
+	return map[string]interface{}{}
+}
+
+// localSchema - the schema of the type registered as typeName, as
+// publishSchema would store it
+func localSchema(typeName string) (p publishedSchema, err error) {
+	t, ok := registeredTypes[typeName]
+	if !ok {
+		return p, fmt.Errorf("unknown type %q (registered: %v)", typeName, registeredNames())
+	}
+	// map keys marshal sorted, so equal schemas give equal bytes
+	p.Schema, err = json.Marshal(typeSchema(t))
+	if err != nil {
+		return p, encodeError(err)
+	}
+	sum := sha256.Sum256(p.Schema)
+	p.Type = typeName
+	p.Fingerprint = hex.EncodeToString(sum[:8])
+	if ms := schemaMigrations[typeName]; len(ms) > 0 {
+		p.Version = ms[len(ms)-1].Version
+	}
+	return
+}
+
+// publishSchema - stores the schema of the type registered as typeName
+// under schemaKey, replacing what an older build published
+func publishSchema(conn redis.Conn, typeName string) (p publishedSchema, err error) {
+	p, err = localSchema(typeName)
+	if err != nil {
+		return
+	}
+	p.Published = time.Now().UTC()
+
+	key := schemaKey(typeName)
+	m := newMultiExec(conn)
+	m.send("HSET", key,
+		"schema", string(p.Schema),
+		"fingerprint", p.Fingerprint,
+		"version", p.Version,
+		"published", p.Published.Format(time.RFC3339))
+	m.send("SADD", schemasKey, typeName)
+	_, err = m.exec(context.Background())
+	if err != nil {
+		return p, newCommandError("HSET", key, err)
+	}
+	return
+}
+
+// storedSchema - the schema published for typeName, redis.ErrNil if none
+func storedSchema(conn redis.Conn, typeName string) (p publishedSchema, err error) {
+	key := schemaKey(typeName)
+	fields, err := redis.StringMap(conn.Do("HGETALL", key))
+	if err != nil {
+		return p, newCommandError("HGETALL", key, err)
+	}
+	if len(fields) == 0 {
+		return p, newCommandError("HGETALL", key, redis.ErrNil)
+	}
+	p.Type = typeName
+	p.Schema = json.RawMessage(fields["schema"])
+	p.Fingerprint = fields["fingerprint"]
+	fmt.Sscan(fields["version"], &p.Version)
+	p.Published, _ = time.Parse(time.RFC3339, fields["published"])
+	return
+}
+
+// errSchemaIncompatible - documents written under the published schema
+// won't decode into the local type
+var errSchemaIncompatible = errors.New("incompatible schema")
+
+// checkSchema - compares the local type with what was published for it.
+// Members added or removed on either side are compatible, as decoding
+// ignores or zeroes them; a member whose JSON type changed is not, and is
+// reported wrapped in errSchemaIncompatible. Nothing published is not an
+// error.
+func checkSchema(conn redis.Conn, typeName string) (err error) {
+	local, err := localSchema(typeName)
+	if err != nil {
+		return
+	}
+	stored, err := storedSchema(conn, typeName)
+	if errors.Is(err, redis.ErrNil) {
+		return nil
+	}
+	if err != nil || stored.Fingerprint == local.Fingerprint {
+		return
+	}
+
+	var a, b map[string]interface{}
+	if err = json.Unmarshal(stored.Schema, &a); err != nil {
+		return fmt.Errorf("%s: %w", schemaKey(typeName), err)
+	}
+	if err = json.Unmarshal(local.Schema, &b); err != nil {
+		return
+	}
+	var conflicts []string
+	schemaConflicts("", a, b, &conflicts)
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return fmt.Errorf("%s: %w: %s", typeName, errSchemaIncompatible, strings.Join(conflicts, "; "))
+	}
+	return
+}
+
+func schemaConflicts(path string, stored, local map[string]interface{}, out *[]string) {
+	if stored["type"] != local["type"] {
+		*out = append(*out, fmt.Sprintf("%s: %v, now %v", orRoot(path), stored["type"], local["type"]))
+		return
+	}
+	sp, _ := stored["properties"].(map[string]interface{})
+	lp, _ := local["properties"].(map[string]interface{})
+	for name, s := range sp {
+		l, ok := lp[name]
+		if !ok {
+			continue
+		}
+		sm, _ := s.(map[string]interface{})
+		lm, _ := l.(map[string]interface{})
+		schemaConflicts(joinPath(path, name), sm, lm, out)
+	}
+	for _, sub := range []string{"items", "additionalProperties"} {
+		sm, sok := stored[sub].(map[string]interface{})
+		lm, lok := local[sub].(map[string]interface{})
+		if sok && lok {
+			schemaConflicts(joinPath(path, "*"), sm, lm, out)
+		}
+	}
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func orRoot(path string) string {
+	if path == "" {
+		return "(document)"
+	}
+	return path
+}
+
+// schemaChecks - type name to the outcome of its checkSchema, so
+// getStructChecked asks the server once per process
+var schemaChecks sync.Map
+
+// getStructChecked - getStruct into value, the type registered as typeName,
+// failing instead when the schema published for it is incompatible
+func getStructChecked(conn redis.Conn, mode storageMode, key, typeName string, value interface{}) (err error) {
+	checked, ok := schemaChecks.Load(typeName)
+	if !ok {
+		err = checkSchema(conn, typeName)
+		if err != nil && !errors.Is(err, errSchemaIncompatible) {
+			// a failed lookup is retried next time
+			return
+		}
+		schemaChecks.Store(typeName, err)
+		checked = err
+	}
+	if checked != nil {
+		return checked.(error)
+	}
+	return getStruct(conn, mode, key, value)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestPublishSchemaExecError(t *testing.T) {
+	_, err := publishSchema(failingExecConn(), "Student")
+	checkExecFailed(t, err)
+}
+
+type enumEmbedded struct {
+	enumDoc
+	Grade string `json:"grade" redis:"grade,enum=A|B"`
+}
+
+func TestTypeSchemaEnums(t *testing.T) {
+	props := typeSchema(reflect.TypeOf(enumEmbedded{}))["properties"].(map[string]interface{})
+	for name, want := range map[string]string{"major": "[CSE EEE]", "grade": "[A B]"} {
+		prop := props[name].(map[string]interface{})
+		if got := fmt.Sprint(prop["enum"]); got != want {
+			t.Errorf("%s: enum %s, want %s", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// scriptRegistry - named Lua scripts. Each is run with EVALSHA, its SHA1
+// computed once at registration, falling back to EVAL (which also caches it
+// on the server) on NOSCRIPT. Register atomic operations on stored structs
+// with the package's scripts registry and run them by name.
+type scriptRegistry struct {
+	mu      sync.RWMutex
+	scripts map[string]*redis.Script
+}
+
+// scripts - the registry the package's own atomic helpers use
+var scripts = newScriptRegistry()
+
+func newScriptRegistry() *scriptRegistry {
+	return &scriptRegistry{scripts: make(map[string]*redis.Script)}
+}
+
+// register - adds src under name, taking keyCount KEYS (-1 when the caller
+// passes the count as the first argument). Registering a name twice panics,
+// as it would silently change what callers of the first script run.
+func (r *scriptRegistry) register(name string, keyCount int, src string) *redis.Script {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.scripts[name]; ok {
+		panic(fmt.Sprintf("script %q registered twice", name))
+	}
+	s := redis.NewScript(keyCount, src)
+	r.scripts[name] = s
+	return s
+}
+
+func (r *scriptRegistry) lookup(name string) (s *redis.Script, err error) {
+	r.mu.RLock()
+	s, ok := r.scripts[name]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no script registered as %q", name)
+	}
+	return
+}
+
+// run - runs the named script: EVALSHA, then EVAL on NOSCRIPT
+func (r *scriptRegistry) run(conn redis.Conn, name string, keysAndArgs ...interface{}) (reply interface{}, err error) {
+	s, err := r.lookup(name)
+	if err != nil {
+		return
+	}
+	reply, err = s.Do(conn, keysAndArgs...)
+	if err != nil {
+		return nil, newCommandError("EVALSHA "+name, scriptKey(keysAndArgs), err)
+	}
+	return
+}
+
+// send - queues the named script on a pipeline. NOSCRIPT can't be recovered
+// from mid-pipeline, so the script is sent by SHA only if it is known to be
+// loaded on conn's server (see load) and in full otherwise.
+func (r *scriptRegistry) send(conn redis.Conn, loaded bool, name string, keysAndArgs ...interface{}) (err error) {
+	s, err := r.lookup(name)
+	if err != nil {
+		return
+	}
+	if loaded {
+		return s.SendHash(conn, keysAndArgs...)
+	}
+	return s.Send(conn, keysAndArgs...)
+}
+
+// load - SCRIPT LOADs every registered script, so pipelines on conn can
+// send them by SHA
+func (r *scriptRegistry) load(conn redis.Conn) (err error) {
+	for _, name := range r.names() {
+		s, _ := r.lookup(name)
+		err = s.Load(conn)
+		if err != nil {
+			return newCommandError("SCRIPT LOAD", name, err)
+		}
+	}
+	return
+}
+
+func (r *scriptRegistry) names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.scripts))
+	for name := range r.scripts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// scriptKey - the first key of a script call, for error messages
+func scriptKey(keysAndArgs []interface{}) string {
+	if len(keysAndArgs) == 0 {
+		return ""
+	}
+	return argString(keysAndArgs[0])
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// searchHit - one FT.SEARCH match
+type searchHit struct {
+	Key string `json:"key"`
+	// Doc - the JSON document for ON JSON indexes, the returned fields
+	// otherwise
+	Doc interface{} `json:"doc"`
+}
+
+// searchDocuments - runs query against a RediSearch index, returning up to
+// limit matches and the total number of documents matching
+func searchDocuments(conn redis.Conn, index, query string, offset, limit int) (hits []searchHit, total int64, err error) {
+	reply, err := redis.Values(conn.Do("FT.SEARCH", index, query, "LIMIT", offset, limit))
+	if err != nil {
+		return nil, 0, newCommandError("FT.SEARCH", index, err)
+	}
+	if len(reply) == 0 {
+		return
+	}
+
+	// total, then key/fields pairs
+	total, err = redis.Int64(reply[0], nil)
+	if err != nil {
+		return
+	}
+	for i := 1; i+1 < len(reply); i += 2 {
+		key, _ := redis.String(reply[i], nil)
+		fields, ferr := redis.StringMap(reply[i+1], nil)
+		if ferr != nil {
+			return hits, total, ferr
+		}
+
+		var doc interface{} = fields
+		if j, ok := fields["$"]; ok {
+			doc = json.RawMessage(j)
+		}
+		hits = append(hits, searchHit{Key: key, Doc: doc})
+	}
+	return
+}
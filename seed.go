@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"text/template"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// seedOptions - what runSeed generates
+type seedOptions struct {
+	// Type - registered type every document must decode into
+	Type  string
+	Count int
+	// Template - text/template rendering one JSON document; fakeFill
+	// populates a Type when empty. See seedFuncs for what it can call.
+	Template string
+	// KeyTemplate - renders the key from {{.I}}, the document number
+	KeyTemplate string
+	Mode        storageMode
+	Batch       int
+	Seed        int64
+	// Progress - called after every batch with the documents written so far
+	Progress func(n int)
+}
+
+// seedData - what templates are executed with
+type seedData struct {
+	// I - document number, from 0
+	I int
+}
+
+// seedFuncs - fake data helpers for seed templates, e.g.
+//
+//	{"info":{"FirstName":"{{firstName}}","Major":"{{pick "CSE" "EEE"}}"},"rank":{{add .I 1}}}
+func seedFuncs(r *rand.Rand) template.FuncMap {
+	pick := func(s []string) string { return s[r.Intn(len(s))] }
+	return template.FuncMap{
+		"firstName": func() string { return pick(fakeFirstNames) },
+		"lastName":  func() string { return pick(fakeLastNames) },
+		"major":     func() string { return pick(fakeMajors) },
+		"word":      func() string { return pick(fakeWords) },
+		"fake":      func(field string) string { return fakeString(field, r) },
+		"pick":      func(s ...string) string { return pick(s) },
+		"intn":      func(n int) int { return r.Intn(n) },
+		"add":       func(a, b int) int { return a + b },
+		"bool":      func() bool { return r.Intn(2) == 1 },
+	}
+}
+
+// runSeed - writes opts.Count generated documents of a registered type,
+// pipelined opts.Batch at a time. The same Seed yields the same data.
+func runSeed(ctx context.Context, conn redis.Conn, opts seedOptions) (n int, err error) {
+	if _, err = newRegistered(opts.Type); err != nil {
+		return
+	}
+	if opts.Batch <= 0 {
+		opts.Batch = 500
+	}
+	if opts.KeyTemplate == "" {
+		opts.KeyTemplate = strings.ToLower(opts.Type) + ":{{.I}}"
+	}
+
+	r := rand.New(rand.NewSource(opts.Seed))
+	keyTmpl, err := template.New("key").Parse(opts.KeyTemplate)
+	if err != nil {
+		return
+	}
+	var docTmpl *template.Template
+	if opts.Template != "" {
+		docTmpl, err = template.New("doc").Funcs(seedFuncs(r)).Option("missingkey=error").Parse(opts.Template)
+		if err != nil {
+			return
+		}
+	}
+
+	// one entry per command sent, so replies can be matched to keys
+	var pending []string
+	var docs int
+	var keyBuf, docBuf bytes.Buffer
+	for i := 0; i < opts.Count; i++ {
+		data := seedData{I: i}
+
+		keyBuf.Reset()
+		err = keyTmpl.Execute(&keyBuf, data)
+		if err != nil {
+			return
+		}
+		key := keyBuf.String()
+
+		var raw []byte
+		if docTmpl != nil {
+			docBuf.Reset()
+			err = docTmpl.Execute(&docBuf, data)
+			if err != nil {
+				return
+			}
+			raw = docBuf.Bytes()
+			raw, err = checkTyped(key, raw, opts.Type)
+			if err != nil {
+				return n, fmt.Errorf("document %d: %w", i, err)
+			}
+		} else {
+			v, _ := newRegistered(opts.Type)
+			fakeFill(v, r)
+			_, err = prepareSet(key, v)
+			if err != nil {
+				return n, fmt.Errorf("document %d: %w", i, err)
+			}
+			raw, err = json.Marshal(v)
+			if err != nil {
+				return n, encodeError(err)
+			}
+		}
+
+		raw, bits, _, cerr := splitRawBits(opts.Mode, key, raw, registeredTypes[opts.Type])
+		if cerr != nil {
+			return n, cerr
+		}
+		cmd, args, cerr := rawCommand(opts.Mode, key, raw)
+		if cerr != nil {
+			return n, cerr
+		}
+		err = conn.Send(cmd, args...)
+		if err != nil {
+			return
+		}
+		pending = append(pending, key)
+		if bits != nil {
+			err = conn.Send("BITFIELD", bits...)
+			if err != nil {
+				return
+			}
+			pending = append(pending, key)
+		}
+		docs++
+
+		if docs >= opts.Batch || i == opts.Count-1 {
+			err = receiveAll(conn, pending)
+			if err != nil {
+				return
+			}
+			n += docs
+			pending, docs = pending[:0], 0
+			if opts.Progress != nil {
+				opts.Progress(n)
+			}
+			if err = ctx.Err(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"sort"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// SetOf - a redis SET of the keys of stored T objects, such as
+// "students:active". Membership is kept by the application: deleting an
+// object doesn't remove its key, and Load reports such stale members.
+type SetOf[T any] struct {
+	Key string
+}
+
+// NewSetOf - the set at key
+func NewSetOf[T any](key string) SetOf[T] {
+	return SetOf[T]{Key: key}
+}
+
+// Add - adds object keys, returning how many weren't members yet
+func (s SetOf[T]) Add(ctx context.Context, conn redis.Conn, keys ...string) (n int, err error) {
+	if len(keys) == 0 {
+		return
+	}
+	n, err = redis.Int(doContext(ctx, conn, "SADD", redis.Args{s.Key}.AddFlat(keys)...))
+	if err != nil {
+		return 0, newCommandError("SADD", s.Key, err)
+	}
+	return
+}
+
+// Remove - removes object keys, returning how many were members
+func (s SetOf[T]) Remove(ctx context.Context, conn redis.Conn, keys ...string) (n int, err error) {
+	if len(keys) == 0 {
+		return
+	}
+	n, err = redis.Int(doContext(ctx, conn, "SREM", redis.Args{s.Key}.AddFlat(keys)...))
+	if err != nil {
+		return 0, newCommandError("SREM", s.Key, err)
+	}
+	return
+}
+
+// Contains - whether key is a member
+func (s SetOf[T]) Contains(ctx context.Context, conn redis.Conn, key string) (ok bool, err error) {
+	ok, err = redis.Bool(doContext(ctx, conn, "SISMEMBER", s.Key, key))
+	if err != nil {
+		return false, newCommandError("SISMEMBER", s.Key, err)
+	}
+	return
+}
+
+// Members - every member key, sorted
+func (s SetOf[T]) Members(ctx context.Context, conn redis.Conn) (keys []string, err error) {
+	keys, err = redis.Strings(doContext(ctx, conn, "SMEMBERS", s.Key))
+	if err != nil {
+		return nil, newCommandError("SMEMBERS", s.Key, err)
+	}
+	sort.Strings(keys)
+	return
+}
+
+// Load - every member decoded, by key, read in one pipeline from objects
+// stored in mode. Members whose object no longer exists are returned as
+// stale rather than failing the call.
+func (s SetOf[T]) Load(ctx context.Context, conn redis.Conn, mode storageMode) (objects map[string]*T, stale []string, err error) {
+	keys, err := s.Members(ctx, conn)
+	if err != nil {
+		return
+	}
+
+	values, errs, err := getMany(ctx, conn, mode, keys, func() interface{} { return new(T) })
+	if err != nil {
+		return
+	}
+
+	objects = make(map[string]*T, len(keys))
+	for i, key := range keys {
+		if errs[i] != nil {
+			return nil, nil, errs[i]
+		}
+		if values[i] == nil {
+			stale = append(stale, key)
+			continue
+		}
+		objects[key] = values[i].(*T)
+	}
+	return
+}
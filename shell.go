@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// shellCommands - what the shell understands, for help
+var shellCommands = [][2]string{
+	{"ls [pattern]", "list keys (default *) with their storage mode"},
+	{"get key", "print a document, indented"},
+	{"set key json", "store a document in the configured mode"},
+	{"fields key", "list a document's fields as dotted paths"},
+	{"keys key [path]", "list the members of the object at path, without reading a ReJSON document"},
+	{"type key path", "JSON type of the member at path"},
+	{"ttl key", "time left before key expires"},
+	{"del key...", "delete keys"},
+	{"help", "this list"},
+	{"exit", "leave (or ^D)"},
+}
+
+// runShell - reads commands from env.stdin until exit or EOF. Errors are
+// printed and the shell carries on. Documents set must decode into the
+// registered type typeName, unless it is empty.
+func runShell(env *cliEnv, typeName string) (err error) {
+	mode, err := parseStorageMode(env.cfg.Mode)
+	if err != nil {
+		return
+	}
+
+	sc := bufio.NewScanner(env.stdin)
+	sc.Buffer(make([]byte, 64<<10), 16<<20)
+	out := env.stdout
+	for {
+		fmt.Fprint(out, "rejson-struct> ")
+		if !sc.Scan() {
+			fmt.Fprintln(out)
+			return sc.Err()
+		}
+
+		name, rest := cutWord(strings.TrimSpace(sc.Text()))
+		if name == "" {
+			continue
+		}
+		if name == "exit" || name == "quit" {
+			return nil
+		}
+
+		serr := shellCommand(env, mode, typeName, name, rest)
+		if serr != nil {
+			fmt.Fprintf(out, "(error) %v\n", serr)
+		}
+	}
+}
+
+func shellCommand(env *cliEnv, mode storageMode, typeName, name, rest string) (err error) {
+	out := env.stdout
+	conn := env.conn
+	key, arg := cutWord(rest)
+
+	needKey := func() error {
+		if key == "" {
+			return fmt.Errorf("%s needs a key", name)
+		}
+		return nil
+	}
+
+	switch name {
+	case "help":
+		tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		for _, c := range shellCommands {
+			fmt.Fprintf(tw, "  %s\t%s\n", c[0], c[1])
+		}
+		return tw.Flush()
+
+	case "ls":
+		pattern := key
+		if pattern == "" {
+			pattern = "*"
+		}
+		tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		err = scanKeys(context.Background(), conn, pattern, func(key string) error {
+			m, derr := detectStorageMode(conn, key)
+			desc := m.String()
+			if derr != nil {
+				desc = "-"
+			}
+			_, werr := fmt.Fprintf(tw, "%s\t%s\n", key, desc)
+			return werr
+		})
+		if ferr := tw.Flush(); err == nil {
+			err = ferr
+		}
+		return
+
+	case "get":
+		if err = needKey(); err != nil {
+			return
+		}
+		var raw []byte
+		raw, err = shellGet(conn, key, prettyJSON)
+		if err != nil {
+			return
+		}
+		_, err = fmt.Fprintf(out, "%s\n", raw)
+		return
+
+	case "set":
+		if err = needKey(); err != nil {
+			return
+		}
+		if arg == "" {
+			return errors.New("set needs a key and a JSON document")
+		}
+		raw := []byte(arg)
+		if typeName != "" {
+			raw, err = checkTyped(key, raw, typeName)
+			if err != nil {
+				return
+			}
+		}
+		err = setRaw(conn, mode, key, raw, registeredTypes[typeName])
+		if err != nil {
+			return
+		}
+		_, err = fmt.Fprintln(out, "OK")
+		return
+
+	case "fields":
+		if err = needKey(); err != nil {
+			return
+		}
+		var raw []byte
+		raw, err = shellGet(conn, key)
+		if err != nil {
+			return
+		}
+		var flat map[string]string
+		flat, err = flattenJSON(raw)
+		if err != nil {
+			return
+		}
+		tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		for _, path := range sortedKeys(flat) {
+			fmt.Fprintf(tw, "%s\t%s\n", path, flat[path])
+		}
+		return tw.Flush()
+
+	case "keys", "type":
+		if err = needKey(); err != nil {
+			return
+		}
+		if name == "type" && arg == "" {
+			return errors.New("type needs a key and a path")
+		}
+		var m storageMode
+		m, err = detectStorageMode(conn, key)
+		if err != nil {
+			return
+		}
+		if name == "type" {
+			var typ string
+			typ, err = fieldType(conn, m, key, arg)
+			if err != nil {
+				return
+			}
+			_, err = fmt.Fprintln(out, typ)
+			return
+		}
+		var names []string
+		names, err = listFields(conn, m, key, arg)
+		if err != nil {
+			return
+		}
+		for _, n := range names {
+			fmt.Fprintln(out, n)
+		}
+		return
+
+	case "ttl":
+		if err = needKey(); err != nil {
+			return
+		}
+		var ms int64
+		ms, err = redis.Int64(conn.Do("PTTL", key))
+		if err != nil {
+			return newCommandError("PTTL", key, err)
+		}
+		switch ms {
+		case -2:
+			_, err = fmt.Fprintln(out, "(no such key)")
+		case -1:
+			_, err = fmt.Fprintln(out, "(no expiry)")
+		default:
+			_, err = fmt.Fprintln(out, time.Duration(ms)*time.Millisecond)
+		}
+		return
+
+	case "del":
+		if err = needKey(); err != nil {
+			return
+		}
+		return cmdDel(env, strings.Fields(rest))
+	}
+	return fmt.Errorf("unknown command %q, try help", name)
+}
+
+// shellGet - reads key, whatever mode it is stored in
+func shellGet(conn redis.Conn, key string, format ...jsonFormat) (raw []byte, err error) {
+	mode, err := detectStorageMode(conn, key)
+	if err != nil {
+		return
+	}
+	return getRaw(conn, mode, key, format...)
+}
+
+// cutWord - first whitespace separated word of s, and the trimmed rest
+func cutWord(s string) (word, rest string) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexAny(s, " \t")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
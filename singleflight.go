@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// readGroup - collapses concurrent reads of a hot key: while one read of a
+// key is in flight, others of the same key into the same type wait for it
+// and each get a copy of the struct it decoded, instead of making their own
+// round trip. Only reads that overlap are shared; nothing is kept after.
+type readGroup struct {
+	mu sync.Mutex
+	// flights - reads in flight, by type and flight key
+	flights map[string]*flight
+
+	// deepCopy - hand every caller a deep copy (see deepCopy), so none
+	// can change what another was given
+	deepCopy bool
+
+	shared uint64
+}
+
+// flight - one read shared by every caller that asked for it while it ran
+type flight struct {
+	// done - closed once res and err are set
+	done chan struct{}
+	res  reflect.Value
+	err  error
+}
+
+// dedupe - wraps load so that concurrent calls for the same key share one.
+// The round trip is made on the conn of the first caller, and its error,
+// if any, is returned to every caller waiting on it. Wrap each loader with
+// its own readGroup, as reads are told apart by key and type only.
+func (r *readGroup) dedupe(load structLoader) structLoader {
+	return func(conn redis.Conn, key string, value interface{}) error {
+		return r.do(key, value, func(fresh interface{}) error {
+			return load(conn, key, fresh)
+		})
+	}
+}
+
+// getStruct - getStruct, shared with concurrent reads of key in mode
+func (r *readGroup) getStruct(conn redis.Conn, mode storageMode, key string, value interface{}) error {
+	return r.do(mode.String()+":"+key, value, func(fresh interface{}) error {
+		return getStruct(conn, mode, key, fresh)
+	})
+}
+
+// do - runs read, which decodes into a fresh value of value's type, unless
+// one for the same flight key and type is already running, then copies the
+// result into value (a pointer to a struct)
+func (r *readGroup) do(flightKey string, value interface{}, read func(fresh interface{}) error) (err error) {
+	defer recoverUnsupported(&err)
+
+	dst := reflect.ValueOf(value).Elem()
+	t := dst.Type()
+	id := t.PkgPath() + "." + t.String() + "\x00" + flightKey
+
+	r.mu.Lock()
+	if r.flights == nil {
+		r.flights = make(map[string]*flight)
+	}
+	f, follow := r.flights[id]
+	if !follow {
+		f = &flight{done: make(chan struct{})}
+		r.flights[id] = f
+	}
+	r.mu.Unlock()
+
+	if follow {
+		<-f.done
+		atomic.AddUint64(&r.shared, 1)
+	} else {
+		r.lead(id, f, t, read)
+	}
+	if err = f.err; err != nil {
+		return
+	}
+	res := f.res
+
+	// every caller gets its own copy of the struct; unless deepCopy is
+	// set, pointers, slices and maps in it are still shared with the others
+	if r.deepCopy {
+		dst.Set(deepCopy(res.Elem()))
+	} else {
+		dst.Set(res.Elem())
+	}
+	return
+}
+
+// lead - runs read for the callers of f, releasing them once it returns,
+// or panics
+func (r *readGroup) lead(id string, f *flight, t reflect.Type, read func(fresh interface{}) error) {
+	defer func() {
+		r.mu.Lock()
+		delete(r.flights, id)
+		r.mu.Unlock()
+		close(f.done)
+	}()
+	defer recoverUnsupported(&f.err)
+
+	f.res = reflect.New(t)
+	f.err = read(f.res.Interface())
+}
+
+// sharedCount - reads that were served by a round trip another caller made
+func (r *readGroup) sharedCount() uint64 {
+	return atomic.LoadUint64(&r.shared)
+}
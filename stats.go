@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// namespaceStats - size and expiry profile of every key under a prefix.
+// Counts are exact; memory and TTL figures come from a sample of the keys.
+type namespaceStats struct {
+	Prefix  string
+	Keys    int
+	Sampled int
+
+	// AvgSize - mean MEMORY USAGE of the sampled keys, in bytes
+	AvgSize int64
+	// TotalMemory - AvgSize extrapolated over Keys
+	TotalMemory int64
+
+	TTL ttlDistribution
+}
+
+// ttlDistribution - sampled keys bucketed by remaining TTL
+type ttlDistribution struct {
+	// NoExpiry - keys without a TTL (PTTL -1); keys gone by the time of
+	// the PTTL (-2) are left out of the stats altogether
+	NoExpiry   int
+	UnderMin   int
+	UnderHour  int
+	UnderDay   int
+	OverOneDay int
+}
+
+func (d *ttlDistribution) add(ttl time.Duration) {
+	switch {
+	case ttl < 0:
+		d.NoExpiry++
+	case ttl < time.Minute:
+		d.UnderMin++
+	case ttl < time.Hour:
+		d.UnderHour++
+	case ttl < 24*time.Hour:
+		d.UnderDay++
+	default:
+		d.OverOneDay++
+	}
+}
+
+// namespaceStatistics - counts every key starting with prefix and samples up
+// to sample of them (in SCAN order, which is effectively random) for MEMORY
+// USAGE and PTTL
+func namespaceStatistics(ctx context.Context, conn redis.Conn, prefix string, sample int) (s namespaceStats, err error) {
+	s.Prefix = prefix
+
+	var total int64
+	err = scanKeys(ctx, conn, prefix+"*", func(key string) (err error) {
+		s.Keys++
+		if s.Sampled >= sample {
+			return
+		}
+
+		mem, err := redis.Int64(doContext(ctx, conn, "MEMORY", "USAGE", key))
+		if err == redis.ErrNil {
+			// expired or deleted since SCAN returned it
+			s.Keys--
+			return nil
+		}
+		if err != nil {
+			return
+		}
+
+		ttl, err := redis.Int64(doContext(ctx, conn, "PTTL", key))
+		if err != nil {
+			return
+		}
+		if ttl == -2 {
+			// gone between MEMORY USAGE and PTTL
+			s.Keys--
+			return nil
+		}
+
+		s.Sampled++
+		total += mem
+		s.TTL.add(time.Duration(ttl) * time.Millisecond)
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	if s.Sampled > 0 {
+		s.AvgSize = total / int64(s.Sampled)
+		s.TotalMemory = s.AvgSize * int64(s.Keys)
+	}
+	return
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	rejson "go-rejson"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// storageMode - one of the three ways main.go stores a struct
+type storageMode int
+
+const (
+	// modeHash - HMSET of the flattened struct
+	modeHash storageMode = iota
+	// modeHashJSON - HSET of the JSON encoded struct under the JSON field
+	modeHashJSON
+	// modeReJSON - JSON.SET of the struct as a ReJSON document
+	modeReJSON
+)
+
+func (m storageMode) String() string {
+	switch m {
+	case modeHash:
+		return "hash"
+	case modeHashJSON:
+		return "hash-json"
+	case modeReJSON:
+		return "rejson"
+	}
+	return fmt.Sprintf("storageMode(%d)", int(m))
+}
+
+// parseStorageMode - inverse of storageMode.String
+func parseStorageMode(s string) (storageMode, error) {
+	for _, m := range []storageMode{modeHash, modeHashJSON, modeReJSON} {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown storage mode %q (want hash, hash-json or rejson)", s)
+}
+
+func addStruct(conn redis.Conn, mode storageMode, key string, value interface{}) (err error) {
+	value, err = prepareSet(key, value)
+	if err != nil {
+		return
+	}
+
+	switch mode {
+	case modeHash:
+		return addStructHash(conn, key, value)
+	case modeHashJSON:
+		return addStructHashWithJSON(conn, key, value)
+	case modeReJSON:
+		return addStructReJSON(conn, key, value)
+	}
+	return fmt.Errorf("unknown storage mode %v", mode)
+}
+
+// prepareSet - value as every Set stores it: computed fields refreshed and
+// enum fields checked. Every write of a typed value goes through it.
+func prepareSet(key string, value interface{}) (out interface{}, err error) {
+	out, err = withComputed(value)
+	if err == nil {
+		err = checkEnums(out, false)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	return
+}
+
+// getStruct - reads key, stored in mode, into value (a pointer to a struct)
+func getStruct(conn redis.Conn, mode storageMode, key string, value interface{}) (err error) {
+	switch mode {
+	case modeHash:
+		err = loadStructHash(conn, key, value)
+	case modeHashJSON:
+		err = loadStructHashWithJSON(conn, key, value)
+	case modeReJSON:
+		err = loadStructReJSON(conn, key, value)
+	default:
+		return fmt.Errorf("unknown storage mode %v", mode)
+	}
+	if err != nil || enumOnDecode == enumAccept {
+		return
+	}
+	err = checkEnums(value, enumOnDecode == enumFallback)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	return
+}
+
+// getManyChunk - keys getMany pipelines per round trip. Each chunk's
+// replies are received and decoded before the next is sent, so a long key
+// list never builds up a multi-megabyte reply, or trips the server's client
+// output buffer limit.
+var getManyChunk = 500
+
+// getMany - the objects at keys, stored in mode, read in pipelines of at
+// most getManyChunk keys on conn. values[i] is a fresh newValue() (a
+// pointer to a struct) holding keys[i], or nil when it doesn't exist;
+// errs[i] is keys[i]'s own failure, an error reply or a document that
+// doesn't decode. err is a failure of the connection itself, or a type
+// whose bits fields can't be laid out, in which case values and errs are
+// nil.
+func getMany(ctx context.Context, conn redis.Conn, mode storageMode, keys []string, newValue func() interface{}) (values []interface{}, errs []error, err error) {
+	cmd := map[storageMode]string{modeHash: "HGETALL", modeHashJSON: "HGET", modeReJSON: "JSON.GET"}[mode]
+	if cmd == "" {
+		return nil, nil, fmt.Errorf("unknown storage mode %v", mode)
+	}
+	var bits []bitField
+	if mode == modeHash && len(keys) > 0 {
+		bits, err = bitFieldsOf(reflect.TypeOf(newValue()))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	chunk := getManyChunk
+	if chunk <= 0 {
+		chunk = len(keys)
+	}
+
+	values = make([]interface{}, len(keys))
+	errs = make([]error, len(keys))
+	for start := 0; start < len(keys); start += chunk {
+		end := start + chunk
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err = ctx.Err(); err == nil {
+			err = getManyPipeline(conn, mode, cmd, bits, keys[start:end], newValue, values[start:end], errs[start:end])
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return
+}
+
+// getManyPipeline - one round trip of getMany, filling values and errs,
+// which line up with keys. In hash mode each HGETALL is followed by a
+// BITFIELD reading the key's bits fields, if the type has any.
+func getManyPipeline(conn redis.Conn, mode storageMode, cmd string, bits []bitField, keys []string, newValue func() interface{}, values []interface{}, errs []error) (err error) {
+	for _, key := range keys {
+		if mode == modeHashJSON {
+			conn.Send(cmd, key, "JSON")
+		} else {
+			conn.Send(cmd, key)
+		}
+		if len(bits) > 0 {
+			conn.Send("BITFIELD", bitsGetArgs(key, bits)...)
+		}
+	}
+	if err = conn.Flush(); err != nil {
+		return newCommandError(cmd, "", err)
+	}
+
+	// every reply is received before any is decoded, so the connection
+	// stays usable whatever fails
+	replies := make([]interface{}, len(keys))
+	packed := make([]interface{}, len(keys))
+	receive := func(cmd, key string, reply *interface{}, failed *error) error {
+		var err error
+		*reply, err = conn.Receive()
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(redis.Error); !ok {
+			return newCommandError(cmd, key, err)
+		}
+		if *failed == nil {
+			*failed = newCommandError(cmd, key, err)
+		}
+		return nil
+	}
+	for i, key := range keys {
+		if err = receive(cmd, key, &replies[i], &errs[i]); err != nil {
+			return
+		}
+		if len(bits) == 0 {
+			continue
+		}
+		if err = receive("BITFIELD", key, &packed[i], &errs[i]); err != nil {
+			return
+		}
+	}
+
+	for i, key := range keys {
+		if errs[i] != nil {
+			continue
+		}
+		v := newValue()
+		var found bool
+		found, errs[i] = decodeStruct(mode, replies[i], v)
+		if errs[i] == nil && found && len(bits) > 0 {
+			errs[i] = scanBits(packed[i], bits, v)
+		}
+		if errs[i] == nil && found && enumOnDecode != enumAccept {
+			errs[i] = checkEnums(v, enumOnDecode == enumFallback)
+		}
+		if errs[i] != nil {
+			errs[i] = fmt.Errorf("%s: %w", key, errs[i])
+			continue
+		}
+		if found {
+			values[i] = v
+		}
+	}
+	return
+}
+
+// decodeStruct - decodes the reply to the read getMany issues for mode into
+// value, reporting false for a key that doesn't exist
+func decodeStruct(mode storageMode, reply interface{}, value interface{}) (found bool, err error) {
+	defer recoverUnsupported(&err)
+
+	if mode == modeHash {
+		var fields []interface{}
+		fields, err = redis.Values(reply, nil)
+		if err != nil || len(fields) == 0 {
+			return
+		}
+		return true, scanHash(fields, value)
+	}
+
+	if reply == nil {
+		return
+	}
+	var b []byte
+	b, err = redis.Bytes(reply, nil)
+	if err != nil {
+		return
+	}
+	return true, unmarshalStruct(b, value)
+}
+
+// loadStructHash - only works for flat structs, see the README for why
+// embedded pointers can't be scanned back
+func loadStructHash(conn redis.Conn, key string, value interface{}) (err error) {
+	defer recoverUnsupported(&err)
+
+	bits, err := bitFieldsOf(reflect.TypeOf(value))
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+
+	var v []interface{}
+	var packed interface{}
+	if len(bits) == 0 {
+		v, err = redis.Values(conn.Do("HGETALL", key))
+	} else {
+		// in one transaction, as addStructHash writes them
+		conn.Send("MULTI")
+		conn.Send("HGETALL", key)
+		conn.Send("BITFIELD", bitsGetArgs(key, bits)...)
+		var replies []interface{}
+		replies, err = redis.Values(conn.Do("EXEC"))
+		if err == nil {
+			v, err = redis.Values(replies[0], nil)
+			packed = replies[1]
+		}
+	}
+	if err != nil {
+		return newCommandError("HGETALL", key, err)
+	}
+	if len(v) == 0 {
+		return newCommandError("HGETALL", key, redis.ErrNil)
+	}
+	if err = scanHash(v, value); err != nil || packed == nil {
+		return
+	}
+	if err = scanBits(packed, bits, value); err != nil {
+		return newCommandError("BITFIELD", key, err)
+	}
+	return
+}
+
+func loadStructReJSON(conn redis.Conn, key string, value interface{}) (err error) {
+	b, err := redis.Bytes(rejson.JSONGet(conn, key, ""))
+	if err != nil {
+		return newCommandError("JSON.GET", key, err)
+	}
+	return unmarshalStruct(b, value)
+}
+
+func loadStructHashWithJSON(conn redis.Conn, key string, value interface{}) (err error) {
+	b, err := redis.Bytes(conn.Do("HGET", key, "JSON"))
+	if err != nil {
+		return newCommandError("HGET", key, err)
+	}
+	return unmarshalStruct(b, value)
+}
+
+// dualWrite - writes every Set to both a legacy hash representation and the
+// ReJSON document, so readers can be moved over one at a time before the
+// hash is dropped. The primary is written first; if it fails the secondary
+// is not attempted.
+type dualWrite struct {
+	// legacy - modeHash or modeHashJSON
+	legacy storageMode
+	// primary - legacy or modeReJSON
+	primary storageMode
+}
+
+// addStruct - writes value to legacyKey and jsonKey. A failed secondary write
+// is reported, but the primary write has already been applied by then. A
+// value hash mode can't read back (see hashRoundTrips) is refused before
+// either write when the legacy mode is modeHash.
+func (d dualWrite) addStruct(conn redis.Conn, legacyKey, jsonKey string, value interface{}) (err error) {
+	if d.legacy == modeHash && !hashRoundTrips(reflect.TypeOf(value)) {
+		return fmt.Errorf("%w: hash mode can't read %T back; dual write it with modeHashJSON", ErrUnsupportedType, value)
+	}
+	primaryKey, secondary, secondaryKey := legacyKey, modeReJSON, jsonKey
+	if d.primary == modeReJSON {
+		primaryKey, secondary, secondaryKey = jsonKey, d.legacy, legacyKey
+	}
+
+	err = addStruct(conn, d.primary, primaryKey, value)
+	if err != nil {
+		return
+	}
+
+	err = addStruct(conn, secondary, secondaryKey, value)
+	if err != nil {
+		return fmt.Errorf("secondary %v write to %s: %w", secondary, secondaryKey, err)
+	}
+	return
+}
+
+// shadowRead - reads from both representations during a migration, returns
+// the primary and logs whenever the shadow copy decodes differently
+type shadowRead struct {
+	// legacy - modeHash or modeHashJSON
+	legacy storageMode
+	// primary - legacy or modeReJSON
+	primary storageMode
+	// logger - receives a Warn per mismatch, defaults to no-op
+	logger Logger
+
+	mismatches uint64
+}
+
+// getStruct - reads the primary copy into value. The shadow copy is decoded
+// into a fresh value of the same type and compared; a failed or differing
+// shadow read is logged and counted but never returned. Types hash mode
+// can't read back (see hashRoundTrips) are not compared against a modeHash
+// copy, which could only ever differ.
+func (s *shadowRead) getStruct(conn redis.Conn, legacyKey, jsonKey string, value interface{}) (err error) {
+	defer recoverUnsupported(&err)
+
+	primaryKey, shadow, shadowKey := legacyKey, modeReJSON, jsonKey
+	if s.primary == modeReJSON {
+		primaryKey, shadow, shadowKey = jsonKey, s.legacy, legacyKey
+	}
+
+	err = getStruct(conn, s.primary, primaryKey, value)
+	if err != nil || (s.legacy == modeHash && !hashRoundTrips(reflect.TypeOf(value))) {
+		return
+	}
+
+	other := reflect.New(reflect.TypeOf(value).Elem())
+	serr := getStruct(conn, shadow, shadowKey, other.Interface())
+	switch {
+	case serr != nil:
+		atomic.AddUint64(&s.mismatches, 1)
+		orNop(s.logger).Warn("shadow read failed", "key", shadowKey, "mode", shadow, "err", serr)
+	case !reflect.DeepEqual(value, other.Interface()):
+		atomic.AddUint64(&s.mismatches, 1)
+		orNop(s.logger).Warn("shadow read mismatch",
+			"key", primaryKey, "mode", s.primary, "value", reflect.ValueOf(value).Elem(),
+			"shadowKey", shadowKey, "shadowMode", shadow, "shadowValue", other.Elem())
+	}
+	return
+}
+
+// mismatchCount - number of shadow reads that failed or differed
+func (s *shadowRead) mismatchCount() uint64 {
+	return atomic.LoadUint64(&s.mismatches)
+}
+
+// hashRoundTrips - whether hash mode reads back everything it stores of t,
+// a struct or a pointer to one. redigo flattens a single level, so a
+// pointer, nested struct, slice or map field is written as its fmt text and
+// can't be scanned back (Student's Info is one).
+func hashRoundTrips(t reflect.Type) bool {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return false
+	}
+	info := structInfoOf(t)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || info.tags[i].Name == "-" || info.tags[i].has("bits") {
+			// not stored as a hash field
+			continue
+		}
+		switch f.Type.Kind() {
+		case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		case reflect.Slice:
+			if f.Type.Elem().Kind() != reflect.Uint8 {
+				return false
+			}
+		case reflect.Struct:
+			// redigo flattens embedded structs into the same hash
+			if !f.Anonymous || !hashRoundTrips(f.Type) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// errUnknownMode - the key exists but isn't laid out like any storageMode
+var errUnknownMode = errors.New("key is not stored in a known storage mode")
+
+// detectStorageMode - works out how key was stored from its TYPE, and for
+// hashes from whether it holds nothing but the JSON field
+func detectStorageMode(conn redis.Conn, key string) (mode storageMode, err error) {
+	typ, err := redis.String(conn.Do("TYPE", key))
+	if err != nil {
+		return mode, newCommandError("TYPE", key, err)
+	}
+
+	switch typ {
+	case "ReJSON-RL":
+		return modeReJSON, nil
+	case "hash":
+		var n int
+		n, err = redis.Int(conn.Do("HLEN", key))
+		if err != nil {
+			return mode, newCommandError("HLEN", key, err)
+		}
+		var hasJSON bool
+		hasJSON, err = redis.Bool(conn.Do("HEXISTS", key, "JSON"))
+		if err != nil {
+			return mode, newCommandError("HEXISTS", key, err)
+		}
+		if n == 1 && hasJSON {
+			return modeHashJSON, nil
+		}
+		return modeHash, nil
+	case "none":
+		return mode, newCommandError("TYPE", key, redis.ErrNil)
+	}
+	return mode, errUnknownMode
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestStudentStoreModifyExecError(t *testing.T) {
+	rec := failingExecConn()
+	inner := rec.reply
+	rec.reply = func(cmd string, args []interface{}) (interface{}, error) {
+		if cmd == "JSON.GET" {
+			return []byte(`{"rank":1}`), nil
+		}
+		return inner(cmd, args)
+	}
+	err := StudentStore{Conn: rec}.ModifyStudent(context.Background(), "1", func(v *Student) error {
+		v.Rank++
+		return nil
+	})
+	checkExecFailed(t, err)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+)
+
+// tableCellWidth - cells longer than this are cut short with "…"
+const tableCellWidth = 40
+
+// tableRow - one document of a table, flattened
+type tableRow struct {
+	Key  string
+	Flat map[string]string
+}
+
+// tableRowOf - raw flattened into a row, nested members as dotted columns
+// (info.FirstName)
+func tableRowOf(key string, raw []byte) (r tableRow, err error) {
+	r.Key = key
+	r.Flat, err = flattenJSON(raw)
+	return
+}
+
+// writeTable - rows as aligned columns: the key, then every dotted path any
+// row has, in order. Missing values are left blank.
+func writeTable(w io.Writer, rows []tableRow) (err error) {
+	seen := make(map[string]bool)
+	var columns []string
+	for _, r := range rows {
+		for path := range r.Flat {
+			if !seen[path] {
+				seen[path] = true
+				columns = append(columns, path)
+			}
+		}
+	}
+	sort.Strings(columns)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	line := func(cells []string) error {
+		_, err := io.WriteString(tw, strings.Join(cells, "\t")+"\n")
+		return err
+	}
+
+	err = line(append([]string{"KEY"}, columns...))
+	if err != nil {
+		return
+	}
+	for _, r := range rows {
+		cells := []string{tableCell(r.Key)}
+		for _, c := range columns {
+			cells = append(cells, tableCell(r.Flat[c]))
+		}
+		err = line(cells)
+		if err != nil {
+			return
+		}
+	}
+	return tw.Flush()
+}
+
+// tableCell - s on one line and at most tableCellWidth runes
+func tableCell(s string) string {
+	if strings.ContainsAny(s, "\t\r\n") {
+		b, _ := json.Marshal(s)
+		s = string(b[1 : len(b)-1])
+	}
+	if utf8.RuneCountInString(s) > tableCellWidth {
+		s = string([]rune(s)[:tableCellWidth-1]) + "…"
+	}
+	return s
+}
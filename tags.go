@@ -0,0 +1,144 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// fieldTag - a struct field's redis tag, `redis:"name,option,option=value"`.
+// Besides redigo's own omitempty the options are this package's:
+//
+//	sensitive  masked or left out of reads for API responses (redact.go)
+//	alias=a|b  older names the field may be stored under (aliases.go)
+//	enum=A|B   the only values the field may hold (enum.go)
+//	computed   derived by a registered function on every Set (computed.go)
+//	owns       on Ref fields: deleted along with the document (delete.go)
+//	bits=N     a small integer or bool packed with the type's other bits
+//	           fields into one BITFIELD string in hash mode (bitfield.go)
+//
+// A separate `default:"..."` tag fills a field in on reads that find it
+// missing (defaults.go). Its field can't also be omitempty, in the json tag
+// or this one: a written zero would read back as the default.
+type fieldTag struct {
+	// Name - the hash field name, empty for the Go field name
+	Name    string
+	options map[string]string
+}
+
+func parseFieldTag(f reflect.StructField) (t fieldTag) {
+	parts := strings.Split(f.Tag.Get("redis"), ",")
+	t.Name = parts[0]
+	for _, opt := range parts[1:] {
+		if t.options == nil {
+			t.options = make(map[string]string)
+		}
+		name, value := opt, ""
+		if i := strings.Index(opt, "="); i >= 0 {
+			name, value = opt[:i], opt[i+1:]
+		}
+		t.options[name] = value
+	}
+	return
+}
+
+// has - whether the tag carries option
+func (t fieldTag) has(option string) bool {
+	_, ok := t.options[option]
+	return ok
+}
+
+// value - what option is set to (enum=CSE|EEE gives "CSE|EEE")
+func (t fieldTag) value(option string) (string, bool) {
+	v, ok := t.options[option]
+	return v, ok
+}
+
+// redigoOptions - tag options redigo knows; it panics on any other
+var redigoOptions = map[string]bool{"omitempty": true}
+
+// redigoTypes - struct type to the twin redigoType made for it
+var redigoTypes sync.Map
+
+// redigoType - t with its redis tags cut down to what redigo understands, so
+// AddFlat and ScanStruct work on types using this package's options. The
+// twin has the same fields, so values convert between the two; t itself is
+// returned when no tag needs cutting.
+func redigoType(t reflect.Type) reflect.Type {
+	if cached, ok := redigoTypes.Load(t); ok {
+		return cached.(reflect.Type)
+	}
+
+	twin := t
+	fields := make([]reflect.StructField, t.NumField())
+	for i := range fields {
+		f := t.Field(i)
+		tag := parseFieldTag(f)
+		kept := []string{tag.Name}
+		for opt := range tag.options {
+			if redigoOptions[opt] {
+				kept = append(kept, opt)
+			}
+		}
+		if tag.has("bits") {
+			// packed into the bits string instead of a hash field
+			kept = []string{"-"}
+		}
+		if len(kept) != len(tag.options)+1 {
+			f.Tag = reflect.StructTag(`redis:"` + strings.Join(kept, ",") + `"`)
+			twin = nil
+		}
+		fields[i] = f
+	}
+	if twin == nil {
+		twin = reflect.StructOf(fields)
+	}
+
+	redigoTypes.Store(t, twin)
+	return twin
+}
+
+// redigoValue - value (a struct, or a pointer to one) converted to its
+// redigoType for AddFlat
+func redigoValue(value interface{}) interface{} {
+	v := reflect.ValueOf(value)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return value
+	}
+	twin := redigoType(v.Type())
+	if twin == v.Type() {
+		return value
+	}
+	return v.Convert(twin).Interface()
+}
+
+// scanStruct - redis.ScanStruct into dest (a pointer to a struct) through
+// its redigoType
+func scanStruct(src []interface{}, dest interface{}) (err error) {
+	d := reflect.ValueOf(dest)
+	if d.Kind() != reflect.Ptr || d.IsNil() || d.Elem().Kind() != reflect.Struct {
+		return redis.ScanStruct(src, dest)
+	}
+	t := d.Elem().Type()
+	twin := redigoType(t)
+	if twin == t {
+		err = redis.ScanStruct(src, dest)
+	} else {
+		src = renameHashAliases(src, t)
+		scanned := reflect.New(twin)
+		scanned.Elem().Set(d.Elem().Convert(twin))
+		err = redis.ScanStruct(src, scanned.Interface())
+		if err == nil {
+			d.Elem().Set(scanned.Elem().Convert(t))
+		}
+	}
+	if err != nil {
+		return
+	}
+	return applyHashDefaults(src, d)
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+type tenantKey struct{}
+
+// withTenant - attaches the tenant whose data work under ctx may touch
+func withTenant(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, id)
+}
+
+// errNoTenant - ctx carries no tenant, so there is nothing to scope to
+var errNoTenant = errors.New("no tenant in context")
+
+func tenantFrom(ctx context.Context) (id string, err error) {
+	id, _ = ctx.Value(tenantKey{}).(string)
+	if id == "" {
+		return "", errNoTenant
+	}
+	if strings.ContainsAny(id, ":*?[]{}") {
+		return "", fmt.Errorf("tenant %q: must not contain any of :*?[]{}", id)
+	}
+	return
+}
+
+// tenantPrefix - what every key and index name of tenant id starts with
+func tenantPrefix(id string) string {
+	return "tenant:" + id + ":"
+}
+
+// tenantArgs - how a command names its keys
+type tenantArgs int
+
+const (
+	argsNoKeys tenantArgs = iota
+	// argsFirst - the first argument is the key
+	argsFirst
+	// argsAll - every argument is a key
+	argsAll
+	// argsAllButLast - every argument but a trailing path (JSON.MGET)
+	argsAllButLast
+	// argsPairs - key value key value... (MSET)
+	argsPairs
+	// argsIndex - the first argument is a search index
+	argsIndex
+	// argsScan - SCAN cursor [MATCH pattern]...
+	argsScan
+)
+
+// tenantCommands - commands a tenant connection passes on, by how their keys
+// are laid out. Anything missing is refused, so a new command can't
+// silently reach another tenant's keys. Scripts and functions (EVAL,
+// EVALSHA, FCALL, SCRIPT...) are left out: prefixing their KEYS wouldn't
+// stop the body from naming any key it likes.
+var tenantCommands = map[string]tenantArgs{
+	"PING":    argsNoKeys,
+	"ECHO":    argsNoKeys,
+	"MULTI":   argsNoKeys,
+	"EXEC":    argsNoKeys,
+	"DISCARD": argsNoKeys,
+	"UNWATCH": argsNoKeys,
+
+	"DEL":     argsAll,
+	"UNLINK":  argsAll,
+	"EXISTS":  argsAll,
+	"TOUCH":   argsAll,
+	"WATCH":   argsAll,
+	"MGET":    argsAll,
+	"PFCOUNT": argsAll,
+
+	"MSET":      argsPairs,
+	"MSETNX":    argsPairs,
+	"JSON.MGET": argsAllButLast,
+
+	"SCAN": argsScan,
+
+	"FT.CREATE":    argsIndex,
+	"FT.SEARCH":    argsIndex,
+	"FT.AGGREGATE": argsIndex,
+	"FT.INFO":      argsIndex,
+	"FT.DROPINDEX": argsIndex,
+	"FT.ALTER":     argsIndex,
+}
+
+func init() {
+	for _, cmd := range strings.Fields(`
+		GET SET SETNX SETEX PSETEX GETSET GETDEL INCR INCRBY INCRBYFLOAT DECR DECRBY APPEND STRLEN
+		EXPIRE PEXPIRE EXPIREAT PEXPIREAT PERSIST TTL PTTL TYPE DUMP RESTORE
+		HSET HSETNX HMSET HGET HMGET HGETALL HDEL HEXISTS HLEN HKEYS HVALS HINCRBY HINCRBYFLOAT HSTRLEN HSCAN
+		LPUSH RPUSH LPOP RPOP LRANGE LTRIM LLEN LINDEX
+		SADD SREM SMEMBERS SISMEMBER SCARD SSCAN
+		ZADD ZREM ZRANGE ZRANGEBYSCORE ZREVRANGE ZINCRBY ZSCORE ZCARD ZSCAN
+		XADD XRANGE XREVRANGE XLEN XTRIM PFADD SETBIT GETBIT BITCOUNT BITFIELD
+		JSON.SET JSON.GET JSON.DEL JSON.FORGET JSON.TYPE JSON.MERGE JSON.NUMINCRBY JSON.NUMMULTBY
+		JSON.STRAPPEND JSON.STRLEN JSON.TOGGLE JSON.CLEAR JSON.ARRAPPEND JSON.ARRINSERT JSON.ARRINDEX
+		JSON.ARRLEN JSON.ARRPOP JSON.ARRTRIM JSON.OBJKEYS JSON.OBJLEN JSON.RESP`) {
+		tenantCommands[cmd] = argsFirst
+	}
+}
+
+// scopeArgs - args of cmd with every key and index name prefixed
+func scopeArgs(prefix, cmd string, args []interface{}) (scoped []interface{}, err error) {
+	layout, ok := tenantCommands[strings.ToUpper(cmd)]
+	if !ok {
+		return nil, fmt.Errorf("%s: not allowed on a tenant connection", cmd)
+	}
+
+	scoped = append([]interface{}(nil), args...)
+	scope := func(i int) {
+		scoped[i] = scopeKey(prefix, argString(scoped[i]))
+	}
+
+	switch layout {
+	case argsFirst:
+		if len(scoped) > 0 {
+			scope(0)
+		}
+	case argsIndex:
+		if len(scoped) > 0 {
+			scoped[0] = prefix + argString(scoped[0])
+		}
+		if strings.EqualFold(cmd, "FT.CREATE") {
+			err = scopeCreatePrefixes(prefix, scoped)
+		}
+	case argsAll:
+		for i := range scoped {
+			scope(i)
+		}
+	case argsAllButLast:
+		for i := 0; i < len(scoped)-1; i++ {
+			scope(i)
+		}
+	case argsPairs:
+		for i := 0; i < len(scoped); i += 2 {
+			scope(i)
+		}
+	case argsScan:
+		match := -1
+		for i := 1; i+1 < len(scoped); i++ {
+			if strings.EqualFold(argString(scoped[i]), "MATCH") {
+				match = i + 1
+			}
+		}
+		if match < 0 {
+			scoped = append(scoped, "MATCH", escapeGlob(prefix)+"*")
+		} else {
+			scoped[match] = escapeGlob(prefix) + argString(scoped[match])
+		}
+	}
+	return
+}
+
+// scopeKey - key under prefix. A bits string (bitsKey) is named after its
+// object's scoped key instead, so the two still share a cluster slot:
+// prefixed as it is, {student:1}:bits would keep hashing on student:1 while
+// the object moves to tenant:id:student:1. Such keys don't start with
+// prefix, so a tenant's SCAN doesn't list them.
+func scopeKey(prefix, key string) string {
+	if isBitsKey(key) {
+		return bitsKey(prefix + bitsObject(key))
+	}
+	return prefix + key
+}
+
+// scopeCreatePrefixes - FT.CREATE ... PREFIX n p1..pn: an index may only
+// cover its tenant's keys, so the prefixes are scoped too, and an index
+// without any is given the tenant's
+func scopeCreatePrefixes(prefix string, args []interface{}) error {
+	for i := 1; i < len(args); i++ {
+		if !strings.EqualFold(argString(args[i]), "PREFIX") {
+			continue
+		}
+		if i+1 >= len(args) {
+			break
+		}
+		n, err := strconv.Atoi(argString(args[i+1]))
+		if err != nil || i+2+n > len(args) {
+			return fmt.Errorf("FT.CREATE: bad PREFIX count %v", args[i+1])
+		}
+		for j := i + 2; j < i+2+n; j++ {
+			args[j] = prefix + argString(args[j])
+		}
+		return nil
+	}
+	return errors.New("FT.CREATE: a tenant index needs a PREFIX clause")
+}
+
+// tenantConn - redis.Conn confining one tenant to its own keys: every key
+// and search index name in Do and Send is prefixed with tenantPrefix (see
+// scopeKey), and commands whose keys it can't find, scripts among them, are
+// refused. SCAN replies through Do
+// have the prefix taken off again; other replies naming keys (FT.SEARCH
+// document ids, pipelined SCANs) keep it.
+type tenantConn struct {
+	redis.Conn
+	prefix string
+}
+
+// withTenantConn - conn scoped to the tenant in ctx
+func withTenantConn(ctx context.Context, conn redis.Conn) (redis.Conn, error) {
+	id, err := tenantFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tenantConn{Conn: conn, prefix: tenantPrefix(id)}, nil
+}
+
+func (c tenantConn) Do(cmd string, args ...interface{}) (reply interface{}, err error) {
+	if cmd == "" {
+		return c.Conn.Do(cmd)
+	}
+	scoped, err := scopeArgs(c.prefix, cmd, args)
+	if err != nil {
+		return
+	}
+	reply, err = c.Conn.Do(cmd, scoped...)
+	if err == nil && strings.EqualFold(cmd, "SCAN") {
+		reply = c.unscopeScan(reply)
+	}
+	return
+}
+
+func (c tenantConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (reply interface{}, err error) {
+	if cmd == "" {
+		return redis.DoWithTimeout(c.Conn, timeout, cmd)
+	}
+	scoped, err := scopeArgs(c.prefix, cmd, args)
+	if err != nil {
+		return
+	}
+	reply, err = redis.DoWithTimeout(c.Conn, timeout, cmd, scoped...)
+	if err == nil && strings.EqualFold(cmd, "SCAN") {
+		reply = c.unscopeScan(reply)
+	}
+	return
+}
+
+func (c tenantConn) Send(cmd string, args ...interface{}) error {
+	scoped, err := scopeArgs(c.prefix, cmd, args)
+	if err != nil {
+		return err
+	}
+	return c.Conn.Send(cmd, scoped...)
+}
+
+func (c tenantConn) unscopeScan(reply interface{}) interface{} {
+	page, ok := reply.([]interface{})
+	if !ok || len(page) != 2 {
+		return reply
+	}
+	keys, ok := page[1].([]interface{})
+	if !ok {
+		return reply
+	}
+	out := make([]interface{}, len(keys))
+	for i, k := range keys {
+		out[i] = []byte(strings.TrimPrefix(argString(k), c.prefix))
+	}
+	return []interface{}{page[0], out}
+}
+
+// tenantAccess - where, and as which ACL user, one tenant's commands run
+type tenantAccess struct {
+	Server   string `json:"server"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	DB       int    `json:"db"`
+}
+
+// tenantPools - a pool per tenant with its own tenantAccess, and a shared
+// one for everyone else. Pools are created on first use and closed by
+// close.
+type tenantPools struct {
+	shared *redis.Pool
+	access map[string]tenantAccess
+	cfg    config
+
+	mu    sync.Mutex
+	pools map[string]*redis.Pool
+}
+
+func newTenantPools(cfg config, shared *redis.Pool, access map[string]tenantAccess) *tenantPools {
+	return &tenantPools{shared: shared, access: access, cfg: cfg, pools: make(map[string]*redis.Pool)}
+}
+
+// get - a connection scoped to the tenant in ctx, from its own pool if it
+// has one. Close it as any pooled connection.
+func (t *tenantPools) get(ctx context.Context) (conn redis.Conn, err error) {
+	id, err := tenantFrom(ctx)
+	if err != nil {
+		return
+	}
+	pool := t.shared
+	if a, ok := t.access[id]; ok {
+		pool = t.pool(id, a)
+	}
+	conn, err = pool.GetContext(ctx)
+	if err != nil {
+		return
+	}
+	return tenantConn{Conn: conn, prefix: tenantPrefix(id)}, nil
+}
+
+func (t *tenantPools) pool(id string, a tenantAccess) *redis.Pool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if p, ok := t.pools[id]; ok {
+		return p
+	}
+
+	cfg := t.cfg
+	cfg.Server, cfg.Password, cfg.DB = a.Server, "", a.DB
+	if cfg.Server == "" {
+		cfg.Server = t.cfg.Server
+	}
+	p := newPool(cfg)
+	dial := p.Dial
+	p.Dial = func() (conn redis.Conn, err error) {
+		conn, err = dial()
+		if err != nil || (a.Username == "" && a.Password == "") {
+			return
+		}
+		args := redis.Args{a.Password}
+		if a.Username != "" {
+			args = redis.Args{a.Username, a.Password}
+		}
+		if _, err = conn.Do("AUTH", args...); err != nil {
+			conn.Close()
+			return nil, newCommandError("AUTH", id, err)
+		}
+		return
+	}
+	t.pools[id] = p
+	return p
+}
+
+// close - closes every per-tenant pool (not the shared one)
+func (t *tenantPools) close() (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for id, p := range t.pools {
+		if cerr := p.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(t.pools, id)
+	}
+	return
+}
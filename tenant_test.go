@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestScopeArgs(t *testing.T) {
+	prefix := tenantPrefix("acme")
+	tests := []struct {
+		cmd  string
+		args []interface{}
+		want []interface{}
+	}{
+		{"GET", []interface{}{"student:1"}, []interface{}{"tenant:acme:student:1"}},
+		{"DEL", []interface{}{"student:1", "{student:1}:bits"}, []interface{}{"tenant:acme:student:1", "{tenant:acme:student:1}:bits"}},
+		{"BITFIELD", []interface{}{"{t}:student:1:bits", "GET", "u4", 0}, []interface{}{"tenant:acme:{t}:student:1:bits", "GET", "u4", 0}},
+		{"FT.SEARCH", []interface{}{"idx", "*"}, []interface{}{"tenant:acme:idx", "*"}},
+	}
+	for _, tt := range tests {
+		got, err := scopeArgs(prefix, tt.cmd, tt.args)
+		if err != nil {
+			t.Errorf("%s: %v", tt.cmd, err)
+			continue
+		}
+		for i := range tt.want {
+			if argString(got[i]) != argString(tt.want[i]) {
+				t.Errorf("%s: got %v, want %v", tt.cmd, got, tt.want)
+				break
+			}
+		}
+	}
+
+	for _, cmd := range []string{"EVAL", "EVALSHA", "FCALL", "FCALL_RO", "SCRIPT", "FLUSHALL"} {
+		if _, err := scopeArgs(prefix, cmd, []interface{}{"return 1", 0}); err == nil {
+			t.Errorf("%s allowed", cmd)
+		}
+	}
+}
+
+func TestScopeKeyKeepsBitsSlot(t *testing.T) {
+	prefix := tenantPrefix("acme")
+	for _, key := range []string{"student:1", "{t}:student:1", "{student:1", "a{}b", "a}b"} {
+		obj, bits := scopeKey(prefix, key), scopeKey(prefix, bitsKey(key))
+		if keySlot(obj) != keySlot(bits) {
+			t.Errorf("%s: %s hashes to slot %d, %s to %d", key, obj, keySlot(obj), bits, keySlot(bits))
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// Package testsupport starts throwaway Redis servers for integration tests,
+// so downstream users don't have to manage one.
+//
+// Plain Redis (enough for the hash storage modes) is run from a local
+// redis-server binary. ReJSON needs the module, so for it a
+// redis/redis-stack-server container is started with docker instead.
+package testsupport
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Options - what kind of server to start
+type Options struct {
+	// ReJSON - start redis-stack in docker instead of a local redis-server
+	ReJSON bool
+	// Image - docker image used when ReJSON is set
+	Image string
+	// StartTimeout - how long to wait for the server to answer PING
+	StartTimeout time.Duration
+}
+
+// Server - a running throwaway Redis
+type Server struct {
+	Addr string
+
+	cmd       *exec.Cmd
+	container string
+	pool      *redis.Pool
+}
+
+// Start - starts a server on a free local port and waits until it answers
+func Start(opts Options) (s *Server, err error) {
+	if opts.Image == "" {
+		opts.Image = "redis/redis-stack-server:latest"
+	}
+	if opts.StartTimeout <= 0 {
+		opts.StartTimeout = 30 * time.Second
+	}
+
+	port, err := freePort()
+	if err != nil {
+		return
+	}
+	s = &Server{Addr: net.JoinHostPort("127.0.0.1", strconv.Itoa(port))}
+
+	if opts.ReJSON {
+		err = s.startContainer(opts.Image, port)
+	} else {
+		err = s.startLocal(port)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.pool = &redis.Pool{
+		MaxIdle: 4,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", s.Addr)
+		},
+	}
+
+	err = s.waitReady(opts.StartTimeout)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return
+}
+
+// New - Start for use in tests: skips the test when no server can be
+// started, and stops the server when the test finishes
+func New(t testing.TB, opts Options) *redis.Pool {
+	t.Helper()
+
+	s, err := Start(opts)
+	if err != nil {
+		t.Skipf("testsupport: no redis available - %s", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s.Pool()
+}
+
+// Pool - a pool of connections to the server
+func (s *Server) Pool() *redis.Pool {
+	return s.pool
+}
+
+// Close - stops the server and releases the pool
+func (s *Server) Close() (err error) {
+	if s.pool != nil {
+		s.pool.Close()
+	}
+
+	if s.container != "" {
+		return exec.Command("docker", "rm", "-f", s.container).Run()
+	}
+	if s.cmd != nil && s.cmd.Process != nil {
+		s.cmd.Process.Kill()
+		s.cmd.Wait()
+	}
+	return
+}
+
+func (s *Server) startLocal(port int) (err error) {
+	bin, err := exec.LookPath("redis-server")
+	if err != nil {
+		return
+	}
+
+	s.cmd = exec.Command(bin,
+		"--port", strconv.Itoa(port),
+		"--bind", "127.0.0.1",
+		"--save", "",
+		"--appendonly", "no",
+	)
+	s.cmd.Stdout = os.Stderr
+	return s.cmd.Start()
+}
+
+func (s *Server) startContainer(image string, port int) (err error) {
+	var out, stderr bytes.Buffer
+	cmd := exec.Command("docker", "run", "-d", "--rm",
+		"-p", fmt.Sprintf("127.0.0.1:%d:6379", port),
+		image)
+	cmd.Stdout, cmd.Stderr = &out, &stderr
+
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("docker run %s: %v: %s", image, err, strings.TrimSpace(stderr.String()))
+	}
+	s.container = strings.TrimSpace(out.String())
+	return
+}
+
+func (s *Server) waitReady(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		conn := s.pool.Get()
+		_, err := conn.Do("PING")
+		conn.Close()
+		if err == nil {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return errors.New("redis did not become ready within " + timeout.String())
+}
+
+func freePort() (port int, err error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,45 @@
+package testsupport
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestNew(t *testing.T) {
+	pool := New(t, Options{StartTimeout: 10 * time.Second})
+
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("SET", "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := redis.String(conn.Do("GET", "k"))
+	if err != nil || got != "v" {
+		t.Errorf("GET: got %q, %v", got, err)
+	}
+}
+
+func TestStartWithoutRedis(t *testing.T) {
+	// nothing to run: Start fails instead of returning a dead server
+	t.Setenv("PATH", "")
+	s, err := Start(Options{StartTimeout: time.Second})
+	if err == nil {
+		s.Close()
+		t.Fatal("no error")
+	}
+	if s != nil {
+		t.Errorf("got a server %+v along with %v", s, err)
+	}
+}
+
+func TestFreePort(t *testing.T) {
+	port, err := freePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port <= 0 || port > 65535 {
+		t.Errorf("port %d", port)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// opTimeouts - how long each class of command may take. A zero value leaves
+// that class on the connection's default read timeout.
+type opTimeouts struct {
+	Read  time.Duration
+	Write time.Duration
+	Scan  time.Duration
+}
+
+// scanCommands - commands that walk many keys or elements
+var scanCommands = map[string]bool{
+	"SCAN":  true,
+	"HSCAN": true,
+	"SSCAN": true,
+	"ZSCAN": true,
+	"KEYS":  true,
+}
+
+// forCommand - the timeout that applies to cmd
+func (t opTimeouts) forCommand(cmd string, args ...interface{}) time.Duration {
+	switch {
+	case scanCommands[strings.ToUpper(cmd)]:
+		return t.Scan
+	case isWriteCommand(cmd, args...):
+		return t.Write
+	}
+	return t.Read
+}
+
+// timeoutConn - redis.Conn that bounds each command by the timeout of its
+// class, e.g. 50ms for reads but 5s for bulk SCANs. Pipelined commands are
+// bounded on Receive by their own class's timeout, and an EXEC by the
+// longest of the commands it runs.
+type timeoutConn struct {
+	redis.Conn
+	timeouts opTimeouts
+
+	// pending - the timeout of each command sent and not yet received,
+	// oldest first
+	pending []time.Duration
+	// multi - whether a MULTI is open; multiMax - the longest timeout of
+	// the commands queued since
+	multi    bool
+	multiMax time.Duration
+}
+
+func withOpTimeouts(conn redis.Conn, t opTimeouts) redis.Conn {
+	return &timeoutConn{Conn: conn, timeouts: t}
+}
+
+// timeoutFor - cmd's timeout, noting it against an open MULTI
+func (c *timeoutConn) timeoutFor(cmd string, args []interface{}) (timeout time.Duration) {
+	timeout = c.timeouts.forCommand(cmd, args...)
+	switch strings.ToUpper(cmd) {
+	case "MULTI":
+		c.multi, c.multiMax = true, 0
+	case "EXEC", "DISCARD":
+		if c.multiMax > timeout {
+			timeout = c.multiMax
+		}
+		c.multi = false
+	default:
+		if c.multi && timeout > c.multiMax {
+			c.multiMax = timeout
+		}
+	}
+	return
+}
+
+func (c *timeoutConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	// Do reads every pending reply as well as its own
+	timeout := c.timeoutFor(cmd, args)
+	for _, t := range c.pending {
+		if t > timeout {
+			timeout = t
+		}
+	}
+	c.pending = nil
+
+	if _, ok := c.Conn.(redis.ConnWithTimeout); timeout <= 0 || !ok {
+		return c.Conn.Do(cmd, args...)
+	}
+	return redis.DoWithTimeout(c.Conn, timeout, cmd, args...)
+}
+
+// DoWithTimeout - an explicit timeout overrides the class timeout
+func (c *timeoutConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	c.timeoutFor(cmd, args)
+	c.pending = nil
+	return redis.DoWithTimeout(c.Conn, timeout, cmd, args...)
+}
+
+func (c *timeoutConn) Send(cmd string, args ...interface{}) (err error) {
+	timeout := c.timeoutFor(cmd, args)
+	err = c.Conn.Send(cmd, args...)
+	if err == nil {
+		c.pending = append(c.pending, timeout)
+	}
+	return
+}
+
+// Receive - the oldest pending reply, within its command's timeout
+func (c *timeoutConn) Receive() (interface{}, error) {
+	var timeout time.Duration
+	if len(c.pending) > 0 {
+		timeout, c.pending = c.pending[0], c.pending[1:]
+	}
+	if _, ok := c.Conn.(redis.ConnWithTimeout); timeout <= 0 || !ok {
+		return c.Conn.Receive()
+	}
+	return redis.ReceiveWithTimeout(c.Conn, timeout)
+}
+
+// ReceiveWithTimeout - an explicit timeout overrides the class timeout
+func (c *timeoutConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	if len(c.pending) > 0 {
+		c.pending = c.pending[1:]
+	}
+	return redis.ReceiveWithTimeout(c.Conn, timeout)
+}
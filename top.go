@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// topOptions - what runTop shows and how often it refreshes
+type topOptions struct {
+	// Interval - screen and rate refresh
+	Interval time.Duration
+	// ScanInterval - namespace recount, a full SCAN
+	ScanInterval time.Duration
+	// Sample - keys per namespace measured with MEMORY USAGE
+	Sample int
+	// Events - change events kept for the tail
+	Events int
+}
+
+// topNamespace - one key prefix, up to its first ':'
+type topNamespace struct {
+	Prefix string
+	Keys   int
+	// Memory - mean sampled MEMORY USAGE extrapolated over Keys
+	Memory int64
+}
+
+// commandStats - cumulative calls per command, from INFO commandstats
+type commandStats map[string]int64
+
+// topState - what the screen shows, shared with the event tail
+type topState struct {
+	mu         sync.Mutex
+	namespaces []topNamespace
+	scanned    time.Time
+	readRate   float64
+	writeRate  float64
+	rates      map[string]float64
+	events     []string
+	maxEvents  int
+	err        error
+}
+
+func (s *topState) event(e string) {
+	s.mu.Lock()
+	s.events = append(s.events, e)
+	if len(s.events) > s.maxEvents {
+		s.events = s.events[len(s.events)-s.maxEvents:]
+	}
+	s.mu.Unlock()
+}
+
+// runTop - redraws a dashboard of namespaces, command rates and recent
+// keyspace events on w until ctx is done. conn serves the polling; sub is
+// dedicated to the keyspace subscription feeding the tail and may be nil.
+func runTop(ctx context.Context, conn, sub redis.Conn, w io.Writer, opts topOptions) (err error) {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	if opts.ScanInterval <= 0 {
+		opts.ScanInterval = 30 * time.Second
+	}
+	if opts.Sample <= 0 {
+		opts.Sample = 20
+	}
+	if opts.Events <= 0 {
+		opts.Events = 10
+	}
+	s := &topState{maxEvents: opts.Events}
+
+	if sub != nil {
+		go tailKeyspace(ctx, sub, s)
+	}
+
+	prev, err := readCommandStats(ctx, conn)
+	if err != nil {
+		return
+	}
+	prevAt := time.Now()
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	for {
+		if time.Since(s.scanned) >= opts.ScanInterval {
+			ns, serr := scanNamespaces(ctx, conn, opts.Sample)
+			s.mu.Lock()
+			s.namespaces, s.scanned, s.err = ns, time.Now(), serr
+			s.mu.Unlock()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		cur, cerr := readCommandStats(ctx, conn)
+		if cerr != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return cerr
+		}
+		now := time.Now()
+		s.rateFrom(prev, cur, now.Sub(prevAt))
+		prev, prevAt = cur, now
+
+		err = s.render(w)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// rateFrom - per second rates between two commandstats readings
+func (s *topState) rateFrom(prev, cur commandStats, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.readRate, s.writeRate = 0, 0
+	s.rates = make(map[string]float64)
+	for cmd, calls := range cur {
+		d := calls - prev[cmd]
+		if d <= 0 || cmd == "info" {
+			continue
+		}
+		r := float64(d) / elapsed.Seconds()
+		s.rates[cmd] = r
+		if isWriteCommand(cmd) {
+			s.writeRate += r
+		} else {
+			s.readRate += r
+		}
+	}
+}
+
+func (s *topState) render(w io.Writer) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J")
+	fmt.Fprintf(&b, "%s%s  reads %.0f/s  writes %.0f/s%s\n\n", ansiBold, time.Now().Format("15:04:05"), s.readRate, s.writeRate, ansiReset)
+
+	tw := tabwriter.NewWriter(&b, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "NAMESPACE\tKEYS\tMEMORY\t\n")
+	for _, ns := range s.namespaces {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t\n", ns.Prefix, ns.Keys, humanBytes(ns.Memory))
+	}
+	tw.Flush()
+	if s.err != nil {
+		fmt.Fprintf(&b, "scan: %v\n", s.err)
+	}
+
+	type rate struct {
+		cmd string
+		r   float64
+	}
+	var top []rate
+	for cmd, r := range s.rates {
+		top = append(top, rate{cmd, r})
+	}
+	sort.Slice(top, func(i, j int) bool { return top[i].r > top[j].r })
+	if len(top) > 8 {
+		top = top[:8]
+	}
+	b.WriteString("\n")
+	tw = tabwriter.NewWriter(&b, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "COMMAND\tCALLS/S\t\n")
+	for _, r := range top {
+		fmt.Fprintf(tw, "%s\t%.1f\t\n", r.cmd, r.r)
+	}
+	tw.Flush()
+
+	b.WriteString("\nRECENT CHANGES\n")
+	for _, e := range s.events {
+		b.WriteString(e + "\n")
+	}
+
+	_, err = io.WriteString(w, b.String())
+	return
+}
+
+// readCommandStats - calls so far per command, lower case
+func readCommandStats(ctx context.Context, conn redis.Conn) (stats commandStats, err error) {
+	info, err := redis.String(doContext(ctx, conn, "INFO", "commandstats"))
+	if err != nil {
+		return nil, newCommandError("INFO", "commandstats", err)
+	}
+
+	stats = make(commandStats)
+	for _, line := range strings.Split(info, "\r\n") {
+		// cmdstat_json.set:calls=12,usec=34,usec_per_call=2.83,...
+		if !strings.HasPrefix(line, "cmdstat_") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		cmd := strings.Replace(line[len("cmdstat_"):i], "|", " ", -1)
+		for _, kv := range strings.Split(line[i+1:], ",") {
+			if strings.HasPrefix(kv, "calls=") {
+				stats[cmd], _ = strconv.ParseInt(kv[len("calls="):], 10, 64)
+			}
+		}
+	}
+	return
+}
+
+// scanNamespaces - every key counted by prefix (up to and including its
+// first ':'), largest first, with memory estimated from sample keys each
+func scanNamespaces(ctx context.Context, conn redis.Conn, sample int) (ns []topNamespace, err error) {
+	byPrefix := make(map[string]*topNamespace)
+	sampled := make(map[string]int)
+	sampledMem := make(map[string]int64)
+
+	err = scanKeys(ctx, conn, "*", func(key string) (err error) {
+		prefix := key
+		if i := strings.Index(key, ":"); i >= 0 {
+			prefix = key[:i+1]
+		}
+		n := byPrefix[prefix]
+		if n == nil {
+			n = &topNamespace{Prefix: prefix}
+			byPrefix[prefix] = n
+		}
+		n.Keys++
+
+		if sampled[prefix] < sample {
+			mem, merr := redis.Int64(doContext(ctx, conn, "MEMORY", "USAGE", key))
+			if merr == nil {
+				sampled[prefix]++
+				sampledMem[prefix] += mem
+			}
+		}
+		return
+	})
+
+	for prefix, n := range byPrefix {
+		if sampled[prefix] > 0 {
+			n.Memory = sampledMem[prefix] / int64(sampled[prefix]) * int64(n.Keys)
+		}
+		ns = append(ns, *n)
+	}
+	sort.Slice(ns, func(i, j int) bool { return ns[i].Keys > ns[j].Keys })
+	return
+}
+
+// tailKeyspace - feeds keyspace events into s until ctx is done
+func tailKeyspace(ctx context.Context, sub redis.Conn, s *topState) {
+	err := enableKeyspaceEvents(sub, "KA")
+	if err != nil {
+		s.event(fmt.Sprintf("(no change events: %v)", err))
+		return
+	}
+
+	psc := redis.PubSubConn{Conn: sub}
+	err = psc.PSubscribe("__keyspace@*__:*")
+	if err != nil {
+		s.event(fmt.Sprintf("(no change events: %v)", err))
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		sub.Close()
+	}()
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			s.event(fmt.Sprintf("%s  %-10s %s", time.Now().Format("15:04:05.000"), v.Data, keyFromChannel(v.Channel)))
+		case error:
+			return
+		}
+	}
+}
+
+// humanBytes - n as B, KiB, MiB or GiB
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	f, suffix := float64(n), ""
+	for _, s := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		f /= unit
+		suffix = s
+		if f < unit {
+			break
+		}
+	}
+	return fmt.Sprintf("%.1f %s", f, suffix)
+}
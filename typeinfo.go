@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// structInfo - what the tag options (tags.go) and JSON walkers need to know
+// about one struct type. Working it out means parsing every field's tags,
+// so it is done once per type, on first use, instead of on every Set and
+// Get.
+type structInfo struct {
+	// tags - each field's parsed redis tag, by field index
+	tags []fieldTag
+	// enums - each field's allowed values, by field index; nil if it has
+	// no enum option
+	enums [][]string
+	// json - exported fields by JSON name, see jsonFields
+	json map[string]reflect.StructField
+	// jsonEnums - the allowed values of json's enum fields, by JSON name
+	jsonEnums map[string][]string
+	aliases   fieldAliases
+	// defaults - see buildDefaults; nil with defaultsErr if a default
+	// can't be used
+	defaults    map[string]json.RawMessage
+	defaultsErr error
+	// bits - fields tagged bits=N, packed as bitfield.go lays them out, or
+	// bitsErr if they can't be
+	bits    []bitField
+	bitsErr error
+	// own - options used by the type's own fields
+	own tagUse
+}
+
+// tagUse - which tag options a type relies on
+type tagUse struct {
+	alias, defaults, enum, computed, sensitive, owns bool
+}
+
+func (u tagUse) or(o tagUse) tagUse {
+	return tagUse{
+		alias:     u.alias || o.alias,
+		defaults:  u.defaults || o.defaults,
+		enum:      u.enum || o.enum,
+		computed:  u.computed || o.computed,
+		sensitive: u.sensitive || o.sensitive,
+		owns:      u.owns || o.owns,
+	}
+}
+
+var (
+	structInfos sync.Map
+	tagUses     sync.Map
+)
+
+// structInfoOf - the cached structInfo of struct type t
+func structInfoOf(t reflect.Type) *structInfo {
+	if cached, ok := structInfos.Load(t); ok {
+		return cached.(*structInfo)
+	}
+
+	info := &structInfo{
+		tags:  make([]fieldTag, t.NumField()),
+		enums: make([][]string, t.NumField()),
+		json:  buildJSONFields(t),
+	}
+	for i := range info.tags {
+		tag := parseFieldTag(t.Field(i))
+		info.tags[i] = tag
+		if list, ok := tag.value("enum"); ok {
+			info.enums[i] = strings.Split(list, "|")
+			info.own.enum = true
+		}
+		info.own.alias = info.own.alias || tag.has("alias")
+		info.own.computed = info.own.computed || tag.has("computed")
+		info.own.sensitive = info.own.sensitive || tag.has("sensitive")
+		info.own.owns = info.own.owns || tag.has("owns")
+	}
+	for name, f := range info.json {
+		if values, ok := fieldEnum(f); ok {
+			if info.jsonEnums == nil {
+				info.jsonEnums = make(map[string][]string)
+			}
+			info.jsonEnums[name] = values
+		}
+	}
+	info.aliases = buildAliases(t, info.tags)
+	info.defaults, info.defaultsErr = buildDefaults(t, info.json)
+	info.own.defaults = info.defaults != nil || info.defaultsErr != nil
+	info.bits, info.bitsErr = buildBits(t, info.tags)
+
+	// a racing first use builds an identical copy; keep whichever won
+	cached, _ := structInfos.LoadOrStore(t, info)
+	return cached.(*structInfo)
+}
+
+// tagUseOf - the tag options t, or any struct type reachable from its
+// fields, relies on. Zero for anything that holds no structs.
+func tagUseOf(t reflect.Type) tagUse {
+	if cached, ok := tagUses.Load(t); ok {
+		return cached.(tagUse)
+	}
+
+	var use tagUse
+	walkStructTypes(t, map[reflect.Type]bool{}, func(st reflect.Type) bool {
+		use = use.or(structInfoOf(st).own)
+		return false
+	})
+	tagUses.Store(t, use)
+	return use
+}
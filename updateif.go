@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// updateIfScript - sets one field of a document only if another holds an
+// expected value, checked and written in one step whatever the key's
+// storage mode. Fields are dotted object member names (info.Major).
+//
+//	KEYS[1]  the document
+//	ARGV[1]  field compared
+//	ARGV[2]  field set
+//	ARGV[3]  expected value, as JSON
+//	ARGV[4]  new value, as JSON
+//	ARGV[5]  new value as a hash field holds it (strings as-is)
+//
+// Values are compared decoded, so it is reliable for scalars; a missing
+// field equals null. Returns 1 if the field was set.
+var updateIfScript = scripts.register("update-if", 1, `
+local key, cond, target = KEYS[1], ARGV[1], ARGV[2]
+local expected = cjson.decode(ARGV[3])
+
+local function split(path)
+	local parts = {}
+	for part in string.gmatch(path, "[^.]+") do
+		parts[#parts + 1] = part
+	end
+	return parts
+end
+
+local function same(cur, exp)
+	if cur == nil then
+		cur = cjson.null
+	end
+	return cur == exp
+end
+
+local typ = redis.call("TYPE", key).ok
+
+if typ == "ReJSON-RL" then
+	local ok, cur = pcall(redis.call, "JSON.GET", key, "." .. cond)
+	if ok and cur then
+		cur = cjson.decode(cur)
+	else
+		cur = nil
+	end
+	if not same(cur, expected) then
+		return 0
+	end
+	redis.call("JSON.SET", key, "." .. target, ARGV[4])
+	return 1
+end
+
+if typ ~= "hash" then
+	return 0
+end
+
+if redis.call("HLEN", key) == 1 and redis.call("HEXISTS", key, "JSON") == 1 then
+	local doc = cjson.decode(redis.call("HGET", key, "JSON"))
+
+	local cur = doc
+	for _, part in ipairs(split(cond)) do
+		if type(cur) ~= "table" then
+			cur = nil
+			break
+		end
+		cur = cur[part]
+	end
+	if not same(cur, expected) then
+		return 0
+	end
+
+	local parts = split(target)
+	local parent = doc
+	for i = 1, #parts - 1 do
+		if type(parent[parts[i]]) ~= "table" then
+			return redis.error_reply("ERR " .. target .. ": parent is not an object")
+		end
+		parent = parent[parts[i]]
+	end
+	parent[parts[#parts]] = cjson.decode(ARGV[4])
+	redis.call("HSET", key, "JSON", cjson.encode(doc))
+	return 1
+end
+
+local cur = redis.call("HGET", key, cond)
+if cur == false then
+	cur = nil
+elseif type(expected) == "number" then
+	cur = tonumber(cur)
+elseif type(expected) == "boolean" then
+	cur = ({["true"] = true, ["false"] = false})[cur]
+end
+if not same(cur, expected) then
+	return 0
+end
+redis.call("HSET", key, target, ARGV[5])
+return 1
+`)
+
+// updateIf - sets targetField to value only if condField currently holds
+// expected (nil for a missing field), atomically, so callers can make state
+// machine transitions like "status=enrolled only if status==applied"
+// without a WATCH loop. Reports whether it did. Fields are dotted member
+// names; in hash mode only top-level ones exist. A hash-json document is
+// re-encoded by the server's cjson, which reorders its members.
+func updateIf(conn redis.Conn, key, condField string, expected interface{}, targetField string, value interface{}) (ok bool, err error) {
+	for _, f := range []string{condField, targetField} {
+		if f == "" || strings.HasPrefix(f, ".") || strings.HasSuffix(f, ".") || strings.Contains(f, "..") {
+			return false, fmt.Errorf("updateIf: bad field %q", f)
+		}
+	}
+
+	exp, err := json.Marshal(expected)
+	if err != nil {
+		return false, encodeError(err)
+	}
+	val, err := json.Marshal(value)
+	if err != nil {
+		return false, encodeError(err)
+	}
+	hashVal := string(val)
+	if s, isString := value.(string); isString {
+		hashVal = s
+	}
+
+	return redis.Bool(scripts.run(conn, "update-if", key, condField, targetField, string(exp), string(val), hashVal))
+}
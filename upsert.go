@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// upsertStruct - ReJSON only. Creates key from defaults with value merged
+// over it when key doesn't exist, and otherwise merge-patches value into
+// the existing document, leaving members value doesn't carry alone. Both
+// are queued in one MULTI (JSON.SET NX, then JSON.MERGE), so a concurrent
+// writer can't slip between the existence check and the write. created
+// reports which happened.
+//
+// value and defaults are anything json.Marshal takes, usually the same
+// struct type; members marshaled as null are dropped from the patch, so a
+// nil pointer without omitempty doesn't delete the stored member. Needs
+// RedisJSON 2.6 for JSON.MERGE.
+func upsertStruct(conn redis.Conn, key string, value, defaults interface{}) (created bool, err error) {
+	err = checkEnums(value, false)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", key, err)
+	}
+	patch, err := jsonObject(value)
+	if err != nil {
+		return
+	}
+	dropNulls(patch)
+
+	doc := map[string]interface{}{}
+	if defaults != nil {
+		doc, err = jsonObject(defaults)
+		if err != nil {
+			return
+		}
+	}
+	mergePatch(doc, patch)
+
+	docJSON, err := json.Marshal(doc)
+	if err != nil {
+		return false, encodeError(err)
+	}
+	patchJSON, err := json.Marshal(patch)
+	if err != nil {
+		return false, encodeError(err)
+	}
+
+	conn.Send("MULTI")
+	conn.Send("JSON.SET", key, ".", string(docJSON), "NX")
+	conn.Send("JSON.MERGE", key, ".", string(patchJSON))
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return false, newCommandError("JSON.MERGE", key, err)
+	}
+	for _, r := range replies {
+		if rerr, ok := r.(redis.Error); ok {
+			return false, newCommandError("JSON.MERGE", key, rerr)
+		}
+	}
+	return replies[0] != nil, nil
+}
+
+// jsonObject - v marshaled and decoded back as a JSON object
+func jsonObject(v interface{}) (obj map[string]interface{}, err error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	err = dec.Decode(&obj)
+	if err != nil || obj == nil {
+		return nil, fmt.Errorf("%T doesn't marshal to a JSON object", v)
+	}
+	return
+}
+
+// mergePatch - applies patch to doc as RFC 7396 describes: objects merge
+// member by member, null deletes, anything else replaces
+func mergePatch(doc, patch map[string]interface{}) {
+	for name, pv := range patch {
+		if pv == nil {
+			delete(doc, name)
+			continue
+		}
+		pobj, ok := pv.(map[string]interface{})
+		if !ok {
+			doc[name] = pv
+			continue
+		}
+		dobj, ok := doc[name].(map[string]interface{})
+		if !ok {
+			dobj = map[string]interface{}{}
+			doc[name] = dobj
+		}
+		mergePatch(dobj, pobj)
+	}
+}
+
+// dropNulls - removes null members from obj, at every depth
+func dropNulls(obj map[string]interface{}) {
+	for name, v := range obj {
+		switch v := v.(type) {
+		case nil:
+			delete(obj, name)
+		case map[string]interface{}:
+			dropNulls(v)
+		}
+	}
+}
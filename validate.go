@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// validationIssue - something about a stored document that doesn't fit the
+// struct it should decode into
+type validationIssue struct {
+	Key string
+	// Kind - "unknown field", "type mismatch" or "decode"
+	Kind   string
+	Detail string
+}
+
+// validateKeys - decodes every document matching pattern into a new value of
+// the registered type typeName, calling fn with each problem found. Every
+// unknown field is reported; encoding/json stops at the first type mismatch,
+// so at most one of those is. Hash documents are coerced as migrate would
+// first. It returns how many documents were checked.
+func validateKeys(ctx context.Context, conn redis.Conn, pattern, typeName string, fn func(validationIssue) error) (n int, err error) {
+	typ, ok := registeredTypes[typeName]
+	if !ok {
+		return 0, fmt.Errorf("unknown type %q (registered: %v)", typeName, registeredNames())
+	}
+
+	err = scanKeys(ctx, conn, pattern, func(key string) (err error) {
+		mode, err := detectStorageMode(conn, key)
+		if err == errUnknownMode || errors.Is(err, redis.ErrNil) {
+			return nil
+		}
+		if err != nil {
+			return
+		}
+		raw, err := getRaw(conn, mode, key)
+		if errors.Is(err, redis.ErrNil) {
+			return nil
+		}
+		if err != nil {
+			return
+		}
+		n++
+
+		for _, issue := range validateDocument(raw, mode, typ) {
+			issue.Key = key
+			err = fn(issue)
+			if err != nil {
+				return
+			}
+		}
+		return
+	})
+	return
+}
+
+// validateDocument - the issues decoding raw, stored in mode, into typ
+func validateDocument(raw []byte, mode storageMode, typ reflect.Type) (issues []validationIssue) {
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	err := dec.Decode(&doc)
+	if err != nil {
+		return []validationIssue{{Kind: "decode", Detail: err.Error()}}
+	}
+
+	if mode == modeHash {
+		doc = typedHashFields(doc)
+		raw, err = json.Marshal(doc)
+		if err != nil {
+			return []validationIssue{{Kind: "decode", Detail: err.Error()}}
+		}
+	}
+
+	unknown := unknownFields(doc, typ, "")
+	sort.Strings(unknown)
+	for _, path := range unknown {
+		issues = append(issues, validationIssue{Kind: "unknown field", Detail: path})
+	}
+
+	err = json.Unmarshal(raw, reflect.New(typ).Interface())
+	var te *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &te):
+		issues = append(issues, validationIssue{
+			Kind:   "type mismatch",
+			Detail: fmt.Sprintf("%s: %s, want %v", te.Field, te.Value, te.Type),
+		})
+	case err != nil:
+		issues = append(issues, validationIssue{Kind: "decode", Detail: err.Error()})
+	}
+	return
+}
+
+// unknownFields - dotted paths of the object members in doc that typ has no
+// field for, matched as encoding/json does (exact, then case-insensitive)
+func unknownFields(doc interface{}, typ reflect.Type, path string) (paths []string) {
+	walkUnknown(doc, typ, path, func(parent map[string]interface{}, name, path string) {
+		paths = append(paths, path)
+	})
+	return
+}
+
+// walkUnknown - calls fn for every member of an object in doc that typ has
+// no field for, with the object holding it
+func walkUnknown(doc interface{}, typ reflect.Type, path string, fn func(parent map[string]interface{}, name, path string)) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	join := func(k string) string {
+		if path == "" {
+			return k
+		}
+		return path + "." + k
+	}
+
+	switch t := doc.(type) {
+	case map[string]interface{}:
+		switch typ.Kind() {
+		case reflect.Struct:
+			fields := jsonFields(typ)
+			for name, v := range t {
+				f, ok := fields[name]
+				if !ok {
+					for fname, ff := range fields {
+						if strings.EqualFold(fname, name) {
+							f, ok = ff, true
+							break
+						}
+					}
+				}
+				if !ok {
+					fn(t, name, join(name))
+					continue
+				}
+				walkUnknown(v, f.Type, join(name), fn)
+			}
+		case reflect.Map:
+			for name, v := range t {
+				walkUnknown(v, typ.Elem(), join(name), fn)
+			}
+		}
+	case []interface{}:
+		if typ.Kind() == reflect.Slice || typ.Kind() == reflect.Array {
+			for i, v := range t {
+				walkUnknown(v, typ.Elem(), join(strconv.Itoa(i)), fn)
+			}
+		}
+	}
+}
+
+// jsonFields - the fields of struct type t by the name they have in JSON,
+// promoted fields of embedded structs included. The map is shared; don't
+// modify it.
+func jsonFields(t reflect.Type) map[string]reflect.StructField {
+	return structInfoOf(t).json
+}
+
+func buildJSONFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+
+		if f.Anonymous && name == "" {
+			et := f.Type
+			if et.Kind() == reflect.Ptr {
+				et = et.Elem()
+			}
+			if et.Kind() == reflect.Struct {
+				for n, ef := range jsonFields(et) {
+					if _, ok := fields[n]; !ok {
+						fields[n] = ef
+					}
+				}
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f
+	}
+	return fields
+}
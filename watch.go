@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// watchKey - calls fn with the field-level changes each time key changes.
+// Changes are picked up from keyspace notifications on sub, a conn dedicated
+// to the subscription, and read through conn. With poll > 0 (for servers
+// where CONFIG SET is disabled) sub is unused and key is re-read every poll
+// instead. It returns when ctx is done.
+func watchKey(ctx context.Context, conn, sub redis.Conn, key string, poll time.Duration, fn func(event string, diffs []fieldDiff) error) (err error) {
+	last, err := watchedDocument(conn, key)
+	if err != nil {
+		return
+	}
+
+	changed := func(event string) (err error) {
+		doc, err := watchedDocument(conn, key)
+		if err != nil {
+			return
+		}
+		diffs := diffFlat(last, doc)
+		last = doc
+		if len(diffs) == 0 && event != "del" && event != "expired" {
+			return nil
+		}
+		return fn(event, diffs)
+	}
+
+	if poll > 0 {
+		ticker := time.NewTicker(poll)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+				err = changed("poll")
+				if err != nil {
+					return
+				}
+			}
+		}
+	}
+
+	err = enableKeyspaceEvents(sub, "KA")
+	if err != nil {
+		return fmt.Errorf("enabling keyspace events (try polling): %w", err)
+	}
+
+	psc := redis.PubSubConn{Conn: sub}
+	err = psc.PSubscribe("__keyspace@*__:" + escapeGlob(key))
+	if err != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sub.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			err = changed(string(v.Data))
+			if err != nil {
+				return
+			}
+		case error:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return v
+		}
+	}
+}
+
+// watchedDocument - flatDocument, with a missing key reading as empty
+func watchedDocument(conn redis.Conn, key string) (flat map[string]string, err error) {
+	flat, err = flatDocument(conn, key)
+	if errors.Is(err, redis.ErrNil) {
+		return map[string]string{}, nil
+	}
+	return
+}
+
+// escapeGlob - s matching only itself in a PSUBSCRIBE/SCAN pattern
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+const (
+	ansiRed   = "\x1b[31m"
+	ansiGreen = "\x1b[32m"
+	ansiBold  = "\x1b[1m"
+	ansiReset = "\x1b[0m"
+)
+
+// printFieldDiffs - one line per removed (-, red) and added (+, green)
+// value, colored unless color is false
+func printFieldDiffs(w io.Writer, diffs []fieldDiff, color bool) (err error) {
+	paint := func(code, s string) string {
+		if !color {
+			return s
+		}
+		return code + s + ansiReset
+	}
+
+	for _, d := range diffs {
+		if d.Source != "" || d.Target == "" {
+			_, err = fmt.Fprintln(w, paint(ansiRed, fmt.Sprintf("- %s: %s", d.Path, d.Source)))
+			if err != nil {
+				return
+			}
+		}
+		if d.Target != "" {
+			_, err = fmt.Fprintln(w, paint(ansiGreen, fmt.Sprintf("+ %s: %s", d.Path, d.Target)))
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}